@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// clientIDPolicy decides which client IDs may register and connect. An ID
+// matching the denylist is always refused; otherwise it must match the
+// allowlist if one is configured. Patterns must match the whole ID.
+type clientIDPolicy struct {
+	allow        map[string]bool
+	allowPattern *regexp.Regexp
+	deny         map[string]bool
+	denyPattern  *regexp.Regexp
+}
+
+func newClientIDPolicy(cfg *Config) (clientIDPolicy, error) {
+	policy := clientIDPolicy{
+		allow: splitList(cfg.ClientAllowlist),
+		deny:  splitList(cfg.ClientDenylist),
+	}
+
+	var err error
+	if policy.allowPattern, err = compileIDPattern(cfg.ClientAllowPattern); err != nil {
+		return policy, err
+	}
+	if policy.denyPattern, err = compileIDPattern(cfg.ClientDenyPattern); err != nil {
+		return policy, err
+	}
+	return policy, nil
+}
+
+func (p clientIDPolicy) allowed(clientID string) bool {
+	if p.deny[clientID] || (p.denyPattern != nil && p.denyPattern.MatchString(clientID)) {
+		return false
+	}
+	if len(p.allow) == 0 && p.allowPattern == nil {
+		return true
+	}
+	return p.allow[clientID] || (p.allowPattern != nil && p.allowPattern.MatchString(clientID))
+}
+
+func compileIDPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// splitList parses a comma-separated flag value into a set.
+func splitList(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
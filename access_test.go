@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientIDPolicy(t *testing.T) {
+	cfg, err := LoadConfig([]string{"-client-allowlist", "db-1, cache", "-client-allow-pattern", "db-[0-9]+", "-client-denylist", "db-13", "-client-deny-pattern", "db-9.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := cfg.clientPolicy
+	for id, want := range map[string]bool{
+		"db-1":    true,
+		"cache":   true,
+		"db-42":   true,
+		"db-13":   false,
+		"db-99":   false,
+		"db-1x":   false,
+		"xdb-1":   false,
+		"unknown": false,
+	} {
+		if got := policy.allowed(id); got != want {
+			t.Errorf("allowed(%q) = %t, want %t", id, got, want)
+		}
+	}
+}
+
+func TestDeniedClientCannotRegisterOrConnect(t *testing.T) {
+	_, ts := newTestServer(t, "-client-denylist", "evil")
+	resp, body := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "evil"}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("registering a denied client got %s: %s, want 403", resp.Status, body)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(ts, "/connect?client_id=evil"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("connecting a denied client got %v, want 403", err)
+	}
+}
+
+func TestBadClientIDPatternIsRejected(t *testing.T) {
+	if _, err := LoadConfig([]string{"-client-allow-pattern", "db-("}); err == nil {
+		t.Error("LoadConfig accepted an invalid -client-allow-pattern")
+	}
+}
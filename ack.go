@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A client may acknowledge a query as soon as it receives it, before it has
+// an answer:
+//
+//	{"request_id":"9f1c...","type":"ack"}
+//
+// Acks are optional. Once a connection has sent one, a query on it that times
+// out is reported as either never acknowledged or acknowledged but
+// unanswered, which tells a lost query apart from a slow client. With
+// -ack-timeout set, a query such a connection hasn't acknowledged by then is
+// given up early and, where queryWithFailover is used, retried on the
+// client's other connections with what is left of the timeout. A query may
+// then reach a client twice if only its ack was lost, which is why
+// non-idempotent POSTs never fail over.
+
+var (
+	errQueryNotAcked   = fmt.Errorf("%w: client never acknowledged the query", errQueryTimeout)
+	errQueryUnanswered = fmt.Errorf("%w: client acknowledged the query but did not reply", errQueryTimeout)
+)
+
+// ack marks the query received by the client. Duplicate acks are harmless.
+func (p *pendingQuery) ack() {
+	p.ackOnce.Do(func() { close(p.acked) })
+}
+
+func (p *pendingQuery) wasAcked() bool {
+	select {
+	case <-p.acked:
+		return true
+	default:
+		return false
+	}
+}
+
+// timeoutError describes a query that got no reply in time, as precisely as
+// the connection's use of acks allows.
+func (c *Client) timeoutError(p *pendingQuery) error {
+	switch {
+	case !c.acks.Load():
+		return errQueryTimeout
+	case p.wasAcked():
+		return errQueryUnanswered
+	default:
+		return errQueryNotAcked
+	}
+}
+
+// failsOver reports whether a query that failed with err may be retried on
+// another connection: the client never acknowledged it, so it most likely
+// never arrived, or the connection broke under it; see deadconn.go.
+func failsOver(err error) bool {
+	return errors.Is(err, errQueryNotAcked) || errors.Is(err, errConnectionBroken)
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAckedQueryThenAnswered(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	result := goGet(ts.URL+"/query/db-1", nil)
+	query := client.readQuery()
+	client.reply(replyMessage{RequestID: query.RequestID, Type: "ack"})
+	client.reply(replyMessage{RequestID: query.RequestID, Body: "answer"})
+
+	if r := <-result; r.status != http.StatusOK || r.body != "answer" {
+		t.Errorf("acked query got %d %q, want its answer", r.status, r.body)
+	}
+}
+
+func TestTimeoutsSayWhetherTheQueryWasAcked(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	for i, ack := range []bool{true, false} {
+		result := goGet(fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), http.Header{"X-Query-Timeout": {"200ms"}})
+		query := client.readQuery()
+		if ack {
+			client.reply(replyMessage{RequestID: query.RequestID, Type: "ack"})
+		}
+		want := errQueryNotAcked.Error()
+		if ack {
+			want = errQueryUnanswered.Error()
+		}
+		if r := <-result; r.status != http.StatusGatewayTimeout || !strings.Contains(r.body, want) {
+			t.Errorf("query acked %t got %d %q, want 504 saying %q", ack, r.status, r.body, want)
+		}
+	}
+}
+
+func TestUnackedQueryFailsOver(t *testing.T) {
+	s, ts := newTestServer(t, "-ack-timeout", "100ms")
+	// The lossy connection shows it sends acks on its first query and then
+	// loses every other message it is sent.
+	lossy := connectClient(t, s, ts, "db-1")
+	warm := goGet(ts.URL+"/query/db-1?q=warm", http.Header{"X-Query-Timeout": {"200ms"}})
+	lossy.reply(replyMessage{RequestID: lossy.readQuery().RequestID, Type: "ack"})
+	<-warm
+	if !s.firstConnection("db-1").acks.Load() {
+		t.Fatal("the lossy connection's ack was not noticed")
+	}
+	connectClient(t, s, ts, "db-1").echo("from healthy")
+
+	for i := 0; i < 4; i++ {
+		resp, body := do(t, "GET", fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil, http.Header{"X-Query-Timeout": {"2s"}})
+		if resp.StatusCode != http.StatusOK || string(body) != "from healthy" {
+			t.Errorf("query %d got %s %q, want it failed over to the healthy connection", i, resp.Status, body)
+		}
+	}
+}
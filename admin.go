@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type exportedClient struct {
+	ClientID     string    `json:"client_id"`
+	ConnectedAt  time.Time `json:"connected_at,omitempty"`
+	LastPing     time.Time `json:"last_ping,omitempty"`
+	PingInterval string    `json:"ping_interval"`
+	Connections  int       `json:"connections"`
+	Token        string    `json:"token,omitempty"`
+	Tenant       string    `json:"tenant,omitempty"`
+	MaxInFlight  int       `json:"max_in_flight,omitempty"`
+	Weight       int       `json:"weight,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// The rest of the registration is exported as it is given to
+	// /register, and ExpiresAt is when a registration not yet used to
+	// connect lapses.
+	Prefetch        []prefetchRequest `json:"prefetch,omitempty"`
+	ResponseSchema  json.RawMessage   `json:"response_schema,omitempty"`
+	Ordering        string            `json:"ordering,omitempty"`
+	QueryTemplate   json.RawMessage   `json:"query_template,omitempty"`
+	CommandTimeouts map[string]string `json:"command_timeouts,omitempty"`
+	Commands        *commandPolicy    `json:"commands,omitempty"`
+	ExpiresAt       *time.Time        `json:"expires_at,omitempty"`
+}
+
+type registryExport struct {
+	ExportedAt time.Time        `json:"exported_at"`
+	Draining   bool             `json:"draining"`
+	Clients    []exportedClient `json:"clients"`
+}
+
+// requireAdmin rejects requests that don't carry the admin credentials:
+// the configured admin token as a bearer token, or -admin-user and
+// -admin-password as HTTP Basic Auth, for tooling that only speaks that.
+// Either or both may be configured, and the admin API is disabled when
+// neither is.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.currentConfig()
+		if cfg.AdminToken == "" && cfg.AdminUser == "" {
+			http.Error(w, "admin API disabled", http.StatusForbidden)
+			return
+		}
+
+		if !adminAuthorized(cfg, r) {
+			if cfg.AdminToken != "" {
+				w.Header().Add("WWW-Authenticate", "Bearer")
+			}
+			if cfg.AdminUser != "" {
+				w.Header().Add("WWW-Authenticate", `Basic realm="proxy admin", charset="UTF-8"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func adminAuthorized(cfg *Config, r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && cfg.AdminToken != "" {
+		return secretsEqual(token, cfg.AdminToken)
+	}
+	if user, password, ok := r.BasicAuth(); ok && cfg.AdminUser != "" {
+		// Both are compared even if the user is wrong, so the time
+		// taken doesn't tell which one was.
+		userOK := secretsEqual(user, cfg.AdminUser)
+		passwordOK := secretsEqual(password, cfg.AdminPassword)
+		return userOK && passwordOK
+	}
+	return false
+}
+
+// secretsEqual compares a presented credential with the configured one in
+// constant time. Hashing both first keeps the comparison from giving away
+// the configured one's length as well.
+func secretsEqual(presented, configured string) bool {
+	a := sha256.Sum256([]byte(presented))
+	b := sha256.Sum256([]byte(configured))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// requireMetricsAuth puts /metrics behind requireAdmin under -metrics-auth.
+func (s *Server) requireMetricsAuth(next http.HandlerFunc) http.HandlerFunc {
+	protected := s.requireAdmin(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.currentConfig().MetricsAuth {
+			protected(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleExport returns a snapshot of every known client: those currently
+// connected and those that registered but haven't connected yet. The output
+// can be fed to /admin/import on another instance.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	export := registryExport{
+		ExportedAt: time.Now(),
+		Draining:   s.draining.Load(),
+		Clients:    []exportedClient{},
+	}
+	seen := make(map[string]bool)
+
+	s.clientsMutex.RLock()
+	for id, set := range s.clients {
+		exported := exportedClient{
+			ClientID:    id,
+			Connections: len(set.conns),
+		}
+		for _, client := range set.conns {
+			if exported.ConnectedAt.IsZero() || client.ConnectedAt.Before(exported.ConnectedAt) {
+				exported.ConnectedAt = client.ConnectedAt
+			}
+			if client.LastPing().After(exported.LastPing) {
+				exported.LastPing = client.LastPing()
+			}
+			exported.PingInterval = client.PingInterval.String()
+		}
+		export.Clients = append(export.Clients, exported)
+		seen[id] = true
+	}
+	s.clientsMutex.RUnlock()
+
+	s.registrationsMutex.RLock()
+	for i, c := range export.Clients {
+		if registration, ok := s.registrations[c.ClientID]; ok {
+			export.Clients[i].setRegistration(registration)
+		}
+	}
+	for id, registration := range s.registrations {
+		if seen[id] {
+			continue
+		}
+		exported := exportedClient{ClientID: id}
+		exported.setRegistration(registration)
+		export.Clients = append(export.Clients, exported)
+	}
+	s.registrationsMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(export)
+}
+
+// handleImport loads the registrations from an /admin/export snapshot so
+// clients moving over from another instance keep their settings when they
+// reconnect here.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	var export registryExport
+	if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	imported := 0
+	s.registrationsMutex.Lock()
+	for _, c := range export.Clients {
+		if c.ClientID == "" || !s.currentConfig().clientPolicy.allowed(c.ClientID) {
+			continue
+		}
+		s.registrations[c.ClientID] = c.registration(s.currentConfig())
+		imported++
+	}
+	s.registrationsMutex.Unlock()
+
+	log.Printf("Imported %d client registrations", imported)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Imported int `json:"imported"`
+	}{
+		Imported: imported,
+	})
+}
+
+// setRegistration fills in the registration's settings. A connected
+// client's ping interval is the one its connections run on.
+func (c *exportedClient) setRegistration(registration Registration) {
+	if c.PingInterval == "" {
+		c.PingInterval = registration.PingInterval.String()
+	}
+	c.Token = registration.Token
+	c.Tenant = registration.Tenant
+	c.MaxInFlight = registration.MaxInFlight
+	c.Weight = registration.Weight
+	c.Metadata = registration.Metadata
+	for _, p := range registration.Prefetch {
+		c.Prefetch = append(c.Prefetch, prefetchRequest{Interval: p.Interval.String(), Query: p.Query})
+	}
+	if registration.responseSchemaJSON != "" {
+		c.ResponseSchema = json.RawMessage(registration.responseSchemaJSON)
+	}
+	if registration.Serial {
+		c.Ordering = "serial"
+	}
+	if registration.QueryTemplate != nil {
+		// It was decoded from JSON, so it encodes again.
+		c.QueryTemplate, _ = json.Marshal(registration.QueryTemplate)
+	}
+	for op, timeout := range registration.CommandTimeouts {
+		if c.CommandTimeouts == nil {
+			c.CommandTimeouts = make(map[string]string, len(registration.CommandTimeouts))
+		}
+		c.CommandTimeouts[op] = timeout.String()
+	}
+	if policy := registration.CommandPolicy; len(policy.Allow) > 0 || len(policy.Deny) > 0 {
+		c.Commands = &policy
+	}
+	if !registration.ExpiresAt.IsZero() {
+		expiresAt := registration.ExpiresAt
+		c.ExpiresAt = &expiresAt
+	}
+}
+
+// registration rebuilds an exported client's registration, checked as
+// /register would check it. Settings that don't pass are dropped with a log
+// line rather than failing the import.
+func (c exportedClient) registration(cfg *Config) Registration {
+	ignore := func(what string, err error) {
+		log.Printf("Ignoring %s for imported client %s: %v", what, c.ClientID, err)
+	}
+
+	var pingInterval time.Duration
+	if c.PingInterval != "" {
+		d, err := time.ParseDuration(c.PingInterval)
+		if err != nil {
+			ignore("ping interval "+strconv.Quote(c.PingInterval), err)
+		}
+		pingInterval = d
+	}
+	// Imported registrations keep their token so that migrating clients
+	// can reconnect under strict registration.
+	registration := Registration{
+		PingInterval: clampPingInterval(cfg, pingInterval),
+		Token:        c.Token,
+		Tenant:       c.Tenant,
+		MaxInFlight:  clampMaxInFlight(cfg, max(c.MaxInFlight, 0)),
+		Serial:       c.Ordering == "serial",
+		Weight:       clampWeight(c.Weight),
+	}
+	if c.ExpiresAt != nil {
+		registration.ExpiresAt = *c.ExpiresAt
+	}
+	if err := validateMetadata(c.Metadata); err != nil {
+		ignore("metadata", err)
+	} else {
+		registration.Metadata = c.Metadata
+	}
+	if prefetches, err := parsePrefetches(c.Prefetch); err != nil {
+		ignore("prefetch", err)
+	} else {
+		registration.Prefetch = prefetches
+	}
+	if schema, err := compileResponseSchema(c.ClientID, c.ResponseSchema); err != nil {
+		ignore("response_schema", err)
+	} else if schema != nil {
+		registration.ResponseSchema = schema
+		registration.responseSchemaJSON = string(c.ResponseSchema)
+	}
+	if template, err := parseQueryTemplate(c.QueryTemplate); err != nil {
+		ignore("query_template", err)
+	} else {
+		registration.QueryTemplate = template
+	}
+	if timeouts, err := parseCommandTimeoutMap(c.CommandTimeouts); err != nil {
+		ignore("command_timeouts", err)
+	} else {
+		registration.CommandTimeouts = timeouts
+	}
+	if c.Commands != nil {
+		if err := c.Commands.validate(); err != nil {
+			ignore("commands", err)
+		} else {
+			registration.CommandPolicy = *c.Commands
+		}
+	}
+	return registration
+}
+
+// handleReconnect tells every connected client to reconnect to the given URL
+// and puts the server into draining mode. Clients receive
+//
+//	{"type":"reconnect","url":"wss://new-host/connect"}
+//
+// and are expected to close their connection and dial the new URL.
+func (s *Server) handleReconnect(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.URL == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+
+	s.draining.Store(true)
+
+	result, err := s.broadcastReconnect(request.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Draining: told %d clients to reconnect to %s (%d failed, %d timed out)", result.Sent, request.URL, len(result.Failed), len(result.TimedOut))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// broadcastReconnect tells every connected client to reconnect to url.
+func (s *Server) broadcastReconnect(url string) (broadcastResult, error) {
+	message, err := json.Marshal(struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	}{
+		Type: "reconnect",
+		URL:  url,
+	})
+	if err != nil {
+		return broadcastResult{}, err
+	}
+	return s.broadcast(s.connectedClients(), message), nil
+}
+
+type flushResult struct {
+	Cleared int `json:"cleared"`
+}
+
+// handleCacheFlush clears the whole cache, or only one client's or one
+// tenant's entries when the route carries a client ID or tenant.
+func (s *Server) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	var result flushResult
+	if tenant, ok := mux.Vars(r)["tenant"]; ok {
+		result.Cleared = s.flushTenantCache(tenant)
+		log.Printf("Flushed %d cache entries for tenant %s", result.Cleared, tenant)
+	} else if clientID, ok := mux.Vars(r)["clientID"]; ok {
+		result.Cleared = s.flushClientCache(clientID)
+		log.Printf("Flushed %d cache entries for client %s", result.Cleared, clientID)
+	} else {
+		result.Cleared = s.flushCache()
+		log.Printf("Flushed %d cache entries", result.Cleared)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
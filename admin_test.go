@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exportRegistry(t *testing.T, url string) registryExport {
+	t.Helper()
+	resp, data := do(t, "GET", url+"/admin/export", nil, adminHeader())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("export: %s: %s", resp.Status, data)
+	}
+	var export registryExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		t.Fatalf("decoding export %s: %v", data, err)
+	}
+	return export
+}
+
+func TestExportImportCarriesWholeRegistration(t *testing.T) {
+	_, primary := newTestServer(t)
+	register(t, primary, map[string]any{
+		"client_id":        "db-1",
+		"tenant":           "acme",
+		"ping_interval":    "20s",
+		"prefetch":         []map[string]string{{"interval": "1m", "query": "q=hot"}},
+		"response_schema":  map[string]any{"type": "object"},
+		"max_in_flight":    3,
+		"ordering":         "serial",
+		"query_template":   map[string]any{"sql": "select {param.q}"},
+		"weight":           2,
+		"metadata":         map[string]string{"region": "eu"},
+		"command_timeouts": map[string]string{"restart": "30s"},
+		"commands":         map[string]any{"allow": []string{"restart", "status"}},
+	})
+	export := exportRegistry(t, primary.URL)
+	if len(export.Clients) != 1 {
+		t.Fatalf("exported %d clients, want 1", len(export.Clients))
+	}
+
+	target, secondary := newTestServer(t)
+	resp, data := do(t, "POST", secondary.URL+"/admin/import", export, adminHeader())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("import: %s: %s", resp.Status, data)
+	}
+
+	target.registrationsMutex.RLock()
+	imported := target.registrations["db-1"]
+	target.registrationsMutex.RUnlock()
+	switch {
+	case imported.ResponseSchema == nil:
+		t.Error("the response schema was not imported")
+	case !imported.Serial:
+		t.Error("the serial ordering was not imported")
+	case len(imported.CommandPolicy.Allow) != 2:
+		t.Errorf("imported command policy %+v, want the exported one", imported.CommandPolicy)
+	case imported.QueryTemplate == nil:
+		t.Error("the query template was not imported")
+	case len(imported.Prefetch) != 1 || imported.CommandTimeouts["restart"] == 0:
+		t.Errorf("imported prefetch %v and command timeouts %v, want the exported ones", imported.Prefetch, imported.CommandTimeouts)
+	}
+
+	reexported := exportRegistry(t, secondary.URL)
+	if !reflect.DeepEqual(reexported.Clients, export.Clients) {
+		t.Errorf("export after import is\n%+v\nwant\n%+v", reexported.Clients, export.Clients)
+	}
+}
+
+func TestImportDropsInvalidSettings(t *testing.T) {
+	s, ts := newTestServer(t)
+	export := map[string]any{"clients": []map[string]any{{
+		"client_id":       "db-1",
+		"tenant":          "acme",
+		"response_schema": map[string]any{"type": 5},
+		"commands":        map[string]any{"allow": []string{""}},
+	}}}
+	resp, data := do(t, "POST", ts.URL+"/admin/import", export, adminHeader())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("import: %s: %s", resp.Status, data)
+	}
+
+	s.registrationsMutex.RLock()
+	imported := s.registrations["db-1"]
+	s.registrationsMutex.RUnlock()
+	if imported.Tenant != "acme" || imported.ResponseSchema != nil || len(imported.CommandPolicy.Allow) != 0 {
+		t.Errorf("imported %+v, want the tenant without the invalid schema and policy", imported)
+	}
+}
+
+func TestCacheFlushEndpoints(t *testing.T) {
+	s, ts := newTestServer(t)
+	entry := ClientResponse{Data: "x", Timestamp: time.Now(), TTL: time.Minute}
+	s.cacheMutex.Lock()
+	for _, key := range []string{"db-1", "db-1?q=1", "db-2", "db-3"} {
+		s.cacheSet(key, entry)
+	}
+	s.cacheMutex.Unlock()
+
+	for _, tc := range []struct {
+		path    string
+		cleared int
+	}{
+		{"/admin/cache/flush/db-1", 2},
+		{"/admin/cache/flush/db-1", 0},
+		{"/admin/cache/flush", 2},
+	} {
+		resp, data := do(t, "POST", ts.URL+tc.path, nil, adminHeader())
+		var result flushResult
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(data, &result) != nil || result.Cleared != tc.cleared {
+			t.Errorf("POST %s got %s %s, want %d cleared", tc.path, resp.Status, data, tc.cleared)
+		}
+	}
+	if resp, _ := do(t, "POST", ts.URL+"/admin/cache/flush", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("flush without credentials got %s, want 401", resp.Status)
+	}
+}
+
+// basicAuth is a header carrying user and password as HTTP Basic Auth.
+func basicAuth(user, password string) http.Header {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth(user, password)
+	return req.Header
+}
+
+func TestAdminBasicAuth(t *testing.T) {
+	_, ts := newTestServer(t, "-admin-user", "ops", "-admin-password", "hunter2")
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"basic auth", basicAuth("ops", "hunter2"), http.StatusOK},
+		{"bearer token", adminHeader(), http.StatusOK},
+		{"wrong password", basicAuth("ops", "guess"), http.StatusUnauthorized},
+		{"wrong user", basicAuth("root", "hunter2"), http.StatusUnauthorized},
+	} {
+		resp, _ := do(t, "GET", ts.URL+"/clients", nil, tc.header)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s got %s, want %d", tc.name, resp.Status, tc.status)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && len(resp.Header.Values("WWW-Authenticate")) != 2 {
+			t.Errorf("%s got challenges %q, want Bearer and Basic", tc.name, resp.Header.Values("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestAdminBasicAuthWithoutToken(t *testing.T) {
+	_, ts := newTestServer(t, "-admin-token", "", "-admin-user", "ops", "-admin-password", "hunter2")
+	if resp, _ := do(t, "GET", ts.URL+"/clients", nil, basicAuth("ops", "hunter2")); resp.StatusCode != http.StatusOK {
+		t.Errorf("basic auth alone got %s, want 200", resp.Status)
+	}
+	resp, _ := do(t, "GET", ts.URL+"/clients", nil, nil)
+	if challenges := resp.Header.Values("WWW-Authenticate"); resp.StatusCode != http.StatusUnauthorized || len(challenges) != 1 || !strings.HasPrefix(challenges[0], "Basic") {
+		t.Errorf("no credentials got %s with challenges %q, want only Basic", resp.Status, challenges)
+	}
+}
+
+func TestAdminUserNeedsPassword(t *testing.T) {
+	if _, err := LoadConfig([]string{"-admin-user", "ops"}); err == nil {
+		t.Error("LoadConfig accepted -admin-user without -admin-password")
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	for _, tc := range []struct {
+		args   []string
+		status int
+	}{
+		{nil, http.StatusOK},
+		{[]string{"-metrics-auth"}, http.StatusUnauthorized},
+	} {
+		_, ts := newTestServer(t, tc.args...)
+		if resp, _ := do(t, "GET", ts.URL+"/metrics", nil, nil); resp.StatusCode != tc.status {
+			t.Errorf("/metrics with %q got %s, want %d", tc.args, resp.Status, tc.status)
+		}
+		if resp, _ := do(t, "GET", ts.URL+"/metrics", nil, adminHeader()); resp.StatusCode != http.StatusOK {
+			t.Errorf("/metrics with %q and the admin token got %s", tc.args, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The connection URL handed out by /register is built from the request's
+// Host header by default, which a caller can set to anything, steering the
+// client to a host of its choosing. Two settings make it trustworthy:
+//
+//	-public-url wss://proxy.example.com/base
+//
+// advertises that URL, with /connect appended, whatever Host says; it
+// replaces the scheme, host and -base-path, for when the proxy sits behind
+// something that changes them. Without it,
+//
+//	-allowed-hosts proxy.example.com,proxy.internal:8380
+//
+// keeps building the URL from Host but refuses registrations whose Host
+// isn't listed, with 400. An entry without a port matches any port.
+
+var errUntrustedHost = errors.New("Host header is not an allowed host")
+
+// parsePublicURL checks a -public-url and returns it without a trailing
+// slash.
+func parsePublicURL(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return "", fmt.Errorf("scheme must be ws or wss")
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("host is missing")
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("must not carry a query, fragment or user info")
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// hostAllowed reports whether host, as sent in a Host header, matches one of
+// the allowed hosts.
+func hostAllowed(allowed map[string]bool, host string) bool {
+	host = strings.ToLower(host)
+	if allowed[host] {
+		return true
+	}
+	name, _, err := net.SplitHostPort(host)
+	return err == nil && allowed[name]
+}
+
+// connectionURL returns the URL clientID should connect to with token.
+func (s *Server) connectionURL(r *http.Request, clientID, token string) (string, error) {
+	cfg := s.currentConfig()
+	query := fmt.Sprintf("/connect?client_id=%s&token=%s", clientID, token)
+	if cfg.publicURL != "" {
+		return cfg.publicURL + query, nil
+	}
+	if len(cfg.allowedHosts) > 0 && !hostAllowed(cfg.allowedHosts, r.Host) {
+		return "", errUntrustedHost
+	}
+
+	scheme := "ws"
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	return scheme + "://" + r.Host + s.basePath + query, nil
+}
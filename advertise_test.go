@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// registerAs registers db-1 with the Host header set to host.
+func registerAs(t *testing.T, url, host string) (*http.Response, registerResponse) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url+"/register", strings.NewReader(`{"client_id":"db-1"}`))
+	req.Host = host
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var registered registerResponse
+	json.NewDecoder(resp.Body).Decode(&registered)
+	return resp, registered
+}
+
+func TestPublicURLIgnoresTheHostHeader(t *testing.T) {
+	_, ts := newTestServer(t, "-public-url", "wss://proxy.example.com/base/")
+	_, registered := registerAs(t, ts.URL, "evil.example.com")
+	if !strings.HasPrefix(registered.ConnectionURL, "wss://proxy.example.com/base/connect?client_id=db-1&token=") {
+		t.Errorf("connection URL %s, want it under -public-url", registered.ConnectionURL)
+	}
+}
+
+func TestAllowedHostsRefuseSpoofedHosts(t *testing.T) {
+	_, ts := newTestServer(t, "-allowed-hosts", "proxy.example.com,127.0.0.1")
+	if resp, _ := registerAs(t, ts.URL, "evil.example.com"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("registration with a spoofed Host got %s, want 400", resp.Status)
+	}
+	_, registered := registerAs(t, ts.URL, "proxy.example.com:8380")
+	if !strings.HasPrefix(registered.ConnectionURL, "ws://proxy.example.com:8380/connect?") {
+		t.Errorf("connection URL %s, want it built from the allowed Host", registered.ConnectionURL)
+	}
+}
+
+func TestParsePublicURL(t *testing.T) {
+	for _, raw := range []string{"https://proxy.example.com", "wss://", "wss://proxy.example.com/?x=1", "wss://user@proxy.example.com"} {
+		if _, err := parsePublicURL(raw); err == nil {
+			t.Errorf("parsePublicURL(%q) succeeded", raw)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A client ID with several connections usually stands for interchangeable
+// replicas, and a query goes to one of them. When each connection holds a
+// part of the answer instead, a GET query with X-Aggregate goes to every
+// healthy connection at once, within the one query timeout, and their
+// replies are combined:
+//
+//   - concat: a JSON array of the bodies of every connection that replied
+//     with a status below 400, each as JSON if it is valid JSON and as a
+//     string otherwise, in no particular order. X-Aggregate-Replies and
+//     X-Aggregate-Failures count the connections that did and didn't
+//     contribute, so a partial result can be told from a complete one.
+//   - first: the first reply with a status below 400, as is; the queries
+//     still out are cancelled.
+//
+// If no connection succeeds, the caller gets an error reply one of them
+// sent, or else the error the last one failed with. Aggregated queries are
+// neither answered from the cache nor stored in it, and a streamed reply is
+// read in full before it is combined. X-Partial-Deadline answers with the
+// replies in by then; see partial.go.
+
+var errInvalidAggregate = errors.New("invalid X-Aggregate")
+
+var aggregateStrategies = map[string]bool{"concat": true, "first": true}
+
+type memberReply struct {
+	reply clientReply
+	err   error
+}
+
+// aggregateMembers returns the connections of clientID an aggregated query
+// goes to: the healthy ones within maxRTT, or all of them if none is
+// healthy.
+func (s *Server) aggregateMembers(clientID string, maxRTT time.Duration) ([]*Client, error) {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+
+	set, ok := s.clients[clientID]
+	if !ok || len(set.conns) == 0 {
+		return nil, errClientNotConnected
+	}
+	conns, err := readyConns(set.conns)
+	if err != nil {
+		return nil, err
+	}
+	if conns, err = s.warmConns(conns); err != nil {
+		return nil, err
+	}
+	if maxRTT > 0 {
+		if conns = withinRTT(conns, maxRTT); len(conns) == 0 {
+			return nil, errClientTooSlow
+		}
+	}
+	var healthy []*Client
+	for _, client := range conns {
+		if !client.unhealthy.Load() {
+			healthy = append(healthy, client)
+		}
+	}
+	if len(healthy) == 0 {
+		return append([]*Client(nil), conns...), nil
+	}
+	return healthy, nil
+}
+
+func (s *Server) serveAggregate(w http.ResponseWriter, r *http.Request, clientID, strategy string, start time.Time) {
+	fail := func(err error) {
+		s.recordQuery(clientID, "", start, err)
+		writeQueryError(w, err)
+	}
+
+	if !aggregateStrategies[strategy] {
+		fail(errInvalidAggregate)
+		return
+	}
+	if s.clientDraining(clientID) {
+		fail(errClientDraining)
+		return
+	}
+	timeout, err := s.queryTimeout(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+	priority, err := queryPriority(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+	maxRTT, err := s.queryMaxRTT(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+	deadline, err := partialDeadline(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+	members, err := s.aggregateMembers(clientID, maxRTT)
+	if err != nil {
+		fail(err)
+		return
+	}
+	s.extendWriteDeadline(w, timeout)
+
+	if !s.acquireQuerySlot() {
+		writeSaturated(w)
+		return
+	}
+	defer s.releaseQuerySlot()
+
+	ctx, cancel, expired := partialContext(r, deadline)
+	defer cancel()
+	replies := make(chan memberReply, len(members))
+	for _, member := range members {
+		query := s.newQueryMessage(r, "")
+		query.Priority = priority
+		query.ctx = ctx
+		go func() {
+			reply, err := s.queryClient(member, query, timeout)
+			if err == nil {
+				reply, err = reply.collect()
+			}
+			if err == nil {
+				reply, err = reply.decompressed()
+			}
+			replies <- memberReply{reply: reply, err: err}
+		}()
+	}
+
+	var parts []json.RawMessage
+	var failed *memberReply
+	cutOff := false
+collect:
+	for range members {
+		var result memberReply
+		select {
+		case result = <-replies:
+			if result.err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				// The partial deadline failed it before expired was seen.
+				cutOff = true
+				continue
+			}
+		case <-expired:
+			cancel()
+			cutOff = true
+			break collect
+		}
+		if result.err == nil && result.reply.statusCode() < 400 {
+			if strategy == "first" {
+				cancel()
+				s.recordQuery(clientID, "", start, nil)
+				s.writeReply(w, r, result.reply)
+				return
+			}
+			parts = append(parts, jsonPart(result.reply.Body))
+			continue
+		}
+		// An error reply from the client says more than a failure to get one.
+		if failed == nil || failed.err != nil {
+			failed = &result
+		}
+	}
+
+	if len(parts) == 0 {
+		if failed == nil {
+			fail(errPartialDeadline)
+			return
+		}
+		if failed.err != nil {
+			fail(failed.err)
+			return
+		}
+		s.recordQuery(clientID, "", start, nil)
+		s.writeReply(w, r, failed.reply)
+		return
+	}
+
+	body, _ := json.Marshal(parts)
+	s.recordQuery(clientID, "", start, nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Aggregate-Replies", strconv.Itoa(len(parts)))
+	w.Header().Set("X-Aggregate-Failures", strconv.Itoa(len(members)-len(parts)))
+	if cutOff {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	w.Write(body)
+}
+
+// jsonPart is body as an element of a JSON array.
+func jsonPart(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
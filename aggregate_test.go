@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+func TestConcatAggregatesEveryConnection(t *testing.T) {
+	s, ts := newTestServer(t)
+	for _, reply := range []replyMessage{
+		{Body: `{"shard":1}`},
+		{Body: "plain"},
+		{Status: http.StatusInternalServerError, Body: "shard down"},
+	} {
+		connectClient(t, s, ts, "shards").serve(func(queryMessage) replyMessage { return reply })
+	}
+
+	resp, body := do(t, "GET", ts.URL+"/query/shards", nil, http.Header{"X-Aggregate": {"concat"}})
+	var parts []any
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &parts) != nil || len(parts) != 2 {
+		t.Fatalf("concat got %s: %s, want the two good replies", resp.Status, body)
+	}
+	if resp.Header.Get("X-Aggregate-Replies") != "2" || resp.Header.Get("X-Aggregate-Failures") != "1" {
+		t.Errorf("concat counted %q replies and %q failures", resp.Header.Get("X-Aggregate-Replies"), resp.Header.Get("X-Aggregate-Failures"))
+	}
+	var kinds []string
+	for _, part := range parts {
+		switch part.(type) {
+		case map[string]any:
+			kinds = append(kinds, "json")
+		case string:
+			kinds = append(kinds, "string")
+		}
+	}
+	sort.Strings(kinds)
+	if len(kinds) != 2 || kinds[0] != "json" || kinds[1] != "string" {
+		t.Errorf("concat parts %v, want one JSON object and one string", parts)
+	}
+	if _, ok := s.cached(s.cacheKey("shards", "")); ok {
+		t.Error("aggregated reply was cached")
+	}
+}
+
+func TestFirstAggregateTakesTheFirstSuccess(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "shards").serve(func(queryMessage) replyMessage {
+		return replyMessage{Status: http.StatusInternalServerError, Body: "shard down"}
+	})
+	connectClient(t, s, ts, "shards").echo("answer")
+
+	if resp, body := do(t, "GET", ts.URL+"/query/shards", nil, http.Header{"X-Aggregate": {"first"}}); resp.StatusCode != http.StatusOK || string(body) != "answer" {
+		t.Errorf("first got %s: %s, want the successful reply", resp.Status, body)
+	}
+}
+
+func TestAggregateWithoutSuccessReturnsAnError(t *testing.T) {
+	s, ts := newTestServer(t)
+	for i := 0; i < 2; i++ {
+		connectClient(t, s, ts, "shards").serve(func(queryMessage) replyMessage {
+			return replyMessage{Status: http.StatusServiceUnavailable, Body: "shard down"}
+		})
+	}
+	if resp, body := do(t, "GET", ts.URL+"/query/shards", nil, http.Header{"X-Aggregate": {"concat"}}); resp.StatusCode != http.StatusServiceUnavailable || string(body) != "shard down" {
+		t.Errorf("aggregate with every connection failing got %s: %s, want one of their errors", resp.Status, body)
+	}
+}
+
+func TestUnknownAggregateIsRejected(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "shards").echo("x")
+	if resp, _ := do(t, "GET", ts.URL+"/query/shards", nil, http.Header{"X-Aggregate": {"sum"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("X-Aggregate sum got %s, want 400", resp.Status)
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// When live queries fill -backpressure-threshold percent of the
+// -max-concurrent-queries slots, every connected client is sent
+//
+//	{"type":"backpressure"}
+//
+// and once they drain to -backpressure-resume percent,
+//
+//	{"type":"resume"}
+//
+// A client that gets backpressure is expected to hold off unsolicited
+// messages, such as pushes and invalidations, until it gets resume, while
+// still answering queries, since replies are what frees slots. The most
+// recent signal is the one in force; a client connecting while backpressure
+// is on is sent it right away. Unsolicited messages that arrive anyway are
+// read at most one per backpressurePushPause per connection until resume.
+
+// backpressurePushPause is how long a connection's reader waits after an
+// unsolicited message while backpressure is on.
+const backpressurePushPause = 20 * time.Millisecond
+
+// checkBackpressure turns backpressure on or off when the share of query
+// slots taken crosses the configured thresholds. It is called whenever a
+// slot is taken or given back, so it must stay cheap; clients are told by
+// runBackpressure.
+func (s *Server) checkBackpressure() {
+	if s.querySlots == nil {
+		return
+	}
+	cfg := s.currentConfig()
+	load := len(s.querySlots) * 100 / cap(s.querySlots)
+
+	var changed bool
+	if s.backpressure.Load() {
+		if cfg.BackpressureThreshold == 0 || load <= cfg.BackpressureResume {
+			changed = s.backpressure.CompareAndSwap(true, false)
+		}
+	} else if cfg.BackpressureThreshold > 0 && load >= cfg.BackpressureThreshold {
+		changed = s.backpressure.CompareAndSwap(false, true)
+	}
+	if changed {
+		select {
+		case s.backpressureChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runBackpressure tells every client when backpressure turns on or off. A
+// burst of changes is coalesced, so clients only ever hear the state it
+// settled in, and never the same signal twice in a row.
+func (s *Server) runBackpressure() {
+	for range s.backpressureChanged {
+		s.backpressureMutex.Lock()
+		on := s.backpressure.Load()
+		if on != s.backpressureSent {
+			s.backpressureSent = on
+			if on {
+				log.Printf("Query slots are past the backpressure threshold, telling clients to back off")
+			} else {
+				log.Printf("Query slots are back under the resume threshold, telling clients to resume")
+			}
+			s.broadcast(s.connectedClients(), backpressureMessage(on))
+		}
+		s.backpressureMutex.Unlock()
+	}
+}
+
+// sendBackpressure tells a newly connected client about backpressure in
+// force. Holding backpressureMutex orders it with runBackpressure's
+// broadcasts, so the client can't be left with a stale signal.
+func (s *Server) sendBackpressure(client *Client) {
+	s.backpressureMutex.Lock()
+	defer s.backpressureMutex.Unlock()
+	if !s.backpressureSent {
+		return
+	}
+	if err := client.writeMessageWithin(websocket.TextMessage, backpressureMessage(true), s.currentConfig().BroadcastTimeout); err != nil {
+		log.Printf("Error sending backpressure to client %s: %v (%s)", client.ID, err, s.recordWebsocketError(client, "write", err))
+	}
+}
+
+func backpressureMessage(on bool) []byte {
+	messageType := "resume"
+	if on {
+		messageType = "backpressure"
+	}
+	message, _ := json.Marshal(struct {
+		Type string `json:"type"`
+	}{
+		Type: messageType,
+	})
+	return message
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// readSignal reads the next message as a backpressure signal.
+func (c *testClient) readSignal() string {
+	c.t.Helper()
+	var signal struct{ Type string }
+	if err := json.Unmarshal(c.read(), &signal); err != nil {
+		c.t.Fatalf("decoding signal: %v", err)
+	}
+	return signal.Type
+}
+
+func TestBackpressureIsSignalledAndLifted(t *testing.T) {
+	s, ts := newTestServer(t, "-max-concurrent-queries", "2", "-backpressure-threshold", "50", "-backpressure-resume", "0")
+	busy := connectClient(t, s, ts, "db-1")
+	observer := connectClient(t, s, ts, "db-2")
+
+	result := goGet(ts.URL+"/query/db-1", nil)
+	query := busy.readQuery()
+	if signal := observer.readSignal(); signal != "backpressure" {
+		t.Fatalf("observer got %q with half the query slots taken, want backpressure", signal)
+	}
+	// A client connecting meanwhile is told straight away.
+	if signal := connectClient(t, s, ts, "db-3").readSignal(); signal != "backpressure" {
+		t.Errorf("new client got %q while backpressure is on", signal)
+	}
+
+	busy.reply(replyMessage{RequestID: query.RequestID, Body: "x"})
+	<-result
+	if signal := observer.readSignal(); signal != "resume" {
+		t.Errorf("observer got %q once the slots drained, want resume", signal)
+	}
+}
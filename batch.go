@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// POST /query-batch runs several GET-style queries, possibly against
+// different clients, in one request:
+//
+//	{"queries":[{"client_id":"a","query":"q=x"},{"client_id":"b"}]}
+//
+// and answers with one result per entry, in the same order:
+//
+//	{"results":[{"client_id":"a","status":200,"headers":{...},"body":"...","cache":"hit"},
+//	            {"client_id":"b","status":404,"error":"Client not connected"}]}
+//
+// Entries go through the cache and to the clients like individual queries,
+// all at once and each with the batch's X-Query-Timeout. Entries that would
+// share a cache entry, the same client with equivalent parameters, are sent
+// to the client once and get the same result. Streamed replies are read to
+// the end before the batch is answered, unless X-Partial-Deadline cuts the
+// batch short; see partial.go.
+
+type batchQuery struct {
+	ClientID string `json:"client_id"`
+	Query    string `json:"query"`
+}
+
+type batchResult struct {
+	ClientID string            `json:"client_id"`
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Cache    string            `json:"cache,omitempty"`
+	// Complete is false for an entry cut off by X-Partial-Deadline.
+	Complete bool `json:"complete"`
+	// Retryable marks a failure worth retrying; see retry.go.
+	Retryable bool `json:"retryable,omitempty"`
+}
+
+var errInvalidBatch = errors.New("invalid batch")
+
+func (s *Server) handleBatchQuery(w http.ResponseWriter, r *http.Request) {
+	var batch struct {
+		Queries []batchQuery `json:"queries"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		if budgetErr := budgetError(r); budgetErr != nil {
+			writeQueryError(w, budgetErr)
+			return
+		}
+		http.Error(w, fmt.Sprintf("%v: %v", errInvalidBatch, err), bodyErrorStatus(err))
+		return
+	}
+	if err := s.validateBatch(batch.Queries); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeout, err := s.queryTimeout(r)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	maxRTT, err := s.queryMaxRTT(r)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	deadline, err := partialDeadline(r)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	s.extendWriteDeadline(w, timeout)
+
+	// Entries with the same cache key are answered by one query.
+	keys := make([]string, len(batch.Queries))
+	distinct := make(map[string]batchQuery)
+	for i, q := range batch.Queries {
+		keys[i] = s.cacheKey(q.ClientID, q.Query)
+		distinct[keys[i]] = q
+	}
+
+	ctx, cancel, expired := partialContext(r, deadline)
+	defer cancel()
+	callerIP := s.clientIP(r)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	byKey := make(map[string]batchResult, len(distinct))
+	for key, q := range distinct {
+		wg.Add(1)
+		go func(key string, q batchQuery) {
+			defer wg.Done()
+			result := s.runBatchQuery(ctx, key, q, callerIP, maxRTT, timeout)
+			if result.Error != "" && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				// The partial deadline failed it, which leaves it cut off.
+				return
+			}
+			result.Complete = true
+			mu.Lock()
+			byKey[key] = result
+			mu.Unlock()
+		}(key, q)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-expired:
+		// Cancel the queries still out before answering without them.
+		cancel()
+	}
+
+	partial := false
+	results := make([]batchResult, len(batch.Queries))
+	mu.Lock()
+	for i, key := range keys {
+		result, ok := byKey[key]
+		if !ok {
+			partial = true
+			result = batchResult{
+				ClientID:  batch.Queries[i].ClientID,
+				Status:    queryErrorStatus(errPartialDeadline),
+				Error:     errPartialDeadline.Error(),
+				Retryable: retryableError(errPartialDeadline),
+			}
+		}
+		results[i] = result
+	}
+	mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if partial {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Results []batchResult `json:"results"`
+	}{
+		Results: results,
+	})
+}
+
+func (s *Server) validateBatch(queries []batchQuery) error {
+	if len(queries) == 0 {
+		return fmt.Errorf("%w: no queries", errInvalidBatch)
+	}
+	if max := s.currentConfig().MaxBatchQueries; max > 0 && len(queries) > max {
+		return fmt.Errorf("%w: %d queries, at most %d allowed", errInvalidBatch, len(queries), max)
+	}
+	for i, q := range queries {
+		if q.ClientID == "" {
+			return fmt.Errorf("%w: query %d has no client_id", errInvalidBatch, i)
+		}
+		if _, err := url.ParseQuery(q.Query); err != nil {
+			return fmt.Errorf("%w: query %d: %v", errInvalidBatch, i, err)
+		}
+	}
+	return nil
+}
+
+// runBatchQuery answers one distinct batch entry the way handleQuery would.
+func (s *Server) runBatchQuery(ctx context.Context, key string, q batchQuery, callerIP string, maxRTT, timeout time.Duration) batchResult {
+	start := time.Now()
+	result := batchResult{ClientID: q.ClientID}
+
+	if s.maintenance.Load() {
+		cached, stale, err := s.maintenanceLookup(key)
+		if err != nil {
+			s.recordQuery(q.ClientID, "miss", start, err)
+			result.Status = queryErrorStatus(err)
+			result.Error = err.Error()
+			result.Retryable = retryableError(err)
+			return result
+		}
+		result.Cache = "hit"
+		if stale {
+			result.Cache = "stale"
+		}
+		s.recordQuery(q.ClientID, result.Cache, start, nil)
+		return batchReply(result, cached.reply())
+	}
+
+	cached, lookup, ok := s.lookupCache(key)
+	if ok {
+		s.recordQuery(q.ClientID, lookup.outcome(), start, nil, lookup)
+		result.Cache = lookup.outcome()
+		return batchReply(result, cached.reply())
+	}
+
+	if !s.acquireQuerySlot() {
+		result.Status = http.StatusServiceUnavailable
+		result.Error = "server is at its query concurrency limit"
+		result.Retryable = true
+		return result
+	}
+	defer s.releaseQuerySlot()
+
+	params, _ := url.ParseQuery(q.Query)
+	query := queryMessage{
+		Type:      "query",
+		RequestID: newRequestID(),
+		Command:   "GET_DATA",
+		Method:    http.MethodGet,
+		Params:    params,
+		CallerIP:  callerIP,
+		path:      s.basePath + "/query/" + q.ClientID,
+		maxRTT:    maxRTT,
+		ctx:       ctx,
+	}
+	reply, err := s.queryWithFailover(q.ClientID, query, timeout)
+	if err == nil {
+		reply, err = reply.collect()
+	}
+	if err != nil {
+		s.recordQuery(q.ClientID, "miss", start, err, lookup)
+		result.Status = queryErrorStatus(err)
+		result.Error = err.Error()
+		result.Retryable = retryableError(err)
+		return result
+	}
+
+	s.recordQuery(q.ClientID, "miss", start, nil, lookup, s.storeReply(key, s.cachePolicy(q.ClientID), reply))
+	result.Cache = "miss"
+	return batchReply(result, reply)
+}
+
+// batchReply fills in result from reply, decompressing a gzip reply since
+// the result is JSON.
+func batchReply(result batchResult, reply clientReply) batchResult {
+	reply, err := reply.decompressed()
+	if err != nil {
+		result.Status = queryErrorStatus(err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Status = reply.statusCode()
+	result.Headers = reply.Headers
+	result.Body = string(reply.Body)
+	return result
+}
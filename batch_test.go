@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// queryBatch posts queries to /query-batch and decodes the results.
+func queryBatch(t *testing.T, url string, queries ...batchQuery) batchResponse {
+	t.Helper()
+	resp, body := do(t, "POST", url+"/query-batch", map[string]any{"queries": queries}, nil)
+	var batch batchResponse
+	if err := json.Unmarshal(body, &batch); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("batch got %s: %s", resp.Status, body)
+	}
+	return batch
+}
+
+func TestBatchAnswersEachEntryInOrder(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "a").serve(func(query queryMessage) replyMessage {
+		return replyMessage{Body: "a:" + query.Params["q"][0]}
+	})
+
+	batch := queryBatch(t, ts.URL, batchQuery{ClientID: "a", Query: "q=x"}, batchQuery{ClientID: "b"}, batchQuery{ClientID: "a", Query: "q=y"})
+	want := []batchResult{
+		{ClientID: "a", Status: http.StatusOK, Body: "a:x"},
+		{ClientID: "b", Status: http.StatusNotFound},
+		{ClientID: "a", Status: http.StatusOK, Body: "a:y"},
+	}
+	if len(batch.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(batch.Results), len(want))
+	}
+	for i, result := range batch.Results {
+		if result.ClientID != want[i].ClientID || result.Status != want[i].Status || result.Body != want[i].Body {
+			t.Errorf("result %d is %+v, want %+v", i, result, want[i])
+		}
+	}
+}
+
+func TestBatchSendsDuplicateEntriesOnce(t *testing.T) {
+	s, ts := newTestServer(t, "-cache=false")
+	var queries atomic.Int32
+	connectClient(t, s, ts, "a").serve(func(queryMessage) replyMessage {
+		queries.Add(1)
+		return replyMessage{Body: "shared"}
+	})
+
+	batch := queryBatch(t, ts.URL, batchQuery{ClientID: "a", Query: "x=1&y=2"}, batchQuery{ClientID: "a", Query: "y=2&x=1"}, batchQuery{ClientID: "a", Query: "x=1&y=2"})
+	for i, result := range batch.Results {
+		if result.Status != http.StatusOK || result.Body != "shared" {
+			t.Errorf("result %d is %+v, want the shared reply", i, result)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("the client was sent %d queries for one distinct entry", n)
+	}
+}
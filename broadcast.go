@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errWriteTimeout = errors.New("write timed out")
+
+// broadcastResult reports how a message sent to every client fared. Clients
+// that didn't take the message within -broadcast-timeout are listed apart
+// from those whose connection failed outright.
+type broadcastResult struct {
+	Sent     int      `json:"sent"`
+	Failed   []string `json:"failed"`
+	TimedOut []string `json:"timed_out"`
+}
+
+// broadcast sends message to every target from a bounded pool of workers, so
+// a few slow clients hold up neither the rest nor the caller for longer than
+// the send timeout. A send that times out leaves the connection unusable,
+// as gorilla/websocket can't resume a half-written frame, so that
+// connection is closed and the client has to reconnect.
+func (s *Server) broadcast(targets []*Client, message []byte) broadcastResult {
+	cfg := s.currentConfig()
+	result := broadcastResult{Failed: []string{}, TimedOut: []string{}}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan *Client)
+	for i := 0; i < cfg.BroadcastWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for client := range work {
+				err := client.writeMessageWithin(websocket.TextMessage, message, cfg.BroadcastTimeout)
+				if errors.Is(err, errWriteTimeout) {
+					client.Connection.Close()
+				}
+
+				mu.Lock()
+				switch {
+				case errors.Is(err, errWriteTimeout):
+					result.TimedOut = append(result.TimedOut, client.ID)
+				case err != nil:
+					log.Printf("Error broadcasting to client %s: %v", client.ID, err)
+					result.Failed = append(result.Failed, client.ID)
+				default:
+					result.Sent++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, client := range targets {
+		work <- client
+	}
+	close(work)
+	wg.Wait()
+
+	return result
+}
+
+// writeMessageWithin is writeMessage with a bound on the total time spent,
+// including waiting behind other writers.
+func (c *Client) writeMessageWithin(messageType int, data []byte, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	result := make(chan error, 1)
+	go func() {
+		c.writeMutex.Lock()
+		defer c.writeMutex.Unlock()
+		if time.Now().After(deadline) {
+			result <- errWriteTimeout
+			return
+		}
+		c.Connection.SetWriteDeadline(deadline)
+		c.prepareWrite(len(data))
+		err := c.Connection.WriteMessage(messageType, data)
+		c.Connection.SetWriteDeadline(time.Time{})
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = errWriteTimeout
+		}
+		result <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return errWriteTimeout
+	}
+}
+
+// handleBroadcast sends the request body, as a text message, to every
+// connected client.
+func (s *Server) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	message, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(message) == 0 {
+		http.Error(w, "message body is required", http.StatusBadRequest)
+		return
+	}
+
+	result := s.broadcast(s.connectedClients(), message)
+	log.Printf("Broadcast to %d clients (%d failed, %d timed out)", result.Sent, len(result.Failed), len(result.TimedOut))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBroadcastReportsSlowClients(t *testing.T) {
+	s, ts := newTestServer(t, "-broadcast-timeout", "100ms")
+	fast := connectClient(t, s, ts, "fast")
+	connectClient(t, s, ts, "slow")
+
+	// A writer stuck on the slow connection keeps the broadcast from it.
+	slow := s.firstConnection("slow")
+	slow.writeMutex.Lock()
+	defer slow.writeMutex.Unlock()
+
+	start := time.Now()
+	resp, body := do(t, "POST", ts.URL+"/admin/broadcast", "hello", adminHeader())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("broadcast took %s behind a slow client", elapsed)
+	}
+	var result broadcastResult
+	if err := json.Unmarshal(body, &result); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("broadcast got %s: %s", resp.Status, body)
+	}
+	if result.Sent != 1 || len(result.TimedOut) != 1 || result.TimedOut[0] != "slow" {
+		t.Errorf("broadcast result %+v, want it sent to fast and slow timed out", result)
+	}
+	if message := fast.read(); string(message) != "hello" {
+		t.Errorf("fast client got %q", message)
+	}
+}
+
+func TestBroadcastNeedsABody(t *testing.T) {
+	_, ts := newTestServer(t)
+	if resp, _ := do(t, "POST", ts.URL+"/admin/broadcast", nil, adminHeader()); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty broadcast got %s, want 400", resp.Status)
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// -request-budget bounds the whole of a query request, from reading it to
+// writing the last byte of the response, whatever it spends the time on:
+// the request body, a queue behind other queries, the round trip to the
+// client and any failover, the chunks of a stream. requestBudget puts the
+// deadline on the request's context and the connection's read and write
+// deadlines, and each stage that waits takes no more than what is left:
+// the query timeout is capped at the remaining budget, so the queue wait
+// and round trip fit in it, and a streamed reply stops at the deadline. A
+// request found to have no budget left before its response has started gets
+// 504, which is given budgetErrorGrace past the deadline to go out; after
+// the response has started, the stream fails or the connection is cut the
+// usual way.
+// X-Query-Timeout can shorten a query's wait but never extend it past the
+// budget.
+
+var errBudgetExhausted = errors.New("request budget exhausted")
+
+const budgetErrorGrace = 250 * time.Millisecond
+
+// requestBudget applies -request-budget to next; zero leaves requests
+// unbounded.
+func (s *Server) requestBudget(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		budget := s.currentConfig().RequestBudget
+		if budget <= 0 {
+			next(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), budget)
+		defer cancel()
+		deadline, _ := ctx.Deadline()
+
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline.Add(budgetErrorGrace))
+		next(&budgetWriter{ResponseWriter: w, deadline: deadline.Add(budgetErrorGrace)}, r.WithContext(ctx))
+	}
+}
+
+// budgetDeadline returns the end of r's budget, if it has one.
+func budgetDeadline(r *http.Request) (time.Time, bool) {
+	return r.Context().Deadline()
+}
+
+// budgetTimeout caps timeout at what is left of r's budget, failing with
+// errBudgetExhausted once nothing is.
+func budgetTimeout(r *http.Request, timeout time.Duration) (time.Duration, error) {
+	deadline, ok := budgetDeadline(r)
+	if !ok {
+		return timeout, nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return 0, errBudgetExhausted
+	}
+	return min(timeout, remaining), nil
+}
+
+// budgetError returns errBudgetExhausted if r's budget has run out, for
+// stages that fail with an error of their own when it does, such as reading
+// the body past the read deadline.
+func budgetError(r *http.Request) error {
+	if deadline, ok := budgetDeadline(r); ok && !time.Now().Before(deadline) {
+		return errBudgetExhausted
+	}
+	return nil
+}
+
+// budgetWriter keeps later write deadlines, such as extendWriteDeadline's,
+// within the budget and its grace.
+type budgetWriter struct {
+	http.ResponseWriter
+	deadline time.Time
+}
+
+func (w *budgetWriter) SetWriteDeadline(t time.Time) error {
+	if t.IsZero() || t.After(w.deadline) {
+		t = w.deadline
+	}
+	return http.NewResponseController(w.ResponseWriter).SetWriteDeadline(t)
+}
+
+func (w *budgetWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (w *budgetWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestBudgetBoundsTheQuery(t *testing.T) {
+	s, ts := newTestServer(t, "-request-budget", "200ms", "-query-timeout", "10s")
+	client := connectClient(t, s, ts, "db-1")
+
+	start := time.Now()
+	result := goGet(ts.URL+"/query/db-1", http.Header{"X-Query-Timeout": {"10s"}})
+	client.readQuery()
+	r := <-result
+	if r.status != http.StatusGatewayTimeout {
+		t.Errorf("query past its budget got %d %q, want 504", r.status, r.body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("query took %s, want it cut off at the 200ms budget", elapsed)
+	}
+}
+
+func TestRequestBudgetOffByDefault(t *testing.T) {
+	s, _ := newTestServer(t)
+	var bounded bool
+	s.requestBudget(func(w http.ResponseWriter, r *http.Request) {
+		_, bounded = budgetDeadline(r)
+	})(httptest.NewRecorder(), httptest.NewRequest("GET", "/query/db-1", nil))
+	if bounded {
+		t.Error("request got a budget without -request-budget")
+	}
+}
+
+func TestBudgetTimeoutCapsAtWhatIsLeft(t *testing.T) {
+	s, _ := newTestServer(t, "-request-budget", "1s")
+	s.requestBudget(func(w http.ResponseWriter, r *http.Request) {
+		if timeout, err := budgetTimeout(r, time.Minute); err != nil || timeout > time.Second {
+			t.Errorf("budgetTimeout = %s, %v, want at most the 1s budget", timeout, err)
+		}
+		if timeout, err := budgetTimeout(r, time.Millisecond); err != nil || timeout != time.Millisecond {
+			t.Errorf("budgetTimeout = %s, %v, want the shorter timeout kept", timeout, err)
+		}
+	})(httptest.NewRecorder(), httptest.NewRequest("GET", "/query/db-1", nil))
+
+	s, _ = newTestServer(t, "-request-budget", "1ms")
+	s.requestBudget(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		if _, err := budgetTimeout(r, time.Minute); err != errBudgetExhausted {
+			t.Errorf("budgetTimeout after the budget ran out = %v", err)
+		}
+		if budgetError(r) != errBudgetExhausted {
+			t.Error("budgetError after the budget ran out = nil")
+		}
+	})(httptest.NewRecorder(), httptest.NewRequest("GET", "/query/db-1", nil))
+}
@@ -0,0 +1,398 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+var errNotCached = errors.New("nothing cached for this query")
+
+// A cacheDecision says why a query was or wasn't answered from the cache, and
+// why its reply was or wasn't stored. Query log lines and events carry them
+// to make cache tuning easier.
+type cacheDecision string
+
+const (
+	// Lookups.
+	cacheFreshHit     cacheDecision = "fresh-hit"
+	cacheNegativeHit  cacheDecision = "negative-hit"
+	cacheGraceHit     cacheDecision = "grace-hit"
+	cacheNotCached    cacheDecision = "not-cached"
+	cacheStaleExpired cacheDecision = "stale-expired"
+	cacheDisabled     cacheDecision = "disabled"
+
+	// Stores.
+	cacheStored         cacheDecision = "stored"
+	cacheNegativeStored cacheDecision = "negative-cache"
+	cacheNegativeOff    cacheDecision = "negative-cache-off"
+	cacheNoCacheHeader  cacheDecision = "nocache-header"
+	cacheTooLarge       cacheDecision = "not-cacheable-size"
+	cacheStreamed       cacheDecision = "not-cacheable-stream"
+	cacheBadStatus      cacheDecision = "not-cacheable-status"
+	cacheEmptyReply     cacheDecision = "empty-reply"
+)
+
+// outcome is the cache outcome a lookup that returned an entry counts as:
+// "stale" for an expired entry served during the grace, "hit" otherwise.
+func (d cacheDecision) outcome() string {
+	if d == cacheGraceHit {
+		return "stale"
+	}
+	return "hit"
+}
+
+// joinCacheDecisions formats decisions for a log line or event.
+func joinCacheDecisions(decisions []cacheDecision) string {
+	names := make([]string, len(decisions))
+	for i, decision := range decisions {
+		names[i] = string(decision)
+	}
+	return strings.Join(names, ",")
+}
+
+// cacheTTL reads the Cache-Control header from a client's reply. A max-age
+// directive overrides the default ttl; no-store and no-cache mean the reply
+// must not be cached at all, reported as ok == false.
+func cacheTTL(headers map[string]string, ttl time.Duration) (time.Duration, bool) {
+
+	var cacheControl string
+	for name, value := range headers {
+		if strings.EqualFold(name, "Cache-Control") {
+			cacheControl = value
+		}
+	}
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, false
+		case "max-age":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || seconds < 0 {
+				continue
+			}
+			if seconds == 0 {
+				return 0, false
+			}
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+	return ttl, true
+}
+
+// lookupCache returns the fresh entry under key, if caching is on and there
+// is one, and why it did or didn't.
+//
+// Without a grace period, every caller that finds an entry expired fetches it
+// anew, so a burst arriving right at the TTL boundary sends the client a
+// burst of identical queries. With -cache-expiry-grace, the first such caller
+// claims the refresh and fetches, and callers behind it are served the
+// expired entry, as a grace-hit, until the refreshed reply replaces it or the
+// grace runs out, when the next caller claims it again. The proxy never
+// revalidates in the background, stale-while-revalidate style: the grace only
+// covers callers queued up behind a refresh already under way. /query-cached
+// is unaffected; it serves expired entries anyway.
+func (s *Server) lookupCache(key string) (ClientResponse, cacheDecision, bool) {
+	cfg := s.currentConfig()
+	if !cfg.Cache {
+		return ClientResponse{}, cacheDisabled, false
+	}
+
+	s.cacheMutex.RLock()
+	cached, ok := s.cache[key]
+	s.cacheMutex.RUnlock()
+	if ok {
+		s.cacheLRU.touch(key)
+	}
+
+	switch {
+	case !ok:
+		return ClientResponse{}, cacheNotCached, false
+	case time.Since(cached.Timestamp) >= cached.TTL:
+		if cfg.CacheExpiryGrace > 0 && !s.claimRefresh(key, cfg.CacheExpiryGrace) {
+			return cached, cacheGraceHit, true
+		}
+		return ClientResponse{}, cacheStaleExpired, false
+	case cached.Status != 0:
+		return cached, cacheNegativeHit, true
+	}
+	return cached, cacheFreshHit, true
+}
+
+// claimRefresh reports whether the caller gets to refresh the expired entry
+// under key, which it does unless another caller claimed it less than grace
+// ago. An entry that is gone or was refreshed meanwhile is the caller's to
+// fetch too.
+func (s *Server) claimRefresh(key string, grace time.Duration) bool {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+
+	cached, ok := s.cache[key]
+	if !ok || time.Since(cached.Timestamp) < cached.TTL {
+		return true
+	}
+	if !cached.refreshClaimed.IsZero() && time.Since(cached.refreshClaimed) < grace {
+		return false
+	}
+	cached.refreshClaimed = time.Now()
+	s.cache[key] = cached
+	return true
+}
+
+// lookupAnyCache returns the entry under key however old it is, if caching
+// is on and there is one. Expired entries stay in the cache until they are
+// replaced or flushed.
+func (s *Server) lookupAnyCache(key string) (ClientResponse, bool) {
+	if !s.currentConfig().Cache {
+		return ClientResponse{}, false
+	}
+
+	s.cacheMutex.RLock()
+	defer s.cacheMutex.RUnlock()
+	cached, ok := s.cache[key]
+	if ok {
+		s.cacheLRU.touch(key)
+	}
+	return cached, ok
+}
+
+// handleCachedQuery serves whatever is cached for a query, fresh or not, and
+// never contacts the client, which makes it cheap to poll. Age says how old
+// the entry is and X-Cache whether it has expired (STALE) or not (HIT).
+// Nothing cached is a 404.
+func (s *Server) handleCachedQuery(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	clientID := mux.Vars(r)["clientID"]
+
+	cached, ok := s.lookupAnyCache(s.cacheKey(clientID, r.URL.RawQuery))
+	if !ok {
+		s.recordQuery(clientID, "", start, errNotCached)
+		http.Error(w, errNotCached.Error(), http.StatusNotFound)
+		return
+	}
+
+	age := time.Since(cached.Timestamp)
+	outcome := "hit"
+	if age >= cached.TTL {
+		outcome = "stale"
+	}
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.Header().Set("X-Cache", strings.ToUpper(outcome))
+	s.writeReply(w, r, s.cachedReply(r, cached))
+	s.recordQuery(clientID, outcome, start, nil)
+}
+
+// storePush caches an unsolicited message from a client under its bare ID.
+func (s *Server) storePush(clientID string, messageType int, message []byte) {
+	if !s.currentConfig().Cache {
+		return
+	}
+
+	policy := s.cachePolicy(clientID)
+	if !policy.Cache {
+		return
+	}
+
+	s.cacheMutex.Lock()
+	s.cacheSet(s.cacheKey(clientID, ""), ClientResponse{Data: string(message), MessageType: messageType, Timestamp: time.Now(), TTL: policy.TTL})
+	s.cacheMutex.Unlock()
+}
+
+// normalizeQuery rewrites a query string so that equivalent queries share a
+// cache entry. With -cache-key-normalize, parameters are sorted by name and
+// re-encoded, so "b=2&a=1" and "a=1&b=2", or "q=%7e" and "q=~", are the same
+// key. The values of a repeated parameter keep their order, since clients may
+// care about it. -cache-key-fold-case also lower-cases parameter names,
+// merging "Q=x" into "q=x"; values are never folded. A query string that
+// doesn't parse is used as is. The client still receives the parameters
+// exactly as the caller sent them.
+func (s *Server) normalizeQuery(rawQuery string) string {
+	cfg := s.currentConfig()
+	if !cfg.CacheKeyNormalize || rawQuery == "" {
+		return rawQuery
+	}
+
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	if cfg.CacheKeyFoldCase {
+		folded := make(url.Values, len(values))
+		for name, vs := range values {
+			lower := strings.ToLower(name)
+			folded[lower] = append(folded[lower], vs...)
+		}
+		values = folded
+	}
+	return values.Encode()
+}
+
+// tooLarge reports whether reply is over the policy's MaxBody, in which case
+// it is served but not cached.
+func (p cachePolicy) tooLarge(reply clientReply) bool {
+	return p.MaxBody > 0 && len(reply.Body) > p.MaxBody
+}
+
+// storeReply caches a reply under key, by policy, for as long as its
+// Cache-Control allows. Empty replies are skipped unless -cache-empty-replies
+// is set, and streamed and oversized replies are never cached. Error replies,
+// those with a 4xx or 5xx status, are cached for at most the policy's
+// ErrorTTL, which by default keeps them out of the cache; other statuses than
+// 200 never are. It returns why the reply was or wasn't stored.
+func (s *Server) storeReply(key string, policy cachePolicy, reply clientReply) cacheDecision {
+	s.trackFlapping(key, reply)
+	cfg := s.currentConfig()
+	switch {
+	case !cfg.Cache || !policy.Cache:
+		return cacheDisabled
+	case policy.tooLarge(reply):
+		return cacheTooLarge
+	case reply.stream != nil:
+		return cacheStreamed
+	}
+	status := reply.statusCode()
+	failed := status >= 400
+	if status != http.StatusOK && !failed {
+		return cacheBadStatus
+	}
+	if failed && policy.ErrorTTL <= 0 {
+		return cacheNegativeOff
+	}
+	if len(reply.Body) == 0 && !cfg.CacheEmptyReplies {
+		return cacheEmptyReply
+	}
+
+	ttl, ok := cacheTTL(reply.Headers, policy.TTL)
+	if !ok {
+		return cacheNoCacheHeader
+	}
+	decision := cacheStored
+	var cachedStatus int
+	if failed {
+		decision = cacheNegativeStored
+		ttl = min(ttl, policy.ErrorTTL)
+		cachedStatus = status
+	}
+
+	entry := ClientResponse{
+		Status:      cachedStatus,
+		Data:        string(reply.Body),
+		Headers:     reply.Headers,
+		MessageType: reply.MessageType,
+		Timestamp:   time.Now(),
+		TTL:         s.jitterCacheTTL(ttl),
+	}
+	entry.gzipData = s.precompress(entry)
+	if !cacheFits(cfg, cacheEntrySize(key, entry)) {
+		return cacheTooLarge
+	}
+	s.cacheMutex.Lock()
+	s.cacheSet(key, entry)
+	s.cacheMutex.Unlock()
+	return decision
+}
+
+// reply turns a cache entry back into the reply it was stored from.
+func (c ClientResponse) reply() clientReply {
+	return clientReply{Status: c.Status, Body: []byte(c.Data), Headers: c.Headers, MessageType: c.MessageType}
+}
+
+// flushCache empties the whole cache and returns how many entries it held.
+func (s *Server) flushCache() int {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+
+	n := len(s.cache)
+	s.cache = make(map[string]ClientResponse)
+	s.cacheLRU.reset()
+	s.cacheFeed.publish(cacheUpdate{Op: "flush"})
+	return n
+}
+
+// flushClientCache removes every cached entry for clientID, with or without
+// query parameters, and returns how many there were.
+func (s *Server) flushClientCache(clientID string) int {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+
+	n := 0
+	for key := range s.cache {
+		if _, owner := splitCacheKey(key); owner == clientID {
+			s.cacheDelete(key)
+			n++
+		}
+	}
+	s.cacheFeed.publish(cacheUpdate{Op: "flush_client", ClientID: clientID})
+	return n
+}
+
+// cacheSettingsChanged reports whether a reload changes how replies are
+// cached, in which case entries stored under the old settings are dropped.
+func cacheSettingsChanged(old, new *Config) bool {
+	return old.Cache != new.Cache ||
+		old.CacheKeyNormalize != new.CacheKeyNormalize ||
+		old.CacheKeyFoldCase != new.CacheKeyFoldCase ||
+		old.CacheTTL != new.CacheTTL ||
+		old.CacheErrorTTL != new.CacheErrorTTL ||
+		!old.cachePolicies.equal(new.cachePolicies) ||
+		old.CacheEmptyReplies != new.CacheEmptyReplies ||
+		old.EmptyReply != new.EmptyReply
+}
+
+// A client that knows its data changed can drop its own cached replies
+// instead of waiting out their TTL, by sending
+//
+//	{"type":"invalidate","query":"q=x"}
+//
+// for the entry of one query string, in any parameter order the cache key
+// would normalize away, or
+//
+//	{"type":"invalidate","all":true}
+//
+// for all of them. An empty query is the entry for the bare client ID, where
+// pushes are kept. A client can only ever invalidate its own entries.
+type invalidateMessage struct {
+	Type  string `json:"type"`
+	Query string `json:"query"`
+	All   bool   `json:"all"`
+}
+
+// handleInvalidate acts on message if it is an invalidation and reports
+// whether it was.
+func (s *Server) handleInvalidate(clientID string, messageType int, message []byte) bool {
+	if messageType != websocket.TextMessage || !bytes.Contains(message, []byte(`"invalidate"`)) {
+		return false
+	}
+	var invalidate invalidateMessage
+	if json.Unmarshal(message, &invalidate) != nil || invalidate.Type != "invalidate" {
+		return false
+	}
+
+	n := 0
+	if invalidate.All {
+		n = s.flushClientCache(clientID)
+	} else {
+		key := s.cacheKey(clientID, invalidate.Query)
+		s.cacheMutex.Lock()
+		if _, ok := s.cache[key]; ok {
+			s.cacheDelete(key)
+			s.cacheFeed.publish(cacheUpdate{Op: "delete", Key: key})
+			n = 1
+		}
+		s.cacheMutex.Unlock()
+	}
+	s.incCounter("proxy_cache_invalidations_total")
+	log.Printf("Client %s invalidated %d cache entries", clientID, n)
+	return true
+}
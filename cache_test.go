@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheTTLFromCacheControl(t *testing.T) {
+	for cacheControl, want := range map[string]time.Duration{
+		"":                     5 * time.Second,
+		"max-age=60":           time.Minute,
+		`public, max-age="30"`: 30 * time.Second,
+		"max-age=oops":         5 * time.Second,
+		"no-store":             0,
+		"private, no-cache":    0,
+		"max-age=0":            0,
+	} {
+		ttl, ok := cacheTTL(map[string]string{"cache-control": cacheControl}, 5*time.Second)
+		if ok != (want > 0) || ttl != want {
+			t.Errorf("cacheTTL(%q) = %s, %t, want %s", cacheControl, ttl, ok, want)
+		}
+	}
+}
+
+func TestClientCacheControlDecidesCaching(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "db-1").serve(func(query queryMessage) replyMessage {
+		return replyMessage{Body: "x", Headers: map[string]string{"Cache-Control": query.Params["cc"][0]}}
+	})
+
+	for cacheControl, want := range map[string]time.Duration{"max-age=120": 2 * time.Minute, "no-store": 0} {
+		query := "cc=" + cacheControl
+		do(t, "GET", fmt.Sprintf("%s/query/db-1?%s", ts.URL, query), nil, nil)
+		entry, ok := s.cached(s.cacheKey("db-1", query))
+		if ok != (want > 0) || ok && entry.TTL != want {
+			t.Errorf("reply with Cache-Control %q cached %t with TTL %s, want TTL %s", cacheControl, ok, entry.TTL, want)
+		}
+	}
+}
+
+func TestCacheOffMakesEveryQueryLive(t *testing.T) {
+	s, ts := newTestServer(t, "-cache=false")
+	var queries atomic.Int32
+	connectClient(t, s, ts, "db-1").serve(func(queryMessage) replyMessage {
+		return replyMessage{Body: fmt.Sprint(queries.Add(1))}
+	})
+
+	for i := 1; i <= 2; i++ {
+		if resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil); string(body) != fmt.Sprint(i) {
+			t.Errorf("query %d got %s %q, want a live reply", i, resp.Status, body)
+		}
+	}
+	s.cacheMutex.RLock()
+	stored := len(s.cache)
+	s.cacheMutex.RUnlock()
+	if stored != 0 {
+		t.Errorf("%d replies cached with -cache=false", stored)
+	}
+	if resp, _ := do(t, "GET", ts.URL+"/query-cached/db-1", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/query-cached got %s, want 404", resp.Status)
+	}
+}
+
+func TestLargeRepliesBypassTheCache(t *testing.T) {
+	s, ts := newTestServer(t, "-max-cache-body", "10")
+	connectClient(t, s, ts, "db-1").serve(func(query queryMessage) replyMessage {
+		return replyMessage{Body: query.Params["body"][0]}
+	})
+
+	for body, want := range map[string]string{"small": "", "larger than ten bytes": "BYPASS"} {
+		query := "body=" + url.QueryEscape(body)
+		resp, _ := do(t, "GET", ts.URL+"/query/db-1?"+query, nil, nil)
+		_, cached := s.cached(s.cacheKey("db-1", query))
+		if got := resp.Header.Get("X-Cache"); got != want || cached != (want == "") {
+			t.Errorf("%d byte reply got X-Cache %q and cached %t, want %q", len(body), got, cached, want)
+		}
+	}
+}
+
+func TestCacheKeyNormalization(t *testing.T) {
+	for _, tc := range []struct {
+		args   []string
+		a, b   string
+		shared bool
+	}{
+		{nil, "b=2&a=1", "a=1&b=2", true},
+		{nil, "q=%7e", "q=~", true},
+		{nil, "q=1&q=2", "q=2&q=1", false},
+		{nil, "Q=x", "q=x", false},
+		{[]string{"-cache-key-fold-case"}, "Q=x", "q=x", true},
+		{[]string{"-cache-key-fold-case"}, "q=X", "q=x", false},
+		{[]string{"-cache-key-normalize=false"}, "b=2&a=1", "a=1&b=2", false},
+	} {
+		s, _ := newTestServer(t, tc.args...)
+		if shared := s.cacheKey("db-1", tc.a) == s.cacheKey("db-1", tc.b); shared != tc.shared {
+			t.Errorf("with %v, %q and %q share a cache key: %t, want %t", tc.args, tc.a, tc.b, shared, tc.shared)
+		}
+	}
+}
+
+func TestReorderedQueryIsACacheHit(t *testing.T) {
+	s, ts := newTestServer(t)
+	var queries atomic.Int32
+	connectClient(t, s, ts, "db-1").serve(func(queryMessage) replyMessage {
+		queries.Add(1)
+		return replyMessage{Body: "x"}
+	})
+
+	do(t, "GET", ts.URL+"/query/db-1?b=2&a=1", nil, nil)
+	do(t, "GET", ts.URL+"/query/db-1?a=1&b=2", nil, nil)
+	if n := queries.Load(); n != 1 {
+		t.Errorf("reordered query reached the client, %d queries in all, want it answered from cache", n)
+	}
+}
+
+func TestQueryCachedNeverContactsTheClient(t *testing.T) {
+	s, ts := newTestServer(t, "-cache-ttl", "50ms")
+	var queries atomic.Int32
+	connectClient(t, s, ts, "db-1").serve(func(queryMessage) replyMessage {
+		queries.Add(1)
+		return replyMessage{Body: "answer"}
+	})
+
+	if resp, _ := do(t, "GET", ts.URL+"/query-cached/db-1?q=x", nil, nil); resp.StatusCode != http.StatusNotFound || queries.Load() != 0 {
+		t.Fatalf("nothing cached got %s after %d queries, want 404 and none", resp.Status, queries.Load())
+	}
+	do(t, "GET", ts.URL+"/query/db-1?q=x", nil, nil)
+	for _, want := range []string{"HIT", "STALE"} {
+		if want == "STALE" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		resp, body := do(t, "GET", ts.URL+"/query-cached/db-1?q=x", nil, nil)
+		if resp.StatusCode != http.StatusOK || string(body) != "answer" || resp.Header.Get("X-Cache") != want || resp.Header.Get("Age") == "" {
+			t.Errorf("cached query got %s %q with X-Cache %q and Age %q, want %s", resp.Status, body, resp.Header.Get("X-Cache"), resp.Header.Get("Age"), want)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("the client was sent %d queries, want only the one that filled the cache", n)
+	}
+}
+
+func TestClientInvalidatesItsCacheEntries(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "db-1").echo("x")
+	connectClient(t, s, ts, "db-2").echo("x")
+	for _, query := range []string{"a=1&b=2", "q=2", "q=3"} {
+		do(t, "GET", ts.URL+"/query/db-1?"+query, nil, nil)
+	}
+	do(t, "GET", ts.URL+"/query/db-2?q=2", nil, nil)
+
+	// Any of the client's connections may invalidate its entries.
+	client := connectClient(t, s, ts, "db-1")
+
+	client.conn.WriteJSON(invalidateMessage{Type: "invalidate", Query: "b=2&a=1"})
+	waitFor(t, "the entry to be invalidated", func() bool {
+		_, ok := s.cached(s.cacheKey("db-1", "a=1&b=2"))
+		return !ok
+	})
+	if _, ok := s.cached(s.cacheKey("db-1", "q=2")); !ok {
+		t.Error("invalidating one query dropped another")
+	}
+
+	client.conn.WriteJSON(invalidateMessage{Type: "invalidate", All: true})
+	waitFor(t, "the client's entries to be invalidated", func() bool {
+		_, two := s.cached(s.cacheKey("db-1", "q=2"))
+		_, three := s.cached(s.cacheKey("db-1", "q=3"))
+		return !two && !three
+	})
+	if _, ok := s.cached(s.cacheKey("db-2", "q=2")); !ok {
+		t.Error("a client invalidated another client's entry")
+	}
+}
+
+func TestErrorRepliesUseTheErrorTTL(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		ttl  time.Duration
+	}{
+		{nil, 0},
+		{[]string{"-cache-error-ttl", "2s"}, 2 * time.Second},
+	} {
+		s, ts := newTestServer(t, tc.args...)
+		connectClient(t, s, ts, "db-1").serve(func(queryMessage) replyMessage {
+			return replyMessage{Status: http.StatusNotFound, Body: "gone", Headers: map[string]string{"Cache-Control": "max-age=60"}}
+		})
+
+		do(t, "GET", ts.URL+"/query/db-1", nil, nil)
+		entry, ok := s.cached(s.cacheKey("db-1", ""))
+		if ok != (tc.ttl > 0) || ok && (entry.TTL != tc.ttl || entry.Status != http.StatusNotFound) {
+			t.Errorf("with %v a 404 was cached %t with TTL %s, want TTL %s", tc.args, ok, entry.TTL, tc.ttl)
+		}
+	}
+}
+
+func TestErrorReplyExpiresBeforeSuccesses(t *testing.T) {
+	s, ts := newTestServer(t, "-cache-ttl", "1m", "-cache-error-ttl", "50ms")
+	var queries atomic.Int32
+	connectClient(t, s, ts, "db-1").serve(func(queryMessage) replyMessage {
+		if queries.Add(1) == 1 {
+			return replyMessage{Status: http.StatusServiceUnavailable, Body: "starting"}
+		}
+		return replyMessage{Body: "ready"}
+	})
+
+	if resp, _ := do(t, "GET", ts.URL+"/query/db-1", nil, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("first query got %s", resp.Status)
+	}
+	if resp, _ := do(t, "GET", ts.URL+"/query/db-1", nil, nil); resp.StatusCode != http.StatusServiceUnavailable || queries.Load() != 1 {
+		t.Errorf("second query got %s after %d queries, want the cached error", resp.Status, queries.Load())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil); string(body) != "ready" {
+		t.Errorf("query after the error TTL got %s %q, want a fresh reply", resp.Status, body)
+	}
+}
+
+func TestCacheDecisionsAreRecorded(t *testing.T) {
+	s, ts := newTestServer(t, "-max-cache-body", "10", "-cache-ttl", "50ms")
+	queries := make(chan QueryInfo, 1)
+	s.SetHooks(Hooks{OnQuery: func(query QueryInfo) { queries <- query }})
+	connectClient(t, s, ts, "db-1").serve(func(query queryMessage) replyMessage {
+		switch query.Params["q"][0] {
+		case "large":
+			return replyMessage{Body: "larger than ten bytes"}
+		case "no-store":
+			return replyMessage{Body: "x", Headers: map[string]string{"Cache-Control": "no-store"}}
+		case "missing":
+			return replyMessage{Status: http.StatusNotFound}
+		}
+		return replyMessage{Body: "x"}
+	})
+
+	reason := func(query string) string {
+		do(t, "GET", ts.URL+"/query/db-1?q="+query, nil, nil)
+		return (<-queries).CacheReason
+	}
+	for _, tc := range []struct{ query, reason string }{
+		{"a", "not-cached,stored"},
+		{"a", "fresh-hit"},
+		{"large", "not-cached,not-cacheable-size"},
+		{"no-store", "not-cached,nocache-header"},
+		{"missing", "not-cached,negative-cache-off"},
+	} {
+		if got := reason(tc.query); got != tc.reason {
+			t.Errorf("query %s recorded cache reason %q, want %q", tc.query, got, tc.reason)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := reason("a"); got != "stale-expired,stored" {
+		t.Errorf("expired query recorded cache reason %q, want stale-expired,stored", got)
+	}
+}
+
+func TestExpiryGraceClaimsOneRefresh(t *testing.T) {
+	s, _ := newTestServer(t)
+	key := s.cacheKey("db-1", "")
+	s.cacheMutex.Lock()
+	s.cacheSet(key, ClientResponse{Data: "old", Timestamp: time.Now().Add(-time.Minute), TTL: time.Second})
+	s.cacheMutex.Unlock()
+
+	if !s.claimRefresh(key, 50*time.Millisecond) {
+		t.Fatal("first caller didn't get the refresh")
+	}
+	if s.claimRefresh(key, 50*time.Millisecond) {
+		t.Error("second caller got the refresh already claimed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !s.claimRefresh(key, 50*time.Millisecond) {
+		t.Error("caller after the grace didn't get the refresh")
+	}
+	if !s.claimRefresh(s.cacheKey("db-2", ""), 50*time.Millisecond) {
+		t.Error("caller of an uncached key didn't get to fetch it")
+	}
+}
+
+func TestExpiryGraceServesCallersBehindTheRefresh(t *testing.T) {
+	s, ts := newTestServer(t, "-cache-expiry-grace", "5s")
+	client := connectClient(t, s, ts, "db-1")
+	s.cacheMutex.Lock()
+	s.cacheSet(s.cacheKey("db-1", ""), ClientResponse{Data: "old", Timestamp: time.Now().Add(-time.Minute), TTL: time.Second})
+	s.cacheMutex.Unlock()
+
+	refreshing := goGet(ts.URL+"/query/db-1", nil)
+	query := client.readQuery()
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil); resp.StatusCode != http.StatusOK || string(body) != "old" {
+		t.Errorf("caller behind the refresh got %s %q, want the expired entry", resp.Status, body)
+	}
+	client.reply(replyMessage{RequestID: query.RequestID, Body: "new"})
+	if result := <-refreshing; result.err != nil || string(result.body) != "new" {
+		t.Fatalf("refreshing caller got %q, %v", result.body, result.err)
+	}
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil); string(body) != "new" {
+		t.Errorf("caller after the refresh got %s %q", resp.Status, body)
+	}
+}
+
+func TestNoExpiryGraceByDefault(t *testing.T) {
+	s, _ := newTestServer(t)
+	key := s.cacheKey("db-1", "")
+	s.cacheMutex.Lock()
+	s.cacheSet(key, ClientResponse{Data: "old", Timestamp: time.Now().Add(-time.Minute), TTL: time.Second})
+	s.cacheMutex.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if _, decision, ok := s.lookupCache(key); ok || decision != cacheStaleExpired {
+			t.Errorf("lookup %d got %s, %t, want the entry expired", i, decision, ok)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+)
+
+// The cache can be bounded two ways, together or apart: -max-cache-entries
+// caps the number of entries and -max-cache-bytes their approximate memory,
+// which matters more when replies vary widely in size. Whichever limit a new
+// entry would break, the least recently used entries are evicted to make
+// room for it, where a lookup that finds an entry counts as a use. A single
+// entry over -max-cache-bytes on its own is not cached at all, like one over
+// -max-cache-body. The size of an entry is estimated from its key, body and
+// headers plus a fixed overhead, so the budget is approximate. Evictions are
+// counted in proxy_cache_evictions_total, and the cache's current size is
+// exported as proxy_cache_entries and proxy_cache_bytes. Lowering either
+// limit on reload takes effect at the next store.
+
+// cacheEntryOverhead approximates the memory an entry takes besides its
+// key, body and headers: its map slot, the struct and the LRU bookkeeping.
+const cacheEntryOverhead = 200
+
+// cacheEntrySize estimates the memory the entry under key takes.
+func cacheEntrySize(key string, entry ClientResponse) int {
+	size := cacheEntryOverhead + len(key) + len(entry.Data) + len(entry.gzipData)
+	for name, value := range entry.Headers {
+		size += len(name) + len(value)
+	}
+	return size
+}
+
+// cacheLRU orders the cache's entries by last use and tracks their total
+// size. It has its own lock so lookups, which only hold cacheMutex for
+// reading, can mark entries used.
+type cacheLRU struct {
+	mutex sync.Mutex
+	// order holds a *cacheUsage per entry, most recently used first.
+	order   *list.List
+	entries map[string]*list.Element
+	bytes   int
+}
+
+type cacheUsage struct {
+	key  string
+	size int
+}
+
+func newCacheLRU() *cacheLRU {
+	return &cacheLRU{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// touch marks key used, if it is still tracked.
+func (l *cacheLRU) touch(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if e, ok := l.entries[key]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+// set tracks key as the most recently used entry, of size bytes.
+func (l *cacheLRU) set(key string, size int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if e, ok := l.entries[key]; ok {
+		usage := e.Value.(*cacheUsage)
+		l.bytes += size - usage.size
+		usage.size = size
+		l.order.MoveToFront(e)
+		return
+	}
+	l.entries[key] = l.order.PushFront(&cacheUsage{key: key, size: size})
+	l.bytes += size
+}
+
+func (l *cacheLRU) remove(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if e, ok := l.entries[key]; ok {
+		l.bytes -= e.Value.(*cacheUsage).size
+		l.order.Remove(e)
+		delete(l.entries, key)
+	}
+}
+
+func (l *cacheLRU) reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.order.Init()
+	l.entries = make(map[string]*list.Element)
+	l.bytes = 0
+}
+
+// oldest returns the least recently used key.
+func (l *cacheLRU) oldest() (string, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	e := l.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(*cacheUsage).key, true
+}
+
+// size returns how many entries are tracked and their estimated bytes.
+func (l *cacheLRU) size() (int, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.entries), l.bytes
+}
+
+// cacheFits reports whether an entry of size bytes may be cached at all.
+func cacheFits(cfg *Config, size int) bool {
+	return cfg.MaxCacheBytes == 0 || size <= cfg.MaxCacheBytes
+}
+
+// cachePut stores entry under key, unless it is too large to cache, and
+// evicts the least recently used entries beyond the limits. It reports
+// whether entry was stored and returns the keys evicted. Callers hold
+// cacheMutex for writing.
+func (s *Server) cachePut(key string, entry ClientResponse) (stored bool, evicted []string) {
+	cfg := s.currentConfig()
+	size := cacheEntrySize(key, entry)
+	if !cacheFits(cfg, size) {
+		return false, nil
+	}
+	s.cache[key] = entry
+	s.cacheLRU.set(key, size)
+
+	for {
+		entries, bytes := s.cacheLRU.size()
+		reason := ""
+		switch {
+		case cfg.MaxCacheEntries > 0 && entries > cfg.MaxCacheEntries:
+			reason = "entries"
+		case cfg.MaxCacheBytes > 0 && bytes > cfg.MaxCacheBytes:
+			reason = "bytes"
+		default:
+			return true, evicted
+		}
+		oldest, ok := s.cacheLRU.oldest()
+		if !ok || oldest == key {
+			return true, evicted
+		}
+		s.cacheDelete(oldest)
+		evicted = append(evicted, oldest)
+		s.incCounter("proxy_cache_evictions_total", "reason", reason)
+	}
+}
+
+// cacheDelete removes the entry under key. Callers hold cacheMutex for
+// writing.
+func (s *Server) cacheDelete(key string) {
+	delete(s.cache, key)
+	s.cacheLRU.remove(key)
+}
+
+// cacheSize returns the number of cache entries and their estimated bytes,
+// for proxy_cache_entries and proxy_cache_bytes.
+func (s *Server) cacheSize() (int, int) {
+	return s.cacheLRU.size()
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func putCached(s *Server, key, data string) bool {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+	stored, _ := s.cachePut(key, ClientResponse{Data: data, Timestamp: time.Now(), TTL: time.Minute})
+	return stored
+}
+
+func TestCacheEntryLimitEvictsLeastRecentlyUsed(t *testing.T) {
+	s, _ := newTestServer(t, "-max-cache-entries", "2")
+	putCached(s, "a", "x")
+	putCached(s, "b", "x")
+	s.lookupCache("a")
+	putCached(s, "c", "x")
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := s.cached(key); ok != want {
+			t.Errorf("entry %s cached %t, want %t", key, ok, want)
+		}
+	}
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	if n := s.metrics.counters[`proxy_cache_evictions_total{reason="entries"}`]; n != 1 {
+		t.Errorf("counted %v evictions for entries, want 1", n)
+	}
+}
+
+func TestCacheByteLimit(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	size := cacheEntrySize("a", ClientResponse{Data: body})
+	s, _ := newTestServer(t, "-max-cache-bytes", strconv.Itoa(2*size))
+	putCached(s, "a", body)
+	putCached(s, "b", body)
+	putCached(s, "c", body)
+	if _, ok := s.cached("a"); ok {
+		t.Error("oldest entry survived going over the byte limit")
+	}
+	if entries, bytes := s.cacheSize(); entries != 2 || bytes != 2*size {
+		t.Errorf("cache holds %d entries of %d bytes, want 2 of %d", entries, bytes, 2*size)
+	}
+
+	if putCached(s, "huge", strings.Repeat("x", 3*size)) {
+		t.Error("entry over the byte limit on its own was cached")
+	}
+	if _, ok := s.cached("b"); !ok {
+		t.Error("an entry too large to cache evicted others")
+	}
+}
+
+func TestCacheEntrySize(t *testing.T) {
+	entry := ClientResponse{Data: "body", Headers: map[string]string{"Content-Type": "text/plain"}}
+	if got, want := cacheEntrySize("key", entry), cacheEntryOverhead+len("key")+len("body")+len("Content-Type")+len("text/plain"); got != want {
+		t.Errorf("cacheEntrySize = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"time"
+)
+
+// The cache settings -cache-ttl, -cache-error-ttl, -max-cache-body and
+// -stale-on-error apply to every client alike. Clients whose data goes stale
+// at different rates can be given their own with a -cache-policies file,
+// which maps query routes, path patterns as in path.Match against
+// /query/{clientID}, to policies:
+//
+//	{"default": {"ttl": "5s"},
+//	 "routes": [
+//	   {"path": "/query/weather-*", "ttl": "1m", "max_body": 65536},
+//	   {"path": "/query/prices", "ttl": "500ms", "error_ttl": "2s"},
+//	   {"path": "/query/audit-*", "cache": false},
+//	   {"path": "/query/catalog-*", "stale_on_error": true}]}
+//
+// The first route that matches applies, and queries matching none get the
+// default. A policy sets any of ttl, the TTL for replies without a
+// Cache-Control of their own; error_ttl, how long 4xx and 5xx replies are
+// cached, 0 for not at all; max_body, the largest body cached, 0 for no
+// limit; cache, false to leave the route's replies out of the cache
+// altogether; and stale_on_error, whether a query the client can't answer
+// is served the route's last good reply from the cache instead of failing,
+// as stale.go describes. What a route leaves out comes from the default, and what the
+// default leaves out from the flags. Patterns match the route the proxy
+// serves, without -base-path, and the same policy applies to /query,
+// /query-batch entries, prefetches and a client's pushes. -cache off still
+// turns the cache off for everything.
+
+// cachePolicy is how replies on a route are cached.
+type cachePolicy struct {
+	Cache    bool
+	TTL      time.Duration
+	ErrorTTL time.Duration
+	MaxBody  int
+	// StaleOnError serves expired entries when the client can't answer;
+	// see stale.go.
+	StaleOnError bool
+}
+
+type cacheRoute struct {
+	pattern string
+	policy  cachePolicy
+}
+
+// cachePolicies are the policies read from -cache-policies, resolved
+// against the flags.
+type cachePolicies struct {
+	fallback cachePolicy
+	routes   []cacheRoute
+}
+
+type cachePolicyFile struct {
+	Default cachePolicyEntry   `json:"default"`
+	Routes  []cachePolicyEntry `json:"routes"`
+}
+
+type cachePolicyEntry struct {
+	Path         string  `json:"path"`
+	Cache        *bool   `json:"cache"`
+	TTL          *string `json:"ttl"`
+	ErrorTTL     *string `json:"error_ttl"`
+	MaxBody      *int    `json:"max_body"`
+	StaleOnError *bool   `json:"stale_on_error"`
+}
+
+// flagCachePolicy is the policy the flags alone give.
+func flagCachePolicy(cfg *Config) cachePolicy {
+	return cachePolicy{Cache: true, TTL: cfg.CacheTTL, ErrorTTL: cfg.CacheErrorTTL, MaxBody: cfg.MaxCacheBody, StaleOnError: cfg.StaleOnError}
+}
+
+func loadCachePolicies(file string, base cachePolicy) (*cachePolicies, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var f cachePolicyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	policies := &cachePolicies{}
+	if f.Default.Path != "" {
+		return nil, fmt.Errorf("default policy can't have a path")
+	}
+	if policies.fallback, err = f.Default.apply(base); err != nil {
+		return nil, fmt.Errorf("default: %w", err)
+	}
+	for _, entry := range f.Routes {
+		if _, err := path.Match(entry.Path, ""); err != nil || entry.Path == "" {
+			return nil, fmt.Errorf("invalid route pattern %q", entry.Path)
+		}
+		policy, err := entry.apply(policies.fallback)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", entry.Path, err)
+		}
+		policies.routes = append(policies.routes, cacheRoute{pattern: entry.Path, policy: policy})
+	}
+	return policies, nil
+}
+
+// apply returns policy with the settings e makes replacing its own.
+func (e cachePolicyEntry) apply(policy cachePolicy) (cachePolicy, error) {
+	if e.Cache != nil {
+		policy.Cache = *e.Cache
+	}
+	if e.TTL != nil {
+		ttl, err := time.ParseDuration(*e.TTL)
+		if err != nil || ttl <= 0 {
+			return cachePolicy{}, fmt.Errorf("invalid ttl %q", *e.TTL)
+		}
+		policy.TTL = ttl
+	}
+	if e.ErrorTTL != nil {
+		ttl, err := time.ParseDuration(*e.ErrorTTL)
+		if err != nil || ttl < 0 {
+			return cachePolicy{}, fmt.Errorf("invalid error_ttl %q", *e.ErrorTTL)
+		}
+		policy.ErrorTTL = ttl
+	}
+	if e.MaxBody != nil {
+		if *e.MaxBody < 0 {
+			return cachePolicy{}, fmt.Errorf("max_body must not be negative")
+		}
+		policy.MaxBody = *e.MaxBody
+	}
+	if e.StaleOnError != nil {
+		policy.StaleOnError = *e.StaleOnError
+	}
+	return policy, nil
+}
+
+// cachePolicy returns the policy for queries to clientID.
+func (s *Server) cachePolicy(clientID string) cachePolicy {
+	cfg := s.currentConfig()
+	if cfg.cachePolicies == nil {
+		return flagCachePolicy(cfg)
+	}
+	route := "/query/" + clientID
+	for _, r := range cfg.cachePolicies.routes {
+		if ok, _ := path.Match(r.pattern, route); ok {
+			return r.policy
+		}
+	}
+	return cfg.cachePolicies.fallback
+}
+
+// maxCachedBody is the largest body any route caches, 0 if some route
+// caches bodies of any size.
+func (cfg *Config) maxCachedBody() int {
+	if cfg.cachePolicies == nil {
+		return cfg.MaxCacheBody
+	}
+	largest := cfg.cachePolicies.fallback.MaxBody
+	for _, r := range cfg.cachePolicies.routes {
+		if largest == 0 || r.policy.MaxBody == 0 {
+			return 0
+		}
+		largest = max(largest, r.policy.MaxBody)
+	}
+	return largest
+}
+
+func (p *cachePolicies) equal(other *cachePolicies) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	return p.fallback == other.fallback && slices.Equal(p.routes, other.routes)
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCachePolicies writes a -cache-policies file of contents and returns
+// its path.
+func writeCachePolicies(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cache-policies.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testCachePolicies = `{"default": {"ttl": "10s"},
+ "routes": [
+   {"path": "/query/weather-*", "ttl": "1m", "max_body": 65536},
+   {"path": "/query/prices", "error_ttl": "2s"},
+   {"path": "/query/audit-*", "cache": false}]}`
+
+func TestCachePoliciesByRoute(t *testing.T) {
+	s, _ := newTestServer(t, "-cache-policies", writeCachePolicies(t, testCachePolicies), "-max-cache-body", "1024")
+	for clientID, want := range map[string]cachePolicy{
+		"weather-eu": {Cache: true, TTL: time.Minute, MaxBody: 65536},
+		"prices":     {Cache: true, TTL: 10 * time.Second, ErrorTTL: 2 * time.Second, MaxBody: 1024},
+		"audit-1":    {Cache: false, TTL: 10 * time.Second, MaxBody: 1024},
+		"catalog":    {Cache: true, TTL: 10 * time.Second, MaxBody: 1024},
+	} {
+		if got := s.cachePolicy(clientID); got != want {
+			t.Errorf("policy for %s = %+v, want %+v", clientID, got, want)
+		}
+	}
+	if n := s.currentConfig().maxCachedBody(); n != 65536 {
+		t.Errorf("maxCachedBody = %d, want the largest route's", n)
+	}
+}
+
+func TestCachePolicyDecidesWhatIsCached(t *testing.T) {
+	s, ts := newTestServer(t, "-cache-policies", writeCachePolicies(t, testCachePolicies))
+	connectClient(t, s, ts, "weather-eu").echo("sunny")
+	connectClient(t, s, ts, "audit-1").echo("entry")
+
+	do(t, "GET", ts.URL+"/query/weather-eu", nil, nil)
+	do(t, "GET", ts.URL+"/query/audit-1", nil, nil)
+	if entry, ok := s.cached(s.cacheKey("weather-eu", "")); !ok || entry.TTL != time.Minute {
+		t.Errorf("weather reply cached %t with TTL %s, want the route's minute", ok, entry.TTL)
+	}
+	if _, ok := s.cached(s.cacheKey("audit-1", "")); ok {
+		t.Error("audit reply was cached on a route with caching off")
+	}
+}
+
+func TestWithoutCachePoliciesTheFlagsApply(t *testing.T) {
+	s, _ := newTestServer(t, "-cache-ttl", "3s", "-max-cache-body", "0")
+	if got := s.cachePolicy("weather-eu"); got != (cachePolicy{Cache: true, TTL: 3 * time.Second}) {
+		t.Errorf("policy without -cache-policies = %+v", got)
+	}
+}
+
+func TestInvalidCachePoliciesAreRejected(t *testing.T) {
+	for _, contents := range []string{
+		`{"default": {"path": "/query/x"}}`,
+		`{"routes": [{"ttl": "1m"}]}`,
+		`{"routes": [{"path": "/query/[", "ttl": "1m"}]}`,
+		`{"routes": [{"path": "/query/x", "ttl": "0s"}]}`,
+		`{"routes": [{"path": "/query/x", "error_ttl": "soon"}]}`,
+		`{"routes": [{"path": "/query/x", "max_body": -1}]}`,
+		`[not json`,
+	} {
+		if _, err := LoadConfig([]string{"-cache-policies", writeCachePolicies(t, contents)}); err == nil {
+			t.Errorf("LoadConfig accepted cache policies %s", contents)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// When the proxy stops waiting on a query the client has already been sent,
+// it tells the client, so the client can stop working on a reply nobody
+// will read:
+//
+//	{"type":"cancel","request_id":"9f1c...","reason":"timeout"}
+//
+// reason is timeout, for a query or request budget that ran out;
+// not-acked, for a query given up for want of an ack; caller-gone, for a
+// caller that closed its connection; or abandoned, for a stream the proxy
+// stopped reading part way, because of a bad chunk or a caller that can't
+// keep up. Clients that don't know the message can ignore it; a reply they
+// send anyway is dropped as an orphan. Cancels are written in the
+// background, within -broadcast-timeout, and never hold up the caller's
+// response. A query failed because its connection closed or was drained is
+// not followed by one.
+
+var errCallerGone = errors.New("caller went away before the client replied")
+
+type cancelMessage struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+	Reason    string `json:"reason"`
+}
+
+// cancelReason is the reason given to the client for a query that failed
+// with err.
+func cancelReason(err error) string {
+	switch {
+	case errors.Is(err, errQueryNotAcked):
+		return "not-acked"
+	case errors.Is(err, errQueryTimeout), errors.Is(err, errBudgetExhausted):
+		return "timeout"
+	case errors.Is(err, errCallerGone):
+		return "caller-gone"
+	}
+	return "abandoned"
+}
+
+// contextError is the error a query fails with once ctx is done: the
+// caller's budget ran out, or the caller went away.
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errBudgetExhausted
+	}
+	return errCallerGone
+}
+
+// sendCancel tells the client the proxy no longer waits on requestID, unless
+// the connection is closing anyway.
+func (c *Client) sendCancel(requestID string, err error) {
+	if errors.Is(err, errClientDisconnected) || errors.Is(err, errClientDraining) {
+		return
+	}
+	select {
+	case <-c.done:
+		return
+	case <-c.cancelled:
+		return
+	default:
+	}
+
+	message, _ := json.Marshal(cancelMessage{Type: "cancel", RequestID: requestID, Reason: cancelReason(err)})
+	go func() {
+		if err := c.writeMessageWithin(websocket.TextMessage, message, c.server.currentConfig().BroadcastTimeout); err != nil {
+			log.Printf("Error cancelling query %s on client %s: %v", requestID, c.ID, err)
+		}
+	}()
+}
+
+// context returns the context of the request the query is made for, if any.
+func (q queryMessage) context() context.Context {
+	if q.ctx == nil {
+		return context.Background()
+	}
+	return q.ctx
+}
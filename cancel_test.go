@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func (c *testClient) readCancel() cancelMessage {
+	c.t.Helper()
+	var cancel cancelMessage
+	if err := json.Unmarshal(c.read(), &cancel); err != nil || cancel.Type != "cancel" {
+		c.t.Fatalf("read %+v, %v, want a cancel", cancel, err)
+	}
+	return cancel
+}
+
+func TestTimedOutQueryIsCancelled(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+
+	result := goGet(ts.URL+"/query/db-1", http.Header{"X-Query-Timeout": {"50ms"}})
+	query := client.readQuery()
+	if cancel := client.readCancel(); cancel.RequestID != query.RequestID || cancel.Reason != "timeout" {
+		t.Errorf("got cancel %+v, want the query's with reason timeout", cancel)
+	}
+	if r := <-result; r.status != http.StatusGatewayTimeout {
+		t.Errorf("timed out query got %d", r.status)
+	}
+}
+
+func TestQueryOfDepartedCallerIsCancelled(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/query/db-1", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	query := client.readQuery()
+	cancel()
+	<-done
+	if cancel := client.readCancel(); cancel.RequestID != query.RequestID || cancel.Reason != "caller-gone" {
+		t.Errorf("got cancel %+v, want the query's with reason caller-gone", cancel)
+	}
+}
+
+func TestCancelReasons(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{errQueryNotAcked, "not-acked"},
+		{errQueryTimeout, "timeout"},
+		{errBudgetExhausted, "timeout"},
+		{fmt.Errorf("query: %w", errCallerGone), "caller-gone"},
+		{errChunkOutOfOrder, "abandoned"},
+	} {
+		if got := cancelReason(tc.err); got != tc.want {
+			t.Errorf("cancelReason(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Every client ID that registers or connects costs the server memory, so
+// how many there may be is capped against registration abuse. With
+// -max-client-ids, a registration for a new client ID is refused with 503
+// once that many are registered, and a connection for a client ID with no
+// other connection once that many are connected. -max-connections-per-client
+// caps the connections one client ID may have at once, refusing more with
+// 503. Re-registering, and connecting under an ID that is already connected,
+// count nothing new. The counts follow connections as they come and go, and
+// show in proxy_client_ids, proxy_registered_clients and
+// proxy_client_id_connections; refusals are counted in
+// proxy_client_limit_rejections_total by limit.
+
+var (
+	errTooManyClientIDs   = errors.New("client ID limit reached")
+	errTooManyConnections = errors.New("connection limit for this client ID reached")
+)
+
+// clientRoomLocked returns why a new connection for clientID must be
+// refused, or nil if there is room for it. Callers must hold clientsMutex.
+func (s *Server) clientRoomLocked(clientID string) error {
+	cfg := s.currentConfig()
+	set, connected := s.clients[clientID]
+	switch {
+	case !connected && cfg.MaxClientIDs > 0 && len(s.clients) >= cfg.MaxClientIDs:
+		return errTooManyClientIDs
+	case connected && cfg.MaxConnectionsPerClient > 0 && len(set.conns) >= cfg.MaxConnectionsPerClient:
+		return errTooManyConnections
+	}
+	return nil
+}
+
+// clientRoom is clientRoomLocked for callers not holding clientsMutex, to
+// refuse a connection before its upgrade. addClient checks again, since
+// other connections may take the room meanwhile.
+func (s *Server) clientRoom(clientID string) error {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	return s.clientRoomLocked(clientID)
+}
+
+// registrationRoomLocked reports whether clientID may register. Callers
+// must hold registrationsMutex.
+func (s *Server) registrationRoomLocked(clientID string) bool {
+	limit := s.currentConfig().MaxClientIDs
+	if _, ok := s.registrations[clientID]; ok || limit <= 0 {
+		return true
+	}
+	return len(s.registrations) < limit
+}
+
+// refuseClient counts and answers a connection or registration refused for
+// err.
+func (s *Server) refuseClient(w http.ResponseWriter, clientID string, err error) {
+	s.countClientLimit(clientID, err)
+	writeTransient(w, err.Error(), http.StatusServiceUnavailable, defaultRetryAfter)
+}
+
+func (s *Server) countClientLimit(clientID string, err error) {
+	limit := "client_ids"
+	if errors.Is(err, errTooManyConnections) {
+		limit = "connections_per_client"
+	}
+	log.Printf("Refused client %s: %v", clientID, err)
+	s.incCounter("proxy_client_limit_rejections_total", "limit", limit)
+}
+
+// closeOverLimit closes a connection that addClient found no room for
+// after its upgrade, with 1013 (try again later).
+func (s *Server) closeOverLimit(conn *websocket.Conn, clientID string, err error) {
+	s.countClientLimit(clientID, err)
+	s.closeConnection(conn, clientID, closeOverLimit, err.Error(), time.Second)
+}
+
+// clientIDConnections returns how many connections each client ID has, for
+// proxy_client_id_connections.
+func (s *Server) clientIDConnections() map[string]float64 {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+
+	counts := make(map[string]float64, len(s.clients))
+	for id, set := range s.clients {
+		counts[id] = float64(len(set.conns))
+	}
+	return counts
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// expectRefused dials clientID and fails unless the upgrade is refused with
+// a 503.
+func expectRefused(t *testing.T, ts *httptest.Server, clientID string) {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL(ts, "/connect?client_id="+clientID), nil)
+	if err == nil {
+		conn.Close()
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("connecting %s got %v, want a 503 with Retry-After", clientID, err)
+	}
+}
+
+func TestMaxClientIDs(t *testing.T) {
+	s, ts := newTestServer(t, "-max-client-ids", "1")
+	connectClient(t, s, ts, "db-1")
+	expectRefused(t, ts, "db-2")
+	// Another connection of a connected client ID takes no new room.
+	connectClient(t, s, ts, "db-1")
+
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	if n := s.metrics.counters[`proxy_client_limit_rejections_total{limit="client_ids"}`]; n != 1 {
+		t.Errorf("client ID rejections = %v, want 1", n)
+	}
+}
+
+func TestMaxClientIDsCapsRegistrations(t *testing.T) {
+	_, ts := newTestServer(t, "-max-client-ids", "1")
+	first := register(t, ts, map[string]any{"client_id": "db-1"})
+
+	resp, body := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-2"}, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("registration over the limit got %s: %s, want 503", resp.Status, body)
+	}
+	register(t, ts, map[string]any{"client_id": "db-1", "token": first.Token, "tenant": "acme"})
+}
+
+func TestMaxConnectionsPerClient(t *testing.T) {
+	s, ts := newTestServer(t, "-max-connections-per-client", "1")
+	connectClient(t, s, ts, "db-1")
+	expectRefused(t, ts, "db-1")
+	connectClient(t, s, ts, "db-2")
+
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	if n := s.metrics.counters[`proxy_client_limit_rejections_total{limit="connections_per_client"}`]; n != 1 {
+		t.Errorf("per-client rejections = %v, want 1", n)
+	}
+}
+
+func TestClientIDRoomFreedOnDisconnect(t *testing.T) {
+	s, ts := newTestServer(t, "-max-client-ids", "1")
+	connectClient(t, s, ts, "db-1").conn.Close()
+	waitFor(t, "db-1 to go", func() bool { return s.connectionCount("db-1") == 0 })
+	connectClient(t, s, ts, "db-2")
+
+	if counts := s.clientIDConnections(); len(counts) != 1 || counts["db-2"] != 1 {
+		t.Errorf("connections by client ID %v, want db-2's one", counts)
+	}
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// clientConnections holds every live connection registered under one client
+// ID. Clients may open several connections for parallelism; queries are
+// spread across them by weight, see pickClient.
+type clientConnections struct {
+	conns []*Client
+	next  int
+}
+
+// addClient registers a new connection for client.ID. Callers hold no locks.
+func (s *Server) addClient(client *Client) (int, error) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+
+	if err := s.clientRoomLocked(client.ID); err != nil {
+		return 0, err
+	}
+	set, ok := s.clients[client.ID]
+	if !ok {
+		set = &clientConnections{}
+		s.clients[client.ID] = set
+	}
+	set.conns = append(set.conns, client)
+	s.clearNotConnectedLocked(client.ID)
+	return len(set.conns), nil
+}
+
+// removeClientLocked drops this particular connection from its client ID's
+// set, leaving any other connections under the same ID in place. Callers must
+// hold clientsMutex for writing.
+//
+// Connections are matched by identity, not by ID, so removing one twice, as
+// happens when cleanupInactiveClients gets to it before its reader's defer
+// does, is harmless, and a stale goroutine of an old connection can never
+// evict a newer connection of the same client.
+func (s *Server) removeClientLocked(client *Client) {
+	set, ok := s.clients[client.ID]
+	if !ok {
+		return
+	}
+	for i, c := range set.conns {
+		if c == client {
+			set.conns = append(set.conns[:i], set.conns[i+1:]...)
+			s.releaseTenantConnectionLocked(client.Tenant)
+			break
+		}
+	}
+	if len(set.conns) == 0 {
+		delete(s.clients, client.ID)
+	}
+}
+
+func (s *Server) removeClient(client *Client) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	s.removeClientLocked(client)
+}
+
+// maxWeight keeps one connection's weight from starving the others
+// entirely.
+const maxWeight = 100
+
+// clampWeight brings a requested connection weight into 1..maxWeight; zero
+// or less means the default of 1.
+func clampWeight(requested int) int {
+	switch {
+	case requested < 1:
+		return 1
+	case requested > maxWeight:
+		return maxWeight
+	}
+	return requested
+}
+
+// connectionWeight is the weight a connection asked for with the weight
+// query parameter on /connect, or else its registration's.
+func connectionWeight(r *http.Request, registration Registration) int {
+	if weight, err := strconv.Atoi(r.URL.Query().Get("weight")); err == nil {
+		return clampWeight(weight)
+	}
+	return clampWeight(registration.Weight)
+}
+
+// pickClient returns the next connection for clientID in weighted
+// round-robin order, or nil if the client has no live connections. Each
+// connection gets a share of the queries in proportion to its Weight, spread
+// out rather than in runs (the smooth weighted round-robin nginx uses), so
+// equal weights make it plain round-robin. Unhealthy connections are skipped
+// unless there is nothing else to pick. Connections whose round trip exceeds
+// maxRTT, if set, are never picked; see rtt.go.
+func (s *Server) pickClient(clientID string, maxRTT time.Duration) (*Client, error) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+
+	set, ok := s.clients[clientID]
+	if !ok || len(set.conns) == 0 {
+		return nil, errClientNotConnected
+	}
+	conns, err := readyConns(set.conns)
+	if err != nil {
+		return nil, err
+	}
+	if conns, err = s.warmConns(conns); err != nil {
+		return nil, err
+	}
+	if maxRTT > 0 {
+		conns = withinRTT(conns, maxRTT)
+		if len(conns) == 0 {
+			return nil, errClientTooSlow
+		}
+	}
+
+	if s.currentConfig().LeastRTTRouting {
+		if client := lowestRTT(conns); client != nil {
+			return client, nil
+		}
+	}
+
+	var best *Client
+	total := 0
+	for _, client := range conns {
+		if client.unhealthy.Load() {
+			continue
+		}
+		client.currentWeight += client.Weight
+		total += client.Weight
+		if best == nil || client.currentWeight > best.currentWeight {
+			best = client
+		}
+	}
+	if best != nil {
+		best.currentWeight -= total
+		return best, nil
+	}
+
+	client := conns[set.next%len(conns)]
+	set.next = (set.next + 1) % len(conns)
+	return client, nil
+}
+
+// writeClientHealth adds X-Client-Last-Ping, the latest sign of life from
+// any of clientID's connections, and X-Client-Health to w: "healthy" if any
+// connection is, "unhealthy" if all are marked unhealthy, or "disconnected".
+func (s *Server) writeClientHealth(w http.ResponseWriter, clientID string) {
+	status := s.clientStatus(clientID)
+	if status.LastPing != nil {
+		w.Header().Set("X-Client-Last-Ping", status.LastPing.UTC().Format(time.RFC3339Nano))
+	}
+	w.Header().Set("X-Client-Health", status.Health)
+}
+
+// connectedClients returns a snapshot of every live connection.
+func (s *Server) connectedClients() []*Client {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+
+	var all []*Client
+	for _, set := range s.clients {
+		all = append(all, set.conns...)
+	}
+	return all
+}
+
+type connectionInfo struct {
+	ConnectedAt         time.Time `json:"connected_at"`
+	LastPing            time.Time `json:"last_ping"`
+	PingInterval        string    `json:"ping_interval"`
+	MaxInFlight         int       `json:"max_in_flight"`
+	Serial              bool      `json:"serial,omitempty"`
+	Weight              int       `json:"weight"`
+	RemoteAddr          string    `json:"remote_addr"`
+	UserAgent           string    `json:"user_agent"`
+	Subprotocol         string    `json:"subprotocol"`
+	Compression         bool      `json:"compression"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveTimeouts int32     `json:"consecutive_timeouts"`
+	// RTT is empty until the connection has answered a ping.
+	RTT string `json:"rtt,omitempty"`
+	// Ready and Capabilities reflect the connection's handshake; see
+	// handshake.go.
+	Ready        bool                `json:"ready"`
+	Capabilities *clientCapabilities `json:"capabilities,omitempty"`
+	// WarmingUp is set during the connection's -client-warmup.
+	WarmingUp bool `json:"warming_up,omitempty"`
+}
+
+type clientInfo struct {
+	ClientID    string           `json:"client_id"`
+	Tenant      string           `json:"tenant,omitempty"`
+	Connections []connectionInfo `json:"connections"`
+}
+
+// handleClients lists every connected client ID with its connections.
+func (s *Server) handleClients(w http.ResponseWriter, r *http.Request) {
+	cfg := s.currentConfig()
+	s.clientsMutex.RLock()
+	list := make([]clientInfo, 0, len(s.clients))
+	for id, set := range s.clients {
+		info := clientInfo{ClientID: id}
+		for _, client := range set.conns {
+			info.Tenant = client.Tenant
+			info.Connections = append(info.Connections, connectionInfo{
+				ConnectedAt:         client.ConnectedAt,
+				LastPing:            client.LastPing(),
+				PingInterval:        client.PingInterval.String(),
+				MaxInFlight:         client.maxInFlight(),
+				Serial:              client.Serial,
+				Weight:              client.Weight,
+				RemoteAddr:          client.RemoteAddr,
+				UserAgent:           client.UserAgent,
+				Subprotocol:         client.Subprotocol,
+				Compression:         client.Compression,
+				Healthy:             !client.unhealthy.Load(),
+				ConsecutiveTimeouts: client.consecutiveTimeouts.Load(),
+				RTT:                 formatRTT(client.rtt()),
+				Ready:               client.ready.Load(),
+				Capabilities:        client.capabilities.Load(),
+				WarmingUp:           client.warmingUp(cfg),
+			})
+		}
+		list = append(list, info)
+	}
+	s.clientsMutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ClientID < list[j].ClientID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestStaleConnectionDoesNotEvictItsReplacement(t *testing.T) {
+	s, ts := newTestServer(t)
+	old := connectClient(t, s, ts, "db-1")
+	stale := s.firstConnection("db-1")
+	fresh := connectClient(t, s, ts, "db-1")
+
+	// The old connection's reader exits and removes it, and the sweep of
+	// inactive connections, having picked it earlier, removes it again.
+	old.conn.Close()
+	waitFor(t, "the old connection to be removed", func() bool { return s.connectionCount("db-1") == 1 })
+	s.removeClient(stale)
+
+	if s.connectionCount("db-1") != 1 || s.firstConnection("db-1") == stale {
+		t.Fatal("removing the old connection evicted its replacement")
+	}
+	fresh.echo("fresh")
+	resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "fresh" {
+		t.Errorf("query got %s %q, want the replacement's answer", resp.Status, body)
+	}
+}
+
+func TestLastPingReadWhileClientTalks(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if client.conn.WriteMessage(websocket.PongMessage, nil) != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		for _, path := range []string{"/status/db-1", "/clients", "/admin/export"} {
+			if resp, body := do(t, "GET", ts.URL+path, nil, adminHeader()); resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET %s: %s: %s", path, resp.Status, body)
+			}
+		}
+	}
+	if s.firstConnection("db-1").LastPing().IsZero() {
+		t.Error("LastPing is unset for a connected client")
+	}
+}
+
+func TestQueriesAreSpreadAcrossConnections(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "db-1").echo("a")
+	connectClient(t, s, ts, "db-1").echo("b")
+
+	answered := map[string]int{}
+	for i := 0; i < 10; i++ {
+		resp, body := do(t, "GET", fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("query %d got %s: %s", i, resp.Status, body)
+		}
+		answered[string(body)]++
+	}
+	if answered["a"] != 5 || answered["b"] != 5 {
+		t.Errorf("connections answered %v, want 5 each", answered)
+	}
+}
+
+func TestClosingOneConnectionLeavesTheOthers(t *testing.T) {
+	s, ts := newTestServer(t)
+	gone := connectClient(t, s, ts, "db-1")
+	connectClient(t, s, ts, "db-1").echo("b")
+	gone.conn.Close()
+	waitFor(t, "the closed connection to be removed", func() bool { return s.connectionCount("db-1") == 1 })
+
+	for i := 0; i < 3; i++ {
+		resp, body := do(t, "GET", fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil, nil)
+		if resp.StatusCode != http.StatusOK || string(body) != "b" {
+			t.Errorf("query %d got %s %q, want the remaining connection's reply", i, resp.Status, body)
+		}
+	}
+}
+
+func TestClientsListConnectionMetadata(t *testing.T) {
+	s, ts := newTestServer(t, "-ws-compression")
+	dialCompressed(t, s, ts, "db-1")
+
+	resp, body := do(t, "GET", ts.URL+"/clients", nil, adminHeader())
+	var list []clientInfo
+	if err := json.Unmarshal(body, &list); err != nil || len(list) != 1 || len(list[0].Connections) != 1 {
+		t.Fatalf("/clients got %s: %s", resp.Status, body)
+	}
+	conn := list[0].Connections[0]
+	if conn.RemoteAddr == "" || conn.UserAgent != "Go-http-client/1.1" || !conn.Compression {
+		t.Errorf("connection metadata %+v, want the remote address, user agent and compression", conn)
+	}
+
+	want := fmt.Sprintf("remote=%s user_agent=%q subprotocol=\"\" compression=on", conn.RemoteAddr, conn.UserAgent)
+	if got := s.firstConnection("db-1").describe(); got != want {
+		t.Errorf("log metadata %s, want %s", got, want)
+	}
+}
+
+func TestClientHealthHeaders(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		s, ts := newTestServer(t, fmt.Sprintf("-client-health-headers=%t", enabled))
+		connectClient(t, s, ts, "db-1").echo("x")
+
+		resp, _ := do(t, "GET", ts.URL+"/query/db-1", nil, nil)
+		health, lastPing := resp.Header.Get("X-Client-Health"), resp.Header.Get("X-Client-Last-Ping")
+		switch {
+		case enabled && (health != "healthy" || lastPing == ""):
+			t.Errorf("with -client-health-headers got health %q and last ping %q", health, lastPing)
+		case !enabled && (health != "" || lastPing != ""):
+			t.Errorf("without -client-health-headers got health %q and last ping %q", health, lastPing)
+		}
+	}
+
+	_, ts := newTestServer(t, "-client-health-headers")
+	if resp, _ := do(t, "GET", ts.URL+"/query/db-2", nil, nil); resp.Header.Get("X-Client-Health") != "disconnected" {
+		t.Errorf("query to a missing client got health %q, want disconnected", resp.Header.Get("X-Client-Health"))
+	}
+}
+
+func TestQueriesFollowConnectionWeights(t *testing.T) {
+	s, ts := newTestServer(t)
+	var heavy, light atomic.Int32
+	dialClient(t, s, wsURL(ts, "/connect?client_id=db-1&weight=3"), "db-1").serve(func(queryMessage) replyMessage {
+		heavy.Add(1)
+		return replyMessage{Body: "heavy"}
+	})
+	dialClient(t, s, wsURL(ts, "/connect?client_id=db-1&weight=1"), "db-1").serve(func(queryMessage) replyMessage {
+		light.Add(1)
+		return replyMessage{Body: "light"}
+	})
+
+	for i := 0; i < 40; i++ {
+		do(t, "GET", fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil, nil)
+	}
+	if heavy.Load() != 30 || light.Load() != 10 {
+		t.Errorf("weights 3:1 got %d:%d queries, want 30:10", heavy.Load(), light.Load())
+	}
+}
+
+func TestConnectionWeightFallsBackToTheRegistration(t *testing.T) {
+	s, ts := newTestServer(t)
+	registered := register(t, ts, map[string]any{"client_id": "db-1", "weight": 5})
+	connectRegistered(t, s, registered, "db-1")
+	if weight := s.firstConnection("db-1").Weight; weight != 5 {
+		t.Errorf("connection weight %d, want the registered 5", weight)
+	}
+
+	for requested, want := range map[int]int{-3: 1, 0: 1, 7: 7, 1000: maxWeight} {
+		if got := clampWeight(requested); got != want {
+			t.Errorf("clampWeight(%d) = %d, want %d", requested, got, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Whenever the proxy closes a client's connection itself, it sends a close
+// frame whose reason says why, so a client that logs its close code and
+// reason can tell what to do about it. Each cause has its own code and a
+// reason template, which the -close-reasons file can replace by cause name:
+//
+//	{"inactive": "no ping from {client_id} within {detail}, check keepalives",
+//	 "drained":  "moved for maintenance, reconnect to the URL you were sent"}
+//
+// {client_id} is the connection's client ID and {detail} the particulars of
+// the cause, which only some have. The causes, with their codes and default
+// reasons, are:
+//
+//	inactive     1001  "no ping received within {detail}"
+//	shutdown     1001  "server shutting down"
+//	drained      1012  "client drained"
+//	kicked       1008  "disconnected by an administrator" (or the code and reason asked for)
+//	auth-failed  1008  "connection authentication failed"
+//	handshake    1008  "{detail}", what went wrong with the capabilities handshake
+//	over-limit   1013  "{detail}", the limit the connection is over
+//	unhealthy    1013  "{detail} consecutive query timeouts"
+//	panic        1011  "internal error"
+//
+// A reason is cut to the 123 bytes a close frame has room for. Connections
+// torn down after failed writes are closed without a frame, since writing
+// is what fails.
+
+type closeCause string
+
+const (
+	closeInactive   closeCause = "inactive"
+	closeShutdown   closeCause = "shutdown"
+	closeDrained    closeCause = "drained"
+	closeKicked     closeCause = "kicked"
+	closeAuthFailed closeCause = "auth-failed"
+	closeHandshake  closeCause = "handshake"
+	closeOverLimit  closeCause = "over-limit"
+	closeUnhealthy  closeCause = "unhealthy"
+	closePanic      closeCause = "panic"
+)
+
+var closeCodes = map[closeCause]int{
+	closeInactive:   websocket.CloseGoingAway,
+	closeShutdown:   websocket.CloseGoingAway,
+	closeDrained:    websocket.CloseServiceRestart,
+	closeKicked:     websocket.ClosePolicyViolation,
+	closeAuthFailed: websocket.ClosePolicyViolation,
+	closeHandshake:  websocket.ClosePolicyViolation,
+	closeOverLimit:  websocket.CloseTryAgainLater,
+	closeUnhealthy:  websocket.CloseTryAgainLater,
+	closePanic:      websocket.CloseInternalServerErr,
+}
+
+var defaultCloseReasons = map[closeCause]string{
+	closeInactive:   "no ping received within {detail}",
+	closeShutdown:   "server shutting down",
+	closeDrained:    "client drained",
+	closeKicked:     defaultDisconnectReason,
+	closeAuthFailed: errConnectionAuth.Error(),
+	closeHandshake:  "{detail}",
+	closeOverLimit:  "{detail}",
+	closeUnhealthy:  "{detail} consecutive query timeouts",
+	closePanic:      "internal error",
+}
+
+// maxCloseReason is what a close frame's 125-byte payload leaves for the
+// reason after the code.
+const maxCloseReason = 123
+
+func loadCloseReasons(path string) (map[closeCause]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var reasons map[closeCause]string
+	if err := json.Unmarshal(data, &reasons); err != nil {
+		return nil, err
+	}
+	for cause := range reasons {
+		if _, ok := closeCodes[cause]; !ok {
+			return nil, fmt.Errorf("unknown close cause %q", cause)
+		}
+	}
+	return reasons, nil
+}
+
+// closeReason renders the reason for closing clientID's connection for
+// cause.
+func (s *Server) closeReason(cause closeCause, clientID, detail string) string {
+	template, ok := s.currentConfig().closeReasons[cause]
+	if !ok {
+		template = defaultCloseReasons[cause]
+	}
+	reason := strings.NewReplacer("{client_id}", clientID, "{detail}", detail).Replace(template)
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	return reason
+}
+
+// closeConnection sends conn, of clientID, a close frame for cause, waiting
+// no longer than timeout, and closes it.
+func (s *Server) closeConnection(conn *websocket.Conn, clientID string, cause closeCause, detail string, timeout time.Duration) {
+	sendClose(conn, closeCodes[cause], s.closeReason(cause, clientID, detail), timeout)
+}
+
+// sendClose sends conn a close frame with code and reason, waiting no longer
+// than timeout, and closes it. Only a disconnect, which can be asked for any
+// code and reason, calls it other than through closeConnection.
+func sendClose(conn *websocket.Conn, code int, reason string, timeout time.Duration) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(timeout))
+	conn.Close()
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDisconnectSendsTheKickedReason(t *testing.T) {
+	reasons := filepath.Join(t.TempDir(), "reasons.json")
+	if err := os.WriteFile(reasons, []byte(`{"kicked": "{client_id} was kicked"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, ts := newTestServer(t, "-close-reasons", reasons)
+	client := connectClient(t, s, ts, "db-1")
+
+	resp, body := do(t, "POST", ts.URL+"/admin/clients/db-1/disconnect", nil, adminHeader())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("disconnect: %s: %s", resp.Status, body)
+	}
+	if closed := client.expectClose(websocket.ClosePolicyViolation); closed.Text != "db-1 was kicked" {
+		t.Errorf("close reason %q, want the -close-reasons one", closed.Text)
+	}
+}
+
+func TestDisconnectWithCodeAndReason(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+
+	resp, body := do(t, "POST", ts.URL+"/admin/clients/db-1/disconnect", map[string]any{"code": 4001, "reason": "flooding replies"}, adminHeader())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("disconnect: %s: %s", resp.Status, body)
+	}
+	if closed := client.expectClose(4001); closed.Text != "flooding replies" {
+		t.Errorf("close reason %q, want the one asked for", closed.Text)
+	}
+}
+
+func TestCloseReasonIsCutToFit(t *testing.T) {
+	s, _ := newTestServer(t)
+	reason := s.closeReason(closeHandshake, "db-1", string(make([]byte, 200))+"é")
+	if len(reason) != maxCloseReason {
+		t.Errorf("reason is %d bytes, want %d", len(reason), maxCloseReason)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	proxy "github.com/suhel-rn/reverse-proxy-server"
+)
+
+func main() {
+	cfg, err := proxy.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	server, err := proxy.NewServer(cfg)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	go reloadOnSIGHUP(server, os.Args[1:])
+	shutdown := make(chan struct{})
+	go shutdownOnSIGTERM(server, shutdown)
+
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdown
+}
+
+// shutdownOnSIGTERM shuts the server down gracefully on the first SIGTERM
+// or SIGINT, closing done when it has; a second signal exits at once. If
+// the graceful shutdown fails, the server is closed outright.
+func shutdownOnSIGTERM(server *proxy.Server, done chan<- struct{}) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	<-signals
+	log.Printf("Shutting down")
+	go func() {
+		<-signals
+		log.Fatal("Shutdown interrupted")
+	}()
+	if err := server.Shutdown(context.Background()); err != nil {
+		log.Printf("Shutdown failed, closing the server: %v", err)
+		server.Close()
+	}
+	close(done)
+}
+
+// reloadOnSIGHUP re-reads the configuration from the same sources on every
+// SIGHUP. An invalid configuration is logged and the current one kept.
+func reloadOnSIGHUP(server *proxy.Server, args []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		cfg, err := proxy.LoadConfig(args)
+		if err == nil {
+			err = server.Reload(cfg)
+		}
+		if err != nil {
+			log.Printf("Configuration reload failed, keeping current configuration: %v", err)
+		}
+	}
+}
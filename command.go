@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// POST /command/{clientID} sends the request body, which must be JSON, to the
+// client as it is, under a request ID for the reply:
+//
+//	{"type":"command","request_id":"9f1c...","command":{"op":"restart","service":"db"}}
+//
+// The client replies exactly as it would to a query, and the reply is
+// returned the same way. Commands are a plain RPC: they are never cached,
+// never rendered through a query template and, like a POST without an
+// Idempotency-Key, never retried on another connection.
+type commandMessage struct {
+	Type      string          `json:"type"`
+	RequestID string          `json:"request_id"`
+	Command   json.RawMessage `json:"command"`
+}
+
+var errInvalidCommand = errors.New("command body must be JSON")
+
+func (s *Server) handleCommand(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	clientID := mux.Vars(r)["clientID"]
+
+	if s.maintenance.Load() {
+		writeQueryError(w, errMaintenance)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if budgetErr := budgetError(r); budgetErr != nil {
+			writeQueryError(w, budgetErr)
+			return
+		}
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+		return
+	}
+	if !json.Valid(body) {
+		http.Error(w, errInvalidCommand.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeout, err := s.commandTimeout(r, clientID, body)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	s.extendWriteDeadline(w, timeout)
+
+	priority, err := queryPriority(r)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	maxRTT, err := s.queryMaxRTT(r)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	if !s.acquireQuerySlot() {
+		writeSaturated(w)
+		return
+	}
+	defer s.releaseQuerySlot()
+
+	reply, err := s.sendCommand(clientID, body, priority, maxRTT, timeout)
+	s.recordQuery(clientID, "", start, err)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	s.writeReply(w, r, reply)
+}
+
+func (s *Server) sendCommand(clientID string, command json.RawMessage, priority int, maxRTT, timeout time.Duration) (clientReply, error) {
+	if err := s.checkCommandPolicy(clientID, command); err != nil {
+		return clientReply{}, err
+	}
+	if s.clientDraining(clientID) {
+		return clientReply{}, errClientDraining
+	}
+	if err := s.checkReplyBudget(clientID); err != nil {
+		return clientReply{}, err
+	}
+	client, err := s.pickClient(clientID, maxRTT)
+	if err != nil {
+		return clientReply{}, err
+	}
+	if !client.supportsCommand(commandType(command)) {
+		return clientReply{}, errUnsupportedCommand
+	}
+	return s.queryClient(client, queryMessage{
+		RequestID: newRequestID(),
+		Priority:  priority,
+		command:   command,
+	}, timeout)
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// readCommand reads the next message as a command.
+func (c *testClient) readCommand() commandMessage {
+	c.t.Helper()
+	var command commandMessage
+	if err := json.Unmarshal(c.read(), &command); err != nil || command.Type != "command" {
+		c.t.Fatalf("expected a command, got %+v, %v", command, err)
+	}
+	return command
+}
+
+func TestCommandRepliesAreCorrelated(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	restart := goPost(ts.URL+"/command/db-1", `{"op":"restart"}`, nil)
+	first := client.readCommand()
+	status := goPost(ts.URL+"/command/db-1", `{"op":"status"}`, nil)
+	second := client.readCommand()
+	if string(first.Command) != `{"op":"restart"}` || string(second.Command) != `{"op":"status"}` {
+		t.Fatalf("client got commands %s and %s, want them verbatim", first.Command, second.Command)
+	}
+
+	// Answered in the opposite order, each reply still finds its caller.
+	client.reply(replyMessage{RequestID: second.RequestID, Body: "up"})
+	client.reply(replyMessage{RequestID: first.RequestID, Body: "restarting"})
+	if r := <-restart; r.status != http.StatusOK || r.body != "restarting" {
+		t.Errorf("restart got %d %q", r.status, r.body)
+	}
+	if r := <-status; r.status != http.StatusOK || r.body != "up" {
+		t.Errorf("status got %d %q", r.status, r.body)
+	}
+}
+
+func TestCommandsAreNeverCached(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	for i := 0; i < 2; i++ {
+		result := goPost(ts.URL+"/command/db-1", `{"op":"status"}`, nil)
+		command := client.readCommand()
+		client.reply(replyMessage{RequestID: command.RequestID, Body: "up"})
+		if r := <-result; r.status != http.StatusOK {
+			t.Errorf("command %d got %d %q", i, r.status, r.body)
+		}
+	}
+}
+
+func TestCommandMustBeJSON(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "db-1")
+	if resp, _ := do(t, "POST", ts.URL+"/command/db-1", "restart", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("non-JSON command got %s, want 400", resp.Status)
+	}
+}
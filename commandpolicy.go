@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+)
+
+// Some commands are too dangerous to let every caller send to every client.
+// The -command-policies file restricts, by the command's "op", which types
+// of /command a client ID or a tenant's clients may be sent:
+//
+//	{"clients": {"db-1": {"allow": ["status", "stats"]}},
+//	 "tenants": {"acme": {"deny": ["restart", "wipe"]}}}
+//
+// A client can restrict itself the same way when it registers, with
+//
+//	{"client_id":"db-1","commands":{"deny":["restart"]}}
+//
+// A command must pass every policy that applies: its client ID's, its
+// tenant's and its registration's. A policy passes a command whose type it
+// doesn't deny and, if it has an allow list, that list names; a command
+// without an "op" passes only policies without one. Anything else is refused
+// with 403 before it reaches the client, and counted in
+// proxy_commands_denied_total.
+
+var errCommandDenied = errors.New("command type is not allowed for this client")
+
+type commandPolicy struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+type commandPolicies struct {
+	Clients map[string]commandPolicy `json:"clients"`
+	Tenants map[string]commandPolicy `json:"tenants"`
+}
+
+func (p commandPolicy) permits(op string) bool {
+	if slices.Contains(p.Deny, op) {
+		return false
+	}
+	return len(p.Allow) == 0 || slices.Contains(p.Allow, op)
+}
+
+func (p commandPolicy) validate() error {
+	for _, op := range append(slices.Clip(p.Allow), p.Deny...) {
+		if op == "" {
+			return fmt.Errorf("empty command type")
+		}
+	}
+	return nil
+}
+
+func loadCommandPolicies(path string) (*commandPolicies, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policies commandPolicies
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, err
+	}
+	for id, policy := range policies.Clients {
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("client %s: %w", id, err)
+		}
+	}
+	for tenant, policy := range policies.Tenants {
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tenant, err)
+		}
+	}
+	return &policies, nil
+}
+
+// checkCommandPolicy returns errCommandDenied if a policy for clientID
+// refuses command.
+func (s *Server) checkCommandPolicy(clientID string, command json.RawMessage) error {
+	s.registrationsMutex.RLock()
+	registration := s.registrations[clientID]
+	s.registrationsMutex.RUnlock()
+
+	applicable := []commandPolicy{registration.CommandPolicy}
+	if policies := s.currentConfig().commandPolicies; policies != nil {
+		applicable = append(applicable, policies.Clients[clientID])
+		if registration.Tenant != "" {
+			applicable = append(applicable, policies.Tenants[registration.Tenant])
+		}
+	}
+
+	op := commandType(command)
+	for _, policy := range applicable {
+		if !policy.permits(op) {
+			log.Printf("Refused command %q for client %s: not allowed by its command policy", op, clientID)
+			s.incCounter("proxy_commands_denied_total", s.withLabels(clientID)...)
+			return errCommandDenied
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeCommandPolicies writes a -command-policies file of contents and
+// returns its path.
+func writeCommandPolicies(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "command-policies.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCommandPoliciesCombine(t *testing.T) {
+	policies := writeCommandPolicies(t, `{"clients": {"db-1": {"allow": ["status", "stats", "restart"]}},
+		"tenants": {"acme": {"deny": ["restart"]}}}`)
+	s, ts := newTestServer(t, "-command-policies", policies)
+	register(t, ts, map[string]any{"client_id": "db-1", "tenant": "acme", "commands": map[string]any{"deny": []string{"stats"}}})
+
+	for command, allowed := range map[string]bool{
+		`{"op":"status"}`:  true,
+		`{"op":"restart"}`: false, // the tenant denies it
+		`{"op":"stats"}`:   false, // the registration denies it
+		`{"op":"backup"}`:  false, // the client's allow list doesn't name it
+		`{}`:               false,
+	} {
+		err := s.checkCommandPolicy("db-1", json.RawMessage(command))
+		if allowed != (err == nil) {
+			t.Errorf("command %s to db-1: %v, want allowed %v", command, err, allowed)
+		}
+	}
+	// A client ID without policies of its own may be sent anything.
+	if err := s.checkCommandPolicy("db-2", json.RawMessage(`{}`)); err != nil {
+		t.Errorf("command to db-2: %v", err)
+	}
+}
+
+func TestDeniedCommandIsRefusedBeforeReachingTheClient(t *testing.T) {
+	policies := writeCommandPolicies(t, `{"clients": {"db-1": {"deny": ["wipe"]}}}`)
+	s, ts := newTestServer(t, "-command-policies", policies)
+	client := connectClient(t, s, ts, "db-1")
+
+	if r := <-goPost(ts.URL+"/command/db-1", `{"op":"wipe"}`, nil); r.status != http.StatusForbidden {
+		t.Errorf("denied command got %d %q, want 403", r.status, r.body)
+	}
+	status := goPost(ts.URL+"/command/db-1", `{"op":"status"}`, nil)
+	// The first command the client is sent is the allowed one.
+	command := client.readCommand()
+	if string(command.Command) != `{"op":"status"}` {
+		t.Fatalf("client was sent %s", command.Command)
+	}
+	client.reply(replyMessage{RequestID: command.RequestID, Body: "up"})
+	if r := <-status; r.status != http.StatusOK || r.body != "up" {
+		t.Errorf("allowed command got %d %q", r.status, r.body)
+	}
+
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	if n := s.metrics.counters["proxy_commands_denied_total"]; n != 1 {
+		t.Errorf("proxy_commands_denied_total = %v, want 1", n)
+	}
+}
+
+func TestLoadCommandPoliciesRefusesEmptyTypes(t *testing.T) {
+	for _, contents := range []string{`{"clients": {"db-1": {"allow": [""]}}}`, `{"tenants": {"acme": {"deny": [""]}}}`, `[not json`} {
+		if _, err := loadCommandPolicies(writeCommandPolicies(t, contents)); err == nil {
+			t.Errorf("loadCommandPolicies accepted %s", contents)
+		}
+	}
+}
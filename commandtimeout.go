@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Commands of different types can take very different times: a status check
+// answers at once while a restart may take minutes. The type of a /command
+// is the string "op" field of its body, and -command-timeouts gives types
+// their own timeout in place of -query-timeout:
+//
+//	-command-timeouts restart=2m,status=2s
+//
+// A client can declare its own when it registers, which take precedence:
+//
+//	{"client_id":"db-1","command_timeouts":{"restart":"5m"}}
+//
+// A caller's X-Query-Timeout still overrides both. Like X-Query-Timeout, a
+// type's timeout is capped at -max-query-timeout and by the request budget.
+// Commands of other types, or without an "op", get -query-timeout.
+
+// commandTypeField is the field of a command body naming its type.
+const commandTypeField = "op"
+
+// parseCommandTimeouts parses a -command-timeouts list.
+func parseCommandTimeouts(list string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		op, timeout, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not type=duration", entry)
+		}
+		timeouts[strings.TrimSpace(op)] = strings.TrimSpace(timeout)
+	}
+	return parseCommandTimeoutMap(timeouts)
+}
+
+// parseCommandTimeoutMap parses timeouts given as Go durations by command
+// type, returning nil if there are none.
+func parseCommandTimeoutMap(timeouts map[string]string) (map[string]time.Duration, error) {
+	if len(timeouts) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string]time.Duration, len(timeouts))
+	for op, value := range timeouts {
+		if op == "" {
+			return nil, fmt.Errorf("empty command type")
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("command type %s: %v", op, err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("command type %s: timeout must be positive", op)
+		}
+		parsed[op] = timeout
+	}
+	return parsed, nil
+}
+
+// commandType returns the type of command, or "" if it has none.
+func commandType(command json.RawMessage) string {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(command, &fields) != nil {
+		return ""
+	}
+	var op string
+	if json.Unmarshal(fields[commandTypeField], &op) != nil {
+		return ""
+	}
+	return op
+}
+
+// commandTimeout returns how long to wait for the reply to command: the
+// caller's X-Query-Timeout, else the timeout for its type, else the default.
+func (s *Server) commandTimeout(r *http.Request, clientID string, command json.RawMessage) (time.Duration, error) {
+	if r.Header.Get("X-Query-Timeout") != "" {
+		return s.queryTimeout(r)
+	}
+	op := commandType(command)
+	if op == "" {
+		return s.queryTimeout(r)
+	}
+
+	s.registrationsMutex.RLock()
+	timeout, ok := s.registrations[clientID].CommandTimeouts[op]
+	s.registrationsMutex.RUnlock()
+	cfg := s.currentConfig()
+	if !ok {
+		timeout, ok = cfg.commandTimeouts[op]
+	}
+	if !ok {
+		return s.queryTimeout(r)
+	}
+	return budgetTimeout(r, min(timeout, cfg.MaxQueryTimeout))
+}
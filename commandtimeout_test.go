@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseCommandTimeouts(t *testing.T) {
+	timeouts, err := parseCommandTimeouts(" restart=2m, status = 2s,")
+	if err != nil || timeouts["restart"] != 2*time.Minute || timeouts["status"] != 2*time.Second {
+		t.Errorf("parseCommandTimeouts = %v, %v", timeouts, err)
+	}
+	for _, list := range []string{"restart", "=2m", "restart=soon", "restart=0s"} {
+		if _, err := parseCommandTimeouts(list); err == nil {
+			t.Errorf("parseCommandTimeouts(%q) succeeded", list)
+		}
+	}
+}
+
+func TestCommandType(t *testing.T) {
+	for command, want := range map[string]string{
+		`{"op":"restart","force":true}`: "restart",
+		`{"op":7}`:                      "",
+		`{"action":"restart"}`:          "",
+		`["restart"]`:                   "",
+	} {
+		if got := commandType(json.RawMessage(command)); got != want {
+			t.Errorf("commandType(%s) = %q, want %q", command, got, want)
+		}
+	}
+}
+
+func TestCommandTimeoutPrecedence(t *testing.T) {
+	s, ts := newTestServer(t, "-command-timeouts", "restart=2m,status=2s", "-query-timeout", "10s", "-max-query-timeout", "3m")
+	register(t, ts, map[string]any{"client_id": "db-1", "command_timeouts": map[string]string{"restart": "5m"}})
+
+	for _, tc := range []struct {
+		clientID, command, header string
+		want                      time.Duration
+	}{
+		{"db-1", `{"op":"status"}`, "", 2 * time.Second},
+		{"db-2", `{"op":"restart"}`, "", 2 * time.Minute},
+		// The registration's 5m is capped at -max-query-timeout.
+		{"db-1", `{"op":"restart"}`, "", 3 * time.Minute},
+		{"db-1", `{"op":"restart"}`, "1s", time.Second},
+		{"db-1", `{"op":"backup"}`, "", 10 * time.Second},
+		{"db-1", `{}`, "", 10 * time.Second},
+	} {
+		r := httptest.NewRequest("POST", "/command/"+tc.clientID, nil)
+		if tc.header != "" {
+			r.Header.Set("X-Query-Timeout", tc.header)
+		}
+		if got, err := s.commandTimeout(r, tc.clientID, json.RawMessage(tc.command)); err != nil || got != tc.want {
+			t.Errorf("timeout of %s to %s with X-Query-Timeout %q = %s, %v, want %s", tc.command, tc.clientID, tc.header, got, err, tc.want)
+		}
+	}
+}
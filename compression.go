@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"compress/flate"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Websocket permessage-deflate is negotiated by gorilla/websocket, which only
+// implements the no-context-takeover variant: every message is compressed
+// with a fresh window on both sides and the server always answers with
+// "server_no_context_takeover; client_no_context_takeover". That keeps
+// per-connection memory to a compressor borrowed from a pool for the
+// duration of a write, instead of a 32KB+ sliding window held for the life of
+// each connection, at the cost of ratio on small, repetitive messages. An
+// idle connection holds no compressor or decompressor at all, so there is
+// no memory to reclaim by turning compression off while it is idle.
+// Because the window is discarded after each message, max window bits
+// buys nothing and isn't negotiated either. What can be tuned is whether
+// compression is offered at all, the deflate level used for writes and,
+// with -ws-compression-threshold, the size below which a message is sent
+// uncompressed: a small frame barely shrinks, if at all, and isn't worth
+// the CPU. Compression is decided per message, so a connection mixes
+// compressed and uncompressed frames, which permessage-deflate allows.
+
+func validateCompressionLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("websocket compression level %d out of range [%d, %d]", level, flate.HuffmanOnly, flate.BestCompression)
+	}
+	return nil
+}
+
+// compressionNegotiated reports whether the upgrade of r agreed on
+// permessage-deflate, which gorilla/websocket does whenever compression is
+// enabled and the client offers it.
+func (s *Server) compressionNegotiated(r *http.Request) bool {
+	if !s.upgrader.EnableCompression {
+		return false
+	}
+	for _, header := range r.Header.Values("Sec-Websocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyCompression sets the write compression level on a freshly upgraded
+// connection. It is a no-op when the client didn't negotiate compression.
+func applyCompression(conn *websocket.Conn, level int) {
+	if err := conn.SetCompressionLevel(level); err != nil {
+		log.Printf("Error setting compression level: %v", err)
+	}
+}
+
+// prepareWrite enables write compression for the next message if it is at
+// least -ws-compression-threshold bytes. The caller holds writeMutex.
+func (c *Client) prepareWrite(size int) {
+	if !c.Compression {
+		return
+	}
+	c.Connection.EnableWriteCompression(size >= c.server.currentConfig().WSCompressionThreshold)
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialCompressed connects clientID offering permessage-deflate and returns
+// the connection with what the proxy answered to the offer.
+func dialCompressed(t *testing.T, s *Server, ts *httptest.Server, clientID string) (*testClient, string) {
+	t.Helper()
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial(wsURL(ts, "/connect?client_id="+clientID), nil)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	waitFor(t, "the connection to be added", func() bool { return s.connectionCount(clientID) == 1 })
+	return &testClient{t: t, conn: conn}, resp.Header.Get("Sec-Websocket-Extensions")
+}
+
+func TestCompressionIsNegotiatedWhenOffered(t *testing.T) {
+	s, ts := newTestServer(t, "-ws-compression")
+	client, extensions := dialCompressed(t, s, ts, "db-1")
+	if !strings.Contains(extensions, "permessage-deflate") || !s.firstConnection("db-1").Compression {
+		t.Fatalf("proxy answered %q to a compression offer, want permessage-deflate", extensions)
+	}
+	client.echo(strings.Repeat("compressible ", 100))
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil); resp.StatusCode != http.StatusOK || len(body) != 1300 {
+		t.Errorf("query over a compressed connection got %s with %d bytes", resp.Status, len(body))
+	}
+}
+
+func TestCompressionIsOffByDefault(t *testing.T) {
+	s, ts := newTestServer(t)
+	_, extensions := dialCompressed(t, s, ts, "db-1")
+	if extensions != "" || s.firstConnection("db-1").Compression {
+		t.Errorf("proxy answered %q to a compression offer without -ws-compression", extensions)
+	}
+}
+
+func TestCompressionLevelIsChecked(t *testing.T) {
+	if _, err := LoadConfig([]string{"-ws-compression-level", "10"}); err == nil {
+		t.Error("LoadConfig accepted -ws-compression-level 10")
+	}
+}
+
+// frameConn records the first byte of each read once recording is on, which
+// is the FIN, RSV and opcode bits of the frame the read starts.
+type frameConn struct {
+	net.Conn
+	recording atomic.Bool
+	first     chan byte
+}
+
+func (c *frameConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.recording.Load() {
+		c.first <- p[0]
+	}
+	return n, err
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	s, ts := newTestServer(t, "-ws-compression", "-ws-compression-threshold", "1000")
+	raw := &frameConn{first: make(chan byte, 1)}
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			raw.Conn = conn
+			return raw, err
+		},
+	}
+	conn, _, err := dialer.Dial(wsURL(ts, "/connect?client_id=db-1"), nil)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	waitFor(t, "the connection to be added", func() bool { return s.connectionCount("db-1") == 1 })
+	client := &testClient{t: t, conn: conn}
+
+	for _, tc := range []struct {
+		query      string
+		compressed bool
+	}{
+		{"q=short", false},
+		{"q=" + strings.Repeat("long", 250), true},
+	} {
+		raw.recording.Store(true)
+		done := goGet(ts.URL+"/query/db-1?"+tc.query, nil)
+		query := client.readQuery()
+		if compressed := <-raw.first&0x40 != 0; compressed != tc.compressed {
+			t.Errorf("query %.10s... sent compressed %t, want %t", tc.query, compressed, tc.compressed)
+		}
+		client.reply(replyMessage{RequestID: query.RequestID, Body: "x"})
+		<-done
+	}
+}
@@ -0,0 +1,806 @@
+package proxy
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix is prepended to a flag's upper-cased name, with dashes turned into
+// underscores, to get the environment variable that sets it: -query-timeout
+// becomes PROXY_QUERY_TIMEOUT.
+const envPrefix = "PROXY_"
+
+type Config struct {
+	// ConfigFile is a JSON object mapping flag names to values.
+	ConfigFile string
+
+	Addr string
+	// UnixSocket, if set, is listened on instead of Addr, with the file
+	// mode in UnixSocketMode; see unix.go. Both are read at startup.
+	UnixSocket     string
+	UnixSocketMode string
+	// BasePath prefixes every route, for deployments behind a gateway that
+	// forwards a subtree; read at startup.
+	BasePath   string
+	AdminToken string
+	// AdminUser and AdminPassword let the admin API be reached with HTTP
+	// Basic Auth instead of, or as well as, AdminToken; see requireAdmin.
+	AdminUser     string
+	AdminPassword string
+	// MetricsAuth puts /metrics behind the same credentials.
+	MetricsAuth bool
+	// MetricLabels lists the registration metadata keys used as metric
+	// labels, each with at most MetricLabelValues values; see labels.go.
+	MetricLabels      string
+	MetricLabelValues int
+	Pprof             bool
+
+	// HTTP server timeouts, read at startup; see timeouts.go.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	ClientAllowlist    string
+	ClientAllowPattern string
+	ClientDenylist     string
+	ClientDenyPattern  string
+	AllowedOrigins     string
+	// PublicURL and AllowedHosts keep the connection URL from following a
+	// spoofed Host header; see advertise.go.
+	PublicURL    string
+	AllowedHosts string
+	// ReplicaOf makes this instance a read-only replica of the primary at
+	// that URL, authenticating with ReplicaToken; see replica.go.
+	ReplicaOf    string
+	ReplicaToken string
+	// TrustedProxies lists the CIDRs whose X-Forwarded-For is believed.
+	TrustedProxies string
+	RegisterRate   float64
+	RegisterBurst  int
+	// RequireRegistration makes /connect refuse client IDs without a live
+	// registration; see registration.go.
+	RequireRegistration bool
+	RegistrationTTL     time.Duration
+	// MaxConnectionsPerTenant caps connections per registered tenant; 0
+	// disables it. See tenant.go.
+	MaxConnectionsPerTenant int
+	// MaxClientIDs and MaxConnectionsPerClient cap client IDs and their
+	// connections; see clientlimit.go.
+	MaxClientIDs            int
+	MaxConnectionsPerClient int
+	// MaxClientOutstandingBytes caps the reply bytes being written per
+	// client ID; see outbound.go.
+	MaxClientOutstandingBytes int64
+	// TenantConnectionWait is how long a connection over the tenant cap
+	// waits for room; see tenant.go.
+	TenantConnectionWait time.Duration
+
+	PingInterval    time.Duration
+	MinPingInterval time.Duration
+	MaxPingInterval time.Duration
+	// TCPKeepAlive is the TCP keepalive period set on client connections
+	// at upgrade; 0 disables keepalive.
+	TCPKeepAlive time.Duration
+	// FirstActivityTimeout is how long a new connection has to send a
+	// message or pong; see awaitFirstActivity.
+	FirstActivityTimeout time.Duration
+
+	QueryTimeout    time.Duration
+	MaxQueryTimeout time.Duration
+	// QuorumReads checks reads against several connections; see
+	// quorum.go.
+	QuorumReads string
+	// ServerTiming adds Server-Timing headers; see servertiming.go.
+	ServerTiming bool
+	// StreamDisconnect is how a stream whose client disconnects mid-way
+	// ends for callers without trailers; see writeStream.
+	StreamDisconnect string
+	// ClientWarmup holds new connections out of routing for that long;
+	// ClientWarmupMode is prefer or strict. See warmup.go.
+	ClientWarmup     time.Duration
+	ClientWarmupMode string
+	// TraceFile is where query traces are appended; see trace.go.
+	TraceFile string
+	// FlapThreshold, if set, is the share of a key's recent replies
+	// differing from the one before above which the key is reported as
+	// flapping; see flap.go.
+	FlapThreshold float64
+	// ShadowClients mirrors queries to shadow clients; see shadow.go.
+	ShadowClients string
+	// CommandTimeouts gives commands of some types their own timeout; see
+	// commandtimeout.go.
+	CommandTimeouts string
+	// CommandPoliciesFile restricts the command types clients may be sent;
+	// see commandpolicy.go.
+	CommandPoliciesFile string
+	// RequestBudget bounds each query request as a whole; see budget.go.
+	RequestBudget time.Duration
+	// SlowReadTimeout is how long a caller may take to read each piece of
+	// a query response; see slowread.go.
+	SlowReadTimeout time.Duration
+	// NotConnectedTTL is how long a client found not connected keeps
+	// getting 404 without a lookup; see notconnected.go.
+	NotConnectedTTL time.Duration
+	// MaxQueryURL and MaxQueryHeaderBytes bound the size of a query
+	// request; see limits.go.
+	MaxQueryURL         int
+	MaxQueryHeaderBytes int
+	// MaxQueryBody and MaxRegisterBody bound request bodies; see
+	// limitBody.
+	MaxQueryBody    int64
+	MaxRegisterBody int64
+	MaxBatchQueries int
+	MaxInFlight     int
+	// MaxDeclaredInFlight caps the in-flight limit a client may declare
+	// for itself at registration.
+	MaxDeclaredInFlight int
+	// MaxQueued is how many queries may wait per connection once
+	// MaxInFlight is reached; see priority.go.
+	MaxQueued int
+	// MaxSubscribers caps /subscribe streams per client ID; see
+	// subscribe.go.
+	MaxSubscribers int
+	// ClientHistory is how many recent requests are kept per client ID;
+	// see history.go.
+	ClientHistory int
+	// PausedQueries is what happens to queries for a paused client, "queue"
+	// or "reject"; see pause.go.
+	PausedQueries string
+	// ResumeOrder is the order a resumed client's queue drains in,
+	// "priority" or "fifo"; see pause.go.
+	ResumeOrder string
+	// ChunkReorderWindow is how far ahead of the next expected chunk of a
+	// streamed reply a chunk may arrive; see stream.go.
+	ChunkReorderWindow int
+	// AckTimeout is how long to wait for a query's ack on connections that
+	// send them before giving up on it; 0 waits the whole query timeout.
+	// See ack.go.
+	AckTimeout time.Duration
+	// HandshakeTimeout, if set, is how long a new connection has to send
+	// its capabilities; see handshake.go.
+	HandshakeTimeout time.Duration
+	// ReconnectGrace is how long a query whose connection dropped waits
+	// for the client to reconnect; see reconnect.go.
+	ReconnectGrace time.Duration
+	// ConnectionAuthKey, if set, is the key connections must prove they
+	// hold within ConnectionAuthTimeout; see connauth.go.
+	ConnectionAuthKey     string
+	ConnectionAuthTimeout time.Duration
+	// ShutdownTimeout is how long Shutdown waits for clients to
+	// disconnect, and ShutdownReconnectURL where it tells them to go; see
+	// shutdown.go.
+	ShutdownTimeout      time.Duration
+	ShutdownReconnectURL string
+	// QueryLogSample and SlowQuery control query logging; see recordQuery.
+	QueryLogSample int
+	SlowQuery      time.Duration
+	// ClientDrainTimeout is the longest a per-client drain waits for
+	// in-flight queries; see drain.go.
+	ClientDrainTimeout time.Duration
+	// JitterPercent spreads ping, prefetch and cleanup intervals by up to
+	// that much either way; see jitter.go.
+	JitterPercent int
+	// UnhealthyAfter is how many consecutive query timeouts mark a
+	// connection unhealthy; 0 disables the check.
+	UnhealthyAfter      int
+	DisconnectUnhealthy bool
+	// MaxPendingPushes and PushDropPolicy bound the pushes waiting to be
+	// handled per connection; see pushbuffer.go.
+	MaxPendingPushes int
+	PushDropPolicy   string
+	// MaxPending bounds each connection's pending queries; see pending.go.
+	MaxPending int
+	// MaxWriteFailures is how many failed query writes in a row tear a
+	// connection down; see deadconn.go.
+	MaxWriteFailures int
+	// LeastRTTRouting sends each query to the connection with the lowest
+	// ping round trip instead of by weight; see rtt.go.
+	LeastRTTRouting bool
+	// MaxRTT excludes connections with a slower ping round trip from
+	// routing; 0 disables it.
+	MaxRTT time.Duration
+	// BroadcastTimeout bounds each client's send in a broadcast, which runs
+	// on BroadcastWorkers goroutines.
+	BroadcastTimeout time.Duration
+	BroadcastWorkers int
+	// MaxConcurrentQueries caps live queries across all clients; 0 disables it.
+	MaxConcurrentQueries int
+	// MaxConcurrentRegistrations caps /register requests handled at once;
+	// 0 disables it. See registration.go.
+	MaxConcurrentRegistrations int
+	// BackpressureThreshold and BackpressureResume are the percentages of
+	// MaxConcurrentQueries at which clients are told to back off and to
+	// resume; see backpressure.go. A threshold of 0 disables it.
+	BackpressureThreshold int
+	BackpressureResume    int
+	// IdempotencyWindow is how long the reply to a POST query is kept for
+	// replay under its Idempotency-Key.
+	IdempotencyWindow time.Duration
+	// Cache turns the query cache off entirely when false, making every
+	// GET query a live fetch.
+	Cache    bool
+	CacheTTL time.Duration
+	// CacheErrorTTL is the longest a 4xx or 5xx reply is cached; 0 keeps
+	// them out of the cache.
+	CacheErrorTTL time.Duration
+	// CacheExpiryGrace is how long callers behind the one refreshing an
+	// expired entry are still served it; see lookupCache.
+	CacheExpiryGrace time.Duration
+	// CacheTTLJitter spreads cache entries' TTLs by up to that percentage
+	// either way; see jitter.go.
+	CacheTTLJitter int
+	// CacheKeyNormalize and CacheKeyFoldCase control how query strings
+	// are turned into cache keys; see normalizeQuery.
+	CacheKeyNormalize bool
+	CacheKeyFoldCase  bool
+	// MaxCacheBody is the largest reply body in bytes that is cached; 0
+	// disables the limit.
+	MaxCacheBody int
+	// StaleOnError serves expired cache entries to queries the client
+	// can't answer; see stale.go.
+	StaleOnError bool
+	// MaxCacheEntries and MaxCacheBytes bound the whole cache; see
+	// cachelimit.go.
+	MaxCacheEntries int
+	MaxCacheBytes   int
+	// CachePoliciesFile sets cache policies per query route; see
+	// cachepolicy.go.
+	CachePoliciesFile string
+	// EmptyReply is how empty client replies are returned; see
+	// emptyReplyModes.
+	EmptyReply        string
+	CacheEmptyReplies bool
+	// FallbackFile holds static replies for unavailable clients; see
+	// fallback.go.
+	FallbackFile string
+	// ResponseHeadersFile lists headers added to query responses; see
+	// headers.go.
+	ResponseHeadersFile string
+	// BodyRewritesFile lists replacements made in reply bodies; see
+	// rewrite.go.
+	BodyRewritesFile string
+	// CloseReasonsFile replaces the reasons sent when the proxy closes a
+	// connection; see closereason.go.
+	CloseReasonsFile string
+
+	// ClientHealthHeaders adds the client's liveness to GET query
+	// responses. It exposes internal state, so it is off by default.
+	ClientHealthHeaders bool
+
+	GzipResponses bool
+	GzipMinSize   int
+	// GzipTypes lists the Content-Types worth compressing; see
+	// gzipContentType.
+	GzipTypes string
+
+	// WSCompression offers permessage-deflate on /connect; see
+	// compression.go for what is and isn't negotiable.
+	WSCompression      bool
+	WSCompressionLevel int
+	// WSCompressionThreshold is the smallest message, in bytes, worth
+	// compressing; zero compresses every message.
+	WSCompressionThreshold int
+
+	// SyntheticClients turns on the load-testing mode in synthetic.go.
+	SyntheticClients     int
+	SyntheticQueries     int
+	SyntheticConcurrency int
+
+	TLSCert                string
+	TLSKey                 string
+	TLSMinVersion          string
+	TLSCipherSuites        string
+	TLSPreferServerCiphers bool
+
+	clientPolicy    clientIDPolicy
+	basePath        string
+	unixSocketMode  os.FileMode
+	origins         map[string]bool
+	publicURL       string
+	metricLabels    []string
+	replicaOf       string
+	allowedHosts    map[string]bool
+	gzipTypes       map[string]bool
+	fallbacks       map[string]fallbackResponse
+	cachePolicies   *cachePolicies
+	responseHeaders *responseHeaders
+	trustedProxies  []netip.Prefix
+	commandTimeouts map[string]time.Duration
+	commandPolicies *commandPolicies
+	closeReasons    map[closeCause]string
+	shadows         map[string]string
+	bodyRewrites    *bodyRewrites
+	quorumReads     []quorumRoute
+}
+
+// currentConfig returns the configuration in effect. Handlers read it per
+// request, so a Reload applies to every request that starts afterwards.
+// Settings consumed once — the listen address, TLS, the global query limit —
+// and per-connection settings fixed at upgrade time, such as a client's ping
+// interval, keep their old values until restart or reconnect.
+func (s *Server) currentConfig() *Config {
+	return s.config.Load()
+}
+
+func newFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	fs.StringVar(&cfg.ConfigFile, "config", "", "JSON file of flag values (flags and environment take precedence)")
+	fs.StringVar(&cfg.Addr, "addr", ":8380", "address to listen on")
+	fs.StringVar(&cfg.UnixSocket, "unix-socket", "", "path of a Unix domain socket to listen on instead of -addr (read at startup)")
+	fs.StringVar(&cfg.UnixSocketMode, "unix-socket-mode", "0660", "file mode of the -unix-socket, in octal (read at startup)")
+	fs.StringVar(&cfg.BasePath, "base-path", "", "path prefix for every route, e.g. /proxy (read at startup)")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "how long a caller may take to send request headers (read at startup)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", 30*time.Second, "how long a caller may take to send a whole request, body included (read at startup)")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", 30*time.Second, "how long writing a response may take, not counting time spent waiting on a client (read at startup)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", 2*time.Minute, "how long an idle keep-alive connection is kept open (read at startup)")
+	fs.StringVar(&cfg.ClientAllowlist, "client-allowlist", "", "comma-separated client IDs allowed to register (all when empty)")
+	fs.StringVar(&cfg.ClientAllowPattern, "client-allow-pattern", "", "regular expression matching client IDs allowed to register")
+	fs.StringVar(&cfg.ClientDenylist, "client-denylist", "", "comma-separated client IDs refused even if allowed")
+	fs.StringVar(&cfg.ClientDenyPattern, "client-deny-pattern", "", "regular expression matching client IDs refused even if allowed")
+	fs.StringVar(&cfg.AllowedOrigins, "allowed-origins", "*", "comma-separated Origin values accepted on /connect, or * for any")
+	fs.StringVar(&cfg.PublicURL, "public-url", "", "ws:// or wss:// base URL advertised to registering clients instead of one built from the Host header")
+	fs.StringVar(&cfg.ReplicaOf, "replica-of", "", "http:// or https:// base URL of a primary whose cache this instance follows, serving only /query-cached (read at startup)")
+	fs.StringVar(&cfg.ReplicaToken, "replica-token", "", "admin token of the -replica-of primary")
+	fs.StringVar(&cfg.AllowedHosts, "allowed-hosts", "", "comma-separated Host header values, with or without port, accepted on /register when -public-url is unset (any when empty)")
+	fs.StringVar(&cfg.TrustedProxies, "trusted-proxies", "", "comma-separated CIDRs of proxies whose X-Forwarded-For header is trusted")
+	fs.Float64Var(&cfg.RegisterRate, "register-rate", 0, "registrations per second allowed from one source IP (0 for no limit)")
+	fs.IntVar(&cfg.RegisterBurst, "register-burst", 5, "registrations one source IP may make in a burst under -register-rate")
+	fs.BoolVar(&cfg.RequireRegistration, "require-registration", false, "refuse /connect for client IDs without a valid, unexpired registration token")
+	fs.DurationVar(&cfg.RegistrationTTL, "registration-ttl", 5*time.Minute, "how long a registration stays valid before its client first connects")
+	fs.IntVar(&cfg.MaxClientIDs, "max-client-ids", 0, "most client IDs registered, and most connected, at once; new ones beyond it get 503 (0 for no limit)")
+	fs.Int64Var(&cfg.MaxClientOutstandingBytes, "max-client-outstanding-bytes", 0, "reply bytes a client ID may have being written to callers before its new queries get 503 (0 for no limit)")
+	fs.IntVar(&cfg.MaxConnectionsPerClient, "max-connections-per-client", 0, "most live connections one client ID may have at once (0 for no limit)")
+	fs.IntVar(&cfg.MaxConnectionsPerTenant, "max-connections-per-tenant", 0, "maximum live connections across all client IDs registered to one tenant (0 for no limit)")
+	fs.DurationVar(&cfg.TenantConnectionWait, "tenant-connection-wait", 0, "how long a connection over -max-connections-per-tenant waits for one of the tenant's connections to close before it is refused (0 to refuse it at once)")
+	fs.DurationVar(&cfg.PingInterval, "ping-interval", 30*time.Second, "default interval between websocket pings")
+	fs.DurationVar(&cfg.MinPingInterval, "min-ping-interval", 5*time.Second, "smallest ping interval a client may request")
+	fs.DurationVar(&cfg.MaxPingInterval, "max-ping-interval", 5*time.Minute, "largest ping interval a client may request")
+	fs.DurationVar(&cfg.TCPKeepAlive, "tcp-keepalive", 15*time.Second, "TCP keepalive period for client websocket connections (0 disables it)")
+	fs.DurationVar(&cfg.FirstActivityTimeout, "first-activity-timeout", 0, "close a new client connection that sends no message or pong within this long of connecting (0 disables it)")
+	fs.StringVar(&cfg.AdminToken, "admin-token", "", "bearer token required by the /admin endpoints (admin API is disabled when empty)")
+	fs.StringVar(&cfg.AdminUser, "admin-user", "", "username accepted with -admin-password as HTTP Basic Auth on the /admin endpoints")
+	fs.StringVar(&cfg.AdminPassword, "admin-password", "", "password for -admin-user, best passed in the environment")
+	fs.BoolVar(&cfg.MetricsAuth, "metrics-auth", false, "require the admin credentials for /metrics")
+	fs.StringVar(&cfg.MetricLabels, "metric-labels", "", "comma-separated registration metadata keys to label per-client metrics with")
+	fs.IntVar(&cfg.MetricLabelValues, "metric-label-values", 20, "most distinct values a -metric-labels key may take; further ones are counted as \"other\"")
+	fs.BoolVar(&cfg.Pprof, "pprof", false, "serve net/http/pprof under /debug/pprof behind admin auth (read at startup)")
+	fs.DurationVar(&cfg.QueryTimeout, "query-timeout", 10*time.Second, "how long to wait for a client to reply to a query")
+	fs.DurationVar(&cfg.MaxQueryTimeout, "max-query-timeout", time.Minute, "longest timeout a caller may request with X-Query-Timeout")
+	fs.StringVar(&cfg.QuorumReads, "quorum-reads", "", "comma-separated route=n/quorum entries, routes being patterns against /query/{clientID}; GET queries on the route go to n of the client's connections and need quorum alike replies, e.g. /query/orders=3/2")
+	fs.Float64Var(&cfg.FlapThreshold, "flap-threshold", 0, "report a cache key as flapping when more than this share (0-1) of its last 16 replies differed from the one before (0 to not track replies)")
+	fs.StringVar(&cfg.TraceFile, "trace-file", "", "append a JSON trace record of every query, with its status, cache decision and phase timings, to this file (read at startup)")
+	fs.DurationVar(&cfg.ClientWarmup, "client-warmup", 0, "how long after connecting a connection is passed over for queries while its client ID has other connections past theirs (0 to route to it at once)")
+	fs.StringVar(&cfg.ClientWarmupMode, "client-warmup-mode", "prefer", "what a query does when all of a client ID's connections are warming up: prefer sends it to one anyway, strict refuses it with 503")
+	fs.StringVar(&cfg.StreamDisconnect, "stream-disconnect", "abort", "how a streamed reply whose client disconnects mid-way ends for callers that read neither trailers nor events: abort the response, or end it normally, truncated")
+	fs.BoolVar(&cfg.ServerTiming, "server-timing", false, "add a Server-Timing header breaking down cache, queue, backend and total time to query responses")
+	fs.StringVar(&cfg.ShadowClients, "shadow-clients", "", "comma-separated client=shadow pairs; GET queries sent to the client are mirrored to the shadow and the replies compared, e.g. orders=orders-canary")
+	fs.StringVar(&cfg.CommandPoliciesFile, "command-policies", "", "JSON file of command types allowed or denied per client ID and per tenant for /command")
+	fs.StringVar(&cfg.CommandTimeouts, "command-timeouts", "", "comma-separated type=duration timeouts for /command by the command's \"op\", e.g. restart=2m,status=2s")
+	fs.DurationVar(&cfg.SlowReadTimeout, "slow-read-timeout", 0, "cut off a caller that takes longer than this to read each 32KiB of a query response, streams included (0 to rely on -write-timeout alone)")
+	fs.DurationVar(&cfg.RequestBudget, "request-budget", 0, "most time a query request may take end to end, including queueing and writing the response; 504 once spent (0 for no limit)")
+	fs.IntVar(&cfg.MaxQueryURL, "max-query-url", 8<<10, "longest query URL in bytes, path and query string; longer ones get 414 (0 for no limit)")
+	fs.DurationVar(&cfg.NotConnectedTTL, "not-connected-ttl", 0, "how long to answer queries for a client found not connected with 404 and a shared Retry-After (0 to disable)")
+	fs.IntVar(&cfg.MaxBatchQueries, "max-batch-queries", 100, "most queries one /query-batch request may hold (0 for no limit)")
+	fs.Int64Var(&cfg.MaxQueryBody, "max-query-body", 10<<20, "largest body in bytes of a POST query, command or batch; larger ones get 413 (0 for no limit)")
+	fs.Int64Var(&cfg.MaxRegisterBody, "max-register-body", 64<<10, "largest /register body in bytes; larger ones get 413 (0 for no limit)")
+	fs.IntVar(&cfg.MaxQueryHeaderBytes, "max-query-header-bytes", 16<<10, "largest total size in bytes of a query's headers; larger ones get 431 (0 for no limit)")
+	fs.IntVar(&cfg.MaxInFlight, "max-in-flight", 16, "maximum number of outstanding queries per client connection, unless the client declares its own")
+	fs.IntVar(&cfg.MaxDeclaredInFlight, "max-declared-in-flight", 64, "highest max_in_flight a client may declare at registration")
+	fs.StringVar(&cfg.PausedQueries, "paused-queries", "queue", "what to do with queries for a paused client: queue (up to -max-queued) or reject (503)")
+	fs.StringVar(&cfg.ResumeOrder, "resume-order", "priority", "order the queries queued for a paused client are sent in once it resumes: priority (highest first) or fifo (oldest first)")
+	fs.IntVar(&cfg.ClientHistory, "client-history", 50, "how many recent requests to keep per client ID for /admin/clients/{id}/history (0 to keep none)")
+	fs.IntVar(&cfg.MaxSubscribers, "max-subscribers", 100, "maximum number of /subscribe streams open per client ID (0 for no limit)")
+	fs.IntVar(&cfg.MaxQueued, "max-queued", 64, "maximum number of queries waiting per client connection once -max-in-flight is reached (0 rejects them)")
+	fs.IntVar(&cfg.ChunkReorderWindow, "chunk-reorder-window", 8, "how many places out of order a streamed reply's chunks may arrive (0 requires strict order)")
+	fs.DurationVar(&cfg.HandshakeTimeout, "handshake-timeout", 0, "require each connection to send a capabilities message first, within this long, before it is sent queries (0 for no handshake)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 0, "on SIGTERM or SIGINT, how long to wait for connected clients to disconnect before closing them (0 to close them at once)")
+	fs.StringVar(&cfg.ShutdownReconnectURL, "shutdown-reconnect-url", "", "on shutdown, tell connected clients to reconnect to this websocket URL")
+	fs.StringVar(&cfg.ConnectionAuthKey, "connection-auth-key", "", "shared key each client connection must sign a challenge with before it is served (empty for no challenge)")
+	fs.DurationVar(&cfg.ConnectionAuthTimeout, "connection-auth-timeout", 10*time.Second, "how long a connection has to answer the -connection-auth-key challenge")
+	fs.DurationVar(&cfg.ReconnectGrace, "reconnect-grace", 0, "how long a query whose client disconnected before replying waits for it to reconnect, to be re-sent (0 to fail it at once)")
+	fs.DurationVar(&cfg.AckTimeout, "ack-timeout", 0, "how long to wait for a client to acknowledge a query before failing over, on connections that send acks (0 to wait the whole query timeout)")
+	fs.IntVar(&cfg.QueryLogSample, "query-log-sample", 0, "log one in this many successful queries, and every failed or slow one (0 to log no queries)")
+	fs.DurationVar(&cfg.SlowQuery, "slow-query", time.Second, "queries taking at least this long are always logged when query logging is on (0 to disable)")
+	fs.DurationVar(&cfg.ClientDrainTimeout, "client-drain-timeout", time.Minute, "longest a per-client drain waits for in-flight queries before failing them and closing the connection")
+	fs.IntVar(&cfg.JitterPercent, "jitter", 0, "percentage by which ping, prefetch and cleanup intervals vary either way, 0 to 50")
+	fs.IntVar(&cfg.MaxPendingPushes, "max-pending-pushes", 0, "handle client pushes off the connection's reader, buffering up to this many per connection and dropping the rest (0 handles them inline)")
+	fs.StringVar(&cfg.PushDropPolicy, "push-drop-policy", "newest", "which push to drop when a connection's push buffer is full: newest or oldest")
+	fs.IntVar(&cfg.MaxPending, "max-pending", 1024, "most queries pending per client connection before the oldest is evicted, a safety net for leaks (0 for no limit)")
+	fs.IntVar(&cfg.MaxWriteFailures, "max-write-failures", 1, "failed query writes in a row after which a client connection is closed and its queries failed over (0 to disable)")
+	fs.IntVar(&cfg.UnhealthyAfter, "unhealthy-after", 3, "consecutive query timeouts after which a client connection is marked unhealthy (0 to disable)")
+	fs.BoolVar(&cfg.LeastRTTRouting, "least-rtt-routing", false, "send queries for a client ID to its connection with the lowest ping round-trip time instead of by weight")
+	fs.DurationVar(&cfg.MaxRTT, "max-rtt", 0, "ping round-trip time above which a connection gets no queries; callers may set their own with X-Max-RTT (0 for no limit)")
+	fs.BoolVar(&cfg.DisconnectUnhealthy, "disconnect-unhealthy", false, "disconnect client connections once they are marked unhealthy")
+	fs.DurationVar(&cfg.BroadcastTimeout, "broadcast-timeout", 5*time.Second, "how long one client may take to accept a broadcast message before it is disconnected")
+	fs.IntVar(&cfg.BroadcastWorkers, "broadcast-workers", 64, "number of concurrent sends during a broadcast")
+	fs.IntVar(&cfg.MaxConcurrentRegistrations, "max-concurrent-registrations", 0, "maximum number of /register requests handled at once, refusing more with 503 (0 for no limit)")
+	fs.IntVar(&cfg.MaxConcurrentQueries, "max-concurrent-queries", 1024, "maximum number of live queries processed at once across all clients (0 for no limit)")
+	fs.IntVar(&cfg.BackpressureThreshold, "backpressure-threshold", 0, "percentage of -max-concurrent-queries in use at which clients are told to hold off unsolicited messages (0 to disable)")
+	fs.IntVar(&cfg.BackpressureResume, "backpressure-resume", 75, "percentage of -max-concurrent-queries in use at or below which clients are told to resume")
+	fs.DurationVar(&cfg.IdempotencyWindow, "idempotency-window", 10*time.Minute, "how long POST query replies are kept for Idempotency-Key replays")
+	fs.BoolVar(&cfg.Cache, "cache", true, "cache GET query replies and client pushes (false makes every query live)")
+	fs.DurationVar(&cfg.CacheTTL, "cache-ttl", 5*time.Second, "how long replies are cached when the client sends no Cache-Control")
+	fs.IntVar(&cfg.CacheTTLJitter, "cache-ttl-jitter", 0, "percentage by which each cache entry's TTL varies either way, so entries stored together don't expire together, 0 to 50")
+	fs.DurationVar(&cfg.CacheExpiryGrace, "cache-expiry-grace", 0, "how long after one caller starts refreshing an expired entry that others are still served it (0 to refresh for every caller)")
+	fs.DurationVar(&cfg.CacheErrorTTL, "cache-error-ttl", 0, "longest a 4xx or 5xx reply is cached, however long its Cache-Control allows (0 to never cache them)")
+	fs.BoolVar(&cfg.CacheKeyNormalize, "cache-key-normalize", true, "sort and re-encode query parameters so equivalent queries share a cache entry")
+	fs.BoolVar(&cfg.CacheKeyFoldCase, "cache-key-fold-case", false, "also treat query parameter names case-insensitively in cache keys")
+	fs.BoolVar(&cfg.StaleOnError, "stale-on-error", false, "when a GET query's client can't answer, serve the expired cached reply, if any, instead of failing")
+	fs.IntVar(&cfg.MaxCacheBody, "max-cache-body", 1<<20, "largest reply body in bytes that is cached; larger ones are served with X-Cache: BYPASS (0 for no limit)")
+	fs.IntVar(&cfg.MaxCacheEntries, "max-cache-entries", 0, "most entries the cache holds, evicting the least recently used beyond it (0 for no limit)")
+	fs.IntVar(&cfg.MaxCacheBytes, "max-cache-bytes", 0, "approximate memory in bytes the cache may use, evicting the least recently used entries beyond it (0 for no limit)")
+	fs.StringVar(&cfg.CachePoliciesFile, "cache-policies", "", "JSON file of cache TTLs, error TTLs and size limits per query route, overriding -cache-ttl, -cache-error-ttl and -max-cache-body where they match")
+	fs.StringVar(&cfg.EmptyReply, "empty-reply", "empty", "how to return empty client replies: empty (200), no-content (204) or error (502)")
+	fs.BoolVar(&cfg.CacheEmptyReplies, "cache-empty-replies", true, "cache empty client replies like any other reply")
+	fs.StringVar(&cfg.ResponseHeadersFile, "response-headers", "", "JSON file of headers set on, or defaulted in, every query response")
+	fs.StringVar(&cfg.CloseReasonsFile, "close-reasons", "", "JSON file of reason templates, by cause, sent in the close frame when the proxy closes a client connection")
+	fs.StringVar(&cfg.BodyRewritesFile, "body-rewrites", "", "JSON file of host and find/replace rewrites made in reply bodies of the listed content types")
+	fs.StringVar(&cfg.FallbackFile, "fallbacks", "", "JSON file of static replies served per client ID when the client is unavailable")
+	fs.BoolVar(&cfg.ClientHealthHeaders, "client-health-headers", false, "add X-Client-Last-Ping and X-Client-Health to GET query responses")
+	fs.BoolVar(&cfg.GzipResponses, "gzip", true, "gzip /query responses for callers that accept it")
+	fs.IntVar(&cfg.GzipMinSize, "gzip-min-size", 1024, "smallest response body in bytes worth compressing")
+	fs.StringVar(&cfg.GzipTypes, "gzip-types", "text/*,application/json,application/*+json,application/javascript,application/xml,application/*+xml,image/svg+xml", "comma-separated Content-Types to compress; type/* and type/*+suffix patterns are allowed")
+	fs.BoolVar(&cfg.WSCompression, "ws-compression", false, "offer permessage-deflate compression to websocket clients (read at startup)")
+	fs.IntVar(&cfg.WSCompressionLevel, "ws-compression-level", flate.BestSpeed, "deflate level for compressed websocket writes, -2 to 9")
+	fs.IntVar(&cfg.WSCompressionThreshold, "ws-compression-threshold", 0, "only compress websocket messages of at least this many bytes (0 = all)")
+	fs.IntVar(&cfg.SyntheticClients, "synthetic-clients", 0, "load-test mode: start this many in-process fake clients, run -synthetic-queries against them, report and exit")
+	fs.IntVar(&cfg.SyntheticQueries, "synthetic-queries", 10000, "number of queries sent in synthetic mode")
+	fs.IntVar(&cfg.SyntheticConcurrency, "synthetic-concurrency", 16, "number of concurrent callers in synthetic mode")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", "", "TLS certificate file (enables TLS together with -tls-key)")
+	fs.StringVar(&cfg.TLSKey, "tls-key", "", "TLS private key file")
+	fs.StringVar(&cfg.TLSMinVersion, "tls-min-version", "1.2", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.StringVar(&cfg.TLSCipherSuites, "tls-cipher-suites", "", "comma-separated TLS 1.2 cipher suite names (Go defaults when empty)")
+	fs.BoolVar(&cfg.TLSPreferServerCiphers, "tls-prefer-server-ciphers", false, "prefer the server's cipher suite order")
+
+	return fs
+}
+
+// LoadConfig builds the configuration from, in increasing precedence, flag
+// defaults, the -config file, PROXY_* environment variables and args.
+func LoadConfig(args []string) (*Config, error) {
+	// The first pass only finds out which config file to read.
+	probe := &Config{}
+	if err := newFlagSet(probe).Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	fs := newFlagSet(cfg)
+	fs.SetOutput(io.Discard)
+
+	if probe.ConfigFile != "" {
+		data, err := os.ReadFile(probe.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		var values map[string]any
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("%s: %w", probe.ConfigFile, err)
+		}
+		for name, value := range values {
+			if err := fs.Set(name, fmt.Sprint(value)); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", probe.ConfigFile, name, err)
+			}
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok && envErr == nil {
+			if err := fs.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate checks settings that flag parsing can't and derives the compiled
+// forms handlers use. It may be run again on a Config it has already
+// checked.
+func (cfg *Config) validate() error {
+	if !emptyReplyModes[cfg.EmptyReply] {
+		return fmt.Errorf("invalid -empty-reply mode %q", cfg.EmptyReply)
+	}
+
+	if !pausedQueryModes[cfg.PausedQueries] {
+		return fmt.Errorf("invalid -paused-queries mode %q", cfg.PausedQueries)
+	}
+	if !resumeOrders[cfg.ResumeOrder] {
+		return fmt.Errorf("invalid -resume-order %q", cfg.ResumeOrder)
+	}
+	if !pushDropPolicies[cfg.PushDropPolicy] {
+		return fmt.Errorf("invalid -push-drop-policy %q", cfg.PushDropPolicy)
+	}
+
+	if cfg.ChunkReorderWindow < 0 {
+		return fmt.Errorf("-chunk-reorder-window must not be negative")
+	}
+	if cfg.MaxDeclaredInFlight < 1 {
+		return fmt.Errorf("-max-declared-in-flight must be at least 1")
+	}
+	// More than 50% could stretch a ping interval past the inactivity
+	// timeout of two intervals.
+	if cfg.JitterPercent < 0 || cfg.JitterPercent > 50 {
+		return fmt.Errorf("-jitter must be between 0 and 50")
+	}
+	if cfg.ClientDrainTimeout <= 0 {
+		return fmt.Errorf("-client-drain-timeout must be positive")
+	}
+	if cfg.QueryLogSample < 0 {
+		return fmt.Errorf("-query-log-sample must not be negative")
+	}
+	if cfg.CacheTTLJitter < 0 || cfg.CacheTTLJitter > 50 {
+		return fmt.Errorf("-cache-ttl-jitter must be between 0 and 50")
+	}
+	if cfg.CacheExpiryGrace < 0 {
+		return fmt.Errorf("-cache-expiry-grace must not be negative")
+	}
+	if cfg.MaxCacheEntries < 0 {
+		return fmt.Errorf("-max-cache-entries must not be negative")
+	}
+	if cfg.MaxCacheBytes < 0 {
+		return fmt.Errorf("-max-cache-bytes must not be negative")
+	}
+	if cfg.CacheErrorTTL < 0 {
+		return fmt.Errorf("-cache-error-ttl must not be negative")
+	}
+	if cfg.NotConnectedTTL < 0 {
+		return fmt.Errorf("-not-connected-ttl must not be negative")
+	}
+	if cfg.MaxClientIDs < 0 {
+		return fmt.Errorf("-max-client-ids must not be negative")
+	}
+	if cfg.MaxClientOutstandingBytes < 0 {
+		return fmt.Errorf("-max-client-outstanding-bytes must not be negative")
+	}
+	if cfg.MaxConnectionsPerClient < 0 {
+		return fmt.Errorf("-max-connections-per-client must not be negative")
+	}
+	if cfg.ClientHistory < 0 {
+		return fmt.Errorf("-client-history must not be negative")
+	}
+	if cfg.MaxSubscribers < 0 {
+		return fmt.Errorf("-max-subscribers must not be negative")
+	}
+	if cfg.MaxRTT < 0 {
+		return fmt.Errorf("-max-rtt must not be negative")
+	}
+	if cfg.HandshakeTimeout < 0 {
+		return fmt.Errorf("-handshake-timeout must not be negative")
+	}
+	if cfg.TenantConnectionWait < 0 {
+		return fmt.Errorf("-tenant-connection-wait must not be negative")
+	}
+	if cfg.ConnectionAuthTimeout <= 0 {
+		return fmt.Errorf("-connection-auth-timeout must be positive")
+	}
+	if cfg.ReconnectGrace < 0 {
+		return fmt.Errorf("-reconnect-grace must not be negative")
+	}
+	if cfg.ClientWarmup < 0 {
+		return fmt.Errorf("-client-warmup must not be negative")
+	}
+	if !warmupModes[cfg.ClientWarmupMode] {
+		return fmt.Errorf("-client-warmup-mode must be prefer or strict")
+	}
+	if !streamDisconnectModes[cfg.StreamDisconnect] {
+		return fmt.Errorf("-stream-disconnect must be abort or end")
+	}
+	if cfg.FlapThreshold < 0 || cfg.FlapThreshold >= 1 {
+		return fmt.Errorf("-flap-threshold must be at least 0 and below 1")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return fmt.Errorf("-shutdown-timeout must not be negative")
+	}
+	if cfg.AckTimeout < 0 {
+		return fmt.Errorf("-ack-timeout must not be negative")
+	}
+
+	if cfg.BackpressureThreshold < 0 || cfg.BackpressureThreshold > 100 {
+		return fmt.Errorf("-backpressure-threshold must be between 0 and 100")
+	}
+	if cfg.BackpressureThreshold > 0 && (cfg.BackpressureResume < 0 || cfg.BackpressureResume >= cfg.BackpressureThreshold) {
+		return fmt.Errorf("-backpressure-resume must be at least 0 and below -backpressure-threshold")
+	}
+
+	if cfg.BroadcastWorkers < 1 {
+		return fmt.Errorf("-broadcast-workers must be at least 1")
+	}
+
+	if cfg.SyntheticClients > 0 && cfg.SyntheticConcurrency < 1 {
+		return fmt.Errorf("-synthetic-concurrency must be at least 1")
+	}
+	if cfg.SyntheticClients > 0 && cfg.UnixSocket != "" {
+		return fmt.Errorf("synthetic mode needs a TCP -addr, not -unix-socket")
+	}
+
+	mode, err := strconv.ParseUint(cfg.UnixSocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid -unix-socket-mode %q: want an octal mode such as 0660", cfg.UnixSocketMode)
+	}
+	cfg.unixSocketMode = os.FileMode(mode)
+
+	if cfg.metricLabels, err = parseMetricLabels(cfg.MetricLabels); err != nil {
+		return fmt.Errorf("invalid -metric-labels: %w", err)
+	}
+	if cfg.MetricLabelValues < 1 {
+		return fmt.Errorf("-metric-label-values must be at least 1")
+	}
+
+	if cfg.FirstActivityTimeout < 0 {
+		return fmt.Errorf("-first-activity-timeout must not be negative")
+	}
+
+	if cfg.RequestBudget < 0 {
+		return fmt.Errorf("-request-budget must not be negative")
+	}
+	if cfg.SlowReadTimeout < 0 {
+		return fmt.Errorf("-slow-read-timeout must not be negative")
+	}
+	if cfg.commandTimeouts, err = parseCommandTimeouts(cfg.CommandTimeouts); err != nil {
+		return fmt.Errorf("invalid -command-timeouts: %w", err)
+	}
+	if cfg.commandPolicies, err = loadCommandPolicies(cfg.CommandPoliciesFile); err != nil {
+		return fmt.Errorf("invalid -command-policies: %w", err)
+	}
+	if cfg.shadows, err = parseShadowClients(cfg.ShadowClients); err != nil {
+		return fmt.Errorf("invalid -shadow-clients: %w", err)
+	}
+	if cfg.quorumReads, err = parseQuorumReads(cfg.QuorumReads); err != nil {
+		return fmt.Errorf("invalid -quorum-reads: %w", err)
+	}
+
+	if (cfg.AdminUser == "") != (cfg.AdminPassword == "") {
+		return fmt.Errorf("-admin-user and -admin-password must be set together")
+	}
+
+	if err := validateCompressionLevel(cfg.WSCompressionLevel); err != nil {
+		return err
+	}
+	if cfg.WSCompressionThreshold < 0 {
+		return fmt.Errorf("-ws-compression-threshold must not be negative")
+	}
+
+	policy, err := newClientIDPolicy(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid client ID pattern: %w", err)
+	}
+	cfg.clientPolicy = policy
+
+	if cfg.trustedProxies, err = parseCIDRs(cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid -trusted-proxies: %w", err)
+	}
+
+	if cfg.cachePolicies, err = loadCachePolicies(cfg.CachePoliciesFile, flagCachePolicy(cfg)); err != nil {
+		return fmt.Errorf("invalid -cache-policies: %w", err)
+	}
+	if cfg.fallbacks, err = loadFallbacks(cfg.FallbackFile); err != nil {
+		return fmt.Errorf("invalid -fallbacks: %w", err)
+	}
+	if cfg.responseHeaders, err = loadResponseHeaders(cfg.ResponseHeadersFile); err != nil {
+		return fmt.Errorf("invalid -response-headers: %w", err)
+	}
+	if cfg.closeReasons, err = loadCloseReasons(cfg.CloseReasonsFile); err != nil {
+		return fmt.Errorf("invalid -close-reasons: %w", err)
+	}
+	if cfg.bodyRewrites, err = loadBodyRewrites(cfg.BodyRewritesFile); err != nil {
+		return fmt.Errorf("invalid -body-rewrites: %w", err)
+	}
+
+	cfg.basePath = normalizeBasePath(cfg.BasePath)
+	cfg.gzipTypes = splitList(strings.ToLower(cfg.GzipTypes))
+
+	if cfg.publicURL, err = parsePublicURL(cfg.PublicURL); err != nil {
+		return fmt.Errorf("invalid -public-url: %w", err)
+	}
+	cfg.allowedHosts = splitList(strings.ToLower(cfg.AllowedHosts))
+	if cfg.replicaOf, err = parseReplicaOf(cfg.ReplicaOf); err != nil {
+		return fmt.Errorf("invalid -replica-of: %w", err)
+	}
+	if cfg.replicaOf != "" && cfg.SyntheticClients > 0 {
+		return fmt.Errorf("synthetic mode needs client connections, which a -replica-of replica doesn't take")
+	}
+
+	if cfg.AllowedOrigins != "*" {
+		cfg.origins = splitList(cfg.AllowedOrigins)
+	}
+	return nil
+}
+
+// Reload replaces the server's configuration with cfg, which is checked
+// first, along with any new TLS certificate; an invalid cfg is refused and
+// the current one kept.
+func (s *Server) Reload(cfg *Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	cert, err := s.reloadCertificate(cfg)
+	if err != nil {
+		return err
+	}
+	old := s.config.Swap(cfg)
+	log.Printf("Configuration reloaded")
+	if cert != nil {
+		s.swapCertificate(cert)
+	}
+
+	if cacheSettingsChanged(old, cfg) {
+		log.Printf("Cache settings changed, flushed %d cache entries", s.flushCache())
+	}
+	s.checkBackpressure()
+	return nil
+}
+
+// normalizeBasePath gives a prefix a leading slash and no trailing one, so
+// "proxy/", "/proxy" and "/proxy/" all mount at /proxy. An empty or "/"
+// prefix means none.
+func normalizeBasePath(path string) string {
+	path = strings.Trim(strings.TrimSpace(path), "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// checkOrigin accepts websocket upgrades from the configured origins.
+// Requests without an Origin header come from non-browser clients and are
+// always accepted.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origins := s.currentConfig().origins
+	if origins == nil {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	return origin == "" || origins[origin]
+}
+
+// clampMaxInFlight returns the in-flight limit a client gets given the one
+// it declared at registration, capped at -max-declared-in-flight. Zero means
+// the client left it to the server and stays zero.
+func clampMaxInFlight(cfg *Config, requested int) int {
+	if requested > cfg.MaxDeclaredInFlight {
+		return cfg.MaxDeclaredInFlight
+	}
+	return requested
+}
+
+// clampPingInterval returns the ping interval a client should use given the
+// interval it asked for at registration. Zero means the client didn't ask for
+// one and gets the default.
+func clampPingInterval(cfg *Config, requested time.Duration) time.Duration {
+	if requested <= 0 {
+		return cfg.PingInterval
+	}
+	if requested < cfg.MinPingInterval {
+		return cfg.MinPingInterval
+	}
+	if requested > cfg.MaxPingInterval {
+		return cfg.MaxPingInterval
+	}
+	return requested
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClampMaxInFlight(t *testing.T) {
+	cfg, err := LoadConfig([]string{"-max-declared-in-flight", "8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for requested, want := range map[int]int{0: 0, 3: 3, 8: 8, 100: 8} {
+		if got := clampMaxInFlight(cfg, requested); got != want {
+			t.Errorf("clampMaxInFlight(%d) = %d, want %d", requested, got, want)
+		}
+	}
+}
+
+func TestClampPingInterval(t *testing.T) {
+	cfg, err := LoadConfig([]string{"-ping-interval", "30s", "-min-ping-interval", "5s", "-max-ping-interval", "5m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for requested, want := range map[time.Duration]time.Duration{
+		0:                30 * time.Second,
+		time.Second:      5 * time.Second,
+		time.Minute:      time.Minute,
+		10 * time.Minute: 5 * time.Minute,
+	} {
+		if got := clampPingInterval(cfg, requested); got != want {
+			t.Errorf("clampPingInterval(%s) = %s, want %s", requested, got, want)
+		}
+	}
+}
+
+func loadConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+	cfg, err := LoadConfig(append([]string{"-admin-token", testAdminToken}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestReloadAppliesNewSettings(t *testing.T) {
+	s, ts := newTestServer(t)
+	if err := s.Reload(loadConfig(t, "-client-denylist", "db-1")); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if resp, _ := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-1"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("registering a client denied by the reloaded config got %s, want 403", resp.Status)
+	}
+}
+
+func TestReloadFlushesTheCacheWhenCachingChanges(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.cacheMutex.Lock()
+	s.cacheSet("db-1", ClientResponse{Data: "x", Timestamp: time.Now(), TTL: time.Minute})
+	s.cacheMutex.Unlock()
+
+	if err := s.Reload(loadConfig(t, "-query-timeout", "7s")); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, ok := s.cached("db-1"); !ok {
+		t.Error("a reload that leaves caching alone flushed the cache")
+	}
+	if err := s.Reload(loadConfig(t, "-cache-ttl", "1m")); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, ok := s.cached("db-1"); ok {
+		t.Error("changing -cache-ttl kept entries cached under the old TTL")
+	}
+}
+
+func TestReloadRefusesAnInvalidConfig(t *testing.T) {
+	s, _ := newTestServer(t)
+	before := s.currentConfig()
+	cfg := loadConfig(t)
+	cfg.EmptyReply = "silence"
+	if err := s.Reload(cfg); err == nil {
+		t.Fatal("Reload accepted an invalid configuration")
+	}
+	if s.currentConfig() != before {
+		t.Error("a refused reload replaced the configuration")
+	}
+}
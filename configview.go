@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strings"
+)
+
+// GET /admin/config shows the configuration in effect, after flags, the
+// environment, the -config file and any reloads have had their say, as
+// the value of every flag:
+//
+//	{"flags": {"addr": ":8380", "admin-token": "[redacted]", "cache-ttl": "5s", ...},
+//	 "restart_required": ["addr"]}
+//
+// Secrets show as [redacted] when set and empty when not. Settings read at
+// startup that a reload has changed since are listed in restart_required:
+// the value shown is the reloaded one, but the old one is still in effect
+// until the proxy restarts.
+
+// startupFlags are read once at startup, besides those whose usage says so.
+var startupFlags = map[string]bool{
+	"addr":                         true,
+	"max-concurrent-queries":       true,
+	"max-concurrent-registrations": true,
+	"tls-min-version":              true,
+	"tls-cipher-suites":            true,
+	"tls-prefer-server-ciphers":    true,
+}
+
+var redactedFlags = map[string]bool{
+	"admin-token":         true,
+	"admin-password":      true,
+	"replica-token":       true,
+	"connection-auth-key": true,
+}
+
+type configView struct {
+	Flags           map[string]string `json:"flags"`
+	RestartRequired []string          `json:"restart_required,omitempty"`
+}
+
+// flagValues returns cfg as the value of each flag.
+func flagValues(cfg *Config) map[string]string {
+	var view Config
+	fs := newFlagSet(&view)
+	// The flags point into view, so this makes them report cfg's values.
+	view = *cfg
+
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if redactedFlags[f.Name] && value != "" {
+			value = "[redacted]"
+		}
+		values[f.Name] = value
+	})
+	return values
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	view := configView{Flags: flagValues(s.currentConfig())}
+
+	startup := flagValues(s.startupConfig)
+	newFlagSet(new(Config)).VisitAll(func(f *flag.Flag) {
+		readAtStartup := startupFlags[f.Name] || strings.Contains(f.Usage, "read at startup")
+		if readAtStartup && startup[f.Name] != view.Flags[f.Name] {
+			view.RestartRequired = append(view.RestartRequired, f.Name)
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
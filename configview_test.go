@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func getConfigView(t *testing.T, url string) configView {
+	t.Helper()
+	resp, body := do(t, "GET", url+"/admin/config", nil, adminHeader())
+	var view configView
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &view) != nil {
+		t.Fatalf("GET /admin/config got %s: %s", resp.Status, body)
+	}
+	return view
+}
+
+func TestConfigViewShowsFlagsWithSecretsRedacted(t *testing.T) {
+	_, ts := newTestServer(t, "-cache-ttl", "7s")
+	view := getConfigView(t, ts.URL)
+	for name, want := range map[string]string{
+		"cache-ttl":      "7s",
+		"admin-token":    "[redacted]",
+		"admin-password": "",
+	} {
+		if got := view.Flags[name]; got != want {
+			t.Errorf("flag %s shown as %q, want %q", name, got, want)
+		}
+	}
+	if len(view.RestartRequired) != 0 {
+		t.Errorf("fresh server lists %q as needing a restart", view.RestartRequired)
+	}
+}
+
+func TestConfigViewListsStartupSettingsChangedByReload(t *testing.T) {
+	s, ts := newTestServer(t)
+	if err := s.Reload(loadConfig(t, "-max-concurrent-queries", "7", "-cache-ttl", "9s")); err != nil {
+		t.Fatal(err)
+	}
+	view := getConfigView(t, ts.URL)
+	if view.Flags["cache-ttl"] != "9s" || view.Flags["max-concurrent-queries"] != "7" {
+		t.Errorf("view after reload shows cache-ttl %q and max-concurrent-queries %q", view.Flags["cache-ttl"], view.Flags["max-concurrent-queries"])
+	}
+	if !slices.Contains(view.RestartRequired, "max-concurrent-queries") || slices.Contains(view.RestartRequired, "cache-ttl") {
+		t.Errorf("restart_required = %q, want only the startup setting", view.RestartRequired)
+	}
+}
+
+func TestConfigViewNeedsAdmin(t *testing.T) {
+	_, ts := newTestServer(t)
+	if resp, _ := do(t, "GET", ts.URL+"/admin/config", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /admin/config without admin got %s, want 401", resp.Status)
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Tokens in /connect URLs end up in access logs. With -connection-auth-key,
+// a connection proves instead that its client holds a shared key: right
+// after the upgrade the proxy sends a fresh nonce,
+//
+//	{"type":"challenge","nonce":"9f86d081884c7d65..."}
+//
+// and the client must answer, as its first message, with the hex
+// HMAC-SHA256 under the key of the nonce followed by its client ID,
+//
+//	{"type":"challenge_response","signature":"3b1f..."}
+//
+// within -connection-auth-timeout. Only then is the connection added to the
+// client's set and sent anything else; a wrong or missing answer closes it
+// with 1008 (policy violation). This works alongside -require-registration,
+// which still checks the URL token when set. Outcomes are counted in
+// proxy_connection_auth_total.
+
+var errConnectionAuth = errors.New("connection authentication failed")
+
+const challengeNonceBytes = 32
+
+type challengeResponse struct {
+	Type      string `json:"type"`
+	Signature string `json:"signature"`
+}
+
+// challengeSignature is what a client holding key answers to nonce.
+func challengeSignature(key, nonce, clientID string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte(clientID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticateConnection challenges a freshly upgraded connection for
+// clientID if -connection-auth-key is set, and reports whether it may be
+// served. A connection that fails is closed.
+func (s *Server) authenticateConnection(conn *websocket.Conn, clientID string) bool {
+	cfg := s.currentConfig()
+	if cfg.ConnectionAuthKey == "" {
+		return true
+	}
+
+	outcome := "ok"
+	err := s.challenge(conn, clientID, cfg.ConnectionAuthKey, cfg.ConnectionAuthTimeout)
+	if err != nil {
+		outcome = "failed"
+		if websocketErrorKind(err) == "timeout" {
+			outcome = "timeout"
+		}
+		log.Printf("Client %s failed to authenticate its connection from %s: %v", clientID, conn.RemoteAddr(), err)
+		s.closeConnection(conn, clientID, closeAuthFailed, err.Error(), time.Second)
+	}
+	s.incCounter("proxy_connection_auth_total", "outcome", outcome)
+	return err == nil
+}
+
+func (s *Server) challenge(conn *websocket.Conn, clientID, key string, timeout time.Duration) error {
+	nonce := make([]byte, challengeNonceBytes)
+	rand.Read(nonce)
+	message, err := json.Marshal(struct {
+		Type  string `json:"type"`
+		Nonce string `json:"nonce"`
+	}{
+		Type:  "challenge",
+		Nonce: hex.EncodeToString(nonce),
+	})
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	conn.SetWriteDeadline(deadline)
+	if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	conn.SetReadDeadline(deadline)
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var response challengeResponse
+	if err := json.Unmarshal(data, &response); err != nil || response.Type != "challenge_response" {
+		return errors.New("first message is not a challenge_response")
+	}
+	want := challengeSignature(key, hex.EncodeToString(nonce), clientID)
+	if !hmac.Equal([]byte(response.Signature), []byte(want)) {
+		return errors.New("wrong signature")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+const testConnectionAuthKey = "shared-secret"
+
+// dialChallenged connects clientID and returns the connection along with the
+// nonce it is challenged with.
+func dialChallenged(t *testing.T, ts *httptest.Server, clientID string) (*testClient, string) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(ts, "/connect?client_id="+clientID), nil)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := &testClient{t: t, conn: conn}
+
+	var challenge struct {
+		Type  string `json:"type"`
+		Nonce string `json:"nonce"`
+	}
+	if err := json.Unmarshal(client.read(), &challenge); err != nil || challenge.Type != "challenge" || challenge.Nonce == "" {
+		t.Fatalf("first message %+v, want a challenge", challenge)
+	}
+	return client, challenge.Nonce
+}
+
+func (c *testClient) answerChallenge(signature string) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(challengeResponse{Type: "challenge_response", Signature: signature}); err != nil {
+		c.t.Fatalf("answering the challenge: %v", err)
+	}
+}
+
+func authOutcomes(s *Server, outcome string) float64 {
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	return s.metrics.counters[`proxy_connection_auth_total{outcome="`+outcome+`"}`]
+}
+
+func TestConnectionAuthAcceptsTheKey(t *testing.T) {
+	s, ts := newTestServer(t, "-connection-auth-key", testConnectionAuthKey)
+	client, nonce := dialChallenged(t, ts, "db-1")
+	if s.connectionCount("db-1") != 0 {
+		t.Fatal("connection added before it answered the challenge")
+	}
+
+	client.answerChallenge(challengeSignature(testConnectionAuthKey, nonce, "db-1"))
+	waitFor(t, "the connection to be added", func() bool { return s.connectionCount("db-1") == 1 })
+	if n := authOutcomes(s, "ok"); n != 1 {
+		t.Errorf("ok outcomes = %v, want 1", n)
+	}
+}
+
+func TestConnectionAuthRefusesWrongSignatures(t *testing.T) {
+	s, ts := newTestServer(t, "-connection-auth-key", testConnectionAuthKey)
+	for _, sign := range []func(nonce string) string{
+		func(nonce string) string { return challengeSignature("guess", nonce, "db-1") },
+		// A signature for another client ID doesn't do either.
+		func(nonce string) string { return challengeSignature(testConnectionAuthKey, nonce, "db-2") },
+	} {
+		client, nonce := dialChallenged(t, ts, "db-1")
+		client.answerChallenge(sign(nonce))
+		client.expectClose(websocket.ClosePolicyViolation)
+	}
+	waitFor(t, "both failures to be counted", func() bool { return authOutcomes(s, "failed") == 2 })
+	if n := s.connectionCount("db-1"); n != 0 {
+		t.Errorf("wrong signatures left %d connections", n)
+	}
+}
+
+func TestConnectionAuthTimesOut(t *testing.T) {
+	s, ts := newTestServer(t, "-connection-auth-key", testConnectionAuthKey, "-connection-auth-timeout", "50ms")
+	client, _ := dialChallenged(t, ts, "db-1")
+	client.expectClose(websocket.ClosePolicyViolation)
+	waitFor(t, "the timeout to be counted", func() bool { return authOutcomes(s, "timeout") == 1 })
+}
+
+func TestConnectionAuthOffByDefault(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	client.echo("ok")
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil); string(body) != "ok" {
+		t.Errorf("query without -connection-auth-key got %s: %s", resp.Status, body)
+	}
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+)
+
+// A failed write usually means a connection is dead before its reader finds
+// out, which may take until the inactivity check, and meanwhile queries keep
+// being routed to it and failing. With -max-write-failures, a connection
+// that fails that many query writes in a row is torn down at once: it is
+// taken out of rotation and closed, and every query waiting on it fails
+// with errConnectionBroken. Those queries, and the one whose write failed,
+// are retried on the client's other connections where queryWithFailover is
+// used, since their replies can no longer arrive. A successful write resets
+// the count; 0 turns the teardown off, leaving each failure to its query.
+
+var errConnectionBroken = fmt.Errorf("%w: writing to the connection failed", errClientDisconnected)
+
+// recordWriteFailure counts a query write to client that failed with err,
+// tears the connection down once there have been enough in a row, and
+// returns the error to fail the query with.
+func (s *Server) recordWriteFailure(client *Client, err error) error {
+	kind := s.recordWebsocketError(client, "write", err)
+	limit := s.currentConfig().MaxWriteFailures
+	if limit <= 0 {
+		return err
+	}
+	n := client.writeFailures.Add(1)
+	if int(n) >= limit && client.torndown.CompareAndSwap(false, true) {
+		s.removeClient(client)
+		client.cancelQueries(errConnectionBroken)
+		client.Connection.Close()
+		s.incCounter("proxy_connections_torn_down_total")
+		log.Printf("Client %s connection torn down after %d failed writes: %v (%s)", client.ID, n, err, kind)
+	}
+	return fmt.Errorf("%w: %v", errConnectionBroken, err)
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+)
+
+var errTestWrite = errors.New("broken pipe")
+
+func TestRepeatedWriteFailuresTearDownTheConnection(t *testing.T) {
+	s, ts := newTestServer(t, "-max-write-failures", "2")
+	broken := connectClient(t, s, ts, "db-1")
+	conn := s.firstConnection("db-1")
+	connectClient(t, s, ts, "db-1")
+
+	if err := s.recordWriteFailure(conn, errTestWrite); !errors.Is(err, errConnectionBroken) || s.connectionCount("db-1") != 2 {
+		t.Fatalf("first failure returned %v with %d connections left, want the connection kept", err, s.connectionCount("db-1"))
+	}
+	s.recordWriteFailure(conn, errTestWrite)
+	if s.connectionCount("db-1") != 1 || !conn.torndown.Load() {
+		t.Fatalf("second failure left %d connections, want the failing one torn down", s.connectionCount("db-1"))
+	}
+	if _, _, err := broken.conn.ReadMessage(); err == nil {
+		t.Error("torn down connection is still open")
+	}
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	if n := s.metrics.counters["proxy_connections_torn_down_total"]; n != 1 {
+		t.Errorf("counted %v teardowns, want 1", n)
+	}
+}
+
+func TestWriteFailureTeardownCanBeTurnedOff(t *testing.T) {
+	s, ts := newTestServer(t, "-max-write-failures", "0")
+	connectClient(t, s, ts, "db-1")
+	conn := s.firstConnection("db-1")
+
+	for i := 0; i < 3; i++ {
+		if err := s.recordWriteFailure(conn, errTestWrite); err != errTestWrite {
+			t.Errorf("failure %d returned %v, want the write error itself", i, err)
+		}
+	}
+	if s.connectionCount("db-1") != 1 {
+		t.Error("connection was torn down with -max-write-failures 0")
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A misbehaving client can be thrown off at once with POST
+// /admin/clients/{clientID}/disconnect. Unlike a drain nothing is waited for:
+// the client's connections are taken out of the registry, the queries in
+// flight or queued on them fail with errClientKicked, which their callers get
+// as a 502, and each connection is closed with the optional code and reason:
+//
+//	{"code":4001,"reason":"flooding replies"}
+//
+// The code defaults to 1008 (policy violation) and the reason to the kicked
+// one of closereason.go. The client's registration and cached replies are
+// dropped too, so it has to register again and nothing it served is answered
+// from cache afterwards. It isn't barred from coming back; drain it for
+// that.
+
+// errClientKicked wraps errClientDisconnected so it is reported the same way.
+var errClientKicked = fmt.Errorf("%w: disconnected by an administrator", errClientDisconnected)
+
+const defaultDisconnectReason = "disconnected by an administrator"
+
+type disconnectResult struct {
+	Connections int `json:"connections"`
+	// Cleared is how many cached replies of the client were dropped.
+	Cleared int `json:"cleared"`
+}
+
+func (s *Server) handleClientDisconnect(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+
+	var request struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Code != 0 && !sendableCloseCode(request.Code) {
+		http.Error(w, "invalid close code", http.StatusBadRequest)
+		return
+	}
+	if len(request.Reason) > maxCloseReason {
+		http.Error(w, "reason is too long", http.StatusBadRequest)
+		return
+	}
+
+	s.clientsMutex.Lock()
+	var conns []*Client
+	if set, ok := s.clients[clientID]; ok {
+		conns = append(conns, set.conns...)
+	}
+	for _, client := range conns {
+		s.removeClientLocked(client)
+	}
+	s.clientsMutex.Unlock()
+
+	s.registrationsMutex.Lock()
+	delete(s.registrations, clientID)
+	s.registrationsMutex.Unlock()
+
+	// Without a code or reason of its own, the disconnect is the kicked
+	// cause, with the reason -close-reasons gives it.
+	code, reason := closeCodes[closeKicked], s.closeReason(closeKicked, clientID, "")
+	if request.Code != 0 {
+		code = request.Code
+	}
+	if request.Reason != "" {
+		reason = request.Reason
+	}
+	deadline := time.Now().Add(s.currentConfig().BroadcastTimeout)
+	for _, client := range conns {
+		client.cancelQueries(errClientKicked)
+		if request.Code == 0 && request.Reason == "" {
+			s.closeConnection(client.Connection, clientID, closeKicked, "", time.Until(deadline))
+		} else {
+			sendClose(client.Connection, code, reason, time.Until(deadline))
+		}
+	}
+
+	result := disconnectResult{
+		Connections: len(conns),
+		Cleared:     s.flushClientCache(clientID),
+	}
+	log.Printf("Disconnected client %s: closed %d connections with %d %q, dropped %d cache entries", clientID, result.Connections, code, reason, result.Cleared)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// sendableCloseCode reports whether code may be sent in a close frame. Codes
+// 1004-1006 and 1015 are reserved for reporting locally and never sent.
+func sendableCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code < 1000 || code > 1014:
+		return false
+	}
+	return code < 1004 || code > 1006
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDisconnectFailsQueriesInFlight(t *testing.T) {
+	s, ts := newTestServer(t)
+	registered := register(t, ts, map[string]any{"client_id": "db-1"})
+	client := connectRegistered(t, s, registered, "db-1")
+	cached := goGet(ts.URL+"/query/db-1", nil)
+	client.reply(replyMessage{RequestID: client.readQuery().RequestID, Body: "cached"})
+	<-cached
+	inFlight := goGet(ts.URL+"/query/db-1?q=in-flight", nil)
+	client.readQuery()
+
+	resp, body := do(t, "POST", ts.URL+"/admin/clients/db-1/disconnect", nil, adminHeader())
+	var result disconnectResult
+	if err := json.Unmarshal(body, &result); err != nil || result != (disconnectResult{Connections: 1, Cleared: 1}) {
+		t.Errorf("disconnect got %s: %s", resp.Status, body)
+	}
+	if r := <-inFlight; r.status != http.StatusBadGateway || !strings.Contains(r.body, "disconnected by an administrator") {
+		t.Errorf("query in flight got %d %q, want 502 naming the disconnect", r.status, r.body)
+	}
+
+	s.registrationsMutex.RLock()
+	_, stillRegistered := s.registrations["db-1"]
+	s.registrationsMutex.RUnlock()
+	if stillRegistered || s.connectionCount("db-1") != 0 {
+		t.Error("the disconnected client is still registered or connected")
+	}
+}
+
+func TestDisconnectChecksItsRequest(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "db-1")
+	for _, body := range []any{
+		map[string]any{"code": 1005},
+		map[string]any{"code": 999},
+		map[string]any{"reason": strings.Repeat("a", maxCloseReason+1)},
+		"not json",
+	} {
+		if resp, _ := do(t, "POST", ts.URL+"/admin/clients/db-1/disconnect", body, adminHeader()); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("disconnect with %v got %s, want 400", body, resp.Status)
+		}
+	}
+	if resp, _ := do(t, "POST", ts.URL+"/admin/clients/db-1/disconnect", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("disconnect without admin credentials got %s, want 401", resp.Status)
+	}
+	if s.connectionCount("db-1") != 1 {
+		t.Error("a refused disconnect closed the connection")
+	}
+}
+
+func TestSendableCloseCode(t *testing.T) {
+	for code, want := range map[int]bool{
+		websocket.CloseNormalClosure: true, websocket.ClosePolicyViolation: true,
+		1004: false, websocket.CloseNoStatusReceived: false, websocket.CloseAbnormalClosure: false,
+		websocket.CloseTLSHandshake: false, 2999: false, 4000: true, 5000: false,
+	} {
+		if got := sendableCloseCode(code); got != want {
+			t.Errorf("sendableCloseCode(%d) = %t, want %t", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// A single client can be drained for maintenance without draining the whole
+// server. POST /admin/clients/{clientID}/drain stops routing new queries to
+// the client, which get 503, waits for the ones in flight or queued on its
+// connections to finish, and then closes each connection with 1012 (service
+// restart) so the client knows to reconnect, elsewhere if the optional url
+// says where:
+//
+//	{"url":"wss://other-host/connect","timeout":"30s"}
+//
+// The timeout bounds the wait. It defaults to, and may not exceed,
+// -client-drain-timeout, so a stuck query or stream can't keep a client
+// draining forever: once it runs out, the queries still in flight or queued
+// are failed with errDrainDeadline, which their callers get as a 504, and the
+// connection is closed regardless. Until DELETE on the same path lifts it,
+// the client may not register or connect here again.
+
+var (
+	errClientDraining = errors.New("client is draining")
+	// errDrainDeadline wraps errQueryTimeout so it is reported the same
+	// way.
+	errDrainDeadline = fmt.Errorf("%w: client drain deadline passed", errQueryTimeout)
+)
+
+func (s *Server) clientDraining(clientID string) bool {
+	s.drainedClientsMutex.RLock()
+	defer s.drainedClientsMutex.RUnlock()
+	return s.drainedClients[clientID]
+}
+
+// idle reports whether the connection has no queries in flight or waiting.
+func (c *Client) idle() bool {
+	c.slotMutex.Lock()
+	defer c.slotMutex.Unlock()
+	return c.inFlight == 0 && len(c.queue) == 0
+}
+
+type drainResult struct {
+	Connections int `json:"connections"`
+	// TimedOut counts connections that still had queries in flight at the
+	// deadline; those queries were failed.
+	TimedOut int `json:"timed_out"`
+}
+
+func (s *Server) handleClientDrain(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+
+	var request struct {
+		URL     string `json:"url"`
+		Timeout string `json:"timeout"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout := s.currentConfig().ClientDrainTimeout
+	if request.Timeout != "" {
+		d, err := time.ParseDuration(request.Timeout)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = min(d, timeout)
+	}
+	s.extendWriteDeadline(w, timeout)
+
+	s.drainedClientsMutex.Lock()
+	s.drainedClients[clientID] = true
+	s.drainedClientsMutex.Unlock()
+
+	var conns []*Client
+	s.clientsMutex.RLock()
+	if set, ok := s.clients[clientID]; ok {
+		conns = append(conns, set.conns...)
+	}
+	s.clientsMutex.RUnlock()
+
+	result := drainResult{Connections: len(conns)}
+	deadline := time.Now().Add(timeout)
+	for _, client := range conns {
+		for !client.idle() && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if !client.idle() {
+			result.TimedOut++
+			client.cancelQueries(errDrainDeadline)
+		}
+		s.closeDrained(client, request.URL)
+	}
+	log.Printf("Drained client %s: closed %d connections (%d with queries in flight)", clientID, result.Connections, result.TimedOut)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// cancelQueries fails every query in flight or queued on the connection
+// with err. Only the first call has any effect.
+func (c *Client) cancelQueries(err error) {
+	c.cancelOnce.Do(func() {
+		c.cancelErr = err
+		close(c.cancelled)
+	})
+}
+
+// closeDrained tells a drained connection where to reconnect, if anywhere,
+// and closes it.
+func (s *Server) closeDrained(client *Client, url string) {
+	timeout := s.currentConfig().BroadcastTimeout
+	if url != "" {
+		message, _ := json.Marshal(struct {
+			Type string `json:"type"`
+			URL  string `json:"url"`
+		}{
+			Type: "reconnect",
+			URL:  url,
+		})
+		if err := client.writeMessageWithin(websocket.TextMessage, message, timeout); err != nil {
+			log.Printf("Error telling drained client %s to reconnect: %v", client.ID, err)
+		}
+	}
+	s.closeConnection(client.Connection, client.ID, closeDrained, "", timeout)
+}
+
+// handleClientUndrain lets a drained client register and connect again.
+func (s *Server) handleClientUndrain(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+
+	s.drainedClientsMutex.Lock()
+	delete(s.drainedClients, clientID)
+	s.drainedClientsMutex.Unlock()
+
+	log.Printf("Client %s is no longer drained", clientID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientDrainLetsQueriesInFlightFinish(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	inFlight := goGet(ts.URL+"/query/db-1?q=in-flight", nil)
+	query := client.readQuery()
+
+	drained := goPost(ts.URL+"/admin/clients/db-1/drain", `{"url":"wss://other-host/connect"}`, adminHeader())
+	waitFor(t, "the drain to start", func() bool { return s.clientDraining("db-1") })
+	if resp, _ := do(t, "GET", ts.URL+"/query/db-1?q=new", nil, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("new query to a draining client got %s, want 503", resp.Status)
+	}
+
+	client.reply(replyMessage{RequestID: query.RequestID, Body: "finished"})
+	if r := <-inFlight; r.status != http.StatusOK || r.body != "finished" {
+		t.Errorf("query in flight got %d %q, want its answer", r.status, r.body)
+	}
+	var reconnect struct{ Type, URL string }
+	if err := json.Unmarshal(client.read(), &reconnect); err != nil || reconnect.Type != "reconnect" || reconnect.URL != "wss://other-host/connect" {
+		t.Errorf("drained client was told %+v, want to reconnect elsewhere", reconnect)
+	}
+	client.expectClose(websocket.CloseServiceRestart)
+
+	var result drainResult
+	if r := <-drained; r.status != http.StatusOK || json.Unmarshal([]byte(r.body), &result) != nil || result != (drainResult{Connections: 1}) {
+		t.Errorf("drain got %d %q", r.status, r.body)
+	}
+}
+
+func TestClientDrainTimesOut(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	inFlight := goGet(ts.URL+"/query/db-1", nil)
+	client.readQuery()
+
+	resp, body := do(t, "POST", ts.URL+"/admin/clients/db-1/drain", map[string]any{"timeout": "100ms"}, adminHeader())
+	var result drainResult
+	if json.Unmarshal(body, &result) != nil || result.TimedOut != 1 {
+		t.Errorf("drain got %s: %s, want the connection timed out", resp.Status, body)
+	}
+	if r := <-inFlight; r.status != http.StatusGatewayTimeout {
+		t.Errorf("query still in flight at the deadline got %d, want 504", r.status)
+	}
+}
+
+func TestDrainedClientStaysAwayUntilUndrained(t *testing.T) {
+	s, ts := newTestServer(t)
+	do(t, "POST", ts.URL+"/admin/clients/db-1/drain", nil, adminHeader())
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL(ts, "/connect?client_id=db-1"), nil); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("drained client connecting got %v, want 503", err)
+	}
+
+	if resp, _ := do(t, "DELETE", ts.URL+"/admin/clients/db-1/drain", nil, adminHeader()); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("undrain got %s", resp.Status)
+	}
+	connectClient(t, s, ts, "db-1")
+}
+
+func TestClientDrainTimeoutCapsTheWait(t *testing.T) {
+	s, ts := newTestServer(t, "-client-drain-timeout", "100ms")
+	client := connectClient(t, s, ts, "db-1")
+	stuck := goGet(ts.URL+"/query/db-1", nil)
+	client.readQuery()
+
+	start := time.Now()
+	resp, body := do(t, "POST", ts.URL+"/admin/clients/db-1/drain", map[string]any{"timeout": "1h"}, adminHeader())
+	if elapsed := time.Since(start); resp.StatusCode != http.StatusOK || elapsed > 3*time.Second {
+		t.Errorf("drain got %s: %s after %s, want it cut off by -client-drain-timeout", resp.Status, body, elapsed)
+	}
+	if r := <-stuck; r.status != http.StatusGatewayTimeout {
+		t.Errorf("stuck query got %d, want 504", r.status)
+	}
+	client.expectClose(websocket.CloseServiceRestart)
+}
+
+func TestClientDrainTimeoutMustBePositive(t *testing.T) {
+	if _, err := LoadConfig([]string{"-client-drain-timeout", "0"}); err == nil {
+		t.Error("LoadConfig accepted -client-drain-timeout 0")
+	}
+}
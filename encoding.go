@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// A client that already holds its reply gzip-compressed can send it that
+// way instead of having the proxy compress it again: it puts
+// Content-Encoding: gzip among the reply's headers and base64-encodes the
+// compressed body, since a JSON string can't carry raw bytes:
+//
+//	{"request_id":"9f1c...","headers":{"Content-Type":"application/json","Content-Encoding":"gzip"},"body":"H4sIAAAA..."}
+//
+// The compressed body is what gets cached, and sent to replicas (see
+// replica.go), and callers that accept gzip get it as is, never compressed a
+// second time. For other callers it is decompressed on the way out, and
+// /query-batch results, which are JSON, always carry it decompressed;
+// response schemas are checked against the decompressed body too. Streamed
+// replies can't be sent pre-compressed.
+
+var (
+	errBadEncodedBody = errors.New("client sent a gzip reply whose body isn't base64")
+	errEncodedStream  = errors.New("client sent a streamed reply as gzip")
+	errBadGzip        = errors.New("client sent a gzip reply that doesn't decompress")
+)
+
+// gzipped reports whether the client sent the reply gzip-compressed.
+func (r clientReply) gzipped() bool {
+	for name, value := range r.Headers {
+		if strings.EqualFold(name, "Content-Encoding") {
+			return strings.EqualFold(strings.TrimSpace(value), "gzip")
+		}
+	}
+	return false
+}
+
+// decodeGzipBody turns the base64 body of a gzip reply, as it arrived, into
+// the compressed bytes.
+func (r clientReply) decodeGzipBody() (clientReply, error) {
+	body, err := base64.StdEncoding.DecodeString(string(r.Body))
+	if err != nil {
+		return clientReply{}, fmt.Errorf("%w: %v", errBadEncodedBody, err)
+	}
+	r.Body = body
+	return r, nil
+}
+
+// decompressed returns a gzip reply with its body decompressed and without
+// the headers describing the compressed one.
+func (r clientReply) decompressed() (clientReply, error) {
+	if !r.gzipped() {
+		return r, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(r.Body))
+	if err != nil {
+		return clientReply{}, fmt.Errorf("%w: %v", errBadGzip, err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		return clientReply{}, fmt.Errorf("%w: %v", errBadGzip, err)
+	}
+
+	headers := make(map[string]string, len(r.Headers))
+	for name, value := range r.Headers {
+		if !strings.EqualFold(name, "Content-Encoding") && !strings.EqualFold(name, "Content-Length") {
+			headers[name] = value
+		}
+	}
+	r.Body = body
+	r.Headers = headers
+	return r, nil
+}
+
+// negotiateEncoding decompresses a gzip reply for a caller that doesn't
+// accept gzip. It reports false, having answered 502, if the body doesn't
+// decompress.
+func negotiateEncoding(w http.ResponseWriter, r *http.Request, reply *clientReply) bool {
+	if !reply.gzipped() {
+		return true
+	}
+	if acceptsGzip(r) {
+		if !varies(w.Header(), "Accept-Encoding") {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		return true
+	}
+	decoded, err := reply.decompressed()
+	if err != nil {
+		log.Printf("Reply for %s: %v", r.URL.Path, err)
+		http.Error(w, errBadGzip.Error(), http.StatusBadGateway)
+		return false
+	}
+	*reply = decoded
+	return true
+}
+
+func varies(h http.Header, name string) bool {
+	for _, value := range h.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
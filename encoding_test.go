@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(data))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// queryGzipped queries db-1, which client answers with body gzip-compressed
+// by the client itself, and returns the compressed bytes.
+func queryGzipped(t *testing.T, ts string, client *testClient, body string) []byte {
+	t.Helper()
+	compressed := gzipBytes(t, body)
+	result := goGet(ts+"/query/db-1", http.Header{"Accept-Encoding": {"gzip"}})
+	query := client.readQuery()
+	client.reply(replyMessage{
+		RequestID: query.RequestID,
+		Headers:   map[string]string{"Content-Type": "application/json", "Content-Encoding": "gzip"},
+		Body:      base64.StdEncoding.EncodeToString(compressed),
+	})
+	r := <-result
+	if r.status != http.StatusOK || r.header.Get("Content-Encoding") != "gzip" || r.body != string(compressed) {
+		t.Fatalf("query got %d %v %x, want the compressed body as sent", r.status, r.header, r.body)
+	}
+	return compressed
+}
+
+func TestPrecompressedReplyIsServedAsSentOrDecompressed(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	compressed := queryGzipped(t, ts.URL, client, `{"rows":[1,2,3]}`)
+	// From here on only the cache can answer.
+	client.conn.Close()
+	waitFor(t, "the client to disconnect", func() bool { return s.connectionCount("db-1") == 0 })
+
+	resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, http.Header{"Accept-Encoding": {"gzip"}})
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, compressed) {
+		t.Errorf("cache hit for a gzip caller got %s %x, want the stored compressed body", resp.Status, body)
+	}
+	resp, body = do(t, "GET", ts.URL+"/query/db-1", nil, http.Header{"Accept-Encoding": {"identity"}})
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != `{"rows":[1,2,3]}` {
+		t.Errorf("caller without gzip got %v %q, want the body decompressed", resp.Header, body)
+	}
+}
+
+func TestPrecompressedReplyRoundTripsToAReplica(t *testing.T) {
+	primary, primaryTS := newTestServer(t)
+	replica, replicaTS := newTestReplica(t, primary, primaryTS.URL)
+	client := connectClient(t, primary, primaryTS, "db-1")
+	compressed := queryGzipped(t, primaryTS.URL, client, `{"rows":[1,2,3]}`)
+
+	waitFor(t, "the replica to cache the reply", func() bool {
+		_, ok := replica.cached("db-1")
+		return ok
+	})
+	resp, body := do(t, "GET", replicaTS.URL+"/query-cached/db-1", nil, http.Header{"Accept-Encoding": {"gzip"}})
+	if resp.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal(body, compressed) {
+		t.Errorf("replica served %v %x to a gzip caller, want the primary's compressed body", resp.Header, body)
+	}
+	resp, body = do(t, "GET", replicaTS.URL+"/query-cached/db-1", nil, http.Header{"Accept-Encoding": {"identity"}})
+	if resp.StatusCode != http.StatusOK || string(body) != `{"rows":[1,2,3]}` {
+		t.Errorf("replica served %s %q to a caller without gzip, want the body decompressed", resp.Status, body)
+	}
+}
+
+func TestUndecodableGzipReplyIsABadGateway(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	result := goGet(ts.URL+"/query/db-1", nil)
+	query := client.readQuery()
+	client.reply(replyMessage{RequestID: query.RequestID, Headers: map[string]string{"Content-Encoding": "gzip"}, Body: "not base64!"})
+	if r := <-result; r.status != http.StatusBadGateway {
+		t.Errorf("got %d %q, want 502", r.status, r.body)
+	}
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventBufferSize is how many events a subscriber may fall behind by before
+// it is dropped.
+const eventBufferSize = 64
+
+type Event struct {
+	Type     string    `json:"type"`
+	ClientID string    `json:"client_id"`
+	Time     time.Time `json:"time"`
+	Cache    string    `json:"cache,omitempty"`
+	// CacheReason lists the cacheDecisions behind Cache, comma-separated.
+	CacheReason string `json:"cache_reason,omitempty"`
+	Duration    string `json:"duration,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// eventBus fans events out to subscribers. Publishing never blocks: a
+// subscriber whose buffer is full is dropped and its channel closed, so one
+// stalled dashboard can't hold up the handlers that publish.
+type eventBus struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[chan Event]struct{})}
+}
+
+func (b *eventBus) subscribe() chan Event {
+	ch := make(chan Event, eventBufferSize)
+	b.mutex.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mutex.Unlock()
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (b *eventBus) publish(event Event) {
+	event.Time = time.Now()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+			log.Printf("Dropped slow event subscriber")
+		}
+	}
+}
+
+// recordQuery publishes a query event, counts the query in the metrics and
+// logs it. With -query-log-sample set to N, one in N successful queries is
+// logged, and every failed one or one slower than -slow-query; zero logs
+// none. The decisions, if the query went through the cache, say why it hit or
+// missed and why its reply was or wasn't stored.
+func (s *Server) recordQuery(clientID, cache string, start time.Time, err error, decisions ...cacheDecision) {
+	took := time.Since(start)
+	reason := joinCacheDecisions(decisions)
+	s.logQuery(clientID, cache, reason, took, err)
+	s.hookQuery(QueryInfo{ClientID: clientID, Cache: cache, CacheReason: reason, Duration: took, Err: err})
+
+	outcome := cache
+	if outcome == "" {
+		outcome = "none"
+	}
+	s.incCounter("proxy_queries_total", s.withLabels(clientID, "cache", outcome)...)
+
+	event := Event{
+		Type:        "query",
+		ClientID:    clientID,
+		Cache:       cache,
+		CacheReason: reason,
+		Duration:    took.String(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	s.events.publish(event)
+}
+
+func (s *Server) logQuery(clientID, cache, reason string, took time.Duration, err error) {
+	cfg := s.currentConfig()
+	if cfg.QueryLogSample <= 0 {
+		return
+	}
+	if cache == "" {
+		cache = "none"
+	}
+	if reason != "" {
+		cache += ": " + reason
+	}
+	switch {
+	case err != nil:
+		log.Printf("Query for client %s failed after %s (cache %s): %v", clientID, took, cache, err)
+	case cfg.SlowQuery > 0 && took >= cfg.SlowQuery:
+		log.Printf("Slow query for client %s took %s (cache %s)", clientID, took, cache)
+	case s.queriesSeen.Add(1)%uint64(cfg.QueryLogSample) == 0:
+		log.Printf("Query for client %s took %s (cache %s)", clientID, took, cache)
+	}
+}
+
+// handleEvents streams connection, disconnection and query events as
+// server-sent events until the caller goes away or falls too far behind.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	clearWriteDeadline(w)
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvents subscribes to url's /events and returns the events as they
+// arrive.
+func readEvents(t *testing.T, s *Server, url string) <-chan Event {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url+"/events", nil)
+	req.Header = adminHeader()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /events got %s %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	waitFor(t, "the event subscription", func() bool {
+		s.events.mutex.Lock()
+		defer s.events.mutex.Unlock()
+		return len(s.events.subscribers) > 0
+	})
+
+	events := make(chan Event, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			var event Event
+			if ok && json.Unmarshal([]byte(data), &event) == nil {
+				events <- event
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+		return Event{}
+	}
+}
+
+func TestEventStreamReportsConnectionsAndQueries(t *testing.T) {
+	s, ts := newTestServer(t)
+	events := readEvents(t, s, ts.URL)
+
+	client := connectClient(t, s, ts, "db-1")
+	if event := nextEvent(t, events); event.Type != "connect" || event.ClientID != "db-1" {
+		t.Errorf("got %+v, want db-1's connect", event)
+	}
+	client.echo("x")
+	do(t, "GET", ts.URL+"/query/db-1", nil, nil)
+	if event := nextEvent(t, events); event.Type != "query" || event.ClientID != "db-1" || event.Cache != "miss" {
+		t.Errorf("got %+v, want a query that missed the cache", event)
+	}
+	client.conn.Close()
+	if event := nextEvent(t, events); event.Type != "disconnect" {
+		t.Errorf("got %+v, want db-1's disconnect", event)
+	}
+}
+
+func TestSlowEventSubscriberIsDropped(t *testing.T) {
+	bus := newEventBus()
+	ch := bus.subscribe()
+	for i := 0; i <= eventBufferSize; i++ {
+		bus.publish(Event{Type: "query"})
+	}
+	for range ch {
+	}
+	if len(bus.subscribers) != 0 {
+		t.Error("the subscriber that fell behind is still subscribed")
+	}
+}
+
+func TestEventStreamNeedsAdmin(t *testing.T) {
+	_, ts := newTestServer(t)
+	if resp, _ := do(t, "GET", ts.URL+"/events", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /events without credentials got %s, want 401", resp.Status)
+	}
+}
+
+// captureLog collects what is logged until the test ends.
+func captureLog(t *testing.T) func() string {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return func() string {
+		log.SetOutput(os.Stderr)
+		return buf.String()
+	}
+}
+
+func TestQueryLogSampling(t *testing.T) {
+	s, _ := newTestServer(t, "-query-log-sample", "10", "-slow-query", "1s")
+	logged := captureLog(t)
+	for i := 0; i < 100; i++ {
+		s.logQuery("db-1", "miss", "", time.Millisecond, nil)
+	}
+	s.logQuery("db-1", "miss", "", time.Millisecond, errClientNotConnected)
+	s.logQuery("db-1", "miss", "", 2*time.Second, nil)
+	if err := s.Reload(loadConfig(t, "-query-log-sample", "1")); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		s.logQuery("db-2", "miss", "", time.Millisecond, nil)
+	}
+
+	out := logged()
+	for line, want := range map[string]int{
+		"Query for client db-1 took":      10,
+		"Query for client db-1 failed":    1,
+		"Slow query for client db-1 took": 1,
+		"Query for client db-2 took":      5,
+	} {
+		if n := strings.Count(out, line); n != want {
+			t.Errorf("logged %q %d times, want %d", line, n, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// fallbackResponse is a static reply served for a client ID when no
+// connection can answer and nothing usable is cached. The -fallbacks file
+// maps client IDs to these:
+//
+//	{"weather": {"status": 200, "headers": {"Content-Type": "application/json"}, "body": "{\"stale\":true}"}}
+//
+// Fallbacks stand in for an unavailable client only. Replies the client did
+// send, including its own errors, are passed on unchanged, and invalid
+// requests still fail.
+type fallbackResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+func loadFallbacks(path string) (map[string]fallbackResponse, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fallbacks map[string]fallbackResponse
+	if err := json.Unmarshal(data, &fallbacks); err != nil {
+		return nil, err
+	}
+	for clientID, fallback := range fallbacks {
+		if fallback.Status == 0 {
+			fallback.Status = http.StatusOK
+			fallbacks[clientID] = fallback
+		}
+		if fallback.Status < 100 || fallback.Status > 599 {
+			return nil, fmt.Errorf("fallback for %s: invalid status %d", clientID, fallback.Status)
+		}
+	}
+	return fallbacks, nil
+}
+
+// clientUnavailable reports whether err means no connection could answer,
+// as opposed to the request or the client's reply being at fault.
+func clientUnavailable(err error) bool {
+	return errors.Is(err, errClientNotConnected) ||
+		errors.Is(err, errClientBusy) ||
+		errors.Is(err, errClientDraining) ||
+		errors.Is(err, errClientTooSlow) ||
+		errors.Is(err, errQueryTimeout) ||
+		errors.Is(err, errClientDisconnected)
+}
+
+// writeFallback serves clientID's fallback if err calls for one and one is
+// configured, reporting whether it did.
+func (s *Server) writeFallback(w http.ResponseWriter, clientID string, err error) bool {
+	if !clientUnavailable(err) {
+		return false
+	}
+	fallback, ok := s.currentConfig().fallbacks[clientID]
+	if !ok {
+		return false
+	}
+
+	for name, value := range fallback.Headers {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("X-Proxy-Fallback", "true")
+	w.WriteHeader(fallback.Status)
+	w.Write([]byte(fallback.Body))
+	return true
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFallbacks writes a -fallbacks file of contents and returns its path.
+func writeFallbacks(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fallbacks.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFallbackServedWhileClientIsAway(t *testing.T) {
+	fallbacks := writeFallbacks(t, `{"weather": {"headers": {"Content-Type": "application/json"}, "body": "{\"stale\":true}"}}`)
+	_, ts := newTestServer(t, "-fallbacks", fallbacks)
+
+	resp, body := do(t, "GET", ts.URL+"/query/weather", nil, nil)
+	if resp.StatusCode != http.StatusOK || string(body) != `{"stale":true}` {
+		t.Fatalf("got %s: %s, want the fallback", resp.Status, body)
+	}
+	if resp.Header.Get("X-Proxy-Fallback") != "true" || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("fallback headers %v", resp.Header)
+	}
+
+	if resp, _ := do(t, "GET", ts.URL+"/query/news", nil, nil); resp.Header.Get("X-Proxy-Fallback") != "" {
+		t.Errorf("client without a fallback got one: %s", resp.Status)
+	}
+}
+
+func TestFallbackNotServedForClientReplies(t *testing.T) {
+	fallbacks := writeFallbacks(t, `{"weather": {"body": "fallback"}}`)
+	s, ts := newTestServer(t, "-fallbacks", fallbacks)
+	connectClient(t, s, ts, "weather").serve(func(queryMessage) replyMessage {
+		return replyMessage{Status: http.StatusNotFound, Body: "no such city"}
+	})
+
+	resp, body := do(t, "GET", ts.URL+"/query/weather", nil, nil)
+	if resp.StatusCode != http.StatusNotFound || string(body) != "no such city" || resp.Header.Get("X-Proxy-Fallback") != "" {
+		t.Errorf("got %s: %s, want the client's own reply", resp.Status, body)
+	}
+}
+
+func TestLoadFallbacks(t *testing.T) {
+	fallbacks, err := loadFallbacks(writeFallbacks(t, `{"weather": {"body": "x"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fallbacks["weather"].Status != http.StatusOK {
+		t.Errorf("status defaulted to %d, want 200", fallbacks["weather"].Status)
+	}
+	for _, contents := range []string{`{"weather": {"status": 42}}`, `[not json`} {
+		if _, err := loadFallbacks(writeFallbacks(t, contents)); err == nil {
+			t.Errorf("loadFallbacks accepted %s", contents)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"log"
+	"math/bits"
+	"strconv"
+	"sync"
+)
+
+// A backend that answers the same query differently from one reply to the
+// next is either serving fast-changing data or is nondeterministic, which
+// is worth knowing about. With -flap-threshold, the proxy hashes each live
+// reply's status and body and remembers, per cache key, whether each of the
+// last flapWindow replies differed from the one before it. When the share
+// that did goes above the threshold, say 0.5, the key is flapping: that is
+// logged and counted in proxy_flapping_responses_total, once until it
+// settles below the threshold again. Nothing about the reply changes.
+// Streamed replies aren't hashed. At most maxFlapKeys keys are tracked;
+// past that, tracking starts over.
+
+const (
+	flapWindow  = 16
+	maxFlapKeys = 10000
+)
+
+// flapState is what is remembered of one key's replies.
+type flapState struct {
+	hash uint64
+	// changes has a bit set for each of the last seen comparisons that
+	// differed, the newest lowest.
+	changes  uint16
+	seen     int
+	flapping bool
+}
+
+type flapTracker struct {
+	mutex sync.Mutex
+	keys  map[string]*flapState
+}
+
+func newFlapTracker() *flapTracker {
+	return &flapTracker{keys: make(map[string]*flapState)}
+}
+
+// record folds a reply hashing to hash into key's state and returns how
+// many of the window's comparisons differed, and whether the key just
+// started or stopped flapping at threshold.
+func (t *flapTracker) record(key string, hash uint64, threshold float64) (changed int, started, stopped bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	state, ok := t.keys[key]
+	if !ok {
+		if len(t.keys) >= maxFlapKeys {
+			t.keys = make(map[string]*flapState)
+		}
+		t.keys[key] = &flapState{hash: hash}
+		return 0, false, false
+	}
+
+	state.changes <<= 1
+	if hash != state.hash {
+		state.changes |= 1
+	}
+	state.hash = hash
+	state.seen = min(state.seen+1, flapWindow)
+
+	changed = bits.OnesCount16(state.changes)
+	flapping := state.seen == flapWindow && float64(changed)/flapWindow > threshold
+	started = flapping && !state.flapping
+	stopped = !flapping && state.flapping
+	state.flapping = flapping
+	return changed, started, stopped
+}
+
+func replyHash(reply clientReply) uint64 {
+	h := fnv.New64a()
+	h.Write(strconv.AppendInt(nil, int64(reply.statusCode()), 10))
+	h.Write([]byte{0})
+	h.Write(reply.Body)
+	return h.Sum64()
+}
+
+// trackFlapping notes a live reply for key if -flap-threshold is set.
+func (s *Server) trackFlapping(key string, reply clientReply) {
+	threshold := s.currentConfig().FlapThreshold
+	if threshold <= 0 || reply.stream != nil {
+		return
+	}
+	changed, started, stopped := s.flaps.record(key, replyHash(reply), threshold)
+	_, clientID := splitCacheKey(key)
+	switch {
+	case started:
+		log.Printf("Replies for %s are flapping: %d of the last %d differed from the one before", key, changed, flapWindow)
+		s.incCounter("proxy_flapping_responses_total", s.withLabels(clientID)...)
+	case stopped:
+		log.Printf("Replies for %s are no longer flapping", key)
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFlapTrackerReportsOnceUntilSettled(t *testing.T) {
+	tracker := newFlapTracker()
+	var starts int
+	for i := 0; i <= flapWindow; i++ {
+		_, started, _ := tracker.record("k", uint64(i%2), 0.5)
+		if started {
+			starts++
+			if i != flapWindow {
+				t.Errorf("flapping started after %d replies, want a full window", i+1)
+			}
+		}
+	}
+	if _, started, _ := tracker.record("k", 0, 0.5); started || starts != 1 {
+		t.Errorf("flapping started %d times, want once while it lasts", starts+1)
+	}
+
+	// Once no more than half of the window changed, the key has settled.
+	for i := 1; ; i++ {
+		changed, started, stopped := tracker.record("k", 0, 0.5)
+		if started {
+			t.Fatal("flapping started again while settling")
+		}
+		if stopped {
+			if changed != flapWindow/2 {
+				t.Errorf("stopped flapping with %d of %d changed", changed, flapWindow)
+			}
+			break
+		}
+		if i > flapWindow {
+			t.Fatal("never stopped flapping")
+		}
+	}
+}
+
+func TestSteadyRepliesDoNotFlap(t *testing.T) {
+	tracker := newFlapTracker()
+	for i := 0; i < 2*flapWindow; i++ {
+		if changed, started, _ := tracker.record("k", 42, 0); started || changed != 0 {
+			t.Fatalf("identical replies make %d changes, started %v", changed, started)
+		}
+	}
+}
+
+func TestReplyHashCoversStatusAndBody(t *testing.T) {
+	ok := replyHash(clientReply{Body: []byte("x")})
+	if ok != replyHash(clientReply{Status: http.StatusOK, Body: []byte("x")}) {
+		t.Error("a zero status hashes differently from 200")
+	}
+	if ok == replyHash(clientReply{Status: http.StatusNotFound, Body: []byte("x")}) || ok == replyHash(clientReply{Body: []byte("y")}) {
+		t.Error("differing replies hash alike")
+	}
+}
+
+func TestFlappingRepliesAreCounted(t *testing.T) {
+	s, ts := newTestServer(t, "-flap-threshold", "0.5", "-cache=false")
+	var n atomic.Int64
+	connectClient(t, s, ts, "clock").serve(func(queryMessage) replyMessage {
+		return replyMessage{Body: strconv.FormatInt(n.Add(1), 10)}
+	})
+
+	for i := 0; i < flapWindow+5; i++ {
+		do(t, "GET", ts.URL+"/query/clock", nil, nil)
+	}
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	if got := s.metrics.counters["proxy_flapping_responses_total"]; got != 1 {
+		t.Errorf("proxy_flapping_responses_total = %v, want 1", got)
+	}
+}
+
+func TestFlapThresholdValidation(t *testing.T) {
+	for _, threshold := range []string{"-0.1", "1"} {
+		if _, err := LoadConfig([]string{"-flap-threshold", threshold}); err == nil {
+			t.Errorf("-flap-threshold %s accepted", threshold)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipResponses compresses responses for callers that accept gzip once the
+// body reaches -gzip-min-size. Bodies are buffered up to that size to make
+// the decision, so small replies go out untouched; those that won't be
+// compressed anyway go out as they are written. Cache hits may come with
+// the body already compressed; see gzipcache.go.
+func (s *Server) gzipResponses(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.currentConfig()
+		if !cfg.GzipResponses {
+			next(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, cfg: cfg, status: http.StatusOK}
+		defer gw.Close()
+		next(gw, r)
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header lists gzip without
+// a q=0 weight.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	// cfg is the configuration the response started under.
+	cfg    *Config
+	status int
+	buf    bytes.Buffer
+	gz     *gzip.Writer
+	// started is set once headers have gone out, compressed or not.
+	started bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.started {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	if w.started {
+		return w.ResponseWriter.Write(p)
+	}
+
+	// The status and headers are settled by the first write, so a response
+	// that won't be compressed streams through rather than being held back
+	// until Close.
+	if !w.compressible() {
+		w.startIdentity()
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf.Write(p)
+	if w.buf.Len() >= w.cfg.GzipMinSize {
+		if err := w.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// compressible excludes responses that shouldn't be re-encoded: errors,
+// bodies the handler already encoded itself and types that don't compress.
+func (w *gzipResponseWriter) compressible() bool {
+	return w.status == http.StatusOK && w.Header().Get("Content-Encoding") == "" &&
+		gzipContentType(w.cfg.gzipTypes, w.Header().Get("Content-Type"))
+}
+
+// gzipContentType reports whether a reply of this Content-Type, normally the
+// one the client put on its reply, is worth compressing. Already compressed
+// formats such as images, archives and video gain nothing, so only types in
+// types, parsed from -gzip-types, are: an exact type, "text/*" for a whole
+// family or "application/*+json" for a structured suffix. A reply without a
+// Content-Type is compressed, as before the type was checked.
+func gzipContentType(types map[string]bool, contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	family, subtype, _ := strings.Cut(mediaType, "/")
+
+	if types[mediaType] || types[family+"/*"] {
+		return true
+	}
+	if i := strings.LastIndex(subtype, "+"); i >= 0 {
+		return types[family+"/*"+subtype[i:]]
+	}
+	return false
+}
+
+func (w *gzipResponseWriter) startGzip() error {
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	// A compressed body is a different representation, so it can't share a
+	// strong ETag with the identity response.
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	w.started = true
+	w.ResponseWriter.WriteHeader(w.status)
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	_, err := w.gz.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+// startIdentity sends the buffered body uncompressed.
+func (w *gzipResponseWriter) startIdentity() {
+	w.started = true
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.buf.Bytes())
+	w.buf.Reset()
+}
+
+// Flush commits to whatever has been decided so far: a body still under the
+// threshold goes out uncompressed.
+func (w *gzipResponseWriter) Flush() {
+	if !w.started {
+		w.startIdentity()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipResponseWriter) Close() {
+	if w.gz != nil {
+		w.gz.Close()
+		return
+	}
+	if !w.started {
+		w.startIdentity()
+	}
+}
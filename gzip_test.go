@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gunzip(t *testing.T, data []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("response isn't gzip: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompressing response: %v", err)
+	}
+	return string(body)
+}
+
+func TestLargeRepliesAreGzipped(t *testing.T) {
+	s, ts := newTestServer(t, "-gzip-min-size", "100")
+	large := strings.Repeat("row,", 100)
+	connectClient(t, s, ts, "db-1").serve(func(query queryMessage) replyMessage {
+		if len(query.Params["small"]) > 0 {
+			return replyMessage{Body: "tiny"}
+		}
+		return replyMessage{Body: large}
+	})
+	accept := http.Header{"Accept-Encoding": {"gzip"}}
+
+	resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, accept)
+	if resp.Header.Get("Content-Encoding") != "gzip" || gunzip(t, body) != large {
+		t.Errorf("large reply came with Content-Encoding %q, want it gzipped", resp.Header.Get("Content-Encoding"))
+	}
+	if !varies(resp.Header, "Accept-Encoding") {
+		t.Error("the response doesn't vary on Accept-Encoding")
+	}
+
+	resp, body = do(t, "GET", ts.URL+"/query/db-1?small=1", nil, accept)
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != "tiny" {
+		t.Errorf("small reply came as %q with Content-Encoding %q, want it as is", body, resp.Header.Get("Content-Encoding"))
+	}
+
+	resp, body = do(t, "GET", ts.URL+"/query/db-1?q=identity", nil, http.Header{"Accept-Encoding": {"identity"}})
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != large {
+		t.Errorf("reply to a caller not accepting gzip came with Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"br, GZIP;q=0.5":    true,
+		"gzip;q=0":          false,
+		"deflate, identity": false,
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", header)
+		if got := acceptsGzip(r); got != want {
+			t.Errorf("acceptsGzip(%q) = %t, want %t", header, got, want)
+		}
+	}
+}
+
+func TestGzipContentType(t *testing.T) {
+	types := splitList("text/*,application/json,application/*+json")
+	for contentType, want := range map[string]bool{
+		"":                                true,
+		"text/plain":                      true,
+		"Text/HTML; charset=utf-8":        true,
+		"application/json":                true,
+		"application/vnd.api+json":        true,
+		"application/xml":                 false,
+		"image/png":                       false,
+		"application/gzip":                false,
+		"application/vnd.api+json; q=0.9": true,
+	} {
+		if got := gzipContentType(types, contentType); got != want {
+			t.Errorf("gzipContentType(%q) = %t, want %t", contentType, got, want)
+		}
+	}
+}
+
+func TestOnlyCompressibleRepliesAreGzipped(t *testing.T) {
+	s, ts := newTestServer(t, "-gzip-min-size", "10")
+	connectClient(t, s, ts, "db-1").serve(func(query queryMessage) replyMessage {
+		return replyMessage{Body: strings.Repeat("x", 100), Headers: map[string]string{"Content-Type": query.Params["type"][0]}}
+	})
+	for contentType, want := range map[string]string{"application/json": "gzip", "image/png": ""} {
+		resp, _ := do(t, "GET", ts.URL+"/query/db-1?type="+contentType, nil, http.Header{"Accept-Encoding": {"gzip"}})
+		if got := resp.Header.Get("Content-Encoding"); got != want {
+			t.Errorf("%s reply came with Content-Encoding %q, want %q", contentType, got, want)
+		}
+	}
+}
+
+func TestUncompressibleRepliesAreNotBuffered(t *testing.T) {
+	s, _ := newTestServer(t, "-gzip-min-size", "100")
+	chunk := strings.Repeat("x", 1000)
+	for name, start := range map[string]func(w http.ResponseWriter){
+		"image/png": func(w http.ResponseWriter) { w.Header().Set("Content-Type", "image/png") },
+		"502":       func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) },
+		"encoded":   func(w http.ResponseWriter) { w.Header().Set("Content-Encoding", "br") },
+	} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/query/db-1", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		s.gzipResponses(func(w http.ResponseWriter, r *http.Request) {
+			start(w)
+			for i := 1; i <= 3; i++ {
+				w.Write([]byte(chunk))
+				if got := rec.Body.Len(); got != i*len(chunk) {
+					t.Errorf("%s: after %d writes the caller has %d bytes, want %d", name, i, got, i*len(chunk))
+				}
+			}
+		})(rec, r)
+		if rec.Header().Get("Content-Encoding") == "gzip" {
+			t.Errorf("%s: response was gzipped", name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// Compressing the same cached reply for every caller that accepts gzip
+// wastes CPU on the hottest entries. With -gzip on, a successful reply large
+// and compressible enough for gzipResponses to compress is compressed once
+// as it is stored, and the cache keeps the compressed bytes next to the
+// uncompressed ones, counting both against -max-cache-bytes. Cache hits for
+// callers that accept gzip are then served the stored bytes as they are,
+// through the same path as a reply the client sent pre-compressed (see
+// encoding.go), and counted in proxy_cache_precompressed_hits_total; other
+// callers and /query-batch get the uncompressed body. Replicas compress the
+// entries they are fed themselves per response.
+
+// precompress returns entry's body gzip-compressed if callers accepting
+// gzip would get it compressed, or "" if not.
+func (s *Server) precompress(entry ClientResponse) string {
+	cfg := s.currentConfig()
+	if !cfg.GzipResponses || entry.Status != 0 || len(entry.Data) < cfg.GzipMinSize {
+		return ""
+	}
+	var contentType string
+	for name, value := range entry.Headers {
+		switch {
+		case strings.EqualFold(name, "Content-Encoding"):
+			return ""
+		case strings.EqualFold(name, "Content-Type"):
+			contentType = value
+		}
+	}
+	if !gzipContentType(cfg.gzipTypes, contentType) {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(entry.Data))
+	if zw.Close() != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// cachedReply is the reply to r from cached: the compressed variant for a
+// caller that accepts gzip, if there is one, else the stored reply.
+func (s *Server) cachedReply(r *http.Request, cached ClientResponse) clientReply {
+	if cached.gzipData == "" || !s.currentConfig().GzipResponses || !acceptsGzip(r) {
+		return cached.reply()
+	}
+
+	headers := make(map[string]string, len(cached.Headers)+1)
+	for name, value := range cached.Headers {
+		switch {
+		case strings.EqualFold(name, "Content-Length"):
+			continue
+		// As in startGzip, the compressed body can't share a strong ETag.
+		case strings.EqualFold(name, "ETag") && !strings.HasPrefix(value, "W/"):
+			value = "W/" + value
+		}
+		headers[name] = value
+	}
+	headers["Content-Encoding"] = "gzip"
+	s.incCounter("proxy_cache_precompressed_hits_total")
+
+	reply := cached.reply()
+	reply.Body = []byte(cached.gzipData)
+	reply.Headers = headers
+	return reply
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCacheHitsServeThePrecompressedCopy(t *testing.T) {
+	s, ts := newTestServer(t, "-gzip-min-size", "100")
+	large := strings.Repeat(`{"row":1},`, 50)
+	connectClient(t, s, ts, "db-1").serve(func(queryMessage) replyMessage {
+		return replyMessage{Body: large, Headers: map[string]string{"Content-Type": "application/json", "ETag": `"v1"`}}
+	})
+	accept := http.Header{"Accept-Encoding": {"gzip"}}
+
+	do(t, "GET", ts.URL+"/query/db-1", nil, accept)
+	if cached, ok := s.cached(s.cacheKey("db-1", "")); !ok || cached.gzipData == "" || gunzip(t, []byte(cached.gzipData)) != large {
+		t.Fatal("the reply was cached without its compressed copy")
+	}
+
+	resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, accept)
+	if resp.Header.Get("Content-Encoding") != "gzip" || gunzip(t, body) != large {
+		t.Errorf("cache hit came with Content-Encoding %q, want the compressed copy", resp.Header.Get("Content-Encoding"))
+	}
+	if etag := resp.Header.Get("ETag"); etag != `W/"v1"` {
+		t.Errorf("compressed hit has ETag %s, want it weakened", etag)
+	}
+
+	resp, body = do(t, "GET", ts.URL+"/query/db-1", nil, http.Header{"Accept-Encoding": {"identity"}})
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != large || resp.Header.Get("ETag") != `"v1"` {
+		t.Errorf("hit for a caller not accepting gzip came with Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	if n := s.metrics.counters["proxy_cache_precompressed_hits_total"]; n != 1 {
+		t.Errorf("proxy_cache_precompressed_hits_total = %v, want 1", n)
+	}
+}
+
+func TestOnlyGzippableEntriesArePrecompressed(t *testing.T) {
+	s, _ := newTestServer(t, "-gzip-min-size", "100")
+	large := strings.Repeat("row,", 100)
+	json := map[string]string{"Content-Type": "application/json"}
+	if s.precompress(ClientResponse{Data: large, Headers: json}) == "" {
+		t.Fatal("large JSON entry wasn't precompressed")
+	}
+	for name, entry := range map[string]ClientResponse{
+		"small":          {Data: "tiny", Headers: json},
+		"error":          {Data: large, Headers: json, Status: http.StatusInternalServerError},
+		"pre-encoded":    {Data: large, Headers: map[string]string{"Content-Type": "application/json", "content-encoding": "br"}},
+		"not compressed": {Data: large, Headers: map[string]string{"Content-Type": "image/png"}},
+	} {
+		if s.precompress(entry) != "" {
+			t.Errorf("%s entry was precompressed", name)
+		}
+	}
+
+	off, _ := newTestServer(t, "-gzip=false", "-gzip-min-size", "100")
+	if off.precompress(ClientResponse{Data: large, Headers: json}) != "" {
+		t.Error("entry precompressed with -gzip off")
+	}
+}
+
+func TestPrecompressedCopyCountsAgainstTheCacheSize(t *testing.T) {
+	entry := ClientResponse{Data: "body"}
+	plain := cacheEntrySize("k", entry)
+	entry.gzipData = "compressed"
+	if got := cacheEntrySize("k", entry); got != plain+len("compressed") {
+		t.Errorf("entry with a compressed copy sized %d, want %d", got, plain+len("compressed"))
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// With -handshake-timeout, a connection is not sent queries until it has
+// said what it can do. Its first message after /connect must be
+//
+//	{"type":"capabilities","version":"2.3.0","commands":["restart","status"],
+//	 "max_concurrency":8,"compression":["gzip"]}
+//
+// version is required; the rest may be left out. max_concurrency replaces
+// the registration's max_in_flight for the connection, within
+// -max-declared-in-flight, and commands, if given, lists the command types
+// the client accepts on /command (see commandtimeout.go); others get 400
+// without being sent. A first message that isn't a valid capabilities
+// message, or none within the timeout, closes the connection. Until then
+// the connection is left out of routing, and a query for a client ID whose
+// connections are all still handshaking gets 503. The capabilities are shown
+// per connection in /clients.
+
+type clientCapabilities struct {
+	Type           string   `json:"type"`
+	Version        string   `json:"version"`
+	Commands       []string `json:"commands,omitempty"`
+	MaxConcurrency int      `json:"max_concurrency,omitempty"`
+	Compression    []string `json:"compression,omitempty"`
+}
+
+var (
+	// errClientNotReady wraps errClientBusy so it is reported the same way.
+	errClientNotReady      = fmt.Errorf("%w: client has not completed its handshake", errClientBusy)
+	errUnsupportedCommand  = errors.New("client does not support this command type")
+	errInvalidCapabilities = errors.New("invalid capabilities message")
+)
+
+// parseCapabilities checks a connection's first message.
+func parseCapabilities(messageType int, message []byte) (*clientCapabilities, error) {
+	if messageType != websocket.TextMessage {
+		return nil, fmt.Errorf("%w: not a text message", errInvalidCapabilities)
+	}
+	var caps clientCapabilities
+	if err := json.Unmarshal(message, &caps); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidCapabilities, err)
+	}
+	switch {
+	case caps.Type != "capabilities":
+		return nil, fmt.Errorf("%w: type is %q, not capabilities", errInvalidCapabilities, caps.Type)
+	case caps.Version == "":
+		return nil, fmt.Errorf("%w: version is missing", errInvalidCapabilities)
+	case caps.MaxConcurrency < 0:
+		return nil, fmt.Errorf("%w: max_concurrency must not be negative", errInvalidCapabilities)
+	case slices.Contains(caps.Commands, ""):
+		return nil, fmt.Errorf("%w: empty command type", errInvalidCapabilities)
+	}
+	return &caps, nil
+}
+
+// awaitHandshake starts the connection's handshake timer, or marks it ready
+// at once if no handshake is required.
+func (s *Server) awaitHandshake(client *Client) {
+	timeout := s.currentConfig().HandshakeTimeout
+	if timeout <= 0 {
+		client.ready.Store(true)
+		return
+	}
+	timer := time.AfterFunc(timeout, func() {
+		if client.ready.Load() {
+			return
+		}
+		log.Printf("Client %s sent no capabilities within %s of connecting and was disconnected", client.ID, timeout)
+		client.closeHandshake("capabilities handshake timed out")
+	})
+	go func() {
+		<-client.done
+		timer.Stop()
+	}()
+}
+
+// acceptHandshake handles the first message of a connection that must
+// handshake, reporting whether the connection may go on.
+func (s *Server) acceptHandshake(client *Client, messageType int, message []byte) bool {
+	caps, err := parseCapabilities(messageType, message)
+	if err != nil {
+		log.Printf("Client %s failed its handshake and was disconnected: %v", client.ID, err)
+		client.closeHandshake(err.Error())
+		return false
+	}
+	caps.MaxConcurrency = clampMaxInFlight(s.currentConfig(), caps.MaxConcurrency)
+	client.capabilities.Store(caps)
+	client.ready.Store(true)
+	log.Printf("Client %s is ready (version %s, %d commands, max concurrency %d)", client.ID, caps.Version, len(caps.Commands), caps.MaxConcurrency)
+	return true
+}
+
+// closeHandshake ends a connection whose handshake failed, telling the
+// client why.
+func (c *Client) closeHandshake(reason string) {
+	c.server.closeConnection(c.Connection, c.ID, closeHandshake, reason, time.Second)
+}
+
+// readyConns returns the connections that have completed their handshake.
+func readyConns(conns []*Client) ([]*Client, error) {
+	var ready []*Client
+	for _, client := range conns {
+		if client.ready.Load() {
+			ready = append(ready, client)
+		}
+	}
+	if len(ready) == 0 {
+		return nil, errClientNotReady
+	}
+	return ready, nil
+}
+
+// supportsCommand reports whether the connection accepts commands of type
+// op; one that listed no commands accepts any.
+func (c *Client) supportsCommand(op string) bool {
+	caps := c.capabilities.Load()
+	return caps == nil || len(caps.Commands) == 0 || slices.Contains(caps.Commands, op)
+}
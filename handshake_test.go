@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestQueriesWaitForTheHandshake(t *testing.T) {
+	s, ts := newTestServer(t, "-handshake-timeout", "5s")
+	client := connectClient(t, s, ts, "db-1")
+
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1?q=early", nil, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("query before the handshake got %s: %s, want 503", resp.Status, body)
+	}
+
+	client.push(websocket.TextMessage, `{"type":"capabilities","version":"2.3.0","commands":["status"],"max_concurrency":4}`)
+	conn := s.firstConnection("db-1")
+	waitFor(t, "the connection to be ready", conn.ready.Load)
+	if caps := conn.capabilities.Load(); caps.Version != "2.3.0" || caps.MaxConcurrency != 4 {
+		t.Errorf("stored capabilities %+v", caps)
+	}
+
+	client.echo("answer")
+	if _, body := do(t, "GET", ts.URL+"/query/db-1?q=ready", nil, nil); string(body) != "answer" {
+		t.Errorf("query after the handshake got %q", body)
+	}
+	if resp, body := do(t, "POST", ts.URL+"/command/db-1", `{"op":"restart"}`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("command the client didn't list got %s: %s, want 400", resp.Status, body)
+	}
+}
+
+func TestInvalidHandshakeClosesTheConnection(t *testing.T) {
+	s, ts := newTestServer(t, "-handshake-timeout", "5s")
+	client := connectClient(t, s, ts, "db-1")
+	client.push(websocket.TextMessage, `{"type":"capabilities"}`)
+	client.expectClose(closeCodes[closeHandshake])
+}
+
+func TestSilentHandshakeTimesOut(t *testing.T) {
+	s, ts := newTestServer(t, "-handshake-timeout", "50ms")
+	connectClient(t, s, ts, "db-1").expectClose(closeCodes[closeHandshake])
+}
+
+func TestParseCapabilities(t *testing.T) {
+	if caps, err := parseCapabilities(websocket.TextMessage, []byte(`{"type":"capabilities","version":"1"}`)); err != nil || caps.Version != "1" {
+		t.Errorf("parseCapabilities = %+v, %v", caps, err)
+	}
+	for _, message := range []string{
+		`{"type":"hello","version":"1"}`,
+		`{"type":"capabilities"}`,
+		`{"type":"capabilities","version":"1","max_concurrency":-1}`,
+		`{"type":"capabilities","version":"1","commands":[""]}`,
+		`not json`,
+	} {
+		if _, err := parseCapabilities(websocket.TextMessage, []byte(message)); err == nil {
+			t.Errorf("parseCapabilities accepted %s", message)
+		}
+	}
+	if _, err := parseCapabilities(websocket.BinaryMessage, []byte(`{"type":"capabilities","version":"1"}`)); err == nil {
+		t.Error("parseCapabilities accepted a binary message")
+	}
+}
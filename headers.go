@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Static headers can be added to every /query, /command, /query-batch and
+// /query-cached response, whatever the client replied. The -response-headers
+// file lists them in two groups:
+//
+//	{"set":     {"X-Served-By": "proxy-1", "Strict-Transport-Security": "max-age=31536000"},
+//	 "default": {"Cache-Control": "no-store"}}
+//
+// "set" headers always win, replacing any header of the same name the client
+// sent in its reply. "default" headers only fill in for headers the response
+// doesn't otherwise carry, from the client or the proxy, such as the
+// Content-Type given to binary replies. Error responses from the proxy itself
+// get both. Headers that describe the body's framing or the connection can't
+// be injected.
+
+type responseHeaders struct {
+	Set     map[string]string `json:"set"`
+	Default map[string]string `json:"default"`
+}
+
+// uninjectableHeaders would corrupt the response if they didn't match what
+// is actually sent.
+var uninjectableHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+func loadResponseHeaders(path string) (*responseHeaders, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var headers responseHeaders
+	if err := json.Unmarshal(data, &headers); err != nil {
+		return nil, err
+	}
+	if headers.Set, err = canonicalHeaders(headers.Set); err != nil {
+		return nil, err
+	}
+	if headers.Default, err = canonicalHeaders(headers.Default); err != nil {
+		return nil, err
+	}
+	return &headers, nil
+}
+
+func canonicalHeaders(headers map[string]string) (map[string]string, error) {
+	canonical := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid value for header %s", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if uninjectableHeaders[name] {
+			return nil, fmt.Errorf("header %s can't be injected", name)
+		}
+		canonical[name] = value
+	}
+	return canonical, nil
+}
+
+// injectResponseHeaders applies the configured response headers just before
+// the response's headers go out, once the handler has set the client's.
+func (s *Server) injectResponseHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		headers := s.currentConfig().responseHeaders
+		if headers == nil {
+			next(w, r)
+			return
+		}
+		next(&headerInjectingWriter{ResponseWriter: w, headers: headers}, r)
+	}
+}
+
+type headerInjectingWriter struct {
+	http.ResponseWriter
+	headers  *responseHeaders
+	injected bool
+}
+
+func (w *headerInjectingWriter) inject() {
+	if w.injected {
+		return
+	}
+	w.injected = true
+	h := w.ResponseWriter.Header()
+	for name, value := range w.headers.Default {
+		if _, ok := h[name]; !ok {
+			h.Set(name, value)
+		}
+	}
+	for name, value := range w.headers.Set {
+		h.Set(name, value)
+	}
+}
+
+func (w *headerInjectingWriter) WriteHeader(status int) {
+	w.inject()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerInjectingWriter) Write(p []byte) (int, error) {
+	w.inject()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *headerInjectingWriter) Flush() {
+	w.inject()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (w *headerInjectingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeResponseHeaders writes a -response-headers file of contents and
+// returns its path.
+func writeResponseHeaders(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "headers.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestResponseHeadersAreInjected(t *testing.T) {
+	headers := writeResponseHeaders(t, `{"set": {"X-Served-By": "proxy-1"}, "default": {"Cache-Control": "no-store", "X-Team": "storage"}}`)
+	s, ts := newTestServer(t, "-response-headers", headers)
+	connectClient(t, s, ts, "db-1").echo("x")
+	connectClient(t, s, ts, "db-2").serve(func(queryMessage) replyMessage {
+		return replyMessage{Body: "x", Headers: map[string]string{"X-Served-By": "client", "X-Team": "client"}}
+	})
+
+	for _, tc := range []struct{ path, servedBy, team string }{
+		{"/query/db-1", "proxy-1", "storage"},
+		{"/query/db-2", "proxy-1", "client"},
+		{"/query/missing", "proxy-1", "storage"},
+	} {
+		resp, _ := do(t, "GET", ts.URL+tc.path, nil, nil)
+		if got := resp.Header.Get("X-Served-By"); got != tc.servedBy {
+			t.Errorf("%s got X-Served-By %q, want %q", tc.path, got, tc.servedBy)
+		}
+		if got := resp.Header.Get("X-Team"); got != tc.team {
+			t.Errorf("%s got X-Team %q, want %q", tc.path, got, tc.team)
+		}
+		if resp.Header.Get("Cache-Control") != "no-store" {
+			t.Errorf("%s got Cache-Control %q, want the default", tc.path, resp.Header.Get("Cache-Control"))
+		}
+	}
+}
+
+func TestFramingHeadersCantBeInjected(t *testing.T) {
+	for _, contents := range []string{`{"set": {"Content-Length": "0"}}`, `{"default": {"transfer-encoding": "chunked"}}`} {
+		if _, err := loadResponseHeaders(writeResponseHeaders(t, contents)); err == nil {
+			t.Errorf("loadResponseHeaders accepted %s", contents)
+		}
+	}
+	if _, err := LoadConfig([]string{"-response-headers", writeResponseHeaders(t, `{"set": {"Upgrade": "h2c"}}`)}); err == nil {
+		t.Error("LoadConfig accepted an Upgrade header")
+	}
+}
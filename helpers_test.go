@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testAdminToken is the admin token of servers started by newTestServer.
+const testAdminToken = "test-admin-token"
+
+// newTestServer starts a Server configured by args, on top of the flag
+// defaults and an admin token, behind an httptest server that is closed when
+// the test ends.
+func newTestServer(t *testing.T, args ...string) (*Server, *httptest.Server) {
+	t.Helper()
+	cfg, err := LoadConfig(append([]string{"-admin-token", testAdminToken}, args...))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	// Streams such as a replica's never end by themselves, so they are cut
+	// off rather than waited for.
+	t.Cleanup(func() {
+		ts.CloseClientConnections()
+		ts.Close()
+	})
+	return s, ts
+}
+
+// do sends a request with an optional JSON body and returns the response
+// with its body read.
+func do(t *testing.T, method, url string, body any, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatalf("encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading %s %s: %v", method, url, err)
+	}
+	return resp, data
+}
+
+// asyncResult is the outcome of a request sent by goGet.
+type asyncResult struct {
+	status int
+	header http.Header
+	body   string
+	err    error
+}
+
+// goGet sends a GET in the background, for queries the test answers as the
+// client while they wait.
+func goGet(url string, header http.Header) <-chan asyncResult {
+	return goRequest("GET", url, "", header)
+}
+
+// goPost is goGet for a POST of body.
+func goPost(url, body string, header http.Header) <-chan asyncResult {
+	return goRequest("POST", url, body, header)
+}
+
+func goRequest(method, url, body string, header http.Header) <-chan asyncResult {
+	result := make(chan asyncResult, 1)
+	go func() {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			result <- asyncResult{err: err}
+			return
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			result <- asyncResult{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		result <- asyncResult{status: resp.StatusCode, header: resp.Header, body: string(body), err: err}
+	}()
+	return result
+}
+
+// adminHeader carries the admin token of servers started by newTestServer.
+func adminHeader() http.Header {
+	return http.Header{"Authorization": {"Bearer " + testAdminToken}}
+}
+
+type registerResponse struct {
+	ConnectionURL string `json:"connection_url"`
+	Token         string `json:"token"`
+	Result        string `json:"result"`
+	Reconnected   int    `json:"reconnected"`
+}
+
+// register posts body to /register and fails the test unless it succeeds.
+func register(t *testing.T, ts *httptest.Server, body map[string]any) registerResponse {
+	t.Helper()
+	resp, data := do(t, "POST", ts.URL+"/register", body, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("register: %s: %s", resp.Status, data)
+	}
+	var registered registerResponse
+	if err := json.Unmarshal(data, &registered); err != nil {
+		t.Fatalf("decoding registration %s: %v", data, err)
+	}
+	return registered
+}
+
+// testClient is the far end of a client connection.
+type testClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// wsURL turns ts's URL plus path into a websocket URL.
+func wsURL(ts *httptest.Server, path string) string {
+	return "ws" + strings.TrimPrefix(ts.URL, "http") + path
+}
+
+// dialClient connects to url, a websocket URL, and waits until s has added
+// the connection for clientID.
+func dialClient(t *testing.T, s *Server, url, clientID string) *testClient {
+	t.Helper()
+	before := s.connectionCount(clientID)
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		status := ""
+		if resp != nil {
+			status = resp.Status
+		}
+		t.Fatalf("dialing %s: %v %s", url, err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	waitFor(t, "connection to be added", func() bool {
+		return s.connectionCount(clientID) > before
+	})
+	return &testClient{t: t, conn: conn}
+}
+
+// connectClient connects clientID to ts without registering it.
+func connectClient(t *testing.T, s *Server, ts *httptest.Server, clientID string) *testClient {
+	t.Helper()
+	return dialClient(t, s, wsURL(ts, "/connect?client_id="+clientID), clientID)
+}
+
+// connectRegistered connects clientID with the connection URL it was given
+// at registration.
+func connectRegistered(t *testing.T, s *Server, registered registerResponse, clientID string) *testClient {
+	t.Helper()
+	return dialClient(t, s, registered.ConnectionURL, clientID)
+}
+
+// connectionCount returns how many connections clientID has.
+func (s *Server) connectionCount(clientID string) int {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	if set, ok := s.clients[clientID]; ok {
+		return len(set.conns)
+	}
+	return 0
+}
+
+// readQuery reads messages until the next query and returns it.
+func (c *testClient) readQuery() queryMessage {
+	c.t.Helper()
+	for {
+		var query queryMessage
+		if json.Unmarshal(c.read(), &query) == nil && query.Type == "query" {
+			return query
+		}
+	}
+}
+
+// read returns the next message the client is sent.
+func (c *testClient) read() []byte {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("reading from proxy: %v", err)
+	}
+	return data
+}
+
+// reply sends reply as a JSON message.
+func (c *testClient) reply(reply replyMessage) {
+	c.t.Helper()
+	data, err := json.Marshal(reply)
+	if err != nil {
+		c.t.Fatalf("encoding reply: %v", err)
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		c.t.Fatalf("writing reply: %v", err)
+	}
+}
+
+// serve answers every query with what answer returns, until the connection
+// closes.
+func (c *testClient) serve(answer func(queryMessage) replyMessage) {
+	go func() {
+		for {
+			_, data, err := c.conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var query queryMessage
+			if json.Unmarshal(data, &query) != nil || query.Type != "query" {
+				continue
+			}
+			reply := answer(query)
+			reply.RequestID = query.RequestID
+			data, _ = json.Marshal(reply)
+			if c.conn.WriteMessage(websocket.TextMessage, data) != nil {
+				return
+			}
+		}
+	}()
+}
+
+// echo answers every query with body.
+func (c *testClient) echo(body string) {
+	c.serve(func(queryMessage) replyMessage {
+		return replyMessage{Body: body}
+	})
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// expectClose reads until the connection closes and fails the test unless
+// the proxy closed it with code.
+func (c *testClient) expectClose(code int) *websocket.CloseError {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := c.conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok || closeErr.Code != code {
+			c.t.Fatalf("connection ended with %v, want close code %d", err, code)
+		}
+		return closeErr
+	}
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// For looking into an incident with one client, the proxy keeps the last
+// -client-history requests made to each client ID on /query, /command and
+// /query-cached: when, the method and path, how big the request and
+// response were, the status, how long it took and, for a failed request, the
+// first few hundred bytes of the response, which for an error of the
+// proxy's own is its message. Bodies aren't kept otherwise. GET
+// /admin/clients/{clientID}/history returns them, newest first:
+//
+//	{"client_id":"abc","size":50,"requests":[{"time":"...","method":"GET",
+//	 "path":"/query/abc","status":504,"duration":"30s","error":"query timed out"}]}
+//
+// A client ID's history starts with a request made while it is connected or
+// registered, so callers asking for made-up IDs can't grow it, and carries
+// on once it is gone, so the queries that failed after it went away are
+// recorded too. -client-history 0 turns it off.
+
+// historyErrorLength bounds the error message kept for a failed request.
+const historyErrorLength = 256
+
+type historyEntry struct {
+	Time          time.Time `json:"time"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	RequestBytes  int64     `json:"request_bytes"`
+	Status        int       `json:"status"`
+	ResponseBytes int64     `json:"response_bytes"`
+	Duration      string    `json:"duration"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// historyRing holds the last len(entries) requests to one client ID.
+type historyRing struct {
+	entries []historyEntry
+	next    int
+	full    bool
+}
+
+// add records entry in a ring of size entries, resizing it, keeping the
+// newest entries, if the size has changed since the last one.
+func (h *historyRing) add(entry historyEntry, size int) {
+	if len(h.entries) != size {
+		kept := h.newest()
+		if len(kept) > size {
+			kept = kept[:size]
+		}
+		h.entries = make([]historyEntry, size)
+		h.next, h.full = 0, false
+		for i := len(kept) - 1; i >= 0; i-- {
+			h.put(kept[i])
+		}
+	}
+	h.put(entry)
+}
+
+func (h *historyRing) put(entry historyEntry) {
+	h.entries[h.next] = entry
+	h.next++
+	if h.next == len(h.entries) {
+		h.next, h.full = 0, true
+	}
+}
+
+// newest returns the recorded entries, newest first.
+func (h *historyRing) newest() []historyEntry {
+	n := h.next
+	if h.full {
+		n = len(h.entries)
+	}
+	entries := make([]historyEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		entries = append(entries, h.entries[(h.next-i+len(h.entries))%len(h.entries)])
+	}
+	return entries
+}
+
+// clientHistories are the rings of every client ID with a history.
+type clientHistories struct {
+	mutex sync.Mutex
+	rings map[string]*historyRing
+}
+
+func newClientHistories() *clientHistories {
+	return &clientHistories{rings: make(map[string]*historyRing)}
+}
+
+func (c *clientHistories) add(clientID string, entry historyEntry, size int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ring, ok := c.rings[clientID]
+	if !ok {
+		ring = &historyRing{}
+		c.rings[clientID] = ring
+	}
+	ring.add(entry, size)
+}
+
+func (c *clientHistories) has(clientID string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.rings[clientID]
+	return ok
+}
+
+func (c *clientHistories) newest(clientID string) []historyEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ring, ok := c.rings[clientID]
+	if !ok {
+		return []historyEntry{}
+	}
+	return ring.newest()
+}
+
+// knownClient reports whether clientID is connected or registered.
+func (s *Server) knownClient(clientID string) bool {
+	s.clientsMutex.RLock()
+	_, connected := s.clients[clientID]
+	s.clientsMutex.RUnlock()
+	if connected {
+		return true
+	}
+	s.registrationsMutex.RLock()
+	defer s.registrationsMutex.RUnlock()
+	_, registered := s.registrations[clientID]
+	return registered
+}
+
+// recordHistory adds each request to its client ID's history once it has
+// been answered.
+func (s *Server) recordHistory(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		size := s.currentConfig().ClientHistory
+		clientID := mux.Vars(r)["clientID"]
+		if size <= 0 || !(s.knownClient(clientID) || s.clientHistories.has(clientID)) {
+			next(w, r)
+			return
+		}
+
+		start := time.Now()
+		hw := &historyWriter{ResponseWriter: w}
+		next(hw, r)
+
+		entry := historyEntry{
+			Time:          start,
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			RequestBytes:  max(r.ContentLength, 0),
+			Status:        hw.status,
+			ResponseBytes: hw.written,
+			Duration:      time.Since(start).String(),
+		}
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		if entry.Status >= http.StatusBadRequest {
+			entry.Error = strings.TrimSpace(hw.errorText.String())
+		}
+		s.clientHistories.add(clientID, entry, size)
+	}
+}
+
+// historyWriter notes the status and size of a response as sent, and the
+// start of an uncompressed error response's body.
+type historyWriter struct {
+	http.ResponseWriter
+	status    int
+	written   int64
+	errorText strings.Builder
+}
+
+func (w *historyWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *historyWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= http.StatusBadRequest && w.Header().Get("Content-Encoding") == "" {
+		if room := historyErrorLength - w.errorText.Len(); room > 0 {
+			w.errorText.Write(p[:min(len(p), room)])
+		}
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *historyWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (w *historyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type historyResult struct {
+	ClientID string         `json:"client_id"`
+	Size     int            `json:"size"`
+	Requests []historyEntry `json:"requests"`
+}
+
+func (s *Server) handleClientHistory(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(historyResult{
+		ClientID: clientID,
+		Size:     s.currentConfig().ClientHistory,
+		Requests: s.clientHistories.newest(clientID),
+	})
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// history fetches the history of clientID from /admin/clients/{clientID}/history.
+func history(t *testing.T, ts *httptest.Server, clientID string) historyResult {
+	t.Helper()
+	resp, body := do(t, "GET", ts.URL+"/admin/clients/"+clientID+"/history", nil, adminHeader())
+	var result historyResult
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &result) != nil {
+		t.Fatalf("GET history got %s: %s", resp.Status, body)
+	}
+	return result
+}
+
+func TestClientHistoryRecordsRequests(t *testing.T) {
+	s, ts := newTestServer(t, "-client-history", "5")
+	connectClient(t, s, ts, "weather").serve(func(q queryMessage) replyMessage {
+		if q.Params["city"][0] == "nowhere" {
+			return replyMessage{Status: http.StatusNotFound, Body: "no such city"}
+		}
+		return replyMessage{Status: http.StatusOK, Body: "sunny"}
+	})
+
+	do(t, "GET", ts.URL+"/query/weather?city=paris", nil, nil)
+	do(t, "GET", ts.URL+"/query/weather?city=nowhere", nil, nil)
+	var result historyResult
+	waitFor(t, "both requests in the history", func() bool {
+		result = history(t, ts, "weather")
+		return len(result.Requests) == 2
+	})
+
+	if result.ClientID != "weather" || result.Size != 5 {
+		t.Errorf("history of %q with size %d", result.ClientID, result.Size)
+	}
+	failed, ok := result.Requests[0], result.Requests[1]
+	if failed.Status != http.StatusNotFound || failed.Error != "no such city" || failed.Method != "GET" || failed.Path != "/query/weather" {
+		t.Errorf("newest entry %+v, want the failed request with its error", failed)
+	}
+	if ok.Status != http.StatusOK || ok.Error != "" || ok.ResponseBytes != int64(len("sunny")) {
+		t.Errorf("oldest entry %+v, want the answered request without an error", ok)
+	}
+}
+
+func TestClientHistoryOnlyStartsForKnownClients(t *testing.T) {
+	s, ts := newTestServer(t)
+	do(t, "GET", ts.URL+"/query/made-up", nil, nil)
+	if result := history(t, ts, "made-up"); len(result.Requests) != 0 {
+		t.Errorf("client ID never seen has history %+v", result.Requests)
+	}
+
+	client := connectClient(t, s, ts, "weather")
+	client.echo("ok")
+	do(t, "GET", ts.URL+"/query/weather", nil, nil)
+	client.conn.Close()
+	waitFor(t, "the client to go", func() bool { return s.connectionCount("weather") == 0 })
+
+	// Once started, the history carries on after the client is gone.
+	do(t, "GET", ts.URL+"/query/weather?city=paris", nil, nil)
+	waitFor(t, "the request after the client went", func() bool {
+		requests := history(t, ts, "weather").Requests
+		return len(requests) == 2 && requests[0].Status >= http.StatusBadRequest && requests[0].Error != ""
+	})
+}
+
+func TestClientHistoryOff(t *testing.T) {
+	s, ts := newTestServer(t, "-client-history", "0")
+	connectClient(t, s, ts, "weather").echo("ok")
+	do(t, "GET", ts.URL+"/query/weather", nil, nil)
+	if s.clientHistories.has("weather") {
+		t.Error("-client-history 0 kept a history")
+	}
+	if _, err := LoadConfig([]string{"-client-history", "-1"}); err == nil {
+		t.Error("negative -client-history accepted")
+	}
+}
+
+func TestHistoryRingKeepsTheNewest(t *testing.T) {
+	var ring historyRing
+	entry := func(status int) historyEntry { return historyEntry{Time: time.Now(), Status: status} }
+	for status := 1; status <= 4; status++ {
+		ring.add(entry(status), 3)
+	}
+	statuses := func() (got []int) {
+		for _, e := range ring.newest() {
+			got = append(got, e.Status)
+		}
+		return got
+	}
+	if got := statuses(); len(got) != 3 || got[0] != 4 || got[2] != 2 {
+		t.Errorf("ring of 3 after 4 adds holds %v, want [4 3 2]", got)
+	}
+
+	// Shrinking keeps the newest entries.
+	ring.add(entry(5), 2)
+	if got := statuses(); len(got) != 2 || got[0] != 5 || got[1] != 4 {
+		t.Errorf("ring shrunk to 2 holds %v, want [5 4]", got)
+	}
+}
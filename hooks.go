@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// hookQueueSize is how many hook calls may wait before new ones are
+// dropped.
+const hookQueueSize = 1024
+
+// Hooks are callbacks for code embedding the proxy that wants to react to
+// connections and queries without changing the handlers. Any of them may be
+// nil.
+//
+// Hooks never run on the goroutine that triggered them: calls are queued and
+// made one at a time, in order, by a single goroutine, so a slow hook delays
+// only later hooks and never a query. If the queue fills up, calls are
+// dropped and counted in proxy_hooks_dropped_total. A hook must not modify
+// the Client it is given, and a panicking hook is logged and skipped.
+type Hooks struct {
+	OnConnect    func(client *Client)
+	OnDisconnect func(client *Client)
+	OnQuery      func(query QueryInfo)
+}
+
+// QueryInfo describes a finished query for Hooks.OnQuery.
+type QueryInfo struct {
+	ClientID string
+	// Cache is "hit", "miss", "stale" or empty when the cache wasn't
+	// consulted. CacheReason says why, as in query log lines, for example
+	// "stale-expired,stored".
+	Cache       string
+	CacheReason string
+	Duration    time.Duration
+	Err         error
+}
+
+// SetHooks installs h. It must be called before the server starts handling
+// requests.
+func (s *Server) SetHooks(h Hooks) {
+	s.hooks = h
+}
+
+func (s *Server) runHooks() {
+	for call := range s.hookCalls {
+		runHook(call)
+	}
+}
+
+func runHook(call func()) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Panic in hook: %v\n%s", p, debug.Stack())
+		}
+	}()
+	call()
+}
+
+// queueHook schedules call without waiting, dropping it if the queue is
+// full.
+func (s *Server) queueHook(call func()) {
+	select {
+	case s.hookCalls <- call:
+	default:
+		s.incCounter("proxy_hooks_dropped_total")
+	}
+}
+
+func (s *Server) hookConnect(client *Client) {
+	if s.hooks.OnConnect != nil {
+		s.queueHook(func() { s.hooks.OnConnect(client) })
+	}
+}
+
+func (s *Server) hookDisconnect(client *Client) {
+	if s.hooks.OnDisconnect != nil {
+		s.queueHook(func() { s.hooks.OnDisconnect(client) })
+	}
+}
+
+func (s *Server) hookQuery(query QueryInfo) {
+	if s.hooks.OnQuery != nil {
+		s.queueHook(func() { s.hooks.OnQuery(query) })
+	}
+}
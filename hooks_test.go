@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHooksFire(t *testing.T) {
+	s, ts := newTestServer(t)
+	connects, disconnects := make(chan string, 1), make(chan string, 1)
+	queries := make(chan QueryInfo, 2)
+	s.SetHooks(Hooks{
+		OnConnect:    func(client *Client) { connects <- client.ID },
+		OnDisconnect: func(client *Client) { disconnects <- client.ID },
+		OnQuery:      func(query QueryInfo) { queries <- query },
+	})
+
+	client := connectClient(t, s, ts, "db-1")
+	client.echo("x")
+	do(t, "GET", ts.URL+"/query/db-1", nil, nil)
+	do(t, "GET", ts.URL+"/query/db-1", nil, nil)
+	client.conn.Close()
+
+	for name, ch := range map[string]chan string{"OnConnect": connects, "OnDisconnect": disconnects} {
+		select {
+		case id := <-ch:
+			if id != "db-1" {
+				t.Errorf("%s got client %s", name, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s never fired", name)
+		}
+	}
+	for _, want := range []string{"miss", "hit"} {
+		select {
+		case query := <-queries:
+			if query.ClientID != "db-1" || query.Cache != want || query.Err != nil {
+				t.Errorf("OnQuery got %+v, want a %s", query, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("OnQuery never fired for the %s", want)
+		}
+	}
+}
+
+func TestSlowOrPanickingHooksDontHoldUpQueries(t *testing.T) {
+	s, ts := newTestServer(t)
+	release := make(chan struct{})
+	defer close(release)
+	calls := 0
+	s.SetHooks(Hooks{OnQuery: func(QueryInfo) {
+		if calls++; calls == 1 {
+			panic("boom")
+		}
+		<-release
+	}})
+	connectClient(t, s, ts, "db-1").echo("x")
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if resp, _ := do(t, "GET", ts.URL+"/query/db-1", nil, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("query %d got %s", i, resp.Status)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("queries took %s behind a blocked hook", elapsed)
+	}
+}
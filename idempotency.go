@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"time"
+)
+
+// idempotentResult is the stored outcome of a POST query made with an
+// Idempotency-Key. These live apart from the GET freshness cache: they are
+// keyed by caller-chosen keys rather than by query and are kept for the whole
+// idempotency window regardless of the cache TTL.
+type idempotentResult struct {
+	Reply     clientReply
+	Complete  bool
+	ExpiresAt time.Time
+}
+
+func idempotencyCacheKey(clientID, key string) string {
+	return clientID + "\x00" + key
+}
+
+// claimIdempotencyKey looks up key. If a completed result is stored it is
+// returned. Otherwise, if no query holds the key, the caller claims it and
+// must later call completeIdempotencyKey or releaseIdempotencyKey. inFlight
+// reports that another query with the same key hasn't finished yet.
+func (s *Server) claimIdempotencyKey(key string) (result *idempotentResult, inFlight bool) {
+	s.idempotencyMutex.Lock()
+	defer s.idempotencyMutex.Unlock()
+
+	existing, ok := s.idempotencyResults[key]
+	if ok && time.Now().Before(existing.ExpiresAt) {
+		if existing.Complete {
+			return existing, false
+		}
+		return nil, true
+	}
+
+	s.idempotencyResults[key] = &idempotentResult{
+		ExpiresAt: time.Now().Add(s.currentConfig().IdempotencyWindow),
+	}
+	return nil, false
+}
+
+// completedIdempotencyKey returns the completed result stored for key, or
+// nil if there is none, without claiming the key.
+func (s *Server) completedIdempotencyKey(key string) *idempotentResult {
+	s.idempotencyMutex.Lock()
+	defer s.idempotencyMutex.Unlock()
+
+	existing, ok := s.idempotencyResults[key]
+	if !ok || !existing.Complete || !time.Now().Before(existing.ExpiresAt) {
+		return nil
+	}
+	return existing
+}
+
+func (s *Server) completeIdempotencyKey(key string, reply clientReply) {
+	s.idempotencyMutex.Lock()
+	defer s.idempotencyMutex.Unlock()
+
+	s.idempotencyResults[key] = &idempotentResult{
+		Reply:     reply,
+		Complete:  true,
+		ExpiresAt: time.Now().Add(s.currentConfig().IdempotencyWindow),
+	}
+}
+
+// releaseIdempotencyKey drops a claim after a failed query so the caller can
+// retry with the same key.
+func (s *Server) releaseIdempotencyKey(key string) {
+	s.idempotencyMutex.Lock()
+	defer s.idempotencyMutex.Unlock()
+	delete(s.idempotencyResults, key)
+}
+
+func (s *Server) expireIdempotencyKeys() {
+	for {
+		time.Sleep(s.jitter(time.Minute))
+
+		now := time.Now()
+		s.idempotencyMutex.Lock()
+		for key, result := range s.idempotencyResults {
+			if now.After(result.ExpiresAt) {
+				delete(s.idempotencyResults, key)
+			}
+		}
+		s.idempotencyMutex.Unlock()
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIdempotencyKeyReplaysThePOSTReply(t *testing.T) {
+	s, ts := newTestServer(t)
+	var queries atomic.Int32
+	connectClient(t, s, ts, "db-1").serve(func(queryMessage) replyMessage {
+		queries.Add(1)
+		return replyMessage{Body: "done"}
+	})
+	header := http.Header{"Idempotency-Key": {"order-7"}}
+
+	first, body := do(t, "POST", ts.URL+"/query/db-1", "charge", header)
+	if first.StatusCode != http.StatusOK || string(body) != "done" || first.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first POST got %s %q, want the client's reply", first.Status, body)
+	}
+	again, body := do(t, "POST", ts.URL+"/query/db-1", "charge", header)
+	if again.StatusCode != http.StatusOK || string(body) != "done" || again.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("repeated POST got %s %q replayed %q, want the stored reply", again.Status, body, again.Header.Get("Idempotent-Replayed"))
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("the client was queried %d times, want once", n)
+	}
+}
+
+func TestIdempotencyKeyInProgressConflicts(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	header := http.Header{"Idempotency-Key": {"order-7"}}
+	first := goPost(ts.URL+"/query/db-1", "charge", header)
+	query := client.readQuery()
+
+	resp, body := do(t, "POST", ts.URL+"/query/db-1", "charge", header)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("POST while the first is in flight got %s: %s, want 409", resp.Status, body)
+	}
+	client.reply(replyMessage{RequestID: query.RequestID, Body: "done"})
+	if r := <-first; r.status != http.StatusOK {
+		t.Errorf("first POST got %d %v", r.status, r.err)
+	}
+}
+
+func TestIdempotencyKeyIsReleasedAfterAFailure(t *testing.T) {
+	s, ts := newTestServer(t)
+	header := http.Header{"Idempotency-Key": {"order-7"}}
+	if resp, _ := do(t, "POST", ts.URL+"/query/db-1", "charge", header); resp.StatusCode == http.StatusOK {
+		t.Fatalf("POST to a client that isn't connected got %s", resp.Status)
+	}
+
+	connectClient(t, s, ts, "db-1").echo("done")
+	resp, body := do(t, "POST", ts.URL+"/query/db-1", "charge", header)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry got %s %q replayed %q, want a fresh reply", resp.Status, body, resp.Header.Get("Idempotent-Replayed"))
+	}
+}
+
+func TestIdempotencyKeyReplaysAfterTheClientHasGone(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	client.echo("done")
+	header := http.Header{"Idempotency-Key": {"order-7"}}
+	if resp, body := do(t, "POST", ts.URL+"/query/db-1", "charge", header); string(body) != "done" {
+		t.Fatalf("first POST got %s %q", resp.Status, body)
+	}
+	client.conn.Close()
+	waitFor(t, "the client to go", func() bool { return s.connectionCount("db-1") == 0 })
+
+	resp, body := do(t, "POST", ts.URL+"/query/db-1", "charge", header)
+	if resp.StatusCode != http.StatusOK || string(body) != "done" || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry without the client got %s %q replayed %q, want the stored reply", resp.Status, body, resp.Header.Get("Idempotent-Replayed"))
+	}
+
+	// Maintenance doesn't stop the replay either.
+	s.maintenance.Store(true)
+	if resp, body := do(t, "POST", ts.URL+"/query/db-1", "charge", header); string(body) != "done" {
+		t.Errorf("retry in maintenance got %s %q, want the stored reply", resp.Status, body)
+	}
+}
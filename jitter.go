@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"math/rand"
+	"time"
+)
+
+// jitter spreads d randomly by up to -jitter either way, so that periodic
+// work started at the same moment, such as pings to clients that connected
+// together, doesn't keep firing in lockstep.
+func (s *Server) jitter(d time.Duration) time.Duration {
+	return spread(d, s.currentConfig().JitterPercent)
+}
+
+// jitterCacheTTL spreads the TTL of a cache entry being stored by up to
+// -cache-ttl-jitter either way, whether the TTL came from the flags, the
+// route's cache policy or the reply's max-age. Entries stored in a burst, as
+// after a restart or a flush, then expire over a spell rather than all at
+// once, sending their clients a trickle of refreshes instead of a herd.
+// -cache-expiry-grace still coalesces the callers piling up behind each
+// entry's own refresh, and since the proxy never revalidates in the
+// background, jitter only moves when that refresh happens.
+func (s *Server) jitterCacheTTL(ttl time.Duration) time.Duration {
+	return spread(ttl, s.currentConfig().CacheTTLJitter)
+}
+
+// spread moves d randomly by up to percent of it either way.
+func spread(d time.Duration, percent int) time.Duration {
+	if percent <= 0 || d <= 0 {
+		return d
+	}
+	amount := float64(d) * float64(percent) / 100
+	return d + time.Duration((rand.Float64()*2-1)*amount)
+}
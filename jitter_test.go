@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestJitterStaysWithinItsPercentage(t *testing.T) {
+	s, _ := newTestServer(t, "-jitter", "20")
+	varied := false
+	for i := 0; i < 1000; i++ {
+		d := s.jitter(time.Minute)
+		if d < 48*time.Second || d > 72*time.Second {
+			t.Fatalf("jitter(1m) = %s, want within 20%% of a minute", d)
+		}
+		varied = varied || d != time.Minute
+	}
+	if !varied {
+		t.Error("jitter never moved the interval")
+	}
+}
+
+func TestNoJitterByDefault(t *testing.T) {
+	s, _ := newTestServer(t)
+	if d := s.jitter(time.Minute); d != time.Minute {
+		t.Errorf("jitter(1m) = %s without -jitter, want 1m", d)
+	}
+}
+
+func TestJitterOutOfRangeIsRejected(t *testing.T) {
+	if _, err := LoadConfig([]string{"-jitter", "60"}); err == nil {
+		t.Error("LoadConfig accepted -jitter 60")
+	}
+}
+
+// storedTTL stores a reply for db-1 under key and returns the TTL its entry
+// was given.
+func storedTTL(t *testing.T, s *Server, key string) time.Duration {
+	t.Helper()
+	s.storeReply(key, s.cachePolicy("db-1"), clientReply{Body: []byte("x")})
+	entry, ok := s.cached(key)
+	if !ok {
+		t.Fatalf("reply under %s wasn't cached", key)
+	}
+	return entry.TTL
+}
+
+func TestCacheTTLJitterSpreadsStoredEntries(t *testing.T) {
+	s, _ := newTestServer(t, "-cache-ttl", "1m", "-cache-ttl-jitter", "20")
+	varied := false
+	for i := 0; i < 100; i++ {
+		ttl := storedTTL(t, s, s.cacheKey("db-1", fmt.Sprint("q=", i)))
+		if ttl < 48*time.Second || ttl > 72*time.Second {
+			t.Fatalf("entry stored with TTL %s, want within 20%% of a minute", ttl)
+		}
+		varied = varied || ttl != time.Minute
+	}
+	if !varied {
+		t.Error("-cache-ttl-jitter never moved a TTL")
+	}
+}
+
+func TestNoCacheTTLJitterByDefault(t *testing.T) {
+	s, _ := newTestServer(t, "-cache-ttl", "1m", "-jitter", "20")
+	if ttl := storedTTL(t, s, s.cacheKey("db-1", "")); ttl != time.Minute {
+		t.Errorf("entry stored with TTL %s without -cache-ttl-jitter, want 1m", ttl)
+	}
+	if _, err := LoadConfig([]string{"-cache-ttl-jitter", "60"}); err == nil {
+		t.Error("LoadConfig accepted -cache-ttl-jitter 60")
+	}
+}
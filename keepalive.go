@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// applyKeepAlive sets TCP keepalive on the socket under a freshly upgraded
+// connection. Websocket pings only notice a dead peer after a ping interval
+// plus the inactivity timeout; TCP keepalive lets the kernel find it sooner
+// and keeps idle NAT mappings alive between pings. A period of zero turns
+// keepalive off. Probe count and interval after the first probe are left to
+// the OS.
+func applyKeepAlive(conn *websocket.Conn, period time.Duration) {
+	netConn := conn.NetConn()
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		netConn = tlsConn.NetConn()
+	}
+	tcpConn, ok := netConn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if err := tcpConn.SetKeepAlive(period > 0); err != nil {
+		log.Printf("Error setting TCP keepalive: %v", err)
+		return
+	}
+	if period > 0 {
+		if err := tcpConn.SetKeepAlivePeriod(period); err != nil {
+			log.Printf("Error setting TCP keepalive period: %v", err)
+		}
+	}
+}
+
+// awaitFirstActivity gives a new connection window to show it is alive,
+// with a message or with the pong to a ping sent right away, rather than
+// waiting a ping interval and the inactivity timeout to find out. It sets a
+// read deadline the reader lifts at the first sign of life, so a client
+// that upgrades and then goes silent is disconnected when it passes. It
+// reports whether a window was set.
+func (c *Client) awaitFirstActivity(window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+	deadline := time.Now().Add(window)
+	c.Connection.SetReadDeadline(deadline)
+	if err := c.Connection.WriteControl(websocket.PingMessage, pingPayload(), deadline); err != nil {
+		log.Printf("Error pinging client %s: %v (%s)", c.ID, err, c.server.recordWebsocketError(c, "write", err))
+	}
+	return true
+}
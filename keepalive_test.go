@@ -0,0 +1,87 @@
+//go:build unix
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// keepAliveOn reports whether SO_KEEPALIVE is set on the socket under the
+// proxy's end of clientID's connection.
+func keepAliveOn(t *testing.T, s *Server, clientID string) bool {
+	t.Helper()
+	raw, err := s.firstConnection(clientID).Connection.NetConn().(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var sockErr error
+	raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return value != 0
+}
+
+func TestTCPKeepAliveIsSetOnClientConnections(t *testing.T) {
+	s, ts := newTestServer(t, "-tcp-keepalive", "30s")
+	connectClient(t, s, ts, "db-1")
+	if !keepAliveOn(t, s, "db-1") {
+		t.Error("TCP keepalive is off with -tcp-keepalive 30s")
+	}
+}
+
+func TestTCPKeepAliveCanBeTurnedOff(t *testing.T) {
+	s, ts := newTestServer(t, "-tcp-keepalive", "0")
+	connectClient(t, s, ts, "db-1")
+	if keepAliveOn(t, s, "db-1") {
+		t.Error("TCP keepalive is on with -tcp-keepalive 0")
+	}
+}
+
+func TestSilentConnectionIsClosedAfterFirstActivityTimeout(t *testing.T) {
+	_, ts := newTestServer(t, "-first-activity-timeout", "50ms")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(ts, "/connect?client_id=db-1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Leaving the proxy's ping unanswered keeps the client silent.
+	conn.SetPingHandler(func(string) error { return nil })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Errorf("silent connection read %v, want it closed by the proxy", err)
+	}
+}
+
+func TestPongCountsAsFirstActivity(t *testing.T) {
+	s, ts := newTestServer(t, "-first-activity-timeout", "50ms")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(ts, "/connect?client_id=db-1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Reading answers the proxy's ping with a pong.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	waitFor(t, "the connection to be added", func() bool { return s.connectionCount("db-1") == 1 })
+	time.Sleep(200 * time.Millisecond)
+	if s.connectionCount("db-1") != 1 {
+		t.Error("connection that answered the ping was closed")
+	}
+}
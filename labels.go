@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// A client may describe itself at registration with free-form metadata:
+//
+//	{"client_id":"eu-1","metadata":{"region":"eu-west","version":"1.4.2"}}
+//
+// With -metric-labels region,version, those keys become labels on the
+// per-client metrics, proxy_queries_total, proxy_client_replies_total,
+// proxy_query_timeouts_total and proxy_client_connections_total, for
+// per-region or per-version dashboards. A client without a key gets an
+// empty label. Since every distinct value is a new series, each key takes
+// at most -metric-label-values distinct values; values past that are counted
+// under "other", and the first one is logged. The values seen are kept for
+// the life of the process.
+
+const (
+	maxMetadataEntries = 32
+	maxMetadataLength  = 256
+
+	// otherLabelValue stands for every value past -metric-label-values.
+	otherLabelValue = "other"
+)
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are used by the metrics the metadata labels go on.
+var reservedLabels = map[string]bool{"cache": true, "status": true, "client_id": true, "in": true}
+
+// parseMetricLabels parses -metric-labels.
+func parseMetricLabels(list string) ([]string, error) {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range strings.Split(list, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if !labelName.MatchString(key) || strings.HasPrefix(key, "__") {
+			return nil, fmt.Errorf("%q is not a valid metric label name", key)
+		}
+		if reservedLabels[key] {
+			return nil, fmt.Errorf("metric label %q is already used by the proxy's metrics", key)
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataEntries {
+		return fmt.Errorf("%d entries, at most %d allowed", len(metadata), maxMetadataEntries)
+	}
+	for key, value := range metadata {
+		if key == "" {
+			return fmt.Errorf("empty key")
+		}
+		if len(key) > maxMetadataLength || len(value) > maxMetadataLength {
+			return fmt.Errorf("%s: keys and values are limited to %d bytes", key, maxMetadataLength)
+		}
+	}
+	return nil
+}
+
+// metadataLabels returns the label pairs for clientID's registered metadata,
+// for incCounter.
+func (s *Server) metadataLabels(clientID string) []string {
+	cfg := s.currentConfig()
+	if len(cfg.metricLabels) == 0 {
+		return nil
+	}
+	s.registrationsMutex.RLock()
+	metadata := s.registrations[clientID].Metadata
+	s.registrationsMutex.RUnlock()
+
+	pairs := make([]string, 0, 2*len(cfg.metricLabels))
+	for _, key := range cfg.metricLabels {
+		pairs = append(pairs, key, s.metricLabelValue(key, metadata[key], cfg.MetricLabelValues))
+	}
+	return pairs
+}
+
+// metricLabelValue admits value for key if it has been seen before or key
+// has room for it, and otherwise returns otherLabelValue.
+func (s *Server) metricLabelValue(key, value string, limit int) string {
+	if value == "" {
+		return ""
+	}
+	s.metricLabelsMutex.Lock()
+	defer s.metricLabelsMutex.Unlock()
+
+	seen := s.metricLabelValues[key]
+	if seen == nil {
+		seen = make(map[string]bool)
+		s.metricLabelValues[key] = seen
+	}
+	switch {
+	case seen[value]:
+		return value
+	case len(seen) < limit:
+		seen[value] = true
+		return value
+	}
+	if !s.metricLabelsCapped[key] {
+		s.metricLabelsCapped[key] = true
+		log.Printf("Metric label %s has reached %d values; %q and any further ones are counted as %q", key, limit, value, otherLabelValue)
+	}
+	return otherLabelValue
+}
+
+// withLabels appends the metadata labels to a metric's own label pairs.
+func (s *Server) withLabels(clientID string, labelPairs ...string) []string {
+	return append(labelPairs, s.metadataLabels(clientID)...)
+}
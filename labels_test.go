@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMetricLabels(t *testing.T) {
+	keys, err := parseMetricLabels(" region, version,region,")
+	if err != nil || !reflect.DeepEqual(keys, []string{"region", "version"}) {
+		t.Errorf("parseMetricLabels = %q, %v", keys, err)
+	}
+	for _, list := range []string{"1region", "__name", "re-gion", "cache", "client_id"} {
+		if _, err := parseMetricLabels(list); err == nil {
+			t.Errorf("parseMetricLabels(%q) succeeded", list)
+		}
+	}
+}
+
+func TestValidateMetadata(t *testing.T) {
+	if err := validateMetadata(map[string]string{"region": "eu"}); err != nil {
+		t.Error(err)
+	}
+	tooMany := make(map[string]string)
+	for i := 0; i <= maxMetadataEntries; i++ {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+	for name, metadata := range map[string]map[string]string{
+		"empty key":  {"": "v"},
+		"long value": {"region": strings.Repeat("x", maxMetadataLength+1)},
+		"too many":   tooMany,
+	} {
+		if err := validateMetadata(metadata); err == nil {
+			t.Errorf("validateMetadata accepted %s", name)
+		}
+	}
+}
+
+func TestMetadataLabelsPerClientMetrics(t *testing.T) {
+	s, ts := newTestServer(t, "-metric-labels", "region,version")
+	registered := register(t, ts, map[string]any{"client_id": "eu-1", "metadata": map[string]string{"region": "eu-west"}})
+	connectRegistered(t, s, registered, "eu-1").echo("x")
+	do(t, "GET", ts.URL+"/query/eu-1", nil, nil)
+
+	_, body := do(t, "GET", ts.URL+"/metrics", nil, nil)
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "proxy_queries_total{") {
+			if !strings.Contains(line, `region="eu-west"`) || !strings.Contains(line, `version=""`) {
+				t.Errorf("query counter %s lacks the metadata labels", line)
+			}
+			return
+		}
+	}
+	t.Errorf("no proxy_queries_total in /metrics:\n%s", body)
+}
+
+func TestMetricLabelValuesAreCapped(t *testing.T) {
+	s, _ := newTestServer(t)
+	for value, want := range map[string]string{"eu": "eu", "us": "us"} {
+		if got := s.metricLabelValue("region", value, 2); got != want {
+			t.Errorf("metricLabelValue(%q) = %q, want %q", value, got, want)
+		}
+	}
+	if got := s.metricLabelValue("region", "ap", 2); got != otherLabelValue {
+		t.Errorf("value past the limit got %q, want %q", got, otherLabelValue)
+	}
+	if got := s.metricLabelValue("region", "eu", 2); got != "eu" {
+		t.Errorf("value seen before got %q after the cap", got)
+	}
+	if got := s.metricLabelValue("region", "", 2); got != "" {
+		t.Errorf("empty value got %q", got)
+	}
+}
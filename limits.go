@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+)
+
+// limitQueryRequest refuses queries whose URL or headers are larger than
+// configured before anything else looks at them, since the query string and
+// headers are forwarded to clients and used in cache keys. The URL limit
+// counts the path and the raw query string; the header limit counts every
+// name and value as they would appear on the wire. Zero disables a limit.
+func (s *Server) limitQueryRequest(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.currentConfig()
+		if cfg.MaxQueryURL > 0 && len(r.URL.RequestURI()) > cfg.MaxQueryURL {
+			http.Error(w, "query URL too long", http.StatusRequestURITooLong)
+			return
+		}
+		if cfg.MaxQueryHeaderBytes > 0 && headerSize(r.Header) > cfg.MaxQueryHeaderBytes {
+			http.Error(w, "query headers too large", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		limitBody(w, r, cfg.MaxQueryBody)
+		next(w, r)
+	}
+}
+
+// limitBody makes reading more than limit bytes of r's body fail, so that a
+// caller can't stream an unbounded body into a decoder; zero disables it.
+// The error is reported with bodyErrorStatus.
+func limitBody(w http.ResponseWriter, r *http.Request, limit int64) {
+	if limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+}
+
+// bodyErrorStatus is the status for a request body that couldn't be read or
+// decoded: 413 if it was over its limit, 400 otherwise.
+func bodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// headerSize is the size of h as "Name: value\r\n" lines.
+func headerSize(h http.Header) int {
+	size := 0
+	for name, values := range h {
+		for _, value := range values {
+			size += len(name) + len(value) + len(": \r\n")
+		}
+	}
+	return size
+}
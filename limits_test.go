@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOversizedQueriesAreRefused(t *testing.T) {
+	s, ts := newTestServer(t, "-max-query-url", "64", "-max-query-header-bytes", "512")
+	connectClient(t, s, ts, "db-1").echo("x")
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		header http.Header
+		want   int
+	}{
+		{"within the limits", "q=short", nil, http.StatusOK},
+		{"long URL", "q=" + strings.Repeat("a", 64), nil, http.StatusRequestURITooLong},
+		{"large headers", "q=headers", http.Header{"X-Padding": {strings.Repeat("a", 512)}}, http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		if resp, body := do(t, "GET", ts.URL+"/query/db-1?"+tc.query, nil, tc.header); resp.StatusCode != tc.want {
+			t.Errorf("query with %s got %s: %s, want %d", tc.name, resp.Status, body, tc.want)
+		}
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	if got := headerSize(http.Header{"A": {"1", "22"}, "Bb": {""}}); got != len("A: 1\r\nA: 22\r\nBb: \r\n") {
+		t.Errorf("headerSize = %d", got)
+	}
+}
+
+func TestOversizedBodiesAreRefused(t *testing.T) {
+	s, ts := newTestServer(t, "-max-register-body", "64", "-max-query-body", "128")
+	connectClient(t, s, ts, "db-1").serve(func(query queryMessage) replyMessage {
+		return replyMessage{Body: query.Body}
+	})
+
+	for _, tc := range []struct {
+		path string
+		body string
+		want int
+	}{
+		{"/register", `{"client_id":"db-2"}`, http.StatusOK},
+		{"/register", `{"client_id":"db-2","tenant":"` + strings.Repeat("a", 64) + `"}`, http.StatusRequestEntityTooLarge},
+		{"/query/db-1", strings.Repeat("a", 128), http.StatusOK},
+		{"/query/db-1", strings.Repeat("a", 129), http.StatusRequestEntityTooLarge},
+		{"/command/db-1", `"` + strings.Repeat("a", 128) + `"`, http.StatusRequestEntityTooLarge},
+	} {
+		if resp, body := do(t, "POST", ts.URL+tc.path, tc.body, nil); resp.StatusCode != tc.want {
+			t.Errorf("%d byte POST %s got %s: %s, want %d", len(tc.body), tc.path, resp.Status, body, tc.want)
+		}
+	}
+}
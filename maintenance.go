@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// For outages where the clients are gone but the cache still holds recent
+// replies, an administrator can put the proxy in maintenance mode with POST
+// /admin/maintenance, and take it out with DELETE. In maintenance mode no
+// query is sent to a client at all: GET /query and /query-batch are answered
+// from the cache whatever the age of the entry, with Age, X-Cache and a
+// Warning header saying the reply comes from the cache under maintenance,
+//
+//	Warning: 199 - "served from cache in maintenance mode"
+//	Warning: 110 - "Response is Stale"
+//
+// the second only for expired entries. A query with nothing cached gets 503,
+// as do POST /query and /command, which can't be answered from the cache.
+// Clients stay connected and pushes are still cached meanwhile. The mode
+// isn't persisted; a restart leaves it.
+
+var errMaintenance = errors.New("proxy is in maintenance mode")
+
+const (
+	maintenanceWarning = `199 - "served from cache in maintenance mode"`
+	staleWarning       = `110 - "Response is Stale"`
+)
+
+func (s *Server) handleMaintenanceOn(w http.ResponseWriter, r *http.Request) {
+	s.setMaintenance(w, true)
+}
+
+func (s *Server) handleMaintenanceOff(w http.ResponseWriter, r *http.Request) {
+	s.setMaintenance(w, false)
+}
+
+func (s *Server) setMaintenance(w http.ResponseWriter, on bool) {
+	if s.maintenance.Swap(on) != on {
+		if on {
+			log.Printf("Entered maintenance mode: serving queries from the cache only")
+		} else {
+			log.Printf("Left maintenance mode")
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Maintenance bool `json:"maintenance"`
+	}{
+		Maintenance: on,
+	})
+}
+
+// maintenanceLookup returns what is cached under key, however old, and
+// whether it has expired.
+func (s *Server) maintenanceLookup(key string) (ClientResponse, bool, error) {
+	cached, ok := s.lookupAnyCache(key)
+	if !ok {
+		return ClientResponse{}, false, fmt.Errorf("%w: %w", errMaintenance, errNotCached)
+	}
+	return cached, time.Since(cached.Timestamp) >= cached.TTL, nil
+}
+
+// serveMaintenance answers a GET /query in maintenance mode.
+func (s *Server) serveMaintenance(w http.ResponseWriter, r *http.Request, clientID, key string, start time.Time) {
+	cached, stale, err := s.maintenanceLookup(key)
+	if err != nil {
+		s.recordQuery(clientID, "miss", start, err)
+		writeQueryError(w, err)
+		return
+	}
+
+	outcome := "hit"
+	w.Header().Add("Warning", maintenanceWarning)
+	if stale {
+		outcome = "stale"
+		w.Header().Add("Warning", staleWarning)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(cached.Timestamp).Seconds())))
+	w.Header().Set("X-Cache", strings.ToUpper(outcome))
+	s.writeReply(w, r, s.cachedReply(r, cached))
+	s.recordQuery(clientID, outcome, start, nil)
+}
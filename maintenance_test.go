@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceServesTheCacheOnly(t *testing.T) {
+	s, ts := newTestServer(t)
+	var queries atomic.Int32
+	connectClient(t, s, ts, "db-1").serve(func(queryMessage) replyMessage {
+		return replyMessage{Body: fmt.Sprint(queries.Add(1))}
+	})
+	do(t, "GET", ts.URL+"/query/db-1?q=fresh", nil, nil)
+	do(t, "GET", ts.URL+"/query/db-1?q=old", nil, nil)
+	key := s.cacheKey("db-1", "q=old")
+	s.cacheMutex.Lock()
+	old := s.cache[key]
+	old.Timestamp = old.Timestamp.Add(-time.Hour)
+	s.cache[key] = old
+	s.cacheMutex.Unlock()
+
+	if resp, body := do(t, "POST", ts.URL+"/admin/maintenance", nil, adminHeader()); resp.StatusCode != http.StatusOK || string(body) != "{\"maintenance\":true}\n" {
+		t.Fatalf("entering maintenance got %s: %s", resp.Status, body)
+	}
+
+	resp, body := do(t, "GET", ts.URL+"/query/db-1?q=fresh", nil, nil)
+	if string(body) != "1" || resp.Header.Get("X-Cache") != "HIT" || len(resp.Header.Values("Warning")) != 1 {
+		t.Errorf("fresh entry got %q with X-Cache %q and Warning %q", body, resp.Header.Get("X-Cache"), resp.Header.Values("Warning"))
+	}
+	resp, body = do(t, "GET", ts.URL+"/query/db-1?q=old", nil, nil)
+	if string(body) != "2" || resp.Header.Get("X-Cache") != "STALE" {
+		t.Errorf("expired entry got %q with X-Cache %q, want it served stale", body, resp.Header.Get("X-Cache"))
+	}
+	if warnings := resp.Header.Values("Warning"); len(warnings) != 2 || warnings[0] != maintenanceWarning || warnings[1] != staleWarning {
+		t.Errorf("expired entry got Warning %q", warnings)
+	}
+
+	for _, tc := range []struct{ method, path string }{
+		{"GET", "/query/db-1?q=uncached"},
+		{"POST", "/query/db-1"},
+		{"POST", "/command/db-1"},
+	} {
+		if resp, body := do(t, tc.method, ts.URL+tc.path, `{"op":"status"}`, nil); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s %s in maintenance got %s: %s, want 503", tc.method, tc.path, resp.Status, body)
+		}
+	}
+	batch := queryBatch(t, ts.URL, batchQuery{ClientID: "db-1", Query: "q=old"}, batchQuery{ClientID: "db-1", Query: "q=uncached"})
+	if batch.Results[0].Body != "2" || batch.Results[1].Status != http.StatusServiceUnavailable {
+		t.Errorf("batch in maintenance got %+v", batch.Results)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("client got %d queries in maintenance", n-2)
+	}
+
+	do(t, "DELETE", ts.URL+"/admin/maintenance", nil, adminHeader())
+	if _, body := do(t, "GET", ts.URL+"/query/db-1?q=uncached", nil, nil); string(body) != "3" {
+		t.Errorf("query after maintenance got %q, want a live reply", body)
+	}
+}
+
+func TestMaintenanceNeedsAdmin(t *testing.T) {
+	s, ts := newTestServer(t)
+	if resp, _ := do(t, "POST", ts.URL+"/admin/maintenance", nil, nil); resp.StatusCode != http.StatusUnauthorized || s.maintenance.Load() {
+		t.Errorf("entering maintenance without admin got %s", resp.Status)
+	}
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var metricsLabels = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics are exposed at /metrics in the Prometheus text format. Counters are
+// keyed by name plus labels; gauges are computed when scraped, labeled ones
+// as one value per label value.
+type metrics struct {
+	counters      map[string]float64
+	counterHelp   map[string]string
+	gauges        map[string]func() float64
+	gaugeHelp     map[string]string
+	labeledGauges map[string]labeledGauge
+	mutex         sync.Mutex
+}
+
+type labeledGauge struct {
+	label  string
+	help   string
+	values func() map[string]float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		counters:      make(map[string]float64),
+		counterHelp:   make(map[string]string),
+		gauges:        make(map[string]func() float64),
+		gaugeHelp:     make(map[string]string),
+		labeledGauges: make(map[string]labeledGauge),
+	}
+}
+
+// incCounter adds one to the counter name with the given label pairs, e.g.
+// incCounter("proxy_queries_total", "cache", "hit").
+func (s *Server) incCounter(name string, labelPairs ...string) {
+	key := name
+	if len(labelPairs) > 0 {
+		var labels []string
+		for i := 0; i+1 < len(labelPairs); i += 2 {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, labelPairs[i], metricsLabels.Replace(labelPairs[i+1])))
+		}
+		key += "{" + strings.Join(labels, ",") + "}"
+	}
+
+	s.metrics.mutex.Lock()
+	s.metrics.counters[key]++
+	s.metrics.mutex.Unlock()
+}
+
+func (s *Server) describeCounter(name, help string) {
+	s.metrics.mutex.Lock()
+	s.metrics.counterHelp[name] = help
+	s.metrics.mutex.Unlock()
+}
+
+func (s *Server) registerGauge(name, help string, value func() float64) {
+	s.metrics.mutex.Lock()
+	s.metrics.gauges[name] = value
+	s.metrics.gaugeHelp[name] = help
+	s.metrics.mutex.Unlock()
+}
+
+// registerLabeledGauge adds a gauge with one series per key of the map
+// values returns, labeled label="key".
+func (s *Server) registerLabeledGauge(name, help, label string, values func() map[string]float64) {
+	s.metrics.mutex.Lock()
+	s.metrics.labeledGauges[name] = labeledGauge{label: label, help: help, values: values}
+	s.metrics.mutex.Unlock()
+}
+
+// registerMetrics describes the server's counters and gauges so they show up
+// in /metrics before their first increment.
+func (s *Server) registerMetrics() {
+	s.describeCounter("proxy_queries_total", "Queries handled, by cache outcome.")
+	s.describeCounter("proxy_query_timeouts_total", "Queries that timed out waiting for the client.")
+	s.describeCounter("proxy_client_replies_total", "Replies received from clients, by the status they reported.")
+	s.describeCounter("proxy_query_failovers_total", "Queries retried on another connection after a 5xx reply.")
+	s.describeCounter("proxy_quorum_disagreements_total", "Quorum reads that failed because the replies disagreed.")
+	s.describeCounter("proxy_registrations_saturated_total", "Registrations refused because -max-concurrent-registrations were already being handled.")
+	s.describeCounter("proxy_cache_precompressed_hits_total", "Cache hits served the entry's stored gzip-compressed body.")
+	s.describeCounter("proxy_commands_denied_total", "Commands refused because a command policy doesn't allow their type.")
+	s.describeCounter("proxy_flapping_responses_total", "Times a cache key's replies started changing from one to the next more often than -flap-threshold.")
+	s.describeCounter("proxy_shadow_queries_total", "Queries mirrored to shadow clients, by outcome.")
+	s.describeCounter("proxy_query_resends_total", "Queries re-sent after their client reconnected.")
+	s.describeCounter("proxy_cache_invalidations_total", "Invalidation messages received from clients.")
+	s.describeCounter("proxy_cache_evictions_total", "Cache entries evicted to stay within -max-cache-entries or -max-cache-bytes, by the limit.")
+	s.describeCounter("proxy_hooks_dropped_total", "Hook calls dropped because the hook queue was full.")
+	s.describeCounter("proxy_panics_total", "Panics recovered, by where they happened.")
+	s.describeCounter("proxy_clients_marked_unhealthy_total", "Times a connection was marked unhealthy after consecutive query timeouts.")
+	s.describeCounter("proxy_websocket_errors_total", "Errors reading from or writing to client connections, by op and kind.")
+	s.describeCounter("proxy_connections_torn_down_total", "Client connections closed after consecutive failed query writes.")
+	s.describeCounter("proxy_client_connections_total", "Client connections accepted.")
+	s.describeCounter("proxy_connection_auth_total", "Connection challenge-responses, by outcome.")
+	s.describeCounter("proxy_client_limit_rejections_total", "Registrations and connections refused by -max-client-ids or -max-connections-per-client, by limit.")
+	s.describeCounter("proxy_dropped_messages_total", "Client pushes dropped because the connection's push buffer was full.")
+	s.describeCounter("proxy_pending_evictions_total", "Pending queries evicted because their connection reached -max-pending.")
+	s.describeCounter("proxy_stream_overruns_total", "Streamed queries failed because the client sent chunks faster than the caller read them.")
+	s.describeCounter("proxy_replica_updates_skipped_total", "Cache updates a replica skipped because they were larger than its own -max-cache-body allows.")
+	s.describeCounter("proxy_orphan_replies_total", "Replies dropped because their request_id wasn't pending.")
+	s.describeCounter("proxy_traces_dropped_total", "Query trace records dropped because the trace writer fell behind.")
+	s.describeCounter("proxy_slow_readers_total", "Query responses cut off because the caller read them too slowly.")
+
+	s.registerGauge("proxy_connected_clients", "Live client connections.", func() float64 {
+		return float64(len(s.connectedClients()))
+	})
+	s.registerGauge("proxy_client_ids", "Client IDs with at least one live connection.", func() float64 {
+		s.clientsMutex.RLock()
+		defer s.clientsMutex.RUnlock()
+		return float64(len(s.clients))
+	})
+	s.registerGauge("proxy_registered_clients", "Client IDs registered.", func() float64 {
+		s.registrationsMutex.RLock()
+		defer s.registrationsMutex.RUnlock()
+		return float64(len(s.registrations))
+	})
+	s.registerGauge("proxy_warming_connections", "Live client connections still within -client-warmup.", s.warmingConnections)
+	s.registerLabeledGauge("proxy_client_outstanding_bytes", "Reply bytes being written to callers for each client ID.", "client_id", s.clientOutstandingBytes)
+	s.registerLabeledGauge("proxy_client_id_connections", "Live connections of each client ID.", "client_id", s.clientIDConnections)
+	s.registerGauge("proxy_backpressure", "1 while clients are told to hold off unsolicited messages, else 0.", func() float64 {
+		if s.backpressure.Load() {
+			return 1
+		}
+		return 0
+	})
+	s.registerGauge("proxy_maintenance", "1 while queries are answered from the cache alone, else 0.", func() float64 {
+		if s.maintenance.Load() {
+			return 1
+		}
+		return 0
+	})
+	s.registerLabeledGauge("proxy_client_rtt_seconds", "Average websocket ping round-trip time of each client ID's connections.", "client_id", s.clientRTTs)
+	s.registerLabeledGauge("proxy_client_pending", "Queries waiting on a reply from each client ID's connections.", "client_id", s.clientPending)
+	s.registerGauge("proxy_cache_entries", "Entries in the cache.", func() float64 {
+		entries, _ := s.cacheSize()
+		return float64(entries)
+	})
+	s.registerGauge("proxy_cache_bytes", "Estimated memory used by the cache, in bytes.", func() float64 {
+		_, bytes := s.cacheSize()
+		return float64(bytes)
+	})
+	s.registerGauge("proxy_push_subscribers", "Open /subscribe streams.", func() float64 {
+		return float64(s.pushSubscriptions.count())
+	})
+	s.registerGauge("proxy_unhealthy_clients", "Live client connections currently marked unhealthy.", func() float64 {
+		n := 0
+		for _, client := range s.connectedClients() {
+			if client.unhealthy.Load() {
+				n++
+			}
+		}
+		return float64(n)
+	})
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.metrics.mutex.Lock()
+	byName := make(map[string][]string)
+	for key := range s.metrics.counters {
+		name, _, _ := strings.Cut(key, "{")
+		byName[name] = append(byName[name], key)
+	}
+	for name := range s.metrics.counterHelp {
+		if _, ok := byName[name]; !ok {
+			byName[name] = nil
+		}
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		if help, ok := s.metrics.counterHelp[name]; ok {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(&b, "# TYPE %s counter\n", name)
+		keys := byName[name]
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s %g\n", key, s.metrics.counters[key])
+		}
+	}
+
+	gaugeNames := make([]string, 0, len(s.metrics.gauges))
+	for name := range s.metrics.gauges {
+		gaugeNames = append(gaugeNames, name)
+	}
+	sort.Strings(gaugeNames)
+	gaugeFuncs := make([]func() float64, len(gaugeNames))
+	gaugeHelps := make([]string, len(gaugeNames))
+	for i, name := range gaugeNames {
+		gaugeFuncs[i] = s.metrics.gauges[name]
+		gaugeHelps[i] = s.metrics.gaugeHelp[name]
+	}
+	labeledNames := make([]string, 0, len(s.metrics.labeledGauges))
+	for name := range s.metrics.labeledGauges {
+		labeledNames = append(labeledNames, name)
+	}
+	sort.Strings(labeledNames)
+	labeled := make([]labeledGauge, len(labeledNames))
+	for i, name := range labeledNames {
+		labeled[i] = s.metrics.labeledGauges[name]
+	}
+	s.metrics.mutex.Unlock()
+
+	// Gauges may take other locks, so they are evaluated outside
+	// metricsMutex.
+	for i, name := range gaugeNames {
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, gaugeHelps[i])
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(&b, "%s %g\n", name, gaugeFuncs[i]())
+	}
+	for i, name := range labeledNames {
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, labeled[i].help)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", name)
+		values := labeled[i].values()
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s{%s=\"%s\"} %g\n", name, labeled[i].label, metricsLabels.Replace(key), values[key])
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
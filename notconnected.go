@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// With -not-connected-ttl set, a query that finds its client not connected
+// starts a window of that length during which further queries for the client
+// get the same 404 without looking for a connection, all with a Retry-After
+// pointing at the end of the window, so callers back off together instead of
+// each on its own schedule. Cache hits are still served and fallbacks still
+// apply. The window closes as soon as the client connects.
+
+// checkNotConnected reports whether clientID is inside a not-connected
+// window, setting Retry-After on w if it is.
+func (s *Server) checkNotConnected(w http.ResponseWriter, clientID string) bool {
+	s.notConnectedMutex.Lock()
+	until, ok := s.notConnectedUntil[clientID]
+	if ok && !time.Now().Before(until) {
+		delete(s.notConnectedUntil, clientID)
+		ok = false
+	}
+	s.notConnectedMutex.Unlock()
+
+	if ok {
+		setRetryAfter(w, until)
+	}
+	return ok
+}
+
+// noteNotConnected opens a not-connected window for clientID if err says it
+// has no connection, setting Retry-After on w.
+func (s *Server) noteNotConnected(w http.ResponseWriter, clientID string, err error) {
+	ttl := s.currentConfig().NotConnectedTTL
+	if ttl <= 0 || !errors.Is(err, errClientNotConnected) {
+		return
+	}
+
+	// Holding clientsMutex orders this against addClient, so a client that
+	// connects in the meantime never finds a stale window.
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	if set, ok := s.clients[clientID]; ok && len(set.conns) > 0 {
+		return
+	}
+
+	s.notConnectedMutex.Lock()
+	until, ok := s.notConnectedUntil[clientID]
+	if !ok || !time.Now().Before(until) {
+		until = time.Now().Add(ttl)
+		s.notConnectedUntil[clientID] = until
+	}
+	s.notConnectedMutex.Unlock()
+	setRetryAfter(w, until)
+}
+
+// clearNotConnectedLocked closes clientID's window. Callers must hold
+// clientsMutex for writing.
+func (s *Server) clearNotConnectedLocked(clientID string) {
+	s.notConnectedMutex.Lock()
+	delete(s.notConnectedUntil, clientID)
+	s.notConnectedMutex.Unlock()
+}
+
+func setRetryAfter(w http.ResponseWriter, until time.Time) {
+	seconds := int(math.Ceil(time.Until(until).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
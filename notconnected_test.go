@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestNotConnectedWindow(t *testing.T) {
+	s, ts := newTestServer(t, "-not-connected-ttl", "1m")
+	first, _ := do(t, "GET", ts.URL+"/query/db-1?q=1", nil, nil)
+	second, _ := do(t, "GET", ts.URL+"/query/db-1?q=2", nil, nil)
+	if first.StatusCode != http.StatusNotFound || second.StatusCode != http.StatusNotFound {
+		t.Fatalf("queries to a missing client got %s and %s, want 404", first.Status, second.Status)
+	}
+	if !s.checkNotConnected(httptest.NewRecorder(), "db-1") {
+		t.Fatal("no not-connected window was opened")
+	}
+	for _, resp := range []*http.Response{first, second} {
+		if retry, _ := strconv.Atoi(resp.Header.Get("Retry-After")); retry < 50 {
+			t.Errorf("Retry-After %q, want the end of the minute-long window", resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// Connecting closes the window at once.
+	connectClient(t, s, ts, "db-1").echo("back")
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1?q=3", nil, nil); resp.StatusCode != http.StatusOK || string(body) != "back" {
+		t.Errorf("query after the client connected got %s %q, want its answer", resp.Status, body)
+	}
+}
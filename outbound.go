@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits on queries bound how many replies a client has under way, but not
+// how big they are: a few large replies to callers reading them slowly can
+// hold a lot of memory. With -max-client-outstanding-bytes, the reply bytes
+// each client ID has being written to callers, whole bodies and the stream
+// chunk being written, are counted, and a query or command for a client ID
+// at or over the budget fails with 503 before it is sent. Cache hits are
+// still served. The counts show in proxy_client_outstanding_bytes.
+
+// errClientOverBudget wraps errClientBusy so it is reported the same way.
+var errClientOverBudget = fmt.Errorf("%w: too many reply bytes outstanding for the client", errClientBusy)
+
+// holdReplyBytes counts n bytes of a reply to r against its client ID
+// until the returned function is called.
+func (s *Server) holdReplyBytes(r *http.Request, n int) func() {
+	clientID := mux.Vars(r)["clientID"]
+	if clientID == "" || n == 0 {
+		return func() {}
+	}
+	s.outstandingMutex.Lock()
+	s.outstandingBytes[clientID] += int64(n)
+	s.outstandingMutex.Unlock()
+
+	return func() {
+		s.outstandingMutex.Lock()
+		defer s.outstandingMutex.Unlock()
+		if s.outstandingBytes[clientID] -= int64(n); s.outstandingBytes[clientID] <= 0 {
+			delete(s.outstandingBytes, clientID)
+		}
+	}
+}
+
+// checkReplyBudget returns errClientOverBudget if clientID has as many
+// reply bytes outstanding as -max-client-outstanding-bytes allows.
+func (s *Server) checkReplyBudget(clientID string) error {
+	limit := s.currentConfig().MaxClientOutstandingBytes
+	if limit <= 0 {
+		return nil
+	}
+	s.outstandingMutex.Lock()
+	defer s.outstandingMutex.Unlock()
+	if s.outstandingBytes[clientID] >= limit {
+		return errClientOverBudget
+	}
+	return nil
+}
+
+// clientOutstandingBytes returns the reply bytes outstanding per client ID,
+// for proxy_client_outstanding_bytes.
+func (s *Server) clientOutstandingBytes() map[string]float64 {
+	s.outstandingMutex.Lock()
+	defer s.outstandingMutex.Unlock()
+
+	bytes := make(map[string]float64, len(s.outstandingBytes))
+	for id, n := range s.outstandingBytes {
+		bytes[id] = float64(n)
+	}
+	return bytes
+}
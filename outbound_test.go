@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// holdFor counts n reply bytes against clientID, as a reply being written
+// would, until the returned function is called.
+func holdFor(s *Server, clientID string, n int) func() {
+	r := mux.SetURLVars(httptest.NewRequest("GET", "/query/"+clientID, nil), map[string]string{"clientID": clientID})
+	return s.holdReplyBytes(r, n)
+}
+
+func TestQueriesFailWhileClientIsOverItsReplyBudget(t *testing.T) {
+	s, ts := newTestServer(t, "-max-client-outstanding-bytes", "100")
+	connectClient(t, s, ts, "db-1").echo("ok")
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1?q=cached", nil, nil); string(body) != "ok" {
+		t.Fatalf("query got %s: %s", resp.Status, body)
+	}
+
+	release := holdFor(s, "db-1", 100)
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1?q=live", nil, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("query over the budget got %s: %s, want 503", resp.Status, body)
+	}
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1?q=cached", nil, nil); string(body) != "ok" {
+		t.Errorf("cache hit over the budget got %s: %s, want it served", resp.Status, body)
+	}
+	if resp, body := do(t, "GET", ts.URL+"/query/db-2", nil, nil); resp.StatusCode == http.StatusServiceUnavailable {
+		t.Errorf("other client ID got %s: %s under db-1's budget", resp.Status, body)
+	}
+
+	release()
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1?q=live", nil, nil); string(body) != "ok" {
+		t.Errorf("query after the bytes were written got %s: %s", resp.Status, body)
+	}
+}
+
+func TestOutstandingBytesAreCountedPerClient(t *testing.T) {
+	s, _ := newTestServer(t)
+	first, second := holdFor(s, "db-1", 10), holdFor(s, "db-1", 5)
+	holdFor(s, "db-2", 7)
+	if got := s.clientOutstandingBytes(); got["db-1"] != 15 || got["db-2"] != 7 {
+		t.Errorf("outstanding bytes %v, want db-1 15 and db-2 7", got)
+	}
+
+	first()
+	second()
+	if _, ok := s.clientOutstandingBytes()["db-1"]; ok {
+		t.Error("db-1 still listed once its replies were written")
+	}
+}
+
+func TestNoReplyBudgetByDefault(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer holdFor(s, "db-1", 1<<30)()
+	if err := s.checkReplyBudget("db-1"); err != nil {
+		t.Errorf("checkReplyBudget without a limit: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A fan-in request is only as fast as its slowest client. A /query-batch,
+// or a concat X-Aggregate query, with X-Partial-Deadline (a Go duration or a
+// number of seconds, like X-Query-Timeout) is answered once that deadline
+// passes with whatever has arrived, rather than when the last query times
+// out. The queries still out are cancelled, which the clients hear as a
+// cancel with reason timeout, and the response is 206 Partial Content:
+//
+//	{"results":[{"client_id":"a","status":200,"body":"...","complete":true},
+//	            {"client_id":"b","status":504,"error":"...","complete":false,"retryable":true}]}
+//
+// Every batch result says whether it is complete; aggregated queries count
+// the connections cut off in X-Aggregate-Failures. A request done before its
+// deadline is answered as usual, and a deadline longer than the query
+// timeout changes nothing. An aggregated query with no success by the
+// deadline fails as if the connections cut off had failed, with 504 if none
+// had answered at all.
+
+var (
+	errInvalidPartialDeadline = errors.New("invalid X-Partial-Deadline")
+	// errPartialDeadline wraps errQueryTimeout so it is reported the same
+	// way.
+	errPartialDeadline = fmt.Errorf("%w: partial deadline passed before the client replied", errQueryTimeout)
+)
+
+// partialDeadline returns the X-Partial-Deadline of r, zero if it has none.
+func partialDeadline(r *http.Request) (time.Duration, error) {
+	header := r.Header.Get("X-Partial-Deadline")
+	if header == "" {
+		return 0, nil
+	}
+	deadline, err := parseTimeoutHeader(header)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errInvalidPartialDeadline, err)
+	}
+	return deadline, nil
+}
+
+// partialContext returns the context for the queries of a fan-in request
+// with the given partial deadline, and the channel that closes when it
+// passes, nil without one.
+func partialContext(r *http.Request, deadline time.Duration) (context.Context, context.CancelFunc, <-chan struct{}) {
+	if deadline <= 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), deadline)
+	return ctx, cancel, ctx.Done()
+}
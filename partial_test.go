@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestBatchAnsweredAtPartialDeadline(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "a").echo("fast")
+	slow := connectClient(t, s, ts, "b")
+
+	result := goPost(ts.URL+"/query-batch", `{"queries":[{"client_id":"a"},{"client_id":"b"}]}`, http.Header{"X-Partial-Deadline": {"100ms"}})
+	query := slow.readQuery()
+	if cancel := slow.readCancel(); cancel.RequestID != query.RequestID || cancel.Reason != "timeout" {
+		t.Errorf("cut-off query cancelled with %+v, want reason timeout", cancel)
+	}
+
+	r := <-result
+	var batch batchResponse
+	if r.err != nil || r.status != http.StatusPartialContent || json.Unmarshal([]byte(r.body), &batch) != nil || len(batch.Results) != 2 {
+		t.Fatalf("batch got %d %q %v, want 206 with both results", r.status, r.body, r.err)
+	}
+	if a := batch.Results[0]; !a.Complete || a.Body != "fast" {
+		t.Errorf("answered entry %+v, want it complete", a)
+	}
+	if b := batch.Results[1]; b.Complete || b.Status != http.StatusGatewayTimeout || !b.Retryable {
+		t.Errorf("cut-off entry %+v, want an incomplete, retryable 504", b)
+	}
+}
+
+func TestBatchDoneBeforeItsPartialDeadline(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "a").echo("fast")
+
+	r := <-goPost(ts.URL+"/query-batch", `{"queries":[{"client_id":"a"}]}`, http.Header{"X-Partial-Deadline": {"5s"}})
+	var batch batchResponse
+	if r.status != http.StatusOK || json.Unmarshal([]byte(r.body), &batch) != nil || !batch.Results[0].Complete {
+		t.Errorf("batch got %d %q, want 200 with a complete result", r.status, r.body)
+	}
+}
+
+func TestConcatAnsweredAtPartialDeadline(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "shards").echo(`{"shard":1}`)
+	slow := connectClient(t, s, ts, "shards")
+	header := http.Header{"X-Aggregate": {"concat"}, "X-Partial-Deadline": {"100ms"}}
+
+	result := goGet(ts.URL+"/query/shards", header)
+	slow.readQuery()
+	r := <-result
+	if r.status != http.StatusPartialContent || r.body != `[{"shard":1}]` || r.header.Get("X-Aggregate-Failures") != "1" {
+		t.Errorf("concat got %d %q with failures %q, want 206 with the one reply", r.status, r.body, r.header.Get("X-Aggregate-Failures"))
+	}
+}
+
+func TestConcatWithNoReplyByThePartialDeadline(t *testing.T) {
+	s, ts := newTestServer(t)
+	slow := connectClient(t, s, ts, "shards")
+
+	result := goGet(ts.URL+"/query/shards", http.Header{"X-Aggregate": {"concat"}, "X-Partial-Deadline": {"50ms"}})
+	slow.readQuery()
+	if r := <-result; r.status != http.StatusGatewayTimeout {
+		t.Errorf("concat with no reply got %d %q, want 504", r.status, r.body)
+	}
+}
+
+func TestInvalidPartialDeadline(t *testing.T) {
+	_, ts := newTestServer(t)
+	if r := <-goPost(ts.URL+"/query-batch", `{"queries":[{"client_id":"a"}]}`, http.Header{"X-Partial-Deadline": {"soon"}}); r.status != http.StatusBadRequest {
+		t.Errorf("X-Partial-Deadline soon got %d %q, want 400", r.status, r.body)
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// A client can be paused for maintenance on its backend with POST
+// /admin/clients/{clientID}/pause, which is lighter than draining it: its
+// connections stay open and nothing is failed, but no new query is sent to
+// them. With -paused-queries queue, the default, queries wait in the
+// connection's queue, up to -max-queued as usual and with their timeout
+// running; with reject they get 503 at once. Queries already sent finish
+// normally. POST /admin/clients/{clientID}/resume lets the queue run again:
+// with -resume-order priority, the default, highest priority first as usual,
+// and with fifo in the order the queries arrived, until the queries that
+// were waiting at the resume have all gone out. Either way, a query whose
+// timeout ran out while it waited fails with 504 instead of being sent. A
+// pause lasts until resumed, across reconnects, and cache hits are served
+// throughout.
+
+// errClientPaused wraps errClientBusy so it is reported the same way.
+var errClientPaused = fmt.Errorf("%w: client is paused", errClientBusy)
+
+var (
+	pausedQueryModes = map[string]bool{"queue": true, "reject": true}
+	resumeOrders     = map[string]bool{"priority": true, "fifo": true}
+)
+
+func (s *Server) clientPaused(clientID string) bool {
+	s.pausedClientsMutex.RLock()
+	defer s.pausedClientsMutex.RUnlock()
+	return s.pausedClients[clientID]
+}
+
+type pauseResult struct {
+	Connections int `json:"connections"`
+	// Queued is how many queries were waiting on the client's connections
+	// when the request was handled.
+	Queued int `json:"queued"`
+}
+
+func (s *Server) handleClientPause(w http.ResponseWriter, r *http.Request) {
+	s.setClientPaused(w, mux.Vars(r)["clientID"], true)
+}
+
+func (s *Server) handleClientResume(w http.ResponseWriter, r *http.Request) {
+	s.setClientPaused(w, mux.Vars(r)["clientID"], false)
+}
+
+func (s *Server) setClientPaused(w http.ResponseWriter, clientID string, paused bool) {
+	s.pausedClientsMutex.Lock()
+	if paused {
+		s.pausedClients[clientID] = true
+	} else {
+		delete(s.pausedClients, clientID)
+	}
+	s.pausedClientsMutex.Unlock()
+
+	var conns []*Client
+	s.clientsMutex.RLock()
+	if set, ok := s.clients[clientID]; ok {
+		conns = append(conns, set.conns...)
+	}
+	s.clientsMutex.RUnlock()
+
+	result := pauseResult{Connections: len(conns)}
+	for _, client := range conns {
+		result.Queued += client.setPaused(paused)
+	}
+	if paused {
+		log.Printf("Paused client %s (%d connections)", clientID, result.Connections)
+	} else {
+		log.Printf("Resumed client %s (%d connections, %d queued queries)", clientID, result.Connections, result.Queued)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// setPaused pauses or resumes the connection and returns how many queries
+// were waiting on it. Resuming hands free slots to the waiting queries.
+func (c *Client) setPaused(paused bool) int {
+	c.slotMutex.Lock()
+	defer c.slotMutex.Unlock()
+
+	queued := len(c.queue)
+	c.paused = paused
+	if !paused {
+		c.fifoUntil = 0
+		if c.server.currentConfig().ResumeOrder == "fifo" {
+			c.fifoUntil = c.queueSeq
+		}
+	}
+	for !paused && len(c.queue) > 0 && c.inFlight < c.maxInFlight() {
+		c.inFlight++
+		if !c.grantLocked() {
+			c.inFlight--
+		}
+	}
+	return queued
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// pause pauses or resumes clientID and returns the result.
+func pause(t *testing.T, url, clientID, action string) pauseResult {
+	t.Helper()
+	resp, body := do(t, "POST", url+"/admin/clients/"+clientID+"/"+action, nil, adminHeader())
+	var result pauseResult
+	if err := json.Unmarshal(body, &result); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s got %s: %s", action, resp.Status, body)
+	}
+	return result
+}
+
+func TestPausedClientQueuesQueriesUntilResumed(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	cached := goGet(ts.URL+"/query/db-1?q=cached", nil)
+	client.reply(replyMessage{RequestID: client.readQuery().RequestID, Body: "cached"})
+	<-cached
+
+	pause(t, ts.URL, "db-1", "pause")
+	waiting := goGet(ts.URL+"/query/db-1?q=waiting", nil)
+	waitFor(t, "the query to queue", func() bool { return s.queued("db-1") == 1 })
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1?q=cached", nil, nil); string(body) != "cached" {
+		t.Errorf("cache hit for a paused client got %s %q", resp.Status, body)
+	}
+
+	if result := pause(t, ts.URL, "db-1", "resume"); result != (pauseResult{Connections: 1, Queued: 1}) {
+		t.Errorf("resume got %+v", result)
+	}
+	query := client.readQuery()
+	if query.Params["q"][0] != "waiting" {
+		t.Fatalf("client was sent %v after the resume, want the waiting query", query.Params)
+	}
+	client.reply(replyMessage{RequestID: query.RequestID, Body: "sent"})
+	if r := <-waiting; r.status != http.StatusOK || r.body != "sent" {
+		t.Errorf("waiting query got %d %q", r.status, r.body)
+	}
+}
+
+func TestPausedClientMayRejectQueries(t *testing.T) {
+	s, ts := newTestServer(t, "-paused-queries", "reject")
+	pause(t, ts.URL, "db-1", "pause")
+	// The pause holds across connecting.
+	connectClient(t, s, ts, "db-1")
+	if resp, _ := do(t, "GET", ts.URL+"/query/db-1", nil, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("query to a paused client got %s, want 503", resp.Status)
+	}
+}
+
+func TestResumeOrder(t *testing.T) {
+	for order, want := range map[string][]string{"priority": {"high", "low"}, "fifo": {"low", "high"}} {
+		t.Run(order, func(t *testing.T) {
+			s, ts := newTestServer(t, "-max-in-flight", "1", "-resume-order", order)
+			client := connectClient(t, s, ts, "db-1")
+			pause(t, ts.URL, "db-1", "pause")
+			goGet(ts.URL+"/query/db-1?q=low", priority(0))
+			waitFor(t, "the low-priority query to queue", func() bool { return s.queued("db-1") == 1 })
+			goGet(ts.URL+"/query/db-1?q=high", priority(5))
+			waitFor(t, "the high-priority query to queue", func() bool { return s.queued("db-1") == 2 })
+
+			pause(t, ts.URL, "db-1", "resume")
+			for _, q := range want {
+				query := client.readQuery()
+				if query.Params["q"][0] != q {
+					t.Fatalf("sent %v, want %s", query.Params, q)
+				}
+				client.reply(replyMessage{RequestID: query.RequestID})
+			}
+		})
+	}
+}
+
+func TestQueryExpiredWhilePausedIsNotSent(t *testing.T) {
+	s, ts := newTestServer(t, "-max-in-flight", "1")
+	client := connectClient(t, s, ts, "db-1")
+	pause(t, ts.URL, "db-1", "pause")
+	expired := goGet(ts.URL+"/query/db-1?q=expired", http.Header{"X-Query-Timeout": {"50ms"}})
+	waitFor(t, "the query to queue", func() bool { return s.queued("db-1") == 1 })
+	if r := <-expired; r.status != http.StatusGatewayTimeout {
+		t.Errorf("query that timed out while paused got %d, want 504", r.status)
+	}
+
+	live := goGet(ts.URL+"/query/db-1?q=live", nil)
+	waitFor(t, "the live query to queue", func() bool { return s.queued("db-1") >= 1 })
+	pause(t, ts.URL, "db-1", "resume")
+	query := client.readQuery()
+	if query.Params["q"][0] != "live" {
+		t.Fatalf("sent %v after the resume, want only the live query", query.Params)
+	}
+	client.reply(replyMessage{RequestID: query.RequestID, Body: "ok"})
+	if r := <-live; r.status != http.StatusOK {
+		t.Errorf("live query got %d", r.status)
+	}
+}
+
+func TestResumeOrderIsChecked(t *testing.T) {
+	if _, err := LoadConfig([]string{"-resume-order", "random"}); err == nil {
+		t.Error("LoadConfig accepted -resume-order random")
+	}
+}
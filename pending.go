@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+)
+
+// A connection's pending queries, those sent and waiting on a reply, are
+// bounded by its in-flight slots, and each one is removed when its caller
+// stops waiting. -max-pending is a safety net in case that accounting ever
+// goes wrong: a connection with that many pending already has its oldest
+// evicted to make room for a new one, failing it with errPendingEvicted and
+// logging it, since it points to a leak. proxy_client_pending shows how
+// many queries each client ID has pending across its connections.
+
+// errPendingEvicted wraps errClientBusy so it is reported the same way.
+var errPendingEvicted = fmt.Errorf("%w: query evicted from the connection's pending queries", errClientBusy)
+
+// evictOldestPendingLocked makes room for one more pending query if the
+// connection is at -max-pending. Callers must hold pendingMutex.
+func (c *Client) evictOldestPendingLocked() {
+	limit := c.server.currentConfig().MaxPending
+	if limit <= 0 || len(c.pending) < limit || len(c.pendingOrder) == 0 {
+		return
+	}
+	requestID := c.pendingOrder[0]
+	c.pendingOrder = c.pendingOrder[1:]
+	if p, ok := c.pending[requestID]; ok {
+		delete(c.pending, requestID)
+		close(p.evicted)
+	}
+	c.server.incCounter("proxy_pending_evictions_total")
+	log.Printf("Evicted query %s from client %s: %d queries pending", requestID, c.ID, limit)
+}
+
+// clientPending returns how many queries each client ID has pending, for
+// proxy_client_pending.
+func (s *Server) clientPending() map[string]float64 {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+
+	pending := make(map[string]float64)
+	for id, set := range s.clients {
+		n := 0
+		for _, client := range set.conns {
+			client.pendingMutex.Lock()
+			n += len(client.pending)
+			client.pendingMutex.Unlock()
+		}
+		pending[id] = float64(n)
+	}
+	return pending
+}
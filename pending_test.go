@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOldestPendingQueryIsEvictedAtTheLimit(t *testing.T) {
+	s, ts := newTestServer(t, "-max-pending", "1", "-max-in-flight", "2")
+	client := connectClient(t, s, ts, "db-1")
+
+	oldest := goGet(ts.URL+"/query/db-1?q=oldest", nil)
+	client.readQuery()
+	if pending := s.clientPending()["db-1"]; pending != 1 {
+		t.Fatalf("client has %v queries pending, want 1", pending)
+	}
+	newest := goGet(ts.URL+"/query/db-1?q=newest", nil)
+	query := client.readQuery()
+
+	if r := <-oldest; r.status != http.StatusServiceUnavailable {
+		t.Errorf("evicted query got %d %q, want 503", r.status, r.body)
+	}
+	client.reply(replyMessage{RequestID: query.RequestID, Body: "newest"})
+	if r := <-newest; r.status != http.StatusOK || r.body != "newest" {
+		t.Errorf("query that made room got %d %q", r.status, r.body)
+	}
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	if n := s.metrics.counters["proxy_pending_evictions_total"]; n != 1 {
+		t.Errorf("counted %v evictions, want 1", n)
+	}
+}
+
+func TestPendingLimitCanBeTurnedOff(t *testing.T) {
+	s, ts := newTestServer(t, "-max-pending", "0", "-max-in-flight", "3")
+	client := connectClient(t, s, ts, "db-1")
+	for _, q := range []string{"a", "b", "c"} {
+		goGet(ts.URL+"/query/db-1?q="+q, nil)
+		client.readQuery()
+	}
+	if pending := s.clientPending()["db-1"]; pending != 3 {
+		t.Errorf("client has %v queries pending, want all 3", pending)
+	}
+}
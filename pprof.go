@@ -0,0 +1,19 @@
+package proxy
+
+import (
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+// registerPprof mounts the net/http/pprof handlers under /debug/pprof behind
+// admin auth. They are only registered when -pprof is set at startup; a
+// reload doesn't add or remove them.
+func (s *Server) registerPprof(r *mux.Router) {
+	r.HandleFunc("/debug/pprof/", s.requireAdmin(pprof.Index))
+	r.HandleFunc("/debug/pprof/cmdline", s.requireAdmin(pprof.Cmdline))
+	r.HandleFunc("/debug/pprof/profile", s.requireAdmin(pprof.Profile))
+	r.HandleFunc("/debug/pprof/symbol", s.requireAdmin(pprof.Symbol))
+	r.HandleFunc("/debug/pprof/trace", s.requireAdmin(pprof.Trace))
+	r.PathPrefix("/debug/pprof/").HandlerFunc(s.requireAdmin(pprof.Index))
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPprofIsServedToAdminsOnly(t *testing.T) {
+	_, ts := newTestServer(t, "-pprof")
+	resp, body := do(t, "GET", ts.URL+"/debug/pprof/goroutine?debug=1", nil, adminHeader())
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine") {
+		t.Errorf("goroutine profile got %s, want it served", resp.Status)
+	}
+	if resp, _ := do(t, "GET", ts.URL+"/debug/pprof/", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("pprof without credentials got %s, want 401", resp.Status)
+	}
+}
+
+func TestPprofIsOffByDefault(t *testing.T) {
+	_, ts := newTestServer(t)
+	if resp, _ := do(t, "GET", ts.URL+"/debug/pprof/", nil, adminHeader()); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("pprof without -pprof got %s, want 404", resp.Status)
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// minPrefetchInterval keeps a misconfigured client from having the server
+// query it in a tight loop.
+const minPrefetchInterval = time.Second
+
+// Prefetch asks the server to run a query against the client on a schedule
+// and keep its result in the cache, so the first real query for it is a hit.
+type Prefetch struct {
+	Interval time.Duration
+	Query    string
+}
+
+type prefetchRequest struct {
+	Interval string `json:"interval"`
+	Query    string `json:"query"`
+}
+
+func parsePrefetches(requests []prefetchRequest) ([]Prefetch, error) {
+	var prefetches []Prefetch
+	for _, p := range requests {
+		interval, err := time.ParseDuration(p.Interval)
+		if err != nil {
+			return nil, err
+		}
+		if interval < minPrefetchInterval {
+			return nil, errors.New("prefetch interval must be at least " + minPrefetchInterval.String())
+		}
+		if _, err := url.ParseQuery(p.Query); err != nil {
+			return nil, err
+		}
+		prefetches = append(prefetches, Prefetch{Interval: interval, Query: p.Query})
+	}
+	return prefetches, nil
+}
+
+// runPrefetches starts the scheduled prefetch queries that are due. Clients
+// that aren't connected are skipped until they are. Each run schedules the
+// next one an interval later, give or take the configured jitter.
+func (s *Server) runPrefetches() {
+	for {
+		time.Sleep(1 * time.Second)
+
+		// Prefetched replies would only be thrown away.
+		if !s.currentConfig().Cache {
+			continue
+		}
+
+		now := time.Now()
+		s.registrationsMutex.RLock()
+		var due []Prefetch
+		var dueClients []string
+		for id, registration := range s.registrations {
+			for _, p := range registration.Prefetch {
+				key := s.cacheKey(id, p.Query)
+				s.prefetchMutex.Lock()
+				if !now.Before(s.prefetchNextRun[key]) {
+					s.prefetchNextRun[key] = now.Add(s.jitter(p.Interval))
+					due = append(due, p)
+					dueClients = append(dueClients, id)
+				}
+				s.prefetchMutex.Unlock()
+			}
+		}
+		s.registrationsMutex.RUnlock()
+
+		for i, p := range due {
+			go s.prefetch(dueClients[i], p.Query)
+		}
+	}
+}
+
+// prefetch runs one scheduled query and stores its result in the cache. It
+// goes through queryClient like any other query, so it is skipped rather than
+// queued when the client or the server is already at its in-flight limit.
+func (s *Server) prefetch(clientID, rawQuery string) {
+	if !s.acquireQuerySlot() {
+		return
+	}
+	defer s.releaseQuerySlot()
+
+	params, _ := url.ParseQuery(rawQuery)
+	query := queryMessage{
+		Type:      "query",
+		RequestID: newRequestID(),
+		Command:   "GET_DATA",
+		Method:    http.MethodGet,
+		Params:    params,
+		Priority:  prefetchPriority,
+		path:      s.basePath + "/query/" + clientID,
+		maxRTT:    s.currentConfig().MaxRTT,
+	}
+
+	reply, err := s.queryWithFailover(clientID, query, s.currentConfig().QueryTimeout)
+	if err == nil {
+		reply, err = reply.collect()
+	}
+	if err != nil {
+		if !errors.Is(err, errClientBusy) && !errors.Is(err, errClientNotConnected) {
+			log.Printf("Prefetch for client %s failed: %v", clientID, err)
+		}
+		return
+	}
+
+	s.storeReply(s.cacheKey(clientID, rawQuery), s.cachePolicy(clientID), reply)
+}
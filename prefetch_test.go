@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParsePrefetches(t *testing.T) {
+	prefetches, err := parsePrefetches([]prefetchRequest{{Interval: "1m", Query: "q=hot"}})
+	if err != nil || len(prefetches) != 1 || prefetches[0].Query != "q=hot" {
+		t.Fatalf("parsePrefetches = %v, %v", prefetches, err)
+	}
+	for _, bad := range []prefetchRequest{{Interval: "soon"}, {Interval: "10ms"}, {Interval: "1m", Query: "q=%zz"}} {
+		if _, err := parsePrefetches([]prefetchRequest{bad}); err == nil {
+			t.Errorf("parsePrefetches accepted %+v", bad)
+		}
+	}
+}
+
+func TestPrefetchWarmsTheCache(t *testing.T) {
+	s, ts := newTestServer(t)
+	var queries atomic.Int32
+	connectClient(t, s, ts, "db-1").serve(func(query queryMessage) replyMessage {
+		queries.Add(1)
+		return replyMessage{Body: "hot " + query.Params["q"][0]}
+	})
+
+	s.prefetch("db-1", "q=x")
+	if _, ok := s.cached(s.cacheKey("db-1", "q=x")); !ok {
+		t.Fatal("the prefetched reply was not cached")
+	}
+	resp, body := do(t, "GET", ts.URL+"/query/db-1?q=x", nil, nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "hot x" || queries.Load() != 1 {
+		t.Errorf("query got %s %q after %d client queries, want the prefetched reply", resp.Status, body, queries.Load())
+	}
+}
+
+func TestRegisterRejectsABadPrefetch(t *testing.T) {
+	_, ts := newTestServer(t)
+	resp, body := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-1", "prefetch": []map[string]string{{"interval": "1ms"}}}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %s: %s, want 400", resp.Status, body)
+	}
+}
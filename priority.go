@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Each connection runs at most maxInFlight queries at once: the max_in_flight
+// its client declared at registration, or -max-in-flight. A client that can
+// only handle one query at a time registers with "ordering": "serial"
+// instead, and each of its connections is sent the next query only once the
+// previous one is answered, or its stream has ended; the default, "parallel",
+// dispatches concurrently as described. Queries beyond that wait in a
+// per-connection queue of up to -max-queued entries, ordered by the caller's
+// X-Query-Priority (an integer, higher first, default 0) and first come,
+// first served within a priority. When the queue is full, a new query
+// displaces the lowest-priority waiting one if it outranks it, and is refused
+// otherwise; either way the loser gets 503.
+//
+// Priorities are strict: as long as higher-priority queries keep arriving,
+// lower ones wait. Nothing waits forever, though: time in the queue counts
+// against the query timeout, so a starved query fails with 504 like any other
+// slow one. Prefetches run at prefetchPriority so they always yield to
+// callers.
+//
+// A reply to a query that had to queue says how long it waited, in
+// X-Queue-Wait, and the furthest back it was, in X-Queue-Position: 1 when
+// it was next in line, higher if others were ahead of it or later jumped
+// ahead. Queries that got a slot at once carry neither.
+
+const prefetchPriority = -1
+
+// orderings are the values a registration's ordering may take; empty is
+// parallel.
+var orderings = map[string]bool{"": true, "parallel": true, "serial": true}
+
+var (
+	errInvalidPriority = fmt.Errorf("invalid X-Query-Priority")
+	// errQueryShed wraps errClientBusy so it is reported the same way.
+	errQueryShed = fmt.Errorf("%w: query shed for a higher-priority one", errClientBusy)
+)
+
+// queuedQuery is a query waiting for one of its connection's slots. ready
+// receives nil once the slot is handed over, or errQueryShed, or
+// errQueryTimeout if deadline passed before its turn came. position is its
+// place in line, 1 for next, and peak the highest position it has had.
+type queuedQuery struct {
+	priority int
+	seq      uint64
+	ready    chan error
+	enqueued time.Time
+	deadline time.Time
+	position int
+	peak     int
+}
+
+// queueWait is how a query fared in its connection's queue, zero if it
+// didn't queue.
+type queueWait struct {
+	wait     time.Duration
+	position int
+}
+
+// ahead reports whether q gets a slot before other.
+func (q *queuedQuery) ahead(other *queuedQuery) bool {
+	return q.priority > other.priority || (q.priority == other.priority && q.seq < other.seq)
+}
+
+// writeQueueHeaders adds X-Queue-Wait and X-Queue-Position for a query that
+// queued.
+func writeQueueHeaders(w http.ResponseWriter, queued queueWait) {
+	if queued.position == 0 {
+		return
+	}
+	w.Header().Set("X-Queue-Wait", queued.wait.String())
+	w.Header().Set("X-Queue-Position", strconv.Itoa(queued.position))
+}
+
+// queryPriority reads the X-Query-Priority header.
+func queryPriority(r *http.Request) (int, error) {
+	header := r.Header.Get("X-Query-Priority")
+	if header == "" {
+		return 0, nil
+	}
+	priority, err := strconv.Atoi(header)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errInvalidPriority, err)
+	}
+	return priority, nil
+}
+
+func (c *Client) maxInFlight() int {
+	if c.Serial {
+		return 1
+	}
+	if caps := c.capabilities.Load(); caps != nil && caps.MaxConcurrency > 0 {
+		return caps.MaxConcurrency
+	}
+	if c.MaxInFlight > 0 {
+		return c.MaxInFlight
+	}
+	return c.server.currentConfig().MaxInFlight
+}
+
+// acquireSlot waits up to timeout for one of the connection's in-flight
+// slots and reports how long it queued for one. A nil error must be paired
+// with releaseSlot.
+func (c *Client) acquireSlot(priority int, timeout time.Duration) (queueWait, error) {
+	cfg := c.server.currentConfig()
+
+	c.slotMutex.Lock()
+	if !c.paused && c.inFlight < c.maxInFlight() && len(c.queue) == 0 {
+		c.inFlight++
+		c.slotMutex.Unlock()
+		return queueWait{}, nil
+	}
+	busy := errClientBusy
+	if c.paused {
+		busy = errClientPaused
+	}
+	if cfg.MaxQueued <= 0 || (c.paused && cfg.PausedQueries == "reject") {
+		c.slotMutex.Unlock()
+		return queueWait{}, busy
+	}
+	if len(c.queue) >= cfg.MaxQueued {
+		lowest := c.queue[0]
+		for _, q := range c.queue[1:] {
+			if lowest.ahead(q) {
+				lowest = q
+			}
+		}
+		if lowest.priority >= priority {
+			c.slotMutex.Unlock()
+			return queueWait{}, busy
+		}
+		c.dequeueLocked(lowest)
+		lowest.ready <- errQueryShed
+	}
+
+	c.queueSeq++
+	now := time.Now()
+	q := &queuedQuery{priority: priority, seq: c.queueSeq, ready: make(chan error, 1), enqueued: now, deadline: now.Add(timeout), position: 1}
+	for _, queued := range c.queue {
+		if queued.ahead(q) {
+			q.position++
+		} else {
+			queued.position++
+			queued.peak = max(queued.peak, queued.position)
+		}
+	}
+	q.peak = q.position
+	c.queue = append(c.queue, q)
+	c.slotMutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case err = <-q.ready:
+	case <-timer.C:
+		err = c.abandonSlot(q, errQueryTimeout)
+	case <-c.done:
+		err = c.abandonSlot(q, errClientDisconnected)
+	case <-c.cancelled:
+		err = c.abandonSlot(q, c.cancelErr)
+	}
+
+	c.slotMutex.Lock()
+	queued := queueWait{wait: time.Since(q.enqueued), position: q.peak}
+	c.slotMutex.Unlock()
+	return queued, err
+}
+
+// abandonSlot takes q out of the queue when its caller gives up. If q was
+// handed a slot in the meantime, the slot is passed on.
+func (c *Client) abandonSlot(q *queuedQuery, err error) error {
+	c.slotMutex.Lock()
+	queued := c.dequeueLocked(q)
+	c.slotMutex.Unlock()
+
+	if !queued && <-q.ready == nil {
+		c.releaseSlot()
+	}
+	return err
+}
+
+// releaseSlot hands the slot to the best waiting query, if there is one and
+// the connection isn't paused.
+func (c *Client) releaseSlot() {
+	c.slotMutex.Lock()
+	defer c.slotMutex.Unlock()
+
+	if c.paused || len(c.queue) == 0 || c.inFlight > c.maxInFlight() || !c.grantLocked() {
+		c.inFlight--
+	}
+}
+
+// grantLocked hands a slot that is already counted in inFlight to the best
+// waiting query, failing those ahead of it whose deadline has passed, and
+// reports whether any query took the slot.
+func (c *Client) grantLocked() bool {
+	now := time.Now()
+	for len(c.queue) > 0 {
+		best := c.nextLocked()
+		c.dequeueLocked(best)
+		if now.Before(best.deadline) {
+			best.ready <- nil
+			return true
+		}
+		best.ready <- errQueryTimeout
+	}
+	return false
+}
+
+// nextLocked returns the query due a slot next: the oldest of those queued
+// before a -resume-order fifo resume while any remain, else the one ahead of
+// the others.
+func (c *Client) nextLocked() *queuedQuery {
+	best := c.queue[0]
+	for _, q := range c.queue[1:] {
+		if q.seq <= c.fifoUntil {
+			if best.seq > c.fifoUntil || q.seq < best.seq {
+				best = q
+			}
+			continue
+		}
+		if best.seq > c.fifoUntil && q.ahead(best) {
+			best = q
+		}
+	}
+	return best
+}
+
+// dequeueLocked takes q out of the queue, moving up those behind it, and
+// reports whether it was still there.
+func (c *Client) dequeueLocked(q *queuedQuery) bool {
+	for i, queued := range c.queue {
+		if queued == q {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			for _, behind := range c.queue {
+				if q.ahead(behind) {
+					behind.position--
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// firstConnection returns clientID's first connection.
+func (s *Server) firstConnection(clientID string) *Client {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	return s.clients[clientID].conns[0]
+}
+
+// queued returns how many queries wait for a slot on clientID's first
+// connection.
+func (s *Server) queued(clientID string) int {
+	conn := s.firstConnection(clientID)
+	conn.slotMutex.Lock()
+	defer conn.slotMutex.Unlock()
+	return len(conn.queue)
+}
+
+func TestDeclaredMaxInFlightLimitsQueriesPerConnection(t *testing.T) {
+	s, ts := newTestServer(t)
+	registered := register(t, ts, map[string]any{"client_id": "db-1", "max_in_flight": 1})
+	client := connectRegistered(t, s, registered, "db-1")
+
+	var results []<-chan asyncResult
+	for i := 0; i < 2; i++ {
+		results = append(results, goGet(fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil))
+	}
+
+	first := client.readQuery()
+	waitFor(t, "the second query to queue behind the first", func() bool { return s.queued("db-1") == 1 })
+	client.reply(replyMessage{RequestID: first.RequestID, Body: "answer"})
+	second := client.readQuery()
+	client.reply(replyMessage{RequestID: second.RequestID, Body: "answer"})
+
+	for _, result := range results {
+		if r := <-result; r.err != nil || r.status != http.StatusOK || r.body != "answer" {
+			t.Errorf("query got %d %q %v, want its answer", r.status, r.body, r.err)
+		}
+	}
+}
+
+func TestConnectionsUseTheServerLimitWithoutADeclaredOne(t *testing.T) {
+	s, ts := newTestServer(t, "-max-in-flight", "2")
+	client := connectClient(t, s, ts, "db-1")
+
+	for i := 0; i < 3; i++ {
+		goGet(fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil)
+	}
+	client.readQuery()
+	client.readQuery()
+	waitFor(t, "the third query to queue", func() bool { return s.queued("db-1") == 1 })
+}
+
+func TestSerialClientTakesOneQueryAtATime(t *testing.T) {
+	s, ts := newTestServer(t, "-max-in-flight", "4")
+	registered := register(t, ts, map[string]any{"client_id": "db-1", "ordering": "serial", "max_in_flight": 4})
+	client := connectRegistered(t, s, registered, "db-1")
+
+	for i := 0; i < 3; i++ {
+		goGet(fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil)
+	}
+	first := client.readQuery()
+	waitFor(t, "the other queries to queue behind the first", func() bool { return s.queued("db-1") == 2 })
+	client.reply(replyMessage{RequestID: first.RequestID, Body: "answer"})
+	client.readQuery()
+	waitFor(t, "the last query to wait its turn", func() bool { return s.queued("db-1") == 1 })
+
+	resp, body := do(t, "GET", ts.URL+"/clients", nil, adminHeader())
+	var clients []clientInfo
+	if err := json.Unmarshal(body, &clients); err != nil || len(clients) != 1 {
+		t.Fatalf("/clients got %s: %s", resp.Status, body)
+	}
+	if conn := clients[0].Connections[0]; !conn.Serial || conn.MaxInFlight != 1 {
+		t.Errorf("serial connection listed as %+v", conn)
+	}
+}
+
+func TestRegisteringAnUnknownOrderingIsRefused(t *testing.T) {
+	_, ts := newTestServer(t)
+	if resp, body := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-1", "ordering": "random"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("ordering random got %s: %s, want 400", resp.Status, body)
+	}
+	register(t, ts, map[string]any{"client_id": "db-1", "ordering": "parallel"})
+}
+
+// priority is an X-Query-Priority header.
+func priority(p int) http.Header {
+	return http.Header{"X-Query-Priority": {fmt.Sprint(p)}}
+}
+
+func TestHigherPriorityQueriesGoFirst(t *testing.T) {
+	s, ts := newTestServer(t, "-max-in-flight", "1")
+	client := connectClient(t, s, ts, "db-1")
+	goGet(ts.URL+"/query/db-1?q=first", nil)
+	first := client.readQuery()
+
+	goGet(ts.URL+"/query/db-1?q=low", priority(0))
+	waitFor(t, "the low-priority query to queue", func() bool { return s.queued("db-1") == 1 })
+	high := goGet(ts.URL+"/query/db-1?q=high", priority(5))
+	waitFor(t, "the high-priority query to queue", func() bool { return s.queued("db-1") == 2 })
+
+	client.reply(replyMessage{RequestID: first.RequestID, Body: "first"})
+	if next := client.readQuery(); next.Params["q"][0] != "high" {
+		t.Fatalf("query %v was sent next, want the high-priority one", next.Params)
+	} else {
+		client.reply(replyMessage{RequestID: next.RequestID, Body: "high"})
+	}
+	if r := <-high; r.status != http.StatusOK || r.header.Get("X-Queue-Position") != "1" {
+		t.Errorf("high-priority query got %d with position %q, want it next in line", r.status, r.header.Get("X-Queue-Position"))
+	}
+}
+
+func TestFullQueueShedsTheLowestPriority(t *testing.T) {
+	s, ts := newTestServer(t, "-max-in-flight", "1", "-max-queued", "1")
+	client := connectClient(t, s, ts, "db-1")
+	goGet(ts.URL+"/query/db-1?q=first", nil)
+	client.readQuery()
+
+	low := goGet(ts.URL+"/query/db-1?q=low", priority(0))
+	waitFor(t, "the low-priority query to queue", func() bool { return s.queued("db-1") == 1 })
+	goGet(ts.URL+"/query/db-1?q=high", priority(5))
+	if r := <-low; r.status != http.StatusServiceUnavailable {
+		t.Errorf("displaced query got %d %q, want 503", r.status, r.body)
+	}
+
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1?q=lower", nil, priority(-1)); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("query that outranks nothing got %s: %s, want 503", resp.Status, body)
+	}
+	if resp, _ := do(t, "GET", ts.URL+"/query/db-1?q=bad", nil, http.Header{"X-Query-Priority": {"urgent"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad X-Query-Priority got %s, want 400", resp.Status)
+	}
+}
+
+func TestQueueHeadersReportWaitAndPeakPosition(t *testing.T) {
+	s, ts := newTestServer(t, "-max-in-flight", "1")
+	client := connectClient(t, s, ts, "db-1")
+	first := goGet(ts.URL+"/query/db-1?q=first", nil)
+	firstQuery := client.readQuery()
+
+	low := goGet(ts.URL+"/query/db-1?q=low", priority(0))
+	waitFor(t, "the low-priority query to queue", func() bool { return s.queued("db-1") == 1 })
+	goGet(ts.URL+"/query/db-1?q=high", priority(5))
+	waitFor(t, "the high-priority query to queue", func() bool { return s.queued("db-1") == 2 })
+
+	client.reply(replyMessage{RequestID: firstQuery.RequestID})
+	for i := 0; i < 2; i++ {
+		client.reply(replyMessage{RequestID: client.readQuery().RequestID})
+	}
+
+	if r := <-first; r.header.Get("X-Queue-Wait") != "" || r.header.Get("X-Queue-Position") != "" {
+		t.Errorf("query that never queued got X-Queue-Wait %q and X-Queue-Position %q", r.header.Get("X-Queue-Wait"), r.header.Get("X-Queue-Position"))
+	}
+	r := <-low
+	if r.header.Get("X-Queue-Position") != "2" {
+		t.Errorf("query overtaken in the queue got position %q, want its peak of 2", r.header.Get("X-Queue-Position"))
+	}
+	if wait, err := time.ParseDuration(r.header.Get("X-Queue-Wait")); err != nil || wait <= 0 {
+		t.Errorf("queued query got X-Queue-Wait %q", r.header.Get("X-Queue-Wait"))
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// A connection's pushes, its unsolicited messages, are cached and handed to
+// subscribers by the goroutine reading the connection, so a chatty client
+// slows its own reads, replies included, and under backpressure its reader
+// sleeps after every push. With -max-pending-pushes, pushes are handled by
+// a goroutine of their own instead, through a buffer of that many per
+// connection, and the reader goes straight back to reading. A push that
+// finds the buffer full is dropped, the new one with -push-drop-policy
+// newest, the default, or the oldest waiting one with oldest, and counted
+// in proxy_dropped_messages_total; a client that keeps pushing faster than
+// they are handled loses pushes rather than growing the proxy's memory.
+// Drops are logged at most once per pushDropLogInterval per connection.
+// Pushes still buffered when the connection closes are dropped.
+
+const pushDropLogInterval = 10 * time.Second
+
+var pushDropPolicies = map[string]bool{"newest": true, "oldest": true}
+
+// pushBuffer holds a connection's pushes on their way to be handled.
+type pushBuffer struct {
+	ch chan pushMessage
+	// dropped counts pushes dropped since the last log line about them,
+	// written at loggedAt, in Unix nanoseconds.
+	dropped  atomic.Int64
+	loggedAt atomic.Int64
+}
+
+// startPushBuffer gives client a push buffer, if -max-pending-pushes calls
+// for one, and the goroutine emptying it.
+func (s *Server) startPushBuffer(client *Client) {
+	size := s.currentConfig().MaxPendingPushes
+	if size <= 0 {
+		return
+	}
+	client.pushes = &pushBuffer{ch: make(chan pushMessage, size)}
+	go s.handlePushes(client)
+}
+
+func (s *Server) handlePushes(client *Client) {
+	defer s.recoverClient(client, "pusher")
+	for {
+		select {
+		case <-client.done:
+			return
+		case message := <-client.pushes.ch:
+			s.handlePush(client, message)
+		}
+	}
+}
+
+// receivePush handles a push from client, or buffers it to be handled.
+func (s *Server) receivePush(client *Client, message pushMessage) {
+	if client.pushes == nil {
+		s.handlePush(client, message)
+		return
+	}
+	policy := s.currentConfig().PushDropPolicy
+	if client.pushes.offer(message, policy) {
+		return
+	}
+	s.incCounter("proxy_dropped_messages_total", s.metadataLabels(client.ID)...)
+	client.pushes.dropped.Add(1)
+
+	now := time.Now().UnixNano()
+	last := client.pushes.loggedAt.Load()
+	if now-last >= int64(pushDropLogInterval) && client.pushes.loggedAt.CompareAndSwap(last, now) {
+		log.Printf("Client %s is pushing faster than its pushes are handled; dropped %d, the %s each time", client.ID, client.pushes.dropped.Swap(0), policy)
+	}
+}
+
+// offer buffers message and reports whether it did so without dropping one.
+func (b *pushBuffer) offer(message pushMessage, policy string) bool {
+	select {
+	case b.ch <- message:
+		return true
+	default:
+	}
+	if policy != "oldest" {
+		return false
+	}
+	select {
+	case <-b.ch:
+	default:
+	}
+	select {
+	case b.ch <- message:
+	default:
+	}
+	return false
+}
+
+func (s *Server) handlePush(client *Client, message pushMessage) {
+	s.storePush(client.ID, message.messageType, message.data)
+	s.pushSubscriptions.publish(client.ID, message)
+	if s.backpressure.Load() {
+		time.Sleep(backpressurePushPause)
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func text(data string) pushMessage {
+	return pushMessage{messageType: websocket.TextMessage, data: []byte(data)}
+}
+
+func TestPushBufferDropPolicies(t *testing.T) {
+	for policy, want := range map[string][]string{"newest": {"a", "b"}, "oldest": {"b", "c"}} {
+		b := &pushBuffer{ch: make(chan pushMessage, 2)}
+		for _, data := range []string{"a", "b"} {
+			if !b.offer(text(data), policy) {
+				t.Errorf("%s: offer of %s to a buffer with room dropped one", policy, data)
+			}
+		}
+		if b.offer(text("c"), policy) {
+			t.Errorf("%s: offer to a full buffer didn't report a drop", policy)
+		}
+		for _, data := range want {
+			if got := string((<-b.ch).data); got != data {
+				t.Errorf("%s: buffer held %s, want %s", policy, got, data)
+			}
+		}
+	}
+}
+
+func TestBufferedPushesAreHandled(t *testing.T) {
+	s, ts := newTestServer(t, "-max-pending-pushes", "4")
+	client := connectClient(t, s, ts, "ticker")
+	events := subscribe(t, s, ts, "ticker")
+
+	client.push(websocket.TextMessage, "101.5")
+	if got := nextPush(t, events); got != "event: push\ndata: 101.5" {
+		t.Errorf("subscriber got %q", got)
+	}
+	if entry, ok := s.cached(s.cacheKey("ticker", "")); !ok || entry.Data != "101.5" {
+		t.Errorf("buffered push cached as %+v, %t", entry, ok)
+	}
+}
+
+func TestPushDropPolicyIsChecked(t *testing.T) {
+	if _, err := LoadConfig([]string{"-push-drop-policy", "random"}); err == nil {
+		t.Error("LoadConfig accepted -push-drop-policy random")
+	}
+}
@@ -0,0 +1,640 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// queryMessage is what a client receives for every query, unless it
+// registered a template of its own (see template.go):
+//
+//	{"type":"query","request_id":"9f1c...","command":"GET_DATA","method":"GET","params":{"q":["x"]}}
+//
+// The client answers with a reply carrying the same request_id, optionally
+// with a status and headers for the HTTP response:
+//
+//	{"request_id":"9f1c...","status":200,"headers":{"Cache-Control":"max-age=30"},"body":"..."}
+//
+// The status defaults to 200. A client reporting an application error picks
+// the class the way an HTTP upstream would: 4xx means the query itself is
+// wrong and is returned to the caller as is, 5xx means this client failed to
+// answer it and the query is retried on the client's other connections before
+// the error is passed on. Only 200 replies are checked against the response
+// schema, and only they are cached unless -cache-error-ttl lets errors be.
+//
+// A client may also answer in chunks; see stream.go. It may acknowledge a
+// query before answering it; see ack.go.
+//
+// Binary messages are always raw replies, and unless the client sets its own
+// Content-Type they go to the caller as application/octet-stream.
+//
+// Replies that aren't JSON objects with a request_id are taken as the answer
+// to the oldest outstanding query, so clients that just write their data back
+// keep working as long as they answer in order.
+//
+// A reply whose request_id isn't pending, because its query timed out or was
+// cancelled, or the ID was never issued, is an orphan: it is logged, counted
+// in proxy_orphan_replies_total and dropped, never cached as a push.
+type queryMessage struct {
+	Type      string              `json:"type"`
+	RequestID string              `json:"request_id"`
+	Command   string              `json:"command"`
+	Method    string              `json:"method"`
+	Params    map[string][]string `json:"params,omitempty"`
+	Body      string              `json:"body,omitempty"`
+	Priority  int                 `json:"priority,omitempty"`
+	// Retry marks a query re-sent after a reconnect; see reconnect.go.
+	Retry bool `json:"retry,omitempty"`
+	// CallerIP is the address of the caller the query is made for, as
+	// clientIP resolves it, so the client can log or authorize by it. A
+	// reply cached for one caller is still served to others.
+	CallerIP string `json:"caller_ip,omitempty"`
+
+	// path is the request path, for query templates.
+	path string
+	// command, if set, makes this a command; see command.go.
+	command json.RawMessage
+	// maxRTT, if set, excludes slower connections; see rtt.go.
+	maxRTT time.Duration
+	// ctx is the caller's request context, if the query has a caller.
+	ctx context.Context
+}
+
+type replyMessage struct {
+	RequestID string            `json:"request_id"`
+	Type      string            `json:"type,omitempty"`
+	Seq       int               `json:"seq,omitempty"`
+	Final     bool              `json:"final,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Trailers  map[string]string `json:"trailers,omitempty"`
+	Status    int               `json:"status,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      string            `json:"body"`
+}
+
+// clientReply is a client's answer to one query.
+type clientReply struct {
+	// Status is the HTTP status the client asked for; zero means 200.
+	Status  int
+	Body    []byte
+	Headers map[string]string
+	// MessageType is the websocket message type the reply arrived in.
+	MessageType int
+
+	// chunk, seq and final describe one chunk of a streamed reply, and a
+	// final chunk may add streamError and trailers. Once a query's first
+	// chunk is in, stream carries the rest.
+	chunk       bool
+	seq         int
+	final       bool
+	streamError string
+	trailers    map[string]string
+	stream      *replyStream
+
+	// queued is how the query fared waiting for a slot on the connection,
+	// and rtt how long the reply took once the query was sent.
+	queued queueWait
+	rtt    time.Duration
+}
+
+// pendingQuery is a query waiting on its reply, or on the chunks of a
+// streamed one.
+type pendingQuery struct {
+	replies chan clientReply
+	// done is closed once the caller stops reading, so the connection's
+	// reader never blocks on a query nobody waits for.
+	done chan struct{}
+	// acked is closed when the client acknowledges the query.
+	acked   chan struct{}
+	ackOnce sync.Once
+	// evicted is closed if the query is evicted to bound the pending
+	// queries; see pending.go.
+	evicted chan struct{}
+	// overrun is closed if the client's chunks got ahead of the caller by
+	// more than replies holds; see deliverReply.
+	overrun chan struct{}
+}
+
+// retryable reports whether the reply is a client-side failure worth trying
+// on another connection.
+func (r clientReply) retryable() bool {
+	return r.statusCode() >= 500
+}
+
+// statusCode is the HTTP status to send for the reply. A status no HTTP
+// response could carry is the client's fault and becomes 502.
+func (r clientReply) statusCode() int {
+	switch {
+	case r.Status == 0:
+		return http.StatusOK
+	case r.Status < 100 || r.Status > 599:
+		return http.StatusBadGateway
+	}
+	return r.Status
+}
+
+var (
+	errClientNotConnected = errors.New("Client not connected")
+	errClientBusy         = errors.New("client has too many queries in flight")
+	errQueryTimeout       = errors.New("timed out waiting for client reply")
+	errClientDisconnected = errors.New("client disconnected before replying")
+	// errRetryBudgetExhausted wraps errQueryTimeout so it is reported the
+	// same way.
+	errRetryBudgetExhausted = fmt.Errorf("%w: query timeout spent before failover", errQueryTimeout)
+)
+
+// acquireQuerySlot takes a slot without blocking and reports whether one was
+// free. A true result must be paired with releaseQuerySlot.
+func (s *Server) acquireQuerySlot() bool {
+	if s.querySlots == nil {
+		return true
+	}
+	select {
+	case s.querySlots <- struct{}{}:
+		s.checkBackpressure()
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) releaseQuerySlot() {
+	if s.querySlots != nil {
+		<-s.querySlots
+		s.checkBackpressure()
+	}
+}
+
+// writeSaturated rejects a query because every slot is taken.
+func writeSaturated(w http.ResponseWriter) {
+	writeTransient(w, "server is at its query concurrency limit", http.StatusServiceUnavailable, defaultRetryAfter)
+}
+
+var errInvalidTimeout = errors.New("invalid X-Query-Timeout")
+
+// queryTimeout returns how long to wait for the client's reply to r. Callers
+// may ask for a different timeout than the server default with
+// X-Query-Timeout, either as a Go duration ("1.5s", "300ms") or a number of
+// seconds; it is capped at the configured maximum.
+func (s *Server) queryTimeout(r *http.Request) (time.Duration, error) {
+	cfg := s.currentConfig()
+	header := r.Header.Get("X-Query-Timeout")
+	if header == "" {
+		return budgetTimeout(r, cfg.QueryTimeout)
+	}
+
+	timeout, err := parseTimeoutHeader(header)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errInvalidTimeout, err)
+	}
+	if timeout > cfg.MaxQueryTimeout {
+		timeout = cfg.MaxQueryTimeout
+	}
+	return budgetTimeout(r, timeout)
+}
+
+// parseTimeoutHeader parses a positive timeout given as a Go duration or a
+// number of seconds.
+func parseTimeoutHeader(header string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(header)
+	if err != nil {
+		seconds, convErr := strconv.ParseFloat(header, 64)
+		if convErr != nil {
+			return 0, err
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	return timeout, nil
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *Server) newQueryMessage(r *http.Request, body string) queryMessage {
+	return queryMessage{
+		Type:      "query",
+		RequestID: newRequestID(),
+		Command:   "GET_DATA",
+		Method:    r.Method,
+		Params:    r.URL.Query(),
+		Body:      body,
+		CallerIP:  s.clientIP(r),
+		path:      r.URL.Path,
+		ctx:       r.Context(),
+	}
+}
+
+// addPending records a query awaiting its reply. The caller must hold one of
+// the connection's slots, which finishPending releases when it stops waiting.
+func (c *Client) addPending(requestID string) *pendingQuery {
+	p := &pendingQuery{
+		replies: make(chan clientReply, c.server.currentConfig().ChunkReorderWindow+1),
+		done:    make(chan struct{}),
+		acked:   make(chan struct{}),
+		evicted: make(chan struct{}),
+		overrun: make(chan struct{}),
+	}
+
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+	c.evictOldestPendingLocked()
+	c.pending[requestID] = p
+	c.pendingOrder = append(c.pendingOrder, requestID)
+	return p
+}
+
+func (c *Client) finishPending(requestID string, p *pendingQuery) {
+	c.removePending(requestID)
+	close(p.done)
+	c.releaseSlot()
+}
+
+func (c *Client) removePending(requestID string) {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+	delete(c.pending, requestID)
+	for i, id := range c.pendingOrder {
+		if id == requestID {
+			c.pendingOrder = append(c.pendingOrder[:i], c.pendingOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// deliverReply hands message to the query waiting for it and reports whether
+// there was one. Messages that don't answer a pending query are unsolicited
+// pushes from the client.
+func (c *Client) deliverReply(messageType int, message []byte) bool {
+	requestID := ""
+	reply := clientReply{Body: message, MessageType: messageType}
+
+	var envelope replyMessage
+	if messageType == websocket.TextMessage && json.Unmarshal(message, &envelope) == nil && envelope.RequestID != "" {
+		requestID = envelope.RequestID
+		reply = clientReply{
+			Status:      envelope.Status,
+			Body:        []byte(envelope.Body),
+			Headers:     envelope.Headers,
+			MessageType: messageType,
+			chunk:       envelope.Type == "chunk",
+			seq:         envelope.Seq,
+			final:       envelope.Final,
+			streamError: envelope.Error,
+			trailers:    envelope.Trailers,
+		}
+	}
+
+	if envelope.Type == "ack" && requestID != "" {
+		c.acks.Store(true)
+		c.pendingMutex.Lock()
+		p, ok := c.pending[requestID]
+		c.pendingMutex.Unlock()
+		if ok {
+			p.ack()
+		}
+		return true
+	}
+
+	c.pendingMutex.Lock()
+	if requestID == "" && len(c.pendingOrder) > 0 {
+		requestID = c.pendingOrder[0]
+	}
+	p, ok := c.pending[requestID]
+	c.pendingMutex.Unlock()
+
+	if !ok {
+		if envelope.RequestID == "" {
+			return false
+		}
+		log.Printf("Dropped orphan reply from client %s for request %s", c.ID, requestID)
+		c.server.incCounter("proxy_orphan_replies_total")
+		return true
+	}
+
+	// A streamed query stays pending until its caller has every chunk.
+	if !reply.chunk {
+		c.removePending(requestID)
+	}
+	// This goroutine reads for every query on the connection, and pongs,
+	// so it never waits for one caller to catch up: a query whose replies
+	// are full fails instead, and whoever waits on it cancels it.
+	select {
+	case p.replies <- reply:
+	case <-p.done:
+	default:
+		c.removePending(requestID)
+		close(p.overrun)
+		c.server.incCounter("proxy_stream_overruns_total")
+		log.Printf("Dropped query %s of client %s: its chunks got more than %d ahead of the caller", requestID, c.ID, cap(p.replies))
+	}
+	return true
+}
+
+// queryClient sends query to client and waits up to timeout for the matching
+// reply, which must satisfy the client's response schema if it registered
+// one. A streamed reply comes back holding its first chunk, with the rest
+// to be read from reply.stream, which the caller must close. If the
+// connection drops first, the query may be re-sent once the client
+// reconnects; see reconnect.go.
+func (s *Server) queryClient(client *Client, query queryMessage, timeout time.Duration) (clientReply, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		reply, err := s.queryConnection(client, query, time.Until(deadline))
+		if err != errClientDisconnected {
+			return reply, err
+		}
+		next := s.awaitReconnect(client, query, deadline)
+		if next == nil {
+			return reply, err
+		}
+		log.Printf("Re-sending query %s to client %s after it reconnected", query.RequestID, client.ID)
+		s.incCounter("proxy_query_resends_total")
+		client = next
+		query.Retry = true
+	}
+}
+
+// queryConnection is one attempt of queryClient, on client alone.
+func (s *Server) queryConnection(client *Client, query queryMessage, timeout time.Duration) (clientReply, error) {
+	payload, err := s.renderQuery(client.ID, query)
+	if err != nil {
+		return clientReply{}, err
+	}
+
+	start := time.Now()
+	queued, err := client.acquireSlot(query.Priority, timeout)
+	if err != nil {
+		return clientReply{}, err
+	}
+	p := client.addPending(query.RequestID)
+	streaming := false
+	defer func() {
+		if !streaming {
+			client.finishPending(query.RequestID, p)
+		}
+	}()
+
+	if err := client.writeMessage(websocket.TextMessage, payload); err != nil {
+		return clientReply{}, s.recordWriteFailure(client, err)
+	}
+	client.writeFailures.Store(0)
+	sent := time.Now()
+
+	remaining := timeout - time.Since(start)
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+
+	ctx := query.context()
+	var ackTimeout <-chan time.Time
+	if wait := s.currentConfig().AckTimeout; wait > 0 && wait < remaining && client.acks.Load() {
+		ackTimer := time.NewTimer(wait)
+		defer ackTimer.Stop()
+		ackTimeout = ackTimer.C
+	}
+	for {
+		select {
+		case <-ackTimeout:
+			if p.wasAcked() {
+				ackTimeout = nil
+				continue
+			}
+			client.recordTimeout()
+			log.Printf("Client %s did not acknowledge query %s within %s", client.ID, query.RequestID, s.currentConfig().AckTimeout)
+			client.sendCancel(query.RequestID, errQueryNotAcked)
+			return clientReply{}, errQueryNotAcked
+		case reply := <-p.replies:
+			client.recordReply()
+			reply.rtt = time.Since(sent)
+			if reply.gzipped() {
+				if reply.chunk {
+					return clientReply{}, errEncodedStream
+				}
+				if reply, err = reply.decodeGzipBody(); err != nil {
+					return clientReply{}, err
+				}
+			}
+			if reply.chunk {
+				stream := newReplyStream(ctx, client, query.RequestID, p, timeout)
+				if reply, err = stream.first(reply); err != nil {
+					if !stream.finished {
+						client.sendCancel(query.RequestID, err)
+					}
+					return clientReply{}, err
+				}
+				// A stream that ends with its first chunk is an ordinary reply.
+				streaming = reply.stream != nil
+			}
+			reply.queued = queued
+			s.incCounter("proxy_client_replies_total", s.withLabels(client.ID, "status", strconv.Itoa(reply.statusCode()))...)
+			if reply.statusCode() != http.StatusOK || reply.stream != nil {
+				return reply, nil
+			}
+			if err := s.validateReply(client.ID, reply); err != nil {
+				return clientReply{}, err
+			}
+			return reply, nil
+		case <-timer.C:
+			client.recordTimeout()
+			err := client.timeoutError(p)
+			client.sendCancel(query.RequestID, err)
+			return clientReply{}, err
+		case <-ctx.Done():
+			err := contextError(ctx)
+			client.sendCancel(query.RequestID, err)
+			return clientReply{}, err
+		case <-p.evicted:
+			client.sendCancel(query.RequestID, errPendingEvicted)
+			return clientReply{}, errPendingEvicted
+		case <-p.overrun:
+			client.sendCancel(query.RequestID, errStreamOverrun)
+			return clientReply{}, errStreamOverrun
+		case <-client.done:
+			return clientReply{}, errClientDisconnected
+		case <-client.cancelled:
+			return clientReply{}, client.cancelErr
+		}
+	}
+}
+
+// queryWithFailover sends query to one of clientID's connections and, while
+// the replies are retryable or failsOver allows, to each of its other
+// connections in turn under a fresh request ID. timeout is the budget for all
+// attempts together: each one gets what the earlier ones left, and once it is
+// spent the query fails with errRetryBudgetExhausted rather than trying
+// again. The last reply is returned if every connection fails.
+func (s *Server) queryWithFailover(clientID string, query queryMessage, timeout time.Duration) (clientReply, error) {
+	if s.clientDraining(clientID) {
+		return clientReply{}, errClientDraining
+	}
+	if err := s.checkReplyBudget(clientID); err != nil {
+		return clientReply{}, err
+	}
+	client, err := s.pickClient(clientID, query.maxRTT)
+	if err != nil {
+		return clientReply{}, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	tried := make(map[*Client]bool)
+	for {
+		tried[client] = true
+		reply, err := s.queryClient(client, query, time.Until(deadline))
+		if err != nil && !failsOver(err) || err == nil && !reply.retryable() {
+			return reply, err
+		}
+
+		client, _ = s.pickClient(clientID, query.maxRTT)
+		if client == nil || tried[client] {
+			return reply, err
+		}
+		if reply.stream != nil {
+			reply.stream.close()
+		}
+
+		outcome := fmt.Sprintf("replied %d", reply.Status)
+		switch {
+		case errors.Is(err, errConnectionBroken):
+			outcome = "broke"
+		case err != nil:
+			outcome = "did not acknowledge the query"
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			log.Printf("Client %s connection %s with no time left to fail over", clientID, outcome)
+			return clientReply{}, errRetryBudgetExhausted
+		}
+		log.Printf("Client %s connection %s, failing over with %s left", clientID, outcome, remaining)
+		s.incCounter("proxy_query_failovers_total")
+		query.RequestID = newRequestID()
+	}
+}
+
+// Empty replies are legitimate for some clients ("nothing to report") but a
+// bare 200 with no body is easy to mistake for a failure. -empty-reply picks
+// how they reach the caller:
+//
+//	"empty"      200 with an empty body (the default)
+//	"no-content" 204 No Content
+//	"error"      502 Bad Gateway, treating the empty reply as a client fault
+//
+// The same mode applies to empty replies served from cache. Whether they are
+// cached at all is controlled separately by -cache-empty-replies.
+var emptyReplyModes = map[string]bool{"empty": true, "no-content": true, "error": true}
+
+// writeReply sends a client's reply, with the headers it asked for, to the
+// caller.
+func (s *Server) writeReply(w http.ResponseWriter, r *http.Request, reply clientReply) {
+	writeQueueHeaders(w, reply.queued)
+	trailer := writeServerTiming(w, r, reply)
+	if reply.stream != nil {
+		s.writeStream(w, r, reply)
+		return
+	}
+	defer s.holdReplyBytes(r, len(reply.Body))()
+	if !s.rewriteReply(w, r, &reply) || !negotiateEncoding(w, r, &reply) {
+		return
+	}
+	if len(reply.Body) == 0 && reply.statusCode() == http.StatusOK && s.currentConfig().EmptyReply == "error" {
+		http.Error(w, "client returned an empty reply", http.StatusBadGateway)
+		return
+	}
+
+	for name, value := range reply.Headers {
+		w.Header().Set(name, value)
+	}
+	// Sniffing would label most binary payloads as text.
+	if reply.MessageType == websocket.BinaryMessage && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	status := reply.statusCode()
+	if len(reply.Body) == 0 && status == http.StatusOK && s.currentConfig().EmptyReply == "no-content" {
+		status = http.StatusNoContent
+	}
+	w.WriteHeader(status)
+	writeTimedBody(w, reply.Body, trailer)
+}
+
+// recordReply clears the timeout streak once the client answers again.
+func (c *Client) recordReply() {
+	c.consecutiveTimeouts.Store(0)
+	if c.unhealthy.CompareAndSwap(true, false) {
+		log.Printf("Client %s is replying again and is healthy", c.ID)
+	}
+}
+
+// recordTimeout counts a query the client never answered. A client that
+// still answers pings but not queries would otherwise look alive forever, so
+// enough timeouts in a row mark it unhealthy and, if configured, disconnect
+// it.
+func (c *Client) recordTimeout() {
+	c.server.incCounter("proxy_query_timeouts_total", c.server.metadataLabels(c.ID)...)
+
+	cfg := c.server.currentConfig()
+	n := c.consecutiveTimeouts.Add(1)
+	if cfg.UnhealthyAfter <= 0 || int(n) < cfg.UnhealthyAfter {
+		return
+	}
+	if !c.unhealthy.CompareAndSwap(false, true) {
+		return
+	}
+
+	c.server.incCounter("proxy_clients_marked_unhealthy_total")
+	log.Printf("Client %s marked unhealthy after %d consecutive query timeouts", c.ID, n)
+	if cfg.DisconnectUnhealthy {
+		go c.server.closeConnection(c.Connection, c.ID, closeUnhealthy, strconv.Itoa(int(n)), cfg.BroadcastTimeout)
+	}
+}
+
+// writeQueryError maps an error from queryClient to an HTTP response.
+func writeQueryError(w http.ResponseWriter, err error) {
+	if retryableError(err) {
+		markRetryable(w, defaultRetryAfter)
+	}
+	http.Error(w, err.Error(), queryErrorStatus(err))
+}
+
+func queryErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidTimeout), errors.Is(err, errInvalidPartialDeadline), errors.Is(err, errInvalidPriority), errors.Is(err, errInvalidMaxRTT),
+		errors.Is(err, errInvalidAggregate), errors.Is(err, errUnsupportedCommand):
+		return http.StatusBadRequest
+	case errors.Is(err, errCommandDenied):
+		return http.StatusForbidden
+	case errors.Is(err, errQuorumDisagreement):
+		return http.StatusConflict
+	case errors.As(err, new(*http.MaxBytesError)):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errClientNotConnected):
+		return http.StatusNotFound
+	case errors.Is(err, errClientBusy), errors.Is(err, errClientDraining), errors.Is(err, errClientTooSlow),
+		errors.Is(err, errMaintenance):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errQueryTimeout), errors.Is(err, errBudgetExhausted):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errClientDisconnected), errors.Is(err, errStreamInterrupted), errors.Is(err, errSchemaViolation),
+		errors.Is(err, errChunkOutOfOrder), errors.Is(err, errChunkGap), errors.Is(err, errNotChunk),
+		errors.Is(err, errStreamFailed), errors.Is(err, errStreamOverrun), errors.Is(err, errBadEncodedBody), errors.Is(err, errEncodedStream),
+		errors.Is(err, errBadGzip):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestQueriesBeyondTheGlobalLimitAreRefused(t *testing.T) {
+	s, ts := newTestServer(t, "-max-concurrent-queries", "1")
+	slow := connectClient(t, s, ts, "db-1")
+	connectClient(t, s, ts, "db-2").echo("b")
+
+	held := goGet(ts.URL+"/query/db-1", nil)
+	query := slow.readQuery()
+	resp, body := do(t, "GET", ts.URL+"/query/db-2", nil, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("query over the limit got %s: %s, want 503 with Retry-After", resp.Status, body)
+	}
+
+	slow.reply(replyMessage{RequestID: query.RequestID, Body: "a"})
+	if r := <-held; r.status != http.StatusOK || r.body != "a" {
+		t.Fatalf("held query got %d %q %v", r.status, r.body, r.err)
+	}
+	if resp, body := do(t, "GET", ts.URL+"/query/db-2", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("query after the slot was freed got %s: %s", resp.Status, body)
+	}
+}
+
+func TestEmptyReplyModes(t *testing.T) {
+	for mode, want := range map[string]int{"empty": http.StatusOK, "no-content": http.StatusNoContent, "error": http.StatusBadGateway} {
+		t.Run(mode, func(t *testing.T) {
+			s, ts := newTestServer(t, "-empty-reply", mode)
+			connectClient(t, s, ts, "db-1").echo("")
+			for _, source := range []string{"client", "cache"} {
+				if resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil); resp.StatusCode != want {
+					t.Errorf("empty reply from the %s got %s: %q, want %d", source, resp.Status, body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyRepliesCanBeLeftUncached(t *testing.T) {
+	s, ts := newTestServer(t, "-cache-empty-replies=false")
+	connectClient(t, s, ts, "db-1").echo("")
+	do(t, "GET", ts.URL+"/query/db-1", nil, nil)
+	if _, ok := s.cached(s.cacheKey("db-1", "")); ok {
+		t.Error("the empty reply was cached")
+	}
+}
+
+func TestUnknownEmptyReplyModeIsRejected(t *testing.T) {
+	if _, err := LoadConfig([]string{"-empty-reply", "silence"}); err == nil {
+		t.Error("LoadConfig accepted -empty-reply silence")
+	}
+}
+
+func TestQueryTimeoutHeader(t *testing.T) {
+	s, _ := newTestServer(t, "-query-timeout", "10s", "-max-query-timeout", "30s")
+	for header, want := range map[string]time.Duration{
+		"":     10 * time.Second,
+		"1.5s": 1500 * time.Millisecond,
+		"2":    2 * time.Second,
+		"0.25": 250 * time.Millisecond,
+		"5m":   30 * time.Second,
+	} {
+		r, _ := http.NewRequest("GET", "/query/db-1", nil)
+		r.Header.Set("X-Query-Timeout", header)
+		if got, err := s.queryTimeout(r); err != nil || got != want {
+			t.Errorf("X-Query-Timeout %q gave %s, %v, want %s", header, got, err, want)
+		}
+	}
+	for _, header := range []string{"soon", "0", "-1s"} {
+		r, _ := http.NewRequest("GET", "/query/db-1", nil)
+		r.Header.Set("X-Query-Timeout", header)
+		if _, err := s.queryTimeout(r); err == nil {
+			t.Errorf("X-Query-Timeout %q was accepted", header)
+		}
+	}
+}
+
+func TestCallerTimeoutEndsTheQuery(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "db-1")
+	start := time.Now()
+	resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, http.Header{"X-Query-Timeout": {"100ms"}})
+	if resp.StatusCode != http.StatusGatewayTimeout || time.Since(start) > 3*time.Second {
+		t.Errorf("unanswered query got %s: %s after %s, want 504 soon after 100ms", resp.Status, body, time.Since(start))
+	}
+	if resp, _ := do(t, "GET", ts.URL+"/query/db-1", nil, http.Header{"X-Query-Timeout": {"soon"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("query with a bad X-Query-Timeout got %s, want 400", resp.Status)
+	}
+}
+
+// timeOut sends n queries to clientID that time out unanswered.
+func timeOut(t *testing.T, url, clientID string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		resp, _ := do(t, "GET", fmt.Sprintf("%s/query/%s?timeout=%d", url, clientID, i), nil, http.Header{"X-Query-Timeout": {"50ms"}})
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Fatalf("unanswered query got %s, want 504", resp.Status)
+		}
+	}
+}
+
+func TestTimeoutsMarkAConnectionUnhealthy(t *testing.T) {
+	s, ts := newTestServer(t, "-unhealthy-after", "2")
+	silent := connectClient(t, s, ts, "db-1")
+	stuck := s.firstConnection("db-1")
+	timeOut(t, ts.URL, "db-1", 2)
+	if !stuck.unhealthy.Load() {
+		t.Fatal("the connection is not unhealthy after 2 timeouts in a row")
+	}
+
+	healthy := connectClient(t, s, ts, "db-1")
+	healthy.echo("healthy")
+	for i := 0; i < 4; i++ {
+		resp, body := do(t, "GET", fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil, nil)
+		if resp.StatusCode != http.StatusOK || string(body) != "healthy" {
+			t.Fatalf("query %d got %s %q, want the healthy connection's reply", i, resp.Status, body)
+		}
+	}
+
+	// Answering again makes it healthy.
+	silent.echo("recovered")
+	healthy.conn.Close()
+	waitFor(t, "the healthy connection to be removed", func() bool { return s.connectionCount("db-1") == 1 })
+	resp, body := do(t, "GET", ts.URL+"/query/db-1?q=last", nil, nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "recovered" || stuck.unhealthy.Load() {
+		t.Errorf("query to the unhealthy connection alone got %s %q, want it answered and the connection healthy", resp.Status, body)
+	}
+}
+
+func TestUnhealthyConnectionsCanBeDisconnected(t *testing.T) {
+	s, ts := newTestServer(t, "-unhealthy-after", "1", "-disconnect-unhealthy")
+	client := connectClient(t, s, ts, "db-1")
+	timeOut(t, ts.URL, "db-1", 1)
+	client.expectClose(websocket.CloseTryAgainLater)
+}
+
+func TestClientErrorStatuses(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "db-1").serve(func(query queryMessage) replyMessage {
+		status, _ := strconv.Atoi(query.Params["status"][0])
+		return replyMessage{Status: status, Body: "status"}
+	})
+	for status, want := range map[string]int{"404": http.StatusNotFound, "503": http.StatusServiceUnavailable, "99": http.StatusBadGateway, "700": http.StatusBadGateway} {
+		if resp, _ := do(t, "GET", ts.URL+"/query/db-1?status="+status, nil, nil); resp.StatusCode != want {
+			t.Errorf("client status %s reached the caller as %s, want %d", status, resp.Status, want)
+		}
+	}
+}
+
+func TestServerErrorsFailOverToAnotherConnection(t *testing.T) {
+	s, ts := newTestServer(t)
+	var failing atomic.Int32
+	connectClient(t, s, ts, "db-1").serve(func(queryMessage) replyMessage {
+		failing.Add(1)
+		return replyMessage{Status: http.StatusInternalServerError, Body: "broken"}
+	})
+	connectClient(t, s, ts, "db-1").echo("fine")
+
+	for i := 0; i < 4; i++ {
+		resp, body := do(t, "GET", fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil, nil)
+		if resp.StatusCode != http.StatusOK || string(body) != "fine" {
+			t.Errorf("query %d got %s %q, want the working connection's reply", i, resp.Status, body)
+		}
+	}
+	if failing.Load() == 0 {
+		t.Error("the failing connection was never tried")
+	}
+}
+
+func TestClientErrorsAreNotRetried(t *testing.T) {
+	s, ts := newTestServer(t)
+	var queries atomic.Int32
+	for i := 0; i < 2; i++ {
+		connectClient(t, s, ts, "db-1").serve(func(queryMessage) replyMessage {
+			queries.Add(1)
+			return replyMessage{Status: http.StatusBadRequest, Body: "bad query"}
+		})
+	}
+	if resp, _ := do(t, "GET", ts.URL+"/query/db-1", nil, nil); resp.StatusCode != http.StatusBadRequest || queries.Load() != 1 {
+		t.Errorf("4xx reply got %s after %d attempts, want it passed on after one", resp.Status, queries.Load())
+	}
+}
+
+func TestBinaryRepliesKeepTheirType(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	body := []byte{0x00, 0xff, 0x10}
+	for _, source := range []string{"client", "cache"} {
+		result := goGet(ts.URL+"/query/db-1", nil)
+		if source == "client" {
+			client.readQuery()
+			client.conn.WriteMessage(websocket.BinaryMessage, body)
+		}
+		r := <-result
+		if r.status != http.StatusOK || r.body != string(body) || r.header.Get("Content-Type") != "application/octet-stream" {
+			t.Errorf("binary reply from the %s got %d %x as %q, want it as application/octet-stream", source, r.status, r.body, r.header.Get("Content-Type"))
+		}
+	}
+	if entry, _ := s.cached(s.cacheKey("db-1", "")); entry.MessageType != websocket.BinaryMessage {
+		t.Errorf("cached as message type %d, want binary", entry.MessageType)
+	}
+}
+
+func TestTextRepliesAreNotLabelledBinary(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "db-1").echo(`{"ok":true}`)
+	resp, _ := do(t, "GET", ts.URL+"/query/db-1", nil, nil)
+	if resp.Header.Get("Content-Type") == "application/octet-stream" {
+		t.Error("a text reply went out as application/octet-stream")
+	}
+}
+
+func TestFailoverStaysWithinTheQueryTimeout(t *testing.T) {
+	s, ts := newTestServer(t)
+	var attempts atomic.Int32
+	for i := 0; i < 3; i++ {
+		connectClient(t, s, ts, "db-1").serve(func(queryMessage) replyMessage {
+			attempts.Add(1)
+			time.Sleep(150 * time.Millisecond)
+			return replyMessage{Status: http.StatusInternalServerError, Body: "slow and broken"}
+		})
+	}
+
+	start := time.Now()
+	resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, http.Header{"X-Query-Timeout": {"250ms"}})
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("failover took %s, beyond the 250ms timeout", elapsed)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("got %s: %s, want 504 once the timeout is spent", resp.Status, body)
+	}
+	if n := attempts.Load(); n > 2 {
+		t.Errorf("%d connections were tried within the timeout, want at most 2", n)
+	}
+}
+
+func TestOrphanRepliesAreDropped(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+
+	client.push(websocket.TextMessage, `{"request_id":"never-issued","body":"late"}`)
+	waitFor(t, "the orphan to be counted", func() bool {
+		s.metrics.mutex.Lock()
+		defer s.metrics.mutex.Unlock()
+		return s.metrics.counters["proxy_orphan_replies_total"] == 1
+	})
+	if entry, ok := s.cached(s.cacheKey("db-1", "")); ok {
+		t.Errorf("orphan reply was cached as a push: %+v", entry)
+	}
+
+	client.echo("answer")
+	if _, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil); string(body) != "answer" {
+		t.Errorf("query after an orphan got %q", body)
+	}
+}
+
+func TestQueriesCarryTheCallerIP(t *testing.T) {
+	s, ts := newTestServer(t, "-trusted-proxies", "127.0.0.1/32")
+	client := connectClient(t, s, ts, "db-1")
+
+	for _, tc := range []struct {
+		forwardedFor string
+		want         string
+	}{
+		{"", "127.0.0.1"},
+		{"203.0.113.7", "203.0.113.7"},
+	} {
+		header := http.Header{}
+		if tc.forwardedFor != "" {
+			header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		result := goGet(ts.URL+"/query/db-1?from="+tc.want, header)
+		query := client.readQuery()
+		if query.CallerIP != tc.want {
+			t.Errorf("query forwarded for %q carried caller IP %q, want %q", tc.forwardedFor, query.CallerIP, tc.want)
+		}
+		client.reply(replyMessage{RequestID: query.RequestID})
+		<-result
+	}
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where a client ID's connections are replicas that ought to agree, reads
+// can be checked against each other. -quorum-reads names query routes, path
+// patterns as in path.Match against /query/{clientID} like those of
+// -cache-policies, with how many connections to ask and how many must
+// agree:
+//
+//	-quorum-reads /query/orders=3/2,/query/ledger-*=5/3
+//
+// The first entry that matches applies. A GET query for orders then goes to
+// 3 of its healthy connections at once, picked at random, as with
+// X-Aggregate, within the one query timeout. Two replies alike in status and
+// body decide it: that reply is returned, with X-Quorum saying how many
+// agreed out of how many were asked, and the queries still out are
+// cancelled. If enough replies came back but no two agree, the caller gets
+// 409 and the disagreement is logged; if too many connections failed, or
+// there are fewer connections than the quorum, 503. Quorum reads are neither
+// answered from the cache nor stored in it.
+
+var (
+	errQuorumDisagreement = errors.New("replies from the client's connections disagree")
+	// errQuorumUnavailable wraps errClientBusy so it is reported the same
+	// way.
+	errQuorumUnavailable = fmt.Errorf("%w: not enough connections replied to reach a quorum", errClientBusy)
+)
+
+type quorumRead struct {
+	n, quorum int
+}
+
+// quorumRoute is a -quorum-reads entry.
+type quorumRoute struct {
+	pattern string
+	read    quorumRead
+}
+
+// parseQuorumReads parses a -quorum-reads list.
+func parseQuorumReads(list string) ([]quorumRoute, error) {
+	var routes []quorumRoute
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, sizes, ok := strings.Cut(entry, "=")
+		pattern = strings.TrimSpace(pattern)
+		n, quorum, ok2 := strings.Cut(sizes, "/")
+		read := quorumRead{}
+		var errN, errQuorum error
+		read.n, errN = strconv.Atoi(strings.TrimSpace(n))
+		read.quorum, errQuorum = strconv.Atoi(strings.TrimSpace(quorum))
+		_, errPattern := path.Match(pattern, "")
+		switch {
+		case !ok || !ok2 || errN != nil || errQuorum != nil || !strings.HasPrefix(pattern, "/"):
+			return nil, fmt.Errorf("%q is not route=n/quorum", entry)
+		case errPattern != nil:
+			return nil, fmt.Errorf("invalid route pattern %q", pattern)
+		case read.quorum < 1 || read.quorum > read.n:
+			return nil, fmt.Errorf("%q: quorum must be between 1 and n", entry)
+		}
+		routes = append(routes, quorumRoute{pattern: pattern, read: read})
+	}
+	return routes, nil
+}
+
+// quorumRead returns how queries to clientID are checked, if their route
+// has a -quorum-reads entry.
+func (s *Server) quorumRead(clientID string) (quorumRead, bool) {
+	route := "/query/" + clientID
+	for _, r := range s.currentConfig().quorumReads {
+		if ok, _ := path.Match(r.pattern, route); ok {
+			return r.read, true
+		}
+	}
+	return quorumRead{}, false
+}
+
+// quorumKey identifies replies that agree.
+func quorumKey(reply clientReply) string {
+	sum := sha256.Sum256(reply.Body)
+	return strconv.Itoa(reply.statusCode()) + ":" + string(sum[:])
+}
+
+func (s *Server) serveQuorum(w http.ResponseWriter, r *http.Request, clientID string, read quorumRead, start time.Time) {
+	fail := func(err error) {
+		s.recordQuery(clientID, "", start, err)
+		writeQueryError(w, err)
+	}
+
+	if s.clientDraining(clientID) {
+		fail(errClientDraining)
+		return
+	}
+	timeout, err := s.queryTimeout(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+	priority, err := queryPriority(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+	maxRTT, err := s.queryMaxRTT(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+	members, err := s.aggregateMembers(clientID, maxRTT)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if len(members) < read.quorum {
+		fail(errQuorumUnavailable)
+		return
+	}
+	rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+	members = members[:min(read.n, len(members))]
+	s.extendWriteDeadline(w, timeout)
+
+	if !s.acquireQuerySlot() {
+		writeSaturated(w)
+		return
+	}
+	defer s.releaseQuerySlot()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	replies := make(chan memberReply, len(members))
+	for _, member := range members {
+		query := s.newQueryMessage(r, "")
+		query.Priority = priority
+		query.ctx = ctx
+		go func() {
+			reply, err := s.queryClient(member, query, timeout)
+			if err == nil {
+				reply, err = reply.collect()
+			}
+			if err == nil {
+				reply, err = reply.decompressed()
+			}
+			replies <- memberReply{reply: reply, err: err}
+		}()
+	}
+
+	votes := make(map[string]int)
+	answered := 0
+	var lastErr error
+	for received := 1; received <= len(members); received++ {
+		result := <-replies
+		if result.err != nil {
+			lastErr = result.err
+		} else {
+			answered++
+			key := quorumKey(result.reply)
+			if votes[key]++; votes[key] >= read.quorum {
+				cancel()
+				s.recordQuery(clientID, "", start, nil)
+				w.Header().Set("X-Quorum", fmt.Sprintf("%d/%d", votes[key], len(members)))
+				s.writeReply(w, r, result.reply)
+				return
+			}
+		}
+		best := 0
+		for _, n := range votes {
+			best = max(best, n)
+		}
+		if best+len(members)-received < read.quorum {
+			break
+		}
+	}
+	cancel()
+
+	if answered >= read.quorum {
+		log.Printf("Quorum read of client %s failed: %d replies in %d different versions, %d needed to agree", clientID, answered, len(votes), read.quorum)
+		s.incCounter("proxy_quorum_disagreements_total", s.metadataLabels(clientID)...)
+		fail(errQuorumDisagreement)
+		return
+	}
+	log.Printf("Quorum read of client %s failed: %d of %d connections replied, %d needed: %v", clientID, answered, len(members), read.quorum, lastErr)
+	fail(errQuorumUnavailable)
+}
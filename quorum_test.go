@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseQuorumReadsByRoute(t *testing.T) {
+	routes, err := parseQuorumReads("/query/orders=3/2, /query/ledger-*=5/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[1].pattern != "/query/ledger-*" || routes[1].read != (quorumRead{n: 5, quorum: 3}) {
+		t.Errorf("parsed %+v", routes)
+	}
+	for _, list := range []string{"orders=3/2", "/query/orders=3", "/query/[=3/2", "/query/orders=2/3", "/query/orders=3/0"} {
+		if _, err := parseQuorumReads(list); err == nil {
+			t.Errorf("parseQuorumReads(%q) succeeded", list)
+		}
+	}
+}
+
+// connectReplicas connects one client per body under clientID, each
+// answering every query with its body.
+func connectReplicas(t *testing.T, s *Server, ts *httptest.Server, clientID string, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		connectClient(t, s, ts, clientID).echo(body)
+	}
+}
+
+func TestQuorumReads(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		bodies []string
+		status int
+		quorum string
+	}{
+		{"agreement", []string{"a", "a", "b"}, http.StatusOK, "2/3"},
+		{"disagreement", []string{"a", "b", "c"}, http.StatusConflict, ""},
+		{"too few connections", []string{"a"}, http.StatusServiceUnavailable, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, ts := newTestServer(t, "-quorum-reads", "/query/orders-*=3/2")
+			connectReplicas(t, s, ts, "orders-eu", tc.bodies...)
+
+			resp, body := do(t, "GET", ts.URL+"/query/orders-eu", nil, nil)
+			if resp.StatusCode != tc.status || resp.Header.Get("X-Quorum") != tc.quorum {
+				t.Fatalf("got %s with X-Quorum %q: %s, want %d with %q", resp.Status, resp.Header.Get("X-Quorum"), body, tc.status, tc.quorum)
+			}
+			if tc.status == http.StatusOK && string(body) != "a" {
+				t.Errorf("got %q, want the reply the quorum agreed on", body)
+			}
+		})
+	}
+}
+
+func TestQuorumReadsOnlyOnMatchingRoutes(t *testing.T) {
+	s, ts := newTestServer(t, "-quorum-reads", "/query/orders-*=3/2")
+	connectReplicas(t, s, ts, "catalog", "a", "b", "c")
+
+	resp, body := do(t, "GET", ts.URL+"/query/catalog", nil, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Quorum") != "" {
+		t.Errorf("got %s with X-Quorum %q: %s, want an ordinary query", resp.Status, resp.Header.Get("X-Quorum"), body)
+	}
+}
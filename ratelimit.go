@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// registerLimiterIdle is how long a source IP may go without registering
+// before its limiter is forgotten.
+const registerLimiterIdle = 10 * time.Minute
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// allowRegistration reports whether ip may register now under the per-IP
+// registration rate. A rate of zero, the default, disables the limit.
+func (s *Server) allowRegistration(ip string) bool {
+	cfg := s.currentConfig()
+	if cfg.RegisterRate <= 0 {
+		return true
+	}
+	limit := rate.Limit(cfg.RegisterRate)
+
+	s.registerLimitersMutex.Lock()
+	defer s.registerLimitersMutex.Unlock()
+
+	l, ok := s.registerLimiters[ip]
+	if !ok {
+		l = &ipLimiter{limiter: rate.NewLimiter(limit, cfg.RegisterBurst)}
+		s.registerLimiters[ip] = l
+	}
+	// Pick up reloaded settings for IPs we already track.
+	if l.limiter.Limit() != limit {
+		l.limiter.SetLimit(limit)
+	}
+	if l.limiter.Burst() != cfg.RegisterBurst {
+		l.limiter.SetBurst(cfg.RegisterBurst)
+	}
+	l.lastSeen = time.Now()
+	return l.limiter.Allow()
+}
+
+func writeRateLimited(w http.ResponseWriter) {
+	writeTransient(w, "too many registrations from this address", http.StatusTooManyRequests, defaultRetryAfter)
+}
+
+func (s *Server) cleanupRegisterLimiters() {
+	for {
+		time.Sleep(s.jitter(time.Minute))
+
+		now := time.Now()
+		s.registerLimitersMutex.Lock()
+		for ip, l := range s.registerLimiters {
+			if now.Sub(l.lastSeen) > registerLimiterIdle {
+				delete(s.registerLimiters, ip)
+			}
+		}
+		s.registerLimitersMutex.Unlock()
+	}
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistrationsAreNotRateLimitedByDefault(t *testing.T) {
+	_, ts := newTestServer(t)
+	for i := 0; i < 50; i++ {
+		register(t, ts, map[string]any{"client_id": fmt.Sprintf("db-%d", i)})
+	}
+}
+
+func TestRegisterRateLimitsOneSourceIP(t *testing.T) {
+	_, ts := newTestServer(t, "-register-rate", "0.01", "-register-burst", "2")
+	register(t, ts, map[string]any{"client_id": "db-1"})
+	register(t, ts, map[string]any{"client_id": "db-2"})
+
+	resp, _ := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-3"}, nil)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third registration in the burst got %s, want 429", resp.Status)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("the refusal has no Retry-After")
+	}
+}
+
+func TestClientIPBelievesOnlyTrustedProxies(t *testing.T) {
+	s, _ := newTestServer(t, "-trusted-proxies", "10.0.0.0/8,192.0.2.1")
+
+	for _, tc := range []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"untrusted without header", "198.51.100.9:1234", nil, "198.51.100.9"},
+		{"untrusted proxy", "198.51.100.9:1234", []string{"203.0.113.7"}, "198.51.100.9"},
+		{"trusted without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"trusted bare address", "192.0.2.1:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"trusted mapped address", "[::ffff:10.0.0.1]:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"remote without port", "10.0.0.1", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"IPv6 hop", "10.0.0.1:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+
+		{"chain through trusted proxies", "10.0.0.1:1234", []string{"203.0.113.7, 192.0.2.1, 10.0.0.5"}, "203.0.113.7"},
+		{"chain stops at the first untrusted hop", "10.0.0.1:1234", []string{"203.0.113.7, 198.51.100.2, 10.0.0.5"}, "198.51.100.2"},
+		{"spoofed leftmost hop", "10.0.0.1:1234", []string{"198.51.100.66,203.0.113.7"}, "203.0.113.7"},
+		{"chain across headers", "10.0.0.1:1234", []string{"203.0.113.7", "198.51.100.2, 10.0.0.5"}, "198.51.100.2"},
+		{"chain of trusted proxies only", "10.0.0.1:1234", []string{"10.1.1.1, 192.0.2.1"}, "10.1.1.1"},
+
+		{"empty header", "10.0.0.1:1234", []string{""}, "10.0.0.1"},
+		{"only separators", "10.0.0.1:1234", []string{" , "}, "10.0.0.1"},
+		{"malformed header", "10.0.0.1:1234", []string{"not-an-address"}, "10.0.0.1"},
+		{"address with port", "10.0.0.1:1234", []string{"203.0.113.7:4000"}, "10.0.0.1"},
+		{"malformed last hop", "10.0.0.1:1234", []string{"203.0.113.7, garbage"}, "10.0.0.1"},
+		{"malformed hop behind a trusted one", "10.0.0.1:1234", []string{"garbage, 10.0.0.5"}, "10.0.0.5"},
+		{"malformed remote address", "not-an-address", []string{"203.0.113.7"}, "not-an-address"},
+	} {
+		r := httptest.NewRequest("GET", "/query/db-1", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for _, value := range tc.forwardedFor {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := s.clientIP(r); got != tc.want {
+			t.Errorf("%s: clientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
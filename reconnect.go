@@ -0,0 +1,48 @@
+package proxy
+
+import "time"
+
+// A client whose connection blips, dropping and reconnecting at once, would
+// otherwise fail every query it had not yet answered. With -reconnect-grace,
+// a query whose connection closes before its reply waits that long, and no
+// longer than its own timeout, for another connection of the client ID, then
+// goes out on it again under the same request ID, marked as a retry:
+//
+//	{"type":"query","request_id":"9f1c...","command":"GET_DATA","retry":true,...}
+//
+// The client may already have acted on the first copy, so one that keeps
+// state across reconnects can use the request ID to answer without doing the
+// work twice. A query still in the connection's queue is re-sent the same
+// way. Queries on a connection that was kicked or drained, and streams the
+// caller has started reading, fail as before.
+
+// reconnectPoll is how often a waiting query looks for a new connection.
+const reconnectPoll = 50 * time.Millisecond
+
+// awaitReconnect waits for a connection of client's ID other than client to
+// re-send query on, and returns it, or nil if none came within the grace
+// period and before deadline.
+func (s *Server) awaitReconnect(client *Client, query queryMessage, deadline time.Time) *Client {
+	grace := s.currentConfig().ReconnectGrace
+	if grace <= 0 {
+		return nil
+	}
+	if until := time.Now().Add(grace); until.Before(deadline) {
+		deadline = until
+	}
+	ctx := query.context()
+	for time.Now().Before(deadline) {
+		if s.clientDraining(client.ID) {
+			return nil
+		}
+		if next, _ := s.pickClient(client.ID, query.maxRTT); next != nil && next != client {
+			return next
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reconnectPoll):
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestQueryIsResentAfterReconnect(t *testing.T) {
+	s, ts := newTestServer(t, "-reconnect-grace", "2s")
+	first := connectClient(t, s, ts, "db-1")
+
+	result := goGet(ts.URL+"/query/db-1", nil)
+	sent := first.readQuery()
+	first.conn.Close()
+	waitFor(t, "the first connection to go", func() bool { return s.connectionCount("db-1") == 0 })
+
+	second := connectClient(t, s, ts, "db-1")
+	resent := second.readQuery()
+	if resent.RequestID != sent.RequestID || !resent.Retry || sent.Retry {
+		t.Errorf("re-sent query %+v after %+v, want the same request ID marked as a retry", resent, sent)
+	}
+	second.reply(replyMessage{RequestID: resent.RequestID, Body: "answer"})
+	if r := <-result; r.status != http.StatusOK || r.body != "answer" {
+		t.Errorf("query across the reconnect got %d %q", r.status, r.body)
+	}
+}
+
+func TestQueryFailsWithoutReconnectGrace(t *testing.T) {
+	s, ts := newTestServer(t, "-reconnect-grace", "0")
+	client := connectClient(t, s, ts, "db-1")
+
+	result := goGet(ts.URL+"/query/db-1", nil)
+	client.readQuery()
+	client.conn.Close()
+	if r := <-result; r.status != http.StatusBadGateway {
+		t.Errorf("query on a closed connection got %d %q, want 502", r.status, r.body)
+	}
+}
+
+func TestReconnectGraceRunsOut(t *testing.T) {
+	s, ts := newTestServer(t, "-reconnect-grace", "100ms")
+	client := connectClient(t, s, ts, "db-1")
+
+	result := goGet(ts.URL+"/query/db-1", nil)
+	client.readQuery()
+	client.conn.Close()
+	if r := <-result; r.status != http.StatusBadGateway {
+		t.Errorf("query with nobody reconnecting got %d %q, want 502", r.status, r.body)
+	}
+}
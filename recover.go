@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// recoverPanics keeps a panicking handler from taking its connection down
+// without a word: the panic is logged with its stack and the request's ID,
+// and the caller gets a 500 naming the same ID so the two can be matched up.
+// The ID is the caller's X-Request-ID if it sent one. http.ErrAbortHandler
+// is let through, since handlers raise it on purpose to cut a response
+// short.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			requestID := r.Header.Get("X-Request-ID")
+			if requestID == "" {
+				requestID = newRequestID()
+			}
+			log.Printf("Panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, requestID, p, debug.Stack())
+			s.incCounter("proxy_panics_total", "in", "handler")
+
+			w.Header().Set("X-Request-ID", requestID)
+			http.Error(w, fmt.Sprintf("internal server error (request %s)", requestID), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverClient is deferred by a client connection's goroutines. A panic
+// there is logged with its stack and closes that one connection, which the
+// reader then cleans up as for any other disconnect, instead of crashing
+// the process.
+func (s *Server) recoverClient(client *Client, goroutine string) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	log.Printf("Panic in %s of client %s: %v\n%s", goroutine, client.ID, p, debug.Stack())
+	s.incCounter("proxy_panics_total", "in", goroutine)
+	s.closeConnection(client.Connection, client.ID, closePanic, "", time.Second)
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPanickingHandlerGets500(t *testing.T) {
+	s, _ := newTestServer(t)
+	handler := s.recoverPanics(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	}))
+
+	r := httptest.NewRequest("GET", "/query/db-1", nil)
+	r.Header.Set("X-Request-ID", "req-42")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "req-42") || w.Header().Get("X-Request-ID") != "req-42" {
+		t.Errorf("panicking handler got %d %q, want 500 naming the request", w.Code, w.Body.String())
+	}
+}
+
+func TestAbortHandlerPanicIsLetThrough(t *testing.T) {
+	s, _ := newTestServer(t)
+	handler := s.recoverPanics(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler passed on", p)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestPanicInAClientGoroutineClosesOnlyThatConnection(t *testing.T) {
+	s, ts := newTestServer(t)
+	broken := connectClient(t, s, ts, "db-1")
+	connectClient(t, s, ts, "db-2").echo("still up")
+
+	client := s.firstConnection("db-1")
+	go func() {
+		defer s.recoverClient(client, "test")
+		panic("boom")
+	}()
+	broken.expectClose(websocket.CloseInternalServerErr)
+
+	if resp, body := do(t, "GET", ts.URL+"/query/db-2", nil, nil); string(body) != "still up" {
+		t.Errorf("other client got %s %q after the panic", resp.Status, body)
+	}
+}
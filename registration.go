@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every registration comes with a token, returned in the connection URL.
+// Under -require-registration, /connect only accepts client IDs that have
+// registered and present that token, and a registration that hasn't been
+// used to connect within -registration-ttl lapses. Once a client has
+// connected, its token stays valid for reconnects until it is refreshed.
+//
+// A client that needs longer to connect can renew its registration before
+// it lapses with POST /register/{clientID}/renew and {"token":"..."}, which
+// gives it another -registration-ttl from then; both /register and the
+// renewal answer with the registration's expires_at. A lapsed registration
+// can't be renewed, only registered again, so nobody holds on to a client ID
+// without connecting.
+//
+// Registering a client ID that is already registered updates it in place,
+// provided the request proves it may: it carries the registration's token
+// as "token", or admin credentials as the admin API takes them. Otherwise it
+// is refused with 403, so nobody can take over another client's ID or push
+// its connections around; a registration that has lapsed is anyone's to
+// register again, as new. On an update the new settings and metadata
+// replace the old, and /register answers with "result":"updated" rather
+// than "created". The registration keeps its token, so connections already
+// made and reconnects with it carry on, unless the request sets
+// "refresh_token":true; the reply carries "token" only when one is issued,
+// on creation or refresh. One that has already been used to connect doesn't
+// lapse again either way. Live connections keep running on the settings
+// they connected with. With "reconnect":true, each is sent
+//
+//	{"type":"reconnect","url":"ws://.../connect?client_id=...&token=..."}
+//
+// as for POST /admin/reconnect, so the client reconnects under the new
+// registration, and /register reports how many were sent it.
+//
+// -max-concurrent-registrations bounds how many /register requests are
+// handled at once, so a storm of them can't tie up the server; one beyond
+// the limit is refused at once with 503 and Retry-After, and counted in
+// proxy_registrations_saturated_total. Renewals aren't limited.
+
+var (
+	errRegistrationNotFound = errors.New("client is not registered")
+	errRegistrationLapsed   = errors.New("registration has lapsed")
+	errRegistrationToken    = errors.New("token does not match the registration")
+)
+
+// acquireRegistrationSlot takes a registration slot without blocking and
+// reports whether one was free. A true result must be paired with
+// releaseRegistrationSlot.
+func (s *Server) acquireRegistrationSlot() bool {
+	if s.registrationSlots == nil {
+		return true
+	}
+	select {
+	case s.registrationSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) releaseRegistrationSlot() {
+	if s.registrationSlots != nil {
+		<-s.registrationSlots
+	}
+}
+
+// registrationToken returns the token and expiry of a registration replacing
+// previous, which exists if reregistered. Callers must hold
+// registrationsMutex.
+func (s *Server) registrationToken(previous Registration, reregistered, refresh bool) (string, time.Time) {
+	token := previous.Token
+	if !reregistered || refresh || token == "" {
+		token = newRequestID()
+	}
+	if reregistered && previous.ExpiresAt.IsZero() {
+		return token, time.Time{}
+	}
+	return token, time.Now().Add(s.currentConfig().RegistrationTTL)
+}
+
+// lapsed reports whether the registration was never used to connect and
+// its TTL has passed.
+func (r Registration) lapsed(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && now.After(r.ExpiresAt)
+}
+
+// mayUpdateRegistration reports whether r, which presented token, may update
+// the registration previous: it knows previous's token, or is an admin.
+func (s *Server) mayUpdateRegistration(r *http.Request, previous Registration, token string) bool {
+	if previous.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(previous.Token)) == 1 {
+		return true
+	}
+	return adminAuthorized(s.currentConfig(), r)
+}
+
+// reconnectClient tells clientID's live connections to reconnect to url and
+// returns how many were told.
+func (s *Server) reconnectClient(clientID, url string) int {
+	s.clientsMutex.RLock()
+	var conns []*Client
+	if set, ok := s.clients[clientID]; ok {
+		conns = append(conns, set.conns...)
+	}
+	s.clientsMutex.RUnlock()
+	if len(conns) == 0 {
+		return 0
+	}
+
+	message, err := json.Marshal(struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	}{
+		Type: "reconnect",
+		URL:  url,
+	})
+	if err != nil {
+		log.Printf("Error encoding reconnect message for client %s: %v", clientID, err)
+		return 0
+	}
+	return s.broadcast(conns, message).Sent
+}
+
+// registrationValid reports whether clientID may connect with token under
+// strict registration.
+func (s *Server) registrationValid(clientID, token string) bool {
+	s.registrationsMutex.RLock()
+	registration, ok := s.registrations[clientID]
+	s.registrationsMutex.RUnlock()
+
+	if !ok || registration.Token == "" {
+		return false
+	}
+	if registration.lapsed(time.Now()) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(registration.Token)) == 1
+}
+
+// markRegistrationUsed stops clientID's registration from lapsing now that
+// it has connected.
+func (s *Server) markRegistrationUsed(clientID string) {
+	s.registrationsMutex.Lock()
+	defer s.registrationsMutex.Unlock()
+
+	if registration, ok := s.registrations[clientID]; ok {
+		registration.ExpiresAt = time.Time{}
+		s.registrations[clientID] = registration
+	}
+}
+
+// expireRegistrations drops registrations that were never used to connect
+// within their TTL. They only lapse under strict registration; otherwise a
+// registration is just settings for a client that may connect at any time.
+func (s *Server) expireRegistrations() {
+	for {
+		time.Sleep(s.jitter(time.Minute))
+
+		if !s.currentConfig().RequireRegistration {
+			continue
+		}
+
+		now := time.Now()
+		s.registrationsMutex.Lock()
+		for id, registration := range s.registrations {
+			if !registration.ExpiresAt.IsZero() && now.After(registration.ExpiresAt) {
+				delete(s.registrations, id)
+				log.Printf("Registration of client %s lapsed without connecting", id)
+			}
+		}
+		s.registrationsMutex.Unlock()
+	}
+}
+
+// renewRegistration extends clientID's unused registration by ttl and
+// returns when it now lapses, zero if the client has connected and it no
+// longer does.
+func (s *Server) renewRegistration(clientID, token string, ttl time.Duration) (time.Time, error) {
+	s.registrationsMutex.Lock()
+	defer s.registrationsMutex.Unlock()
+
+	registration, ok := s.registrations[clientID]
+	if !ok {
+		return time.Time{}, errRegistrationNotFound
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(registration.Token)) != 1 {
+		return time.Time{}, errRegistrationToken
+	}
+	if registration.ExpiresAt.IsZero() {
+		return time.Time{}, nil
+	}
+	now := time.Now()
+	if now.After(registration.ExpiresAt) {
+		return time.Time{}, errRegistrationLapsed
+	}
+	registration.ExpiresAt = now.Add(ttl)
+	s.registrations[clientID] = registration
+	return registration.ExpiresAt, nil
+}
+
+func (s *Server) handleRegisterRenew(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	if !s.allowRegistration(s.clientIP(r)) {
+		writeRateLimited(w)
+		return
+	}
+
+	var renewal struct {
+		Token string `json:"token"`
+	}
+	limitBody(w, r, s.currentConfig().MaxRegisterBody)
+	if err := json.NewDecoder(r.Body).Decode(&renewal); err != nil {
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+		return
+	}
+
+	expiresAt, err := s.renewRegistration(clientID, renewal.Token, s.currentConfig().RegistrationTTL)
+	switch {
+	case errors.Is(err, errRegistrationToken):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !expiresAt.IsZero() {
+		log.Printf("Renewed registration of client %s until %s", clientID, expiresAt.Format(time.RFC3339))
+	}
+
+	writeRegistrationResponse(w, clientID, registrationExpiry(expiresAt))
+}
+
+type registrationExpiryResponse struct {
+	// ExpiresAt is omitted once the client has connected.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func registrationExpiry(expiresAt time.Time) registrationExpiryResponse {
+	if expiresAt.IsZero() {
+		return registrationExpiryResponse{}
+	}
+	return registrationExpiryResponse{ExpiresAt: &expiresAt}
+}
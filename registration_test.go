@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReregisteringWithoutTokenIsRefused(t *testing.T) {
+	s, ts := newTestServer(t)
+	first := register(t, ts, map[string]any{"client_id": "db-1", "tenant": "acme"})
+	connectRegistered(t, s, first, "db-1")
+
+	resp, body := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-1", "tenant": "evil", "reconnect": true}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("second registration got %s: %s, want 403", resp.Status, body)
+	}
+	resp, body = do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-1", "token": "guess"}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("registration with a wrong token got %s: %s, want 403", resp.Status, body)
+	}
+
+	s.registrationsMutex.RLock()
+	registration := s.registrations["db-1"]
+	s.registrationsMutex.RUnlock()
+	if registration.Tenant != "acme" || registration.Token != first.Token {
+		t.Errorf("refused registrations changed it to %+v", registration)
+	}
+}
+
+func TestReregisteringWithTokenUpdates(t *testing.T) {
+	_, ts := newTestServer(t)
+	first := register(t, ts, map[string]any{"client_id": "db-1"})
+	if first.Token == "" || first.Result != "created" {
+		t.Fatalf("first registration got %+v, want a new token", first)
+	}
+
+	updated := register(t, ts, map[string]any{"client_id": "db-1", "token": first.Token, "tenant": "acme"})
+	if updated.Result != "updated" || updated.Token != "" {
+		t.Errorf("update got %+v, want it updated without the token repeated", updated)
+	}
+
+	refreshed := register(t, ts, map[string]any{"client_id": "db-1", "token": first.Token, "refresh_token": true})
+	if refreshed.Token == "" || refreshed.Token == first.Token {
+		t.Errorf("refresh got token %q, want a new one", refreshed.Token)
+	}
+}
+
+func TestAdminMayReregister(t *testing.T) {
+	_, ts := newTestServer(t)
+	register(t, ts, map[string]any{"client_id": "db-1"})
+
+	resp, body := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-1", "tenant": "acme"}, adminHeader())
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("admin update got %s: %s, want 200", resp.Status, body)
+	}
+}
+
+func TestLapsedRegistrationCanBeTakenOver(t *testing.T) {
+	s, ts := newTestServer(t, "-require-registration", "-registration-ttl", "10ms")
+	first := register(t, ts, map[string]any{"client_id": "db-1"})
+	waitFor(t, "the registration to lapse", func() bool {
+		s.registrationsMutex.RLock()
+		defer s.registrationsMutex.RUnlock()
+		return s.registrations["db-1"].lapsed(time.Now())
+	})
+
+	again := register(t, ts, map[string]any{"client_id": "db-1"})
+	if again.Result != "created" || again.Token == "" || again.Token == first.Token {
+		t.Errorf("registering a lapsed client ID got %+v, want a new registration", again)
+	}
+}
+
+func TestStrictModeNeedsTheRegistrationToken(t *testing.T) {
+	s, ts := newTestServer(t, "-require-registration")
+	for _, url := range []string{"/connect?client_id=db-1", "/connect?client_id=db-1&token=guess"} {
+		if _, resp, err := websocket.DefaultDialer.Dial(wsURL(ts, url), nil); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("connecting to %s got %v, want 403", url, err)
+		}
+	}
+
+	registered := register(t, ts, map[string]any{"client_id": "db-1"})
+	if !strings.Contains(registered.ConnectionURL, "token="+registered.Token) {
+		t.Fatalf("connection URL %s doesn't carry the token", registered.ConnectionURL)
+	}
+	connectRegistered(t, s, registered, "db-1")
+	// A connected client's token keeps working for reconnects.
+	connectRegistered(t, s, registered, "db-1")
+}
+
+func TestRenewingARegistration(t *testing.T) {
+	_, ts := newTestServer(t, "-require-registration")
+	registered := register(t, ts, map[string]any{"client_id": "db-1"})
+
+	resp, body := do(t, "POST", ts.URL+"/register/db-1/renew", map[string]string{"token": registered.Token}, nil)
+	var renewed registrationExpiryResponse
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &renewed) != nil || renewed.ExpiresAt == nil {
+		t.Errorf("renewal got %s: %s, want a new expires_at", resp.Status, body)
+	}
+	if resp, _ := do(t, "POST", ts.URL+"/register/db-1/renew", map[string]string{"token": "guess"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("renewal with a wrong token got %s, want 403", resp.Status)
+	}
+	if resp, _ := do(t, "POST", ts.URL+"/register/db-2/renew", map[string]string{"token": "guess"}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("renewing an unknown registration got %s, want 404", resp.Status)
+	}
+}
+
+func TestLapsedRegistrationCannotBeRenewed(t *testing.T) {
+	s, ts := newTestServer(t, "-require-registration", "-registration-ttl", "10ms")
+	registered := register(t, ts, map[string]any{"client_id": "db-1"})
+	waitFor(t, "the registration to lapse", func() bool {
+		s.registrationsMutex.RLock()
+		defer s.registrationsMutex.RUnlock()
+		return s.registrations["db-1"].lapsed(time.Now())
+	})
+
+	if resp, body := do(t, "POST", ts.URL+"/register/db-1/renew", map[string]string{"token": registered.Token}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("renewing a lapsed registration got %s: %s, want 404", resp.Status, body)
+	}
+}
+
+func TestRegistrationResponseThatCannotBeEncodedIs500(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeRegistrationResponse(w, "db-1", map[string]any{"bad": make(chan int)})
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "bad") {
+		t.Errorf("unencodable response got %d: %s, want a bare 500", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	writeRegistrationResponse(w, "db-1", map[string]string{"token": "x"})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" || w.Body.String() != "{\"token\":\"x\"}\n" {
+		t.Errorf("response got %d %q: %q", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+}
+
+func TestConcurrentRegistrationsAreBounded(t *testing.T) {
+	s, ts := newTestServer(t, "-max-concurrent-registrations", "1")
+	// A registration still being handled holds the only slot.
+	if !s.acquireRegistrationSlot() {
+		t.Fatal("no registration slot free at startup")
+	}
+
+	resp, body := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-1"}, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("registration beyond the limit got %s: %s, want 503 with Retry-After", resp.Status, body)
+	}
+	s.metrics.mutex.Lock()
+	saturated := s.metrics.counters["proxy_registrations_saturated_total"]
+	s.metrics.mutex.Unlock()
+	if saturated != 1 {
+		t.Errorf("proxy_registrations_saturated_total = %v, want 1", saturated)
+	}
+
+	s.releaseRegistrationSlot()
+	register(t, ts, map[string]any{"client_id": "db-1"})
+	// The registration gave its slot back.
+	register(t, ts, map[string]any{"client_id": "db-2"})
+}
@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Pure cache reads can be offloaded to replicas. An instance started with
+//
+//	-replica-of https://primary:8380 -replica-token <primary admin token>
+//
+// holds no client connections: it follows the primary's cache through GET
+// /admin/cache/stream and serves /query-cached from its copy, plus /metrics;
+// every other route answers 501. The stream is server-sent events, each a
+// cacheUpdate, starting with a flush and the primary's whole cache and then
+// every change as it happens, so a replica that reconnects, after the
+// primary restarted or dropped it for falling behind, starts over from a
+// consistent copy. Meanwhile it keeps serving what it has, marked STALE once
+// expired. Entries keep the primary's timestamps, so clocks should agree.
+//
+// Bodies travel base64-encoded, so binary replies and those the client sent
+// gzip-compressed arrive intact. An update too large for the replica's own
+// -max-cache-body, and -cache-policies, is skipped with a log line, and the
+// key it was for dropped from the replica's copy rather than left stale.
+
+// cacheFeedBufferSize is how many updates a replica may fall behind by
+// before the primary drops it.
+const cacheFeedBufferSize = 1024
+
+type cacheUpdate struct {
+	// Op is "set" or "delete" for Key, "flush_client" for ClientID's
+	// entries, "flush_tenant" for Tenant's, or "flush" for all of them.
+	Op       string        `json:"op"`
+	Key      string        `json:"key,omitempty"`
+	ClientID string        `json:"client_id,omitempty"`
+	Tenant   string        `json:"tenant,omitempty"`
+	Entry    *replicaEntry `json:"entry,omitempty"`
+}
+
+// replicaEntry is a cache entry as it is sent to replicas. Data is bytes,
+// which encoding/json sends as base64, since a JSON string would replace
+// bytes that aren't valid UTF-8.
+type replicaEntry struct {
+	Status      int               `json:"status,omitempty"`
+	Data        []byte            `json:"data"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	MessageType int               `json:"message_type"`
+	Timestamp   time.Time         `json:"timestamp"`
+	TTL         time.Duration     `json:"ttl"`
+}
+
+func newReplicaEntry(entry ClientResponse) *replicaEntry {
+	return &replicaEntry{
+		Status:      entry.Status,
+		Data:        []byte(entry.Data),
+		Headers:     entry.Headers,
+		MessageType: entry.MessageType,
+		Timestamp:   entry.Timestamp,
+		TTL:         entry.TTL,
+	}
+}
+
+func (e *replicaEntry) cacheEntry() ClientResponse {
+	return ClientResponse{
+		Status:      e.Status,
+		Data:        string(e.Data),
+		Headers:     e.Headers,
+		MessageType: e.MessageType,
+		Timestamp:   e.Timestamp,
+		TTL:         e.TTL,
+	}
+}
+
+// replicaUpdateSlack is room, on top of an entry's encoded body, for its key
+// and headers.
+const replicaUpdateSlack = 64 << 10
+
+// replicaUpdateLimit is the longest cache update line a replica reads, 0 for
+// no limit: room for the largest body it would cache itself, base64-encoded.
+func replicaUpdateLimit(cfg *Config) int {
+	largest := cfg.maxCachedBody()
+	if largest == 0 {
+		return 0
+	}
+	return base64.StdEncoding.EncodedLen(largest) + replicaUpdateSlack
+}
+
+// cacheFeed fans cache updates out to replicas. Like eventBus it never
+// blocks: a subscriber that falls behind is dropped and has to resync.
+type cacheFeed struct {
+	mutex       sync.Mutex
+	subscribers map[chan cacheUpdate]struct{}
+}
+
+func newCacheFeed() *cacheFeed {
+	return &cacheFeed{subscribers: make(map[chan cacheUpdate]struct{})}
+}
+
+func (f *cacheFeed) subscribe() chan cacheUpdate {
+	ch := make(chan cacheUpdate, cacheFeedBufferSize)
+	f.mutex.Lock()
+	f.subscribers[ch] = struct{}{}
+	f.mutex.Unlock()
+	return ch
+}
+
+func (f *cacheFeed) unsubscribe(ch chan cacheUpdate) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.subscribers[ch]; ok {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish sends update to every replica. Callers hold cacheMutex, so
+// updates go out in the order they were applied.
+func (f *cacheFeed) publish(update cacheUpdate) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for ch := range f.subscribers {
+		select {
+		case ch <- update:
+		default:
+			delete(f.subscribers, ch)
+			close(ch)
+			log.Printf("Dropped replica that fell behind the cache stream")
+		}
+	}
+}
+
+// cacheSet stores entry under key and tells replicas. Callers hold
+// cacheMutex for writing.
+func (s *Server) cacheSet(key string, entry ClientResponse) {
+	stored, evicted := s.cachePut(key, entry)
+	if stored {
+		s.cacheFeed.publish(cacheUpdate{Op: "set", Key: key, Entry: newReplicaEntry(entry)})
+	}
+	for _, key := range evicted {
+		s.cacheFeed.publish(cacheUpdate{Op: "delete", Key: key})
+	}
+}
+
+// handleCacheStream streams the cache to a replica as server-sent events
+// until the replica goes away or falls too far behind.
+func (s *Server) handleCacheStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	clearWriteDeadline(w)
+
+	// Subscribing under the lock means no update is missed or repeated
+	// between the snapshot and the stream.
+	s.cacheMutex.RLock()
+	ch := s.cacheFeed.subscribe()
+	snapshot := []cacheUpdate{{Op: "flush"}}
+	for key, entry := range s.cache {
+		snapshot = append(snapshot, cacheUpdate{Op: "set", Key: key, Entry: newReplicaEntry(entry)})
+	}
+	s.cacheMutex.RUnlock()
+	defer s.cacheFeed.unsubscribe(ch)
+
+	log.Printf("Replica %s subscribed to the cache (%d entries)", s.clientIP(r), len(snapshot)-1)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, update := range snapshot {
+		writeCacheUpdate(w, update)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case update, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeCacheUpdate(w, update)
+			flusher.Flush()
+		}
+	}
+}
+
+func writeCacheUpdate(w http.ResponseWriter, update cacheUpdate) {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: cache\ndata: %s\n\n", data)
+}
+
+// parseReplicaOf checks a -replica-of URL and returns it without a trailing
+// slash.
+func parseReplicaOf(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("host is missing")
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// followPrimary keeps the cache in step with the primary's for as long as
+// the server runs, reconnecting with backoff whenever the stream ends.
+func (s *Server) followPrimary() {
+	backoff := time.Second
+	for {
+		cfg := s.currentConfig()
+		start := time.Now()
+		err := s.syncFromPrimary(cfg.replicaOf, cfg.ReplicaToken)
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("Cache stream from primary %s ended: %v; retrying in %s", cfg.replicaOf, err, backoff)
+		time.Sleep(s.jitter(backoff))
+		backoff = min(2*backoff, 30*time.Second)
+	}
+}
+
+func (s *Server) syncFromPrimary(primary, token string) error {
+	req, err := http.NewRequest(http.MethodGet, primary+"/admin/cache/stream", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary answered %s", resp.Status)
+	}
+	log.Printf("Following the cache of primary %s", primary)
+
+	reader := bufio.NewReader(resp.Body)
+	limit := replicaUpdateLimit(s.currentConfig())
+	for {
+		line, oversized, err := readUpdateLine(reader, limit)
+		if err == io.EOF {
+			return fmt.Errorf("primary closed the stream")
+		}
+		if err != nil {
+			return err
+		}
+		data, ok := bytes.CutPrefix(line, []byte("data: "))
+		if !ok {
+			continue
+		}
+		if oversized {
+			s.skipCacheUpdate(data, limit)
+			continue
+		}
+		var update cacheUpdate
+		if err := json.Unmarshal(data, &update); err != nil {
+			return fmt.Errorf("bad cache update: %w", err)
+		}
+		s.applyCacheUpdate(update)
+	}
+}
+
+// readUpdateLine reads one line of the cache stream. A line longer than
+// limit, if there is one, is read to its end but only its first limit bytes
+// returned, with oversized set.
+func readUpdateLine(r *bufio.Reader, limit int) (line []byte, oversized bool, err error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if limit == 0 || len(line) < limit {
+			line = append(line, chunk...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err != nil:
+			return nil, false, err
+		}
+		if limit > 0 && len(line) > limit {
+			return line[:limit], true, nil
+		}
+		return bytes.TrimSuffix(line, []byte("\n")), false, nil
+	}
+}
+
+// skipCacheUpdate passes over a cache update cut short at limit bytes. One
+// that sets a key, whose op and key come first, drops what the replica has
+// under it, which is older.
+func (s *Server) skipCacheUpdate(truncated []byte, limit int) {
+	s.incCounter("proxy_replica_updates_skipped_total")
+	var op, key string
+	decoder := json.NewDecoder(bytes.NewReader(truncated))
+	if token, _ := decoder.Token(); token == json.Delim('{') {
+		for i := 0; i < 2 && decoder.More(); i++ {
+			name, _ := decoder.Token()
+			value, _ := decoder.Token()
+			switch name {
+			case "op":
+				op, _ = value.(string)
+			case "key":
+				key, _ = value.(string)
+			}
+		}
+	}
+	log.Printf("Skipped a cache update of more than %d bytes for key %q; the primary caches larger bodies than -max-cache-body here", limit, key)
+	if op == "set" && key != "" {
+		s.cacheMutex.Lock()
+		s.cacheDelete(key)
+		s.cacheMutex.Unlock()
+	}
+}
+
+func (s *Server) applyCacheUpdate(update cacheUpdate) {
+	switch update.Op {
+	case "set":
+		if update.Entry != nil {
+			s.learnTenant(update.Key)
+			s.cacheMutex.Lock()
+			s.cachePut(update.Key, update.Entry.cacheEntry())
+			s.cacheMutex.Unlock()
+		}
+	case "delete":
+		s.cacheMutex.Lock()
+		s.cacheDelete(update.Key)
+		s.cacheMutex.Unlock()
+	case "flush_client":
+		s.flushClientCache(update.ClientID)
+	case "flush_tenant":
+		s.flushTenantCache(update.Tenant)
+	case "flush":
+		s.flushCache()
+	}
+}
+
+// replicaRoutes mounts what a replica serves on r.
+func (s *Server) replicaRoutes(r *mux.Router) {
+	r.HandleFunc("/query-cached/{clientID}", s.limitQueryRequest(s.gzipResponses(s.injectResponseHeaders(s.handleCachedQuery)))).Methods("GET")
+	r.HandleFunc("/metrics", s.requireMetricsAuth(s.handleMetrics)).Methods("GET")
+	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "read-only replica: only /query-cached is served here", http.StatusNotImplemented)
+	})
+}
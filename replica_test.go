@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestReplica starts a replica of primary, with args added, and waits
+// until it has subscribed to the primary's cache.
+func newTestReplica(t *testing.T, primary *Server, url string, args ...string) (*Server, *httptest.Server) {
+	t.Helper()
+	replica, ts := newTestServer(t, append([]string{"-replica-of", url, "-replica-token", testAdminToken}, args...)...)
+	waitFor(t, "the replica to subscribe", func() bool {
+		primary.cacheFeed.mutex.Lock()
+		defer primary.cacheFeed.mutex.Unlock()
+		return len(primary.cacheFeed.subscribers) > 0
+	})
+	return replica, ts
+}
+
+// cached returns what s has cached under key.
+func (s *Server) cached(key string) (ClientResponse, bool) {
+	s.cacheMutex.RLock()
+	defer s.cacheMutex.RUnlock()
+	entry, ok := s.cache[key]
+	return entry, ok
+}
+
+func TestReplicaReceivesBinaryBodiesIntact(t *testing.T) {
+	primary, primaryTS := newTestServer(t)
+	replica, replicaTS := newTestReplica(t, primary, primaryTS.URL)
+	client := connectClient(t, primary, primaryTS, "db-1")
+
+	body := []byte{0x00, 0xff, 0xfe, 'a', 0x80, 0xc3}
+	result := goGet(primaryTS.URL+"/query/db-1", nil)
+	client.readQuery()
+	client.conn.WriteMessage(websocket.BinaryMessage, body)
+	if r := <-result; r.status != http.StatusOK {
+		t.Fatalf("query got %d %q", r.status, r.body)
+	}
+
+	waitFor(t, "the replica to cache the reply", func() bool {
+		_, ok := replica.cached("db-1")
+		return ok
+	})
+	resp, got := do(t, "GET", replicaTS.URL+"/query-cached/db-1", nil, nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, body) {
+		t.Errorf("replica served %s %x, want %x", resp.Status, got, body)
+	}
+}
+
+func TestReplicaSkipsUpdatesLargerThanItCaches(t *testing.T) {
+	primary, primaryTS := newTestServer(t, "-max-cache-body", "0")
+	replica, _ := newTestReplica(t, primary, primaryTS.URL, "-max-cache-body", "1024")
+
+	// The replica has an older copy of the key the oversized update is
+	// for, which it must not keep serving.
+	replica.cacheMutex.Lock()
+	replica.cachePut("big", ClientResponse{Data: "old", Timestamp: time.Now(), TTL: time.Minute})
+	replica.cacheMutex.Unlock()
+
+	primary.cacheMutex.Lock()
+	primary.cacheSet("big", ClientResponse{Data: strings.Repeat("x", replicaUpdateLimit(replica.currentConfig())), Timestamp: time.Now(), TTL: time.Minute})
+	primary.cacheSet("small", ClientResponse{Data: "fits", Timestamp: time.Now(), TTL: time.Minute})
+	primary.cacheMutex.Unlock()
+
+	waitFor(t, "the update after the oversized one", func() bool {
+		_, ok := replica.cached("small")
+		return ok
+	})
+	if _, ok := replica.cached("big"); ok {
+		t.Error("the replica kept its older copy of the key it skipped an update for")
+	}
+}
+
+func TestReplicaUpdateLimitFollowsMaxCacheBody(t *testing.T) {
+	cfg, err := LoadConfig([]string{"-max-cache-body", "3000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := replicaUpdateLimit(cfg); limit < 4000000 {
+		t.Errorf("limit for a 3 MB -max-cache-body is %d, too small for it base64-encoded", limit)
+	}
+	cfg, err = LoadConfig([]string{"-max-cache-body", "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := replicaUpdateLimit(cfg); limit != 0 {
+		t.Errorf("limit without -max-cache-body is %d, want none", limit)
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Error responses say whether trying again can succeed. A transient refusal
+// carries X-Retryable: true and a Retry-After in seconds, to wait out
+// before the retry: the proxy or the client busy, paused, draining or in
+// maintenance, a rate or connection limit, a query that timed out or lost
+// its connection, or a client that isn't connected yet. An error response
+// without X-Retryable is permanent as far as the proxy can tell, because
+// the request is malformed (400, 413), not allowed (401, 403), or the
+// client's reply was unusable, and repeating it unchanged gets the same
+// answer. /query-batch entries say the same with "retryable": true. This
+// covers /register and /connect as well as queries, so client libraries
+// can retry on the header alone.
+
+// defaultRetryAfter is the Retry-After, in seconds, of transient errors that
+// don't call for a particular one.
+const defaultRetryAfter = 1
+
+// retryableError reports whether the failure that err describes may not
+// recur.
+func retryableError(err error) bool {
+	return clientUnavailable(err) ||
+		errors.Is(err, errMaintenance) ||
+		errors.Is(err, errBudgetExhausted)
+}
+
+// markRetryable flags an error response as transient, keeping a Retry-After
+// that is already set.
+func markRetryable(w http.ResponseWriter, retryAfter int) {
+	w.Header().Set("X-Retryable", "true")
+	if w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+}
+
+// writeTransient answers with a transient error worth retrying after
+// retryAfter seconds.
+func writeTransient(w http.ResponseWriter, message string, status, retryAfter int) {
+	markRetryable(w, retryAfter)
+	http.Error(w, message, status)
+}
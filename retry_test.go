@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTransientErrorsAreMarkedRetryable(t *testing.T) {
+	s, ts := newTestServer(t)
+	for _, tc := range []struct {
+		name      string
+		method    string
+		path      string
+		status    int
+		retryable bool
+	}{
+		{"client not connected", "GET", "/query/db-1", http.StatusNotFound, true},
+		{"malformed command", "POST", "/command/db-1", http.StatusBadRequest, false},
+		{"missing admin credential", "GET", "/clients", http.StatusUnauthorized, false},
+	} {
+		resp, body := do(t, tc.method, ts.URL+tc.path, "not json", nil)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s got %s: %s, want %d", tc.name, resp.Status, body, tc.status)
+			continue
+		}
+		if retryable := resp.Header.Get("X-Retryable") == "true"; retryable != tc.retryable {
+			t.Errorf("%s marked retryable %t, want %t", tc.name, retryable, tc.retryable)
+		}
+		if tc.retryable && resp.Header.Get("Retry-After") == "" {
+			t.Errorf("%s has no Retry-After", tc.name)
+		}
+	}
+
+	s.maintenance.Store(true)
+	if resp, _ := do(t, "GET", ts.URL+"/query/db-1?q=uncached", nil, nil); resp.Header.Get("X-Retryable") != "true" {
+		t.Errorf("maintenance refusal got %s without X-Retryable", resp.Status)
+	}
+}
+
+func TestBatchEntriesSayWhetherRetryable(t *testing.T) {
+	_, ts := newTestServer(t)
+	batch := queryBatch(t, ts.URL, batchQuery{ClientID: "db-1"})
+	if !batch.Results[0].Retryable {
+		t.Errorf("batch entry for a client not connected got %+v, want it retryable", batch.Results[0])
+	}
+}
+
+func TestMarkRetryableKeepsRetryAfter(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set("Retry-After", "30")
+	markRetryable(w, defaultRetryAfter)
+	if w.Header().Get("Retry-After") != "30" || w.Header().Get("X-Retryable") != "true" {
+		t.Errorf("markRetryable left %v", w.Header())
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clients often reply with links to their own internal hostnames, which
+// mean nothing to callers. The -body-rewrites file lists replacements made
+// in the bodies of replies on their way to the caller:
+//
+//	{"content_types": ["application/json", "text/*"],
+//	 "hosts": {"orders.internal:8080": "api.example.com"},
+//	 "rules": [{"find": "http://api.example.com", "replace": "https://api.example.com"}]}
+//
+// A host entry replaces "//orders.internal:8080" with "//api.example.com",
+// keeping the scheme, and comes before the rules, which are literal
+// find/replace pairs tried in order. At each point in the body the first that
+// matches wins, and replaced text is not looked at again. Only replies whose
+// Content-Type is listed are rewritten, application/json and text/* if the
+// file names none; binary messages never are. A gzip reply is decompressed
+// to be rewritten. Streamed replies are rewritten as they pass through, text
+// held back between chunks only as long as it could be the start of a match;
+// event-stream chunks are rewritten each on its own. The cache and
+// /query-batch keep replies as the client sent them.
+
+type bodyRewriteFile struct {
+	ContentTypes []string          `json:"content_types"`
+	Hosts        map[string]string `json:"hosts"`
+	Rules        []bodyRewriteRule `json:"rules"`
+}
+
+type bodyRewriteRule struct {
+	Find    string `json:"find"`
+	Replace string `json:"replace"`
+}
+
+type bodyRewrites struct {
+	contentTypes []string
+	rules        []bodyRewriteRule
+}
+
+func loadBodyRewrites(path string) (*bodyRewrites, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file bodyRewriteFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	rewrites := &bodyRewrites{contentTypes: file.ContentTypes}
+	if len(rewrites.contentTypes) == 0 {
+		rewrites.contentTypes = []string{"application/json", "text/*"}
+	}
+	for i, contentType := range rewrites.contentTypes {
+		rewrites.contentTypes[i] = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	for from, to := range file.Hosts {
+		if from == "" {
+			return nil, fmt.Errorf("empty host")
+		}
+		rewrites.rules = append(rewrites.rules, bodyRewriteRule{Find: "//" + from, Replace: "//" + to})
+	}
+	for _, rule := range file.Rules {
+		if rule.Find == "" {
+			return nil, fmt.Errorf("rule with an empty find")
+		}
+		rewrites.rules = append(rewrites.rules, rule)
+	}
+	return rewrites, nil
+}
+
+// applies reports whether replies of contentType are rewritten.
+func (b *bodyRewrites) applies(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, listed := range b.contentTypes {
+		if listed == mediaType || strings.HasSuffix(listed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(listed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite applies the rules to data. Unless final, text at the end that
+// could still become a match is returned as rest, to be put in front of
+// what follows.
+func (b *bodyRewrites) rewrite(data []byte, final bool) (out, rest []byte) {
+	out = make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		matched := false
+		for _, rule := range b.rules {
+			if bytes.HasPrefix(data[i:], []byte(rule.Find)) {
+				out = append(out, rule.Replace...)
+				i += len(rule.Find)
+				matched = true
+				break
+			}
+			if !final && strings.HasPrefix(rule.Find, string(data[i:])) {
+				return out, data[i:]
+			}
+		}
+		if !matched {
+			out = append(out, data[i])
+			i++
+		}
+	}
+	return out, nil
+}
+
+// replyContentType returns the Content-Type the client gave its reply.
+func replyContentType(headers map[string]string) string {
+	for name, value := range headers {
+		if strings.EqualFold(name, "Content-Type") {
+			return value
+		}
+	}
+	return ""
+}
+
+// rewritesFor returns the rewrites that apply to reply, or nil.
+func (s *Server) rewritesFor(reply clientReply) *bodyRewrites {
+	rewrites := s.currentConfig().bodyRewrites
+	if rewrites == nil || reply.MessageType == websocket.BinaryMessage || !rewrites.applies(replyContentType(reply.Headers)) {
+		return nil
+	}
+	return rewrites
+}
+
+// rewriteReply applies -body-rewrites to a whole reply. It reports false,
+// having answered 502, if a gzip body doesn't decompress.
+func (s *Server) rewriteReply(w http.ResponseWriter, r *http.Request, reply *clientReply) bool {
+	rewrites := s.rewritesFor(*reply)
+	if rewrites == nil {
+		return true
+	}
+	decoded, err := reply.decompressed()
+	if err != nil {
+		log.Printf("Reply for %s: %v", r.URL.Path, err)
+		http.Error(w, errBadGzip.Error(), http.StatusBadGateway)
+		return false
+	}
+	decoded.Body, _ = rewrites.rewrite(decoded.Body, true)
+	decoded.Headers = withoutContentLength(decoded.Headers)
+	*reply = decoded
+	return true
+}
+
+// withoutContentLength copies headers without Content-Length, which a
+// rewritten body no longer matches.
+func withoutContentLength(headers map[string]string) map[string]string {
+	copied := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if !strings.EqualFold(name, "Content-Length") {
+			copied[name] = value
+		}
+	}
+	return copied
+}
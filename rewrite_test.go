@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testBodyRewrites = `{"hosts": {"orders.internal:8080": "api.example.com"},
+ "rules": [{"find": "http://api.example.com", "replace": "https://api.example.com"}]}`
+
+// writeBodyRewrites writes a -body-rewrites file of contents and returns
+// its path.
+func writeBodyRewrites(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rewrites.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBodyRewriteRules(t *testing.T) {
+	rewrites, err := loadBodyRewrites(writeBodyRewrites(t, testBodyRewrites))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The host rewrite's output isn't looked at again by the rule after it.
+	out, rest := rewrites.rewrite([]byte(`{"next":"http://orders.internal:8080/p/2"}`), true)
+	if string(out) != `{"next":"http://api.example.com/p/2"}` || rest != nil {
+		t.Errorf("rewrite = %s, %q", out, rest)
+	}
+	out, _ = rewrites.rewrite([]byte(`see http://api.example.com`), true)
+	if string(out) != `see https://api.example.com` {
+		t.Errorf("rewrite = %s", out)
+	}
+	out, rest = rewrites.rewrite([]byte(`link: http://api.exa`), false)
+	if string(out) != "link: " || string(rest) != "http://api.exa" {
+		t.Errorf("rewrite of a chunk ending in a partial match = %q, %q", out, rest)
+	}
+}
+
+func TestBodyRewriteContentTypes(t *testing.T) {
+	rewrites, err := loadBodyRewrites(writeBodyRewrites(t, testBodyRewrites))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for contentType, want := range map[string]bool{
+		"application/json; charset=utf-8": true,
+		"text/html":                       true,
+		"image/png":                       false,
+		"":                                false,
+	} {
+		if got := rewrites.applies(contentType); got != want {
+			t.Errorf("applies(%q) = %t, want %t", contentType, got, want)
+		}
+	}
+}
+
+func TestRepliesAreRewrittenForCallers(t *testing.T) {
+	s, ts := newTestServer(t, "-body-rewrites", writeBodyRewrites(t, testBodyRewrites))
+	connectClient(t, s, ts, "orders").serve(func(query queryMessage) replyMessage {
+		return replyMessage{Headers: map[string]string{"Content-Type": query.Params["type"][0]}, Body: "http://orders.internal:8080/x"}
+	})
+
+	if _, body := do(t, "GET", ts.URL+"/query/orders?type=application/json", nil, nil); string(body) != "http://api.example.com/x" {
+		t.Errorf("JSON reply got %q, want it rewritten", body)
+	}
+	if entry, _ := s.cached(s.cacheKey("orders", "type=application/json")); entry.Data != "http://orders.internal:8080/x" {
+		t.Errorf("cached %q, want the reply as the client sent it", entry.Data)
+	}
+	if _, body := do(t, "GET", ts.URL+"/query/orders?type=application/octet-stream", nil, nil); string(body) != "http://orders.internal:8080/x" {
+		t.Errorf("octet-stream reply got %q, want it untouched", body)
+	}
+}
+
+func TestStreamsAreRewrittenAcrossChunks(t *testing.T) {
+	s, ts := newTestServer(t, "-body-rewrites", writeBodyRewrites(t, testBodyRewrites))
+	client := connectClient(t, s, ts, "orders")
+
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(ts.URL + "/query/orders")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		result <- string(body)
+	}()
+	query := client.readQuery()
+	text := map[string]string{"Content-Type": "text/plain"}
+	client.reply(replyMessage{RequestID: query.RequestID, Type: "chunk", Seq: 0, Headers: text, Body: "go to http://orders.inte"})
+	client.reply(replyMessage{RequestID: query.RequestID, Type: "chunk", Seq: 1, Final: true, Body: "rnal:8080/x"})
+	if body := <-result; body != "go to http://api.example.com/x" {
+		t.Errorf("stream got %q, want the match split across chunks rewritten", body)
+	}
+}
+
+func TestInvalidBodyRewritesAreRejected(t *testing.T) {
+	for _, contents := range []string{
+		`{"hosts": {"": "api.example.com"}}`,
+		`{"rules": [{"find": "", "replace": "x"}]}`,
+		`[not json`,
+	} {
+		if _, err := LoadConfig([]string{"-body-rewrites", writeBodyRewrites(t, contents)}); err == nil {
+			t.Errorf("LoadConfig accepted body rewrites %s", contents)
+		}
+	}
+}
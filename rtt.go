@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Each websocket ping carries the time it was sent, which the client echoes
+// back in its pong, so every pong gives a round-trip time for the
+// connection. They are smoothed into a moving average, the way TCP smooths
+// its RTT, and shown per connection in /clients and per client ID in
+// proxy_client_rtt_seconds. With -least-rtt-routing, queries for a client ID
+// with several connections go to the healthy one with the lowest average,
+// instead of by weight; until some connection has been measured, weights
+// apply.
+//
+// Connections too slow for a caller's latency budget can be left out:
+// -max-rtt, or a caller's X-Max-RTT, excludes connections whose average is
+// above it from routing and failover, and a query for a client ID that has
+// only such connections fails with 503 rather than waiting on one. A
+// connection not yet measured is not excluded.
+
+var (
+	errInvalidMaxRTT = errors.New("invalid X-Max-RTT")
+	errClientTooSlow = errors.New("every connection of the client exceeds the round-trip limit")
+)
+
+// rttSmoothing is the weight of the newest sample in the moving average.
+const rttSmoothing = 8
+
+// pingPayload is the application data of a ping sent now.
+func pingPayload() []byte {
+	return strconv.AppendInt(nil, time.Now().UnixNano(), 10)
+}
+
+// recordPong folds the round trip of the ping a pong answers into the
+// connection's average. Pongs that don't echo one of our pings are ignored.
+func (c *Client) recordPong(payload string) {
+	sent, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return
+	}
+	sample := time.Since(time.Unix(0, sent))
+	if sample < 0 {
+		return
+	}
+	average := time.Duration(c.rttNanos.Load())
+	if average == 0 {
+		average = sample
+	} else {
+		average += (sample - average) / rttSmoothing
+	}
+	c.rttNanos.Store(max(int64(average), 1))
+}
+
+// rtt returns the connection's average round-trip time, zero until its
+// first pong.
+func (c *Client) rtt() time.Duration {
+	return time.Duration(c.rttNanos.Load())
+}
+
+func formatRTT(rtt time.Duration) string {
+	if rtt == 0 {
+		return ""
+	}
+	return rtt.String()
+}
+
+// withinRTT returns the connections whose round trip is at most maxRTT. An
+// unmeasured connection is given the benefit of the doubt.
+func withinRTT(conns []*Client, maxRTT time.Duration) []*Client {
+	var within []*Client
+	for _, client := range conns {
+		if client.rtt() <= maxRTT {
+			within = append(within, client)
+		}
+	}
+	return within
+}
+
+// queryMaxRTT returns the round-trip limit for r's query: -max-rtt, or what
+// the caller asked for with X-Max-RTT, a Go duration where 0 lifts the limit.
+func (s *Server) queryMaxRTT(r *http.Request) (time.Duration, error) {
+	header := r.Header.Get("X-Max-RTT")
+	if header == "" {
+		return s.currentConfig().MaxRTT, nil
+	}
+	maxRTT, err := time.ParseDuration(header)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errInvalidMaxRTT, err)
+	}
+	if maxRTT < 0 {
+		return 0, fmt.Errorf("%w: must not be negative", errInvalidMaxRTT)
+	}
+	return maxRTT, nil
+}
+
+// lowestRTT returns the healthy connection with the lowest measured RTT, or
+// nil if none has been measured.
+func lowestRTT(conns []*Client) *Client {
+	var best *Client
+	for _, client := range conns {
+		if client.unhealthy.Load() || client.rtt() == 0 {
+			continue
+		}
+		if best == nil || client.rtt() < best.rtt() {
+			best = client
+		}
+	}
+	return best
+}
+
+// clientRTTs returns the average RTT in seconds of each client ID's measured
+// connections, for proxy_client_rtt_seconds.
+func (s *Server) clientRTTs() map[string]float64 {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+
+	rtts := make(map[string]float64)
+	for id, set := range s.clients {
+		var total time.Duration
+		measured := 0
+		for _, client := range set.conns {
+			if rtt := client.rtt(); rtt > 0 {
+				total += rtt
+				measured++
+			}
+		}
+		if measured > 0 {
+			rtts[id] = (total / time.Duration(measured)).Seconds()
+		}
+	}
+	return rtts
+}
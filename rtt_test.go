@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pong answers a ping as if it had been sent rtt ago.
+func (c *testClient) pong(rtt time.Duration) {
+	c.t.Helper()
+	payload := strconv.FormatInt(time.Now().Add(-rtt).UnixNano(), 10)
+	if err := c.conn.WriteMessage(websocket.PongMessage, []byte(payload)); err != nil {
+		c.t.Fatalf("writing pong: %v", err)
+	}
+}
+
+// measured waits until clientID's connection n has a round trip.
+func (s *Server) measured(t *testing.T, clientID string, n int) *Client {
+	t.Helper()
+	s.clientsMutex.RLock()
+	conn := s.clients[clientID].conns[n]
+	s.clientsMutex.RUnlock()
+	waitFor(t, "the pong to be recorded", func() bool { return conn.rtt() > 0 })
+	return conn
+}
+
+func TestRTTIsRecordedFromPongs(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	client.pong(100 * time.Millisecond)
+	conn := s.measured(t, "db-1", 0)
+	if rtt := conn.rtt(); rtt < 100*time.Millisecond || rtt > time.Second {
+		t.Errorf("RTT %s after a 100ms pong", rtt)
+	}
+
+	_, body := do(t, "GET", ts.URL+"/clients", nil, adminHeader())
+	var list []clientInfo
+	if err := json.Unmarshal(body, &list); err != nil || list[0].Connections[0].RTT == "" {
+		t.Errorf("/clients shows no RTT: %s", body)
+	}
+
+	// Later samples are smoothed in, and stray pongs ignored.
+	before := conn.rtt()
+	conn.recordPong(strconv.FormatInt(time.Now().Add(-900*time.Millisecond).UnixNano(), 10))
+	conn.recordPong("not a ping")
+	if rtt := conn.rtt(); rtt <= before || rtt >= 900*time.Millisecond {
+		t.Errorf("RTT went from %s to %s after a 900ms sample, want it smoothed", before, rtt)
+	}
+}
+
+func TestLeastRTTRouting(t *testing.T) {
+	s, ts := newTestServer(t, "-least-rtt-routing")
+	slow := connectClient(t, s, ts, "db-1")
+	fast := connectClient(t, s, ts, "db-1")
+	slow.pong(200 * time.Millisecond)
+	fast.pong(time.Millisecond)
+	s.measured(t, "db-1", 0)
+	s.measured(t, "db-1", 1)
+	slow.echo("slow")
+	fast.echo("fast")
+
+	for i := 0; i < 4; i++ {
+		if resp, body := do(t, "GET", fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil, nil); string(body) != "fast" {
+			t.Errorf("query %d got %s %q, want the lowest-RTT connection", i, resp.Status, body)
+		}
+	}
+}
+
+func TestSlowConnectionsAreLeftOut(t *testing.T) {
+	s, ts := newTestServer(t, "-max-rtt", "50ms")
+	slow := connectClient(t, s, ts, "db-1")
+	slow.pong(200 * time.Millisecond)
+	s.measured(t, "db-1", 0)
+	slow.echo("slow")
+
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1?q=only-slow", nil, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("query with only a slow connection got %s %q, want 503", resp.Status, body)
+	}
+	// An unmeasured connection is given the benefit of the doubt.
+	connectClient(t, s, ts, "db-1").echo("unmeasured")
+	for i := 0; i < 3; i++ {
+		if resp, body := do(t, "GET", fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil, nil); string(body) != "unmeasured" {
+			t.Errorf("query %d got %s %q, want the slow connection skipped", i, resp.Status, body)
+		}
+	}
+	// A caller may allow more.
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1?q=lenient", nil, http.Header{"X-Max-RTT": {"1s"}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("query with X-Max-RTT 1s got %s %q", resp.Status, body)
+	}
+	if resp, _ := do(t, "GET", ts.URL+"/query/db-1?q=bad", nil, http.Header{"X-Max-RTT": {"soon"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad X-Max-RTT got %s, want 400", resp.Status)
+	}
+}
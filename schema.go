@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+var errSchemaViolation = errors.New("client reply does not match its response schema")
+
+// compileResponseSchema compiles the JSON Schema a client registered for its
+// replies. It is compiled once at registration and kept on the Registration.
+func compileResponseSchema(clientID string, raw json.RawMessage) (*jsonschema.Schema, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	return jsonschema.CompileString("client:"+clientID+".json", string(raw))
+}
+
+func (s *Server) responseSchema(clientID string) *jsonschema.Schema {
+	s.registrationsMutex.RLock()
+	defer s.registrationsMutex.RUnlock()
+	return s.registrations[clientID].ResponseSchema
+}
+
+// validateReply checks a reply body against the client's response schema, if
+// it registered one. Violations are logged in full; the caller only learns
+// that the reply was rejected.
+func (s *Server) validateReply(clientID string, reply clientReply) error {
+	schema := s.responseSchema(clientID)
+	if schema == nil {
+		return nil
+	}
+	reply, err := reply.decompressed()
+	if err != nil {
+		log.Printf("Reply from client %s: %v", clientID, err)
+		return err
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(reply.Body, &v); err != nil {
+		log.Printf("Reply from client %s is not JSON: %v", clientID, err)
+		return fmt.Errorf("%w: %v", errSchemaViolation, err)
+	}
+	if err := schema.Validate(v); err != nil {
+		log.Printf("Reply from client %s failed schema validation: %#v", clientID, err)
+		return errSchemaViolation
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRepliesAreValidatedAgainstTheRegisteredSchema(t *testing.T) {
+	s, ts := newTestServer(t)
+	registered := register(t, ts, map[string]any{
+		"client_id": "db-1",
+		"response_schema": map[string]any{
+			"type":     "object",
+			"required": []string{"rows"},
+		},
+	})
+	connectRegistered(t, s, registered, "db-1").serve(func(query queryMessage) replyMessage {
+		return replyMessage{Body: query.Params["body"][0]}
+	})
+
+	for body, want := range map[string]int{
+		`{"rows":[]}`: http.StatusOK,
+		`{"count":1}`: http.StatusBadGateway,
+		`not json`:    http.StatusBadGateway,
+	} {
+		resp, got := do(t, "GET", ts.URL+"/query/db-1?body="+url.QueryEscape(body), nil, nil)
+		if resp.StatusCode != want {
+			t.Errorf("reply %s got %s: %s, want %d", body, resp.Status, got, want)
+		}
+		if _, ok := s.cached(s.cacheKey("db-1", "body="+url.QueryEscape(body))); ok != (want == http.StatusOK) {
+			t.Errorf("reply %s cached: %t", body, ok)
+		}
+	}
+}
+
+func TestRegisterRejectsAnInvalidSchema(t *testing.T) {
+	_, ts := newTestServer(t)
+	resp, body := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-1", "response_schema": map[string]any{"type": 5}}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %s: %s, want 400", resp.Status, body)
+	}
+}
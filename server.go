@@ -0,0 +1,1163 @@
+// Package proxy is a reverse proxy for clients that can't accept incoming
+// connections. Clients register, hold a websocket open to the proxy and
+// answer the queries callers send to /query/{clientID} over it; replies are
+// cached and served to further callers while fresh. See NewServer.
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+type Client struct {
+	ID           string
+	Tenant       string
+	Connection   *websocket.Conn
+	PingInterval time.Duration
+	// MaxInFlight is the limit the client declared at registration, or
+	// zero; see maxInFlight.
+	MaxInFlight int
+	// Serial is set for clients that registered with ordering "serial",
+	// which take one query at a time; see maxInFlight.
+	Serial bool
+	// Weight is the connection's share of its client's queries, and
+	// currentWeight its place in the rotation, guarded by clientsMutex; see
+	// pickClient.
+	Weight        int
+	currentWeight int
+	ConnectedAt   time.Time
+	// Connection metadata captured at upgrade, for logs and /clients.
+	RemoteAddr   string
+	UserAgent    string
+	Subprotocol  string
+	Compression  bool
+	done         chan struct{}
+	writeMutex   sync.Mutex
+	pending      map[string]*pendingQuery
+	pendingOrder []string
+	pendingMutex sync.Mutex
+	// inFlight counts the slots in use and queue holds queries waiting for
+	// one; see priority.go.
+	inFlight int
+	queue    []*queuedQuery
+	queueSeq uint64
+	// paused holds new queries back in the queue, and fifoUntil is the
+	// last of the queries queued at a resume that drain oldest first; see
+	// pause.go.
+	paused    bool
+	fifoUntil uint64
+	slotMutex sync.Mutex
+	// consecutiveTimeouts counts queries in a row that got no reply. Once it
+	// reaches the configured threshold the connection is marked unhealthy,
+	// which takes it out of rotation while the client has healthy ones.
+	consecutiveTimeouts atomic.Int32
+	unhealthy           atomic.Bool
+	// writeFailures counts query writes in a row that failed, and
+	// torndown is set once they tore the connection down; see deadconn.go.
+	writeFailures atomic.Int32
+	torndown      atomic.Bool
+	// pushes buffers the connection's pushes if -max-pending-pushes is
+	// set; see pushbuffer.go.
+	pushes *pushBuffer
+	// acks is set once the client has acknowledged a query on this
+	// connection; see ack.go.
+	acks atomic.Bool
+	// ready is set once the connection may be sent queries, and
+	// capabilities holds what it said it can do; see handshake.go.
+	ready        atomic.Bool
+	capabilities atomic.Pointer[clientCapabilities]
+	// rttNanos is the moving average ping round trip; see rtt.go.
+	rttNanos atomic.Int64
+	// cancelled is closed to fail the connection's outstanding queries
+	// with cancelErr, when a drain runs out of time or an administrator
+	// disconnects the client; see drain.go and disconnect.go.
+	cancelled  chan struct{}
+	cancelErr  error
+	cancelOnce sync.Once
+	// lastActive is when the client last sent a message or a pong, in
+	// Unix nanoseconds. The reader sets it while others read it; see
+	// LastPing.
+	lastActive atomic.Int64
+	// server is the Server the connection belongs to.
+	server *Server
+}
+
+// LastPing returns when the client was last heard from, by a message or a
+// pong.
+func (c *Client) LastPing() time.Time {
+	return time.Unix(0, c.lastActive.Load())
+}
+
+func (c *Client) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// describe formats the connection's metadata for log lines.
+func (c *Client) describe() string {
+	compression := "off"
+	if c.Compression {
+		compression = "on"
+	}
+	return fmt.Sprintf("remote=%s user_agent=%q subprotocol=%q compression=%s", c.RemoteAddr, c.UserAgent, c.Subprotocol, compression)
+}
+
+// writeMessage serializes writes to the client's connection, which only
+// supports one concurrent writer.
+func (c *Client) writeMessage(messageType int, data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.prepareWrite(len(data))
+	return c.Connection.WriteMessage(messageType, data)
+}
+
+type Registration struct {
+	PingInterval   time.Duration
+	Prefetch       []Prefetch
+	ResponseSchema *jsonschema.Schema
+	// Token must accompany /connect under strict registration; ExpiresAt
+	// is when an unused registration lapses, zero once it has connected.
+	Token     string
+	ExpiresAt time.Time
+	Tenant    string
+	// MaxInFlight is the client's own limit on queries in flight per
+	// connection, already clamped; zero means the server default.
+	MaxInFlight int
+	// Serial is set when the client registered with ordering "serial".
+	Serial bool
+	// Weight is the default weight of the client's connections, already
+	// clamped; a connection may ask for its own on /connect.
+	Weight int
+	// QueryTemplate is the parsed query_template, or nil; see template.go.
+	QueryTemplate interface{}
+	// Metadata describes the client, for metric labels; see labels.go.
+	Metadata map[string]string
+	// CommandTimeouts are the client's own timeouts by command type; see
+	// commandtimeout.go.
+	CommandTimeouts map[string]time.Duration
+	// CommandPolicy is the client's own restriction on the command types it
+	// may be sent; see commandpolicy.go.
+	CommandPolicy commandPolicy
+	// responseSchemaJSON is the schema as registered, kept to notice when a
+	// re-registration changes it.
+	responseSchemaJSON string
+}
+
+type ClientResponse struct {
+	// Status is the status of a cached error reply, zero for a success.
+	Status  int
+	Data    string
+	Headers map[string]string
+	// MessageType is the websocket message type the data arrived in.
+	MessageType int
+	Timestamp   time.Time
+	TTL         time.Duration
+	// refreshClaimed is when a caller last set out to refresh the entry
+	// after it expired; see lookupCache.
+	refreshClaimed time.Time
+	// gzipData is Data gzip-compressed, or empty; see gzipcache.go.
+	gzipData string
+}
+
+// Server is one proxy: the clients connected to it, their registrations, the
+// reply cache and everything else a running instance keeps in memory. Each
+// Server is independent, so several can live in one process, each serving
+// its own Handler.
+type Server struct {
+	// config holds the configuration in effect; see currentConfig.
+	// startupConfig is the one NewServer was given, for /admin/config.
+	config        atomic.Pointer[Config]
+	startupConfig *Config
+	// basePath is the normalized -base-path the routes were mounted under,
+	// and writeTimeout the write timeout the server was started with; both
+	// are fixed by NewServer.
+	basePath     string
+	writeTimeout time.Duration
+	handler      http.Handler
+	// httpServer is the server ListenAndServe started, for Shutdown.
+	httpServer atomic.Pointer[http.Server]
+	// tracer writes query traces, nil when they are off; see trace.go.
+	tracer atomic.Pointer[tracer]
+
+	clients map[string]*clientConnections
+	// tenantConnections counts live and about-to-be-upgraded connections
+	// per tenant; see tenant.go.
+	tenantConnections map[string]int
+	// tenantConnectionFreed is closed, and replaced, whenever a tenant
+	// connection is released, guarded by clientsMutex.
+	tenantConnectionFreed chan struct{}
+	clientsMutex          sync.RWMutex
+	cache                 map[string]ClientResponse
+	cacheMutex            sync.RWMutex
+	// cacheLRU tracks the cache's use and size; see cachelimit.go.
+	cacheLRU *cacheLRU
+	// flaps follows how often each key's replies change; see flap.go.
+	flaps *flapTracker
+	// shadowSlots bounds the shadow queries running; see shadow.go.
+	shadowSlots chan struct{}
+	// pushSubscriptions are the callers following clients' unsolicited
+	// messages; see subscribe.go.
+	pushSubscriptions *pushSubscriptions
+	// clientHistories are the recent requests to each client; see
+	// history.go.
+	clientHistories *clientHistories
+	// cacheFeed carries every cache change to replicas; see replica.go.
+	cacheFeed          *cacheFeed
+	registrations      map[string]Registration
+	registrationsMutex sync.RWMutex
+	upgrader           websocket.Upgrader
+
+	// draining is set once clients have been told to reconnect elsewhere.
+	// While draining, new registrations and connections are refused so
+	// clients that reconnect immediately don't land back on this instance.
+	draining            atomic.Bool
+	drainedClients      map[string]bool
+	drainedClientsMutex sync.RWMutex
+	// pausedClients are the client IDs paused by an administrator, applied
+	// to each of their connections as it is made; see pause.go.
+	pausedClients      map[string]bool
+	pausedClientsMutex sync.RWMutex
+
+	// querySlots bounds how many live queries the whole server processes at
+	// once. Each live query holds a slot for its full round trip; cache hits
+	// never take one. It is nil when the limit is disabled.
+	querySlots chan struct{}
+	// registrationSlots bounds the /register requests handled at once, nil
+	// when unlimited; see registration.go.
+	registrationSlots chan struct{}
+
+	// backpressure is on while querySlots are filled past the configured
+	// threshold; backpressureSent is what clients were last told, under
+	// backpressureMutex. See backpressure.go.
+	backpressure        atomic.Bool
+	backpressureChanged chan struct{}
+	// maintenance answers queries from the cache alone; see maintenance.go.
+	maintenance atomic.Bool
+	// certificate is the TLS certificate being served, nil without TLS;
+	// see tls.go.
+	certificate       atomic.Pointer[tls.Certificate]
+	backpressureSent  bool
+	backpressureMutex sync.Mutex
+
+	// outstandingBytes are the reply bytes being written per client ID,
+	// under outstandingMutex; see outbound.go.
+	outstandingBytes      map[string]int64
+	outstandingMutex      sync.Mutex
+	notConnectedUntil     map[string]time.Time
+	notConnectedMutex     sync.Mutex
+	idempotencyResults    map[string]*idempotentResult
+	idempotencyMutex      sync.Mutex
+	registerLimiters      map[string]*ipLimiter
+	registerLimitersMutex sync.Mutex
+	prefetchNextRun       map[string]time.Time
+	prefetchMutex         sync.Mutex
+
+	events *eventBus
+	// queriesSeen counts successful, fast queries for log sampling.
+	queriesSeen atomic.Uint64
+	metrics     *metrics
+	// metricLabelValues are the values admitted so far for each
+	// -metric-labels key, and metricLabelsCapped the keys that have run
+	// out of room; see labels.go.
+	metricLabelValues  map[string]map[string]bool
+	metricLabelsCapped map[string]bool
+	metricLabelsMutex  sync.Mutex
+	hooks              Hooks
+	hookCalls          chan func()
+}
+
+// NewServer returns a Server running on cfg, which is best built by
+// LoadConfig so that every setting has its default. The background work a
+// server needs, such as dropping inactive clients and running prefetches,
+// starts right away; requests are served by Handler or ListenAndServe.
+func NewServer(cfg *Config) (*Server, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		startupConfig:         cfg,
+		basePath:              cfg.basePath,
+		writeTimeout:          cfg.WriteTimeout,
+		clients:               make(map[string]*clientConnections),
+		tenantConnections:     make(map[string]int),
+		tenantConnectionFreed: make(chan struct{}),
+		cache:                 make(map[string]ClientResponse),
+		cacheLRU:              newCacheLRU(),
+		flaps:                 newFlapTracker(),
+		shadowSlots:           make(chan struct{}, maxShadowQueries),
+		registrations:         make(map[string]Registration),
+		drainedClients:        make(map[string]bool),
+		pausedClients:         make(map[string]bool),
+		outstandingBytes:      make(map[string]int64),
+		notConnectedUntil:     make(map[string]time.Time),
+		idempotencyResults:    make(map[string]*idempotentResult),
+		registerLimiters:      make(map[string]*ipLimiter),
+		prefetchNextRun:       make(map[string]time.Time),
+		events:                newEventBus(),
+		cacheFeed:             newCacheFeed(),
+		pushSubscriptions:     newPushSubscriptions(),
+		clientHistories:       newClientHistories(),
+		metrics:               newMetrics(),
+		metricLabelValues:     make(map[string]map[string]bool),
+		metricLabelsCapped:    make(map[string]bool),
+		hookCalls:             make(chan func(), hookQueueSize),
+		backpressureChanged:   make(chan struct{}, 1),
+	}
+	s.config.Store(cfg)
+	s.upgrader = websocket.Upgrader{
+		CheckOrigin:       s.checkOrigin,
+		EnableCompression: cfg.WSCompression,
+	}
+	if cfg.MaxConcurrentQueries > 0 {
+		s.querySlots = make(chan struct{}, cfg.MaxConcurrentQueries)
+	}
+	if cfg.MaxConcurrentRegistrations > 0 {
+		s.registrationSlots = make(chan struct{}, cfg.MaxConcurrentRegistrations)
+	}
+
+	s.registerMetrics()
+	s.handler = s.recoverPanics(s.routes(cfg))
+
+	traceFile, err := openTraceFile(cfg.TraceFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -trace-file: %w", err)
+	}
+	if traceFile != nil {
+		s.SetTraceSink(traceFile)
+	}
+
+	go s.runHooks()
+	go s.runBackpressure()
+	go s.cleanupInactiveClients()
+	go s.expireIdempotencyKeys()
+	go s.runPrefetches()
+	go s.cleanupRegisterLimiters()
+	go s.expireRegistrations()
+	if cfg.replicaOf != "" {
+		go s.followPrimary()
+	}
+	return s, nil
+}
+
+func (s *Server) routes(cfg *Config) http.Handler {
+	root := mux.NewRouter()
+	r := root
+	if s.basePath != "" {
+		r = root.PathPrefix(s.basePath).Subrouter()
+	}
+	if cfg.replicaOf != "" {
+		s.replicaRoutes(r)
+		return root
+	}
+	r.HandleFunc("/register", s.handleRegister).Methods("POST")
+	r.HandleFunc("/register/{clientID}/renew", s.handleRegisterRenew).Methods("POST")
+	r.HandleFunc("/connect", s.handleWebSocket)
+	r.HandleFunc("/query/{clientID}", s.recordHistory(s.requestBudget(s.slowReads(s.limitQueryRequest(s.gzipResponses(s.injectResponseHeaders(s.serverTimings(s.handleQuery)))))))).Methods("GET")
+	r.HandleFunc("/query/{clientID}", s.recordHistory(s.requestBudget(s.slowReads(s.limitQueryRequest(s.gzipResponses(s.injectResponseHeaders(s.serverTimings(s.handlePostQuery)))))))).Methods("POST")
+	r.HandleFunc("/command/{clientID}", s.recordHistory(s.requestBudget(s.slowReads(s.limitQueryRequest(s.gzipResponses(s.injectResponseHeaders(s.serverTimings(s.handleCommand)))))))).Methods("POST")
+	r.HandleFunc("/query-batch", s.requestBudget(s.slowReads(s.limitQueryRequest(s.gzipResponses(s.injectResponseHeaders(s.handleBatchQuery)))))).Methods("POST")
+	r.HandleFunc("/query-cached/{clientID}", s.recordHistory(s.requestBudget(s.slowReads(s.limitQueryRequest(s.gzipResponses(s.injectResponseHeaders(s.serverTimings(s.handleCachedQuery)))))))).Methods("GET")
+	r.HandleFunc("/status/{clientID}", s.handleStatus).Methods("GET")
+	r.HandleFunc("/subscribe/{clientID}", s.limitQueryRequest(s.handleSubscribe)).Methods("GET")
+	r.HandleFunc("/clients", s.requireAdmin(s.handleClients)).Methods("GET")
+	r.HandleFunc("/events", s.requireAdmin(s.handleEvents)).Methods("GET")
+	r.HandleFunc("/metrics", s.requireMetricsAuth(s.handleMetrics)).Methods("GET")
+	r.HandleFunc("/admin/config", s.requireAdmin(s.handleConfig)).Methods("GET")
+	r.HandleFunc("/admin/export", s.requireAdmin(s.handleExport)).Methods("GET")
+	r.HandleFunc("/admin/import", s.requireAdmin(s.handleImport)).Methods("POST")
+	r.HandleFunc("/admin/reconnect", s.requireAdmin(s.handleReconnect)).Methods("POST")
+	r.HandleFunc("/admin/broadcast", s.requireAdmin(s.handleBroadcast)).Methods("POST")
+	r.HandleFunc("/admin/clients/{clientID}/drain", s.requireAdmin(s.handleClientDrain)).Methods("POST")
+	r.HandleFunc("/admin/clients/{clientID}/drain", s.requireAdmin(s.handleClientUndrain)).Methods("DELETE")
+	r.HandleFunc("/admin/clients/{clientID}/pause", s.requireAdmin(s.handleClientPause)).Methods("POST")
+	r.HandleFunc("/admin/clients/{clientID}/resume", s.requireAdmin(s.handleClientResume)).Methods("POST")
+	r.HandleFunc("/admin/clients/{clientID}/history", s.requireAdmin(s.handleClientHistory)).Methods("GET")
+	r.HandleFunc("/admin/clients/{clientID}/disconnect", s.requireAdmin(s.handleClientDisconnect)).Methods("POST")
+	r.HandleFunc("/admin/maintenance", s.requireAdmin(s.handleMaintenanceOn)).Methods("POST")
+	r.HandleFunc("/admin/maintenance", s.requireAdmin(s.handleMaintenanceOff)).Methods("DELETE")
+	r.HandleFunc("/admin/cache/flush", s.requireAdmin(s.handleCacheFlush)).Methods("POST")
+	r.HandleFunc("/admin/cache/stream", s.requireAdmin(s.handleCacheStream)).Methods("GET")
+	r.HandleFunc("/admin/cache/flush/{clientID}", s.requireAdmin(s.handleCacheFlush)).Methods("POST")
+	r.HandleFunc("/admin/cache/flush/tenant/{tenant}", s.requireAdmin(s.handleCacheFlush)).Methods("POST")
+	if cfg.Pprof {
+		s.registerPprof(r)
+	}
+	return root
+}
+
+// Handler returns the handler serving every route, for mounting the proxy
+// in an http.Server of one's own.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// ListenAndServe serves the proxy on the configured address, or Unix socket,
+// with TLS if a certificate is configured and the HTTP timeouts described in
+// timeouts.go. In synthetic mode it also starts the load test, which exits
+// the process when done.
+func (s *Server) ListenAndServe() error {
+	cfg := s.currentConfig()
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           s.handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+
+	tlsEnabled := cfg.TLSCert != "" || cfg.TLSKey != ""
+	if tlsEnabled {
+		tlsConfig, err := buildTLSConfig(cfg)
+		if err != nil {
+			return fmt.Errorf("invalid TLS configuration: %w", err)
+		}
+		cert, err := loadCertificate(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return fmt.Errorf("invalid TLS certificate: %w", err)
+		}
+		s.swapCertificate(cert)
+		tlsConfig.GetCertificate = s.getCertificate
+		server.TLSConfig = tlsConfig
+	}
+
+	var listener net.Listener
+	var err error
+	where := "port " + cfg.Addr
+	if cfg.UnixSocket != "" {
+		listener, err = listenUnix(cfg.UnixSocket, cfg.unixSocketMode)
+		where = "socket " + cfg.UnixSocket
+	} else {
+		listener, err = net.Listen("tcp", cfg.Addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cfg.SyntheticClients > 0 {
+		go s.runSynthetic(cfg)
+	}
+
+	s.httpServer.Store(server)
+
+	if tlsEnabled {
+		log.Printf("Server starting on %s (TLS)", where)
+		return server.ServeTLS(listener, "", "")
+	}
+	log.Printf("Server starting on %s", where)
+	return server.Serve(listener)
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		writeTransient(w, "server is draining", http.StatusServiceUnavailable, defaultRetryAfter)
+		return
+	}
+
+	if !s.allowRegistration(s.clientIP(r)) {
+		writeRateLimited(w)
+		return
+	}
+
+	if !s.acquireRegistrationSlot() {
+		s.incCounter("proxy_registrations_saturated_total")
+		writeTransient(w, "server is at its registration concurrency limit", http.StatusServiceUnavailable, defaultRetryAfter)
+		return
+	}
+	defer s.releaseRegistrationSlot()
+
+	var registration struct {
+		ClientID       string            `json:"client_id"`
+		Tenant         string            `json:"tenant"`
+		PingInterval   string            `json:"ping_interval"`
+		Prefetch       []prefetchRequest `json:"prefetch"`
+		ResponseSchema json.RawMessage   `json:"response_schema"`
+		MaxInFlight    int               `json:"max_in_flight"`
+		Ordering       string            `json:"ordering"`
+		QueryTemplate  json.RawMessage   `json:"query_template"`
+		Weight         int               `json:"weight"`
+		Metadata       map[string]string `json:"metadata"`
+		// CommandTimeouts maps command types to durations, as in
+		// -command-timeouts.
+		CommandTimeouts map[string]string `json:"command_timeouts"`
+		Commands        commandPolicy     `json:"commands"`
+		// Token, RefreshToken and Reconnect only matter when the client
+		// ID is already registered; see registration.go.
+		Token        string `json:"token"`
+		RefreshToken bool   `json:"refresh_token"`
+		Reconnect    bool   `json:"reconnect"`
+	}
+
+	limitBody(w, r, s.currentConfig().MaxRegisterBody)
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+		return
+	}
+
+	if !s.currentConfig().clientPolicy.allowed(registration.ClientID) {
+		http.Error(w, "client_id is not allowed", http.StatusForbidden)
+		return
+	}
+
+	if s.clientDraining(registration.ClientID) {
+		writeTransient(w, errClientDraining.Error(), http.StatusServiceUnavailable, defaultRetryAfter)
+		return
+	}
+
+	var pingInterval time.Duration
+	if registration.PingInterval != "" {
+		d, err := time.ParseDuration(registration.PingInterval)
+		if err != nil {
+			http.Error(w, "invalid ping_interval: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		pingInterval = d
+	}
+
+	prefetches, err := parsePrefetches(registration.Prefetch)
+	if err != nil {
+		http.Error(w, "invalid prefetch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateMetadata(registration.Metadata); err != nil {
+		http.Error(w, "invalid metadata: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	commandTimeouts, err := parseCommandTimeoutMap(registration.CommandTimeouts)
+	if err != nil {
+		http.Error(w, "invalid command_timeouts: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := registration.Commands.validate(); err != nil {
+		http.Error(w, "invalid commands: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if registration.MaxInFlight < 0 {
+		http.Error(w, "invalid max_in_flight: must not be negative", http.StatusBadRequest)
+		return
+	}
+	if !orderings[registration.Ordering] {
+		http.Error(w, `invalid ordering: must be "parallel" or "serial"`, http.StatusBadRequest)
+		return
+	}
+
+	schema, err := compileResponseSchema(registration.ClientID, registration.ResponseSchema)
+	if err != nil {
+		http.Error(w, "invalid response_schema: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	template, err := parseQueryTemplate(registration.QueryTemplate)
+	if err != nil {
+		http.Error(w, "invalid query_template: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.registrationsMutex.Lock()
+	if !s.registrationRoomLocked(registration.ClientID) {
+		s.registrationsMutex.Unlock()
+		s.refuseClient(w, registration.ClientID, errTooManyClientIDs)
+		return
+	}
+	previous, reregistered := s.registrations[registration.ClientID]
+	if reregistered && previous.lapsed(time.Now()) {
+		previous, reregistered = Registration{}, false
+	}
+	if reregistered && !s.mayUpdateRegistration(r, previous, registration.Token) {
+		s.registrationsMutex.Unlock()
+		log.Printf("Refused update of client %s's registration from %s without its token", registration.ClientID, s.clientIP(r))
+		http.Error(w, "client_id is already registered; updating it takes its token or admin credentials", http.StatusForbidden)
+		return
+	}
+	token, expiresAt := s.registrationToken(previous, reregistered, registration.RefreshToken)
+	connectionUrl, err := s.connectionURL(r, registration.ClientID, token)
+	if err != nil {
+		s.registrationsMutex.Unlock()
+		log.Printf("Refused registration of client %s from %s: %v (Host %q)", registration.ClientID, s.clientIP(r), err, r.Host)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.registrations[registration.ClientID] = Registration{
+		PingInterval:    clampPingInterval(s.currentConfig(), pingInterval),
+		Prefetch:        prefetches,
+		ResponseSchema:  schema,
+		Token:           token,
+		ExpiresAt:       expiresAt,
+		Tenant:          registration.Tenant,
+		MaxInFlight:     clampMaxInFlight(s.currentConfig(), registration.MaxInFlight),
+		Serial:          registration.Ordering == "serial",
+		QueryTemplate:   template,
+		Weight:          clampWeight(registration.Weight),
+		Metadata:        registration.Metadata,
+		CommandTimeouts: commandTimeouts,
+		CommandPolicy:   registration.Commands,
+
+		responseSchemaJSON: string(registration.ResponseSchema),
+	}
+	s.registrationsMutex.Unlock()
+
+	// Cached replies were validated against the old schema, or are keyed
+	// under the old tenant.
+	if reregistered && (previous.responseSchemaJSON != string(registration.ResponseSchema) || previous.Tenant != registration.Tenant) {
+		s.flushClientCache(registration.ClientID)
+	}
+
+	result := "created"
+	var reconnected int
+	if reregistered {
+		result = "updated"
+		if registration.Reconnect {
+			reconnected = s.reconnectClient(registration.ClientID, connectionUrl)
+		}
+		log.Printf("Updated registration of client %s (token refreshed: %t, connections told to reconnect: %d)", registration.ClientID, token != previous.Token, reconnected)
+	}
+
+	// The token is only sent when it is new; whoever updates a
+	// registration already has it, or is an admin.
+	issued := token
+	if reregistered && token == previous.Token {
+		issued = ""
+	}
+	response := struct {
+		ConnectionUrl string `json:"connection_url"`
+		Token         string `json:"token,omitempty"`
+		// Result is "created" or "updated".
+		Result      string `json:"result"`
+		Reconnected int    `json:"reconnected,omitempty"`
+		registrationExpiryResponse
+	}{
+		ConnectionUrl:              connectionUrl,
+		Token:                      issued,
+		Result:                     result,
+		Reconnected:                reconnected,
+		registrationExpiryResponse: registrationExpiry(expiresAt),
+	}
+
+	writeRegistrationResponse(w, registration.ClientID, response)
+}
+
+// writeRegistrationResponse writes v as the JSON reply to a registration.
+// Encoding happens before anything is written, so a value that can't be
+// encoded is a 500 rather than a 200 with a truncated body; a failure to
+// write it is only logged, since the caller will find the body cut short.
+func writeRegistrationResponse(w http.ResponseWriter, clientID string, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding registration response for client %s: %v", clientID, err)
+		http.Error(w, "could not encode registration response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(append(body, '\n')); err != nil {
+		log.Printf("Error writing registration response for client %s: %v", clientID, err)
+	}
+}
+
+// connectClientID reads the client ID for /connect from the X-Client-ID
+// header or, failing that, the client_id query parameter. The header keeps
+// the ID out of access logs that record URLs.
+func connectClientID(r *http.Request) string {
+	if clientID := r.Header.Get("X-Client-ID"); clientID != "" {
+		return clientID
+	}
+	return r.URL.Query().Get("client_id")
+}
+
+// handleWebSocket upgrades a client's connection. Every check that can refuse
+// a client runs before the upgrade, while an HTTP error can still be sent.
+// A successful upgrade hijacks the connection, after which w must not be
+// touched again, so the rest happens in serveClient, which never sees w.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	clientID := connectClientID(r)
+	if clientID == "" {
+		http.Error(w, "client_id query parameter or X-Client-ID header is required", http.StatusBadRequest)
+		return
+	}
+
+	if !s.currentConfig().clientPolicy.allowed(clientID) {
+		http.Error(w, "client_id is not allowed", http.StatusForbidden)
+		return
+	}
+
+	if s.currentConfig().RequireRegistration && !s.registrationValid(clientID, r.URL.Query().Get("token")) {
+		http.Error(w, "client_id is not registered or its token is invalid or expired", http.StatusForbidden)
+		return
+	}
+
+	if s.draining.Load() {
+		writeTransient(w, "server is draining", http.StatusServiceUnavailable, defaultRetryAfter)
+		return
+	}
+	if s.clientDraining(clientID) {
+		writeTransient(w, errClientDraining.Error(), http.StatusServiceUnavailable, defaultRetryAfter)
+		return
+	}
+
+	s.registrationsMutex.RLock()
+	registration, registered := s.registrations[clientID]
+	s.registrationsMutex.RUnlock()
+
+	if err := s.clientRoom(clientID); err != nil {
+		s.refuseClient(w, clientID, err)
+		return
+	}
+
+	if !s.reserveTenantConnection(r.Context(), registration.Tenant) {
+		writeTenantLimited(w)
+		return
+	}
+
+	// Upgrade has already answered the handshake itself when it fails.
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.releaseTenantConnection(registration.Tenant)
+		log.Println(err)
+		return
+	}
+	s.serveClient(conn, r, clientID, registration, registered)
+}
+
+// serveClient sets up a freshly upgraded connection. Errors from here on can
+// only be reported to the client as a websocket close.
+func (s *Server) serveClient(conn *websocket.Conn, r *http.Request, clientID string, registration Registration, registered bool) {
+	applyCompression(conn, s.currentConfig().WSCompressionLevel)
+	applyKeepAlive(conn, s.currentConfig().TCPKeepAlive)
+	if !s.authenticateConnection(conn, clientID) {
+		s.releaseTenantConnection(registration.Tenant)
+		return
+	}
+
+	pingInterval := s.currentConfig().PingInterval
+	if registered {
+		pingInterval = registration.PingInterval
+		s.markRegistrationUsed(clientID)
+	}
+
+	client := &Client{
+		ID:           clientID,
+		Tenant:       registration.Tenant,
+		MaxInFlight:  registration.MaxInFlight,
+		Serial:       registration.Serial,
+		Weight:       connectionWeight(r, registration),
+		Connection:   conn,
+		PingInterval: pingInterval,
+		ConnectedAt:  time.Now(),
+		RemoteAddr:   r.RemoteAddr,
+		UserAgent:    r.UserAgent(),
+		Subprotocol:  conn.Subprotocol(),
+		Compression:  s.compressionNegotiated(r),
+		done:         make(chan struct{}),
+		cancelled:    make(chan struct{}),
+		paused:       s.clientPaused(clientID),
+		pending:      make(map[string]*pendingQuery),
+		server:       s,
+	}
+	client.touch()
+
+	connections, err := s.addClient(client)
+	if err != nil {
+		s.releaseTenantConnection(registration.Tenant)
+		s.closeOverLimit(conn, clientID, err)
+		return
+	}
+	s.incCounter("proxy_client_connections_total", s.metadataLabels(clientID)...)
+
+	log.Printf("Client connected: %s (ping interval %s, %d connections, %s)", clientID, pingInterval, connections, client.describe())
+	s.events.publish(Event{Type: "connect", ClientID: clientID})
+	s.hookConnect(client)
+	s.sendBackpressure(client)
+
+	s.startPushBuffer(client)
+	s.awaitHandshake(client)
+	go s.handleClientMessages(client)
+	go s.pingClient(client)
+}
+
+// cacheKey identifies a cached GET query. Unsolicited pushes from a client are
+// stored under the key of a query without parameters, the bare client ID
+// behind the client's tenant, if it has one; see tenantcache.go.
+func (s *Server) cacheKey(clientID, rawQuery string) string {
+	key := clientKeyPrefix(s.clientTenant(clientID), clientID)
+	rawQuery = s.normalizeQuery(rawQuery)
+	if rawQuery == "" {
+		return key
+	}
+	return key + "?" + rawQuery
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	clientID := vars["clientID"]
+	key := s.cacheKey(clientID, r.URL.RawQuery)
+
+	if s.currentConfig().ClientHealthHeaders {
+		s.writeClientHealth(w, clientID)
+	}
+
+	if s.maintenance.Load() {
+		s.serveMaintenance(w, r, clientID, key, start)
+		return
+	}
+
+	if strategy := r.Header.Get("X-Aggregate"); strategy != "" {
+		s.serveAggregate(w, r, clientID, strategy, start)
+		return
+	}
+	if read, ok := s.quorumRead(clientID); ok {
+		s.serveQuorum(w, r, clientID, read, start)
+		return
+	}
+
+	lookupStart := time.Now()
+	cachedResponse, lookup, ok := s.lookupCache(key)
+	timingOf(r).recordCache(time.Since(lookupStart), lookup)
+	if ok {
+		s.writeReply(w, r, s.cachedReply(r, cachedResponse))
+		s.recordQuery(clientID, lookup.outcome(), start, nil, lookup)
+		return
+	}
+
+	if s.checkNotConnected(w, clientID) {
+		if s.serveStaleOnError(w, r, clientID, key, start, lookup) {
+			return
+		}
+		s.recordQuery(clientID, "miss", start, errClientNotConnected, lookup)
+		if !s.writeFallback(w, clientID, errClientNotConnected) {
+			writeQueryError(w, errClientNotConnected)
+		}
+		return
+	}
+
+	timeout, err := s.queryTimeout(r)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	s.extendWriteDeadline(w, timeout)
+
+	if !s.acquireQuerySlot() {
+		writeSaturated(w)
+		return
+	}
+	defer s.releaseQuerySlot()
+
+	priority, err := queryPriority(r)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	maxRTT, err := s.queryMaxRTT(r)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	query := s.newQueryMessage(r, "")
+	query.Priority = priority
+	query.maxRTT = maxRTT
+	reply, err := s.queryWithFailover(clientID, query, timeout)
+	if err != nil {
+		s.noteNotConnected(w, clientID, err)
+		if clientUnavailable(err) && s.serveStaleOnError(w, r, clientID, key, start, lookup) {
+			return
+		}
+		s.recordQuery(clientID, "miss", start, err, lookup)
+		if s.writeFallback(w, clientID, err) {
+			return
+		}
+		writeQueryError(w, err)
+		return
+	}
+
+	s.mirrorQuery(clientID, query, reply)
+	stored := s.storeReply(key, s.cachePolicy(clientID), reply)
+	timingOf(r).recordCache(0, stored)
+	s.recordQuery(clientID, "miss", start, nil, lookup, stored)
+	if stored == cacheTooLarge {
+		w.Header().Set("X-Cache", "BYPASS")
+	}
+
+	s.writeReply(w, r, reply)
+}
+
+// handlePostQuery forwards the request body to the client. POST queries are
+// never cached; callers that need safe retries send an Idempotency-Key header
+// and get the stored reply back for repeats of that key within the
+// idempotency window.
+func (s *Server) handlePostQuery(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	clientID := vars["clientID"]
+
+	// A retry of a request that completed gets the stored reply, even once
+	// the client has gone or the proxy is in maintenance or saturated.
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		idempotencyKey = idempotencyCacheKey(clientID, idempotencyKey)
+		if result := s.completedIdempotencyKey(idempotencyKey); result != nil {
+			w.Header().Set("Idempotent-Replayed", "true")
+			s.writeReply(w, r, result.Reply)
+			return
+		}
+	}
+
+	if s.maintenance.Load() {
+		writeQueryError(w, errMaintenance)
+		return
+	}
+
+	if s.checkNotConnected(w, clientID) {
+		s.recordQuery(clientID, "", start, errClientNotConnected)
+		writeQueryError(w, errClientNotConnected)
+		return
+	}
+
+	timeout, err := s.queryTimeout(r)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	s.extendWriteDeadline(w, timeout)
+
+	if !s.acquireQuerySlot() {
+		writeSaturated(w)
+		return
+	}
+	defer s.releaseQuerySlot()
+
+	if idempotencyKey != "" {
+		result, inFlight := s.claimIdempotencyKey(idempotencyKey)
+		if inFlight {
+			http.Error(w, "a request with this Idempotency-Key is already in progress", http.StatusConflict)
+			return
+		}
+		if result != nil {
+			w.Header().Set("Idempotent-Replayed", "true")
+			s.writeReply(w, r, result.Reply)
+			return
+		}
+	}
+
+	reply, err := s.postQuery(r, clientID, timeout)
+	if err == nil && idempotencyKey != "" {
+		// Replays need the whole reply.
+		reply, err = reply.collect()
+	}
+	s.recordQuery(clientID, "", start, err)
+	if err != nil {
+		if idempotencyKey != "" {
+			s.releaseIdempotencyKey(idempotencyKey)
+		}
+		s.noteNotConnected(w, clientID, err)
+		writeQueryError(w, err)
+		return
+	}
+
+	if idempotencyKey != "" {
+		s.completeIdempotencyKey(idempotencyKey, reply)
+	}
+
+	s.writeReply(w, r, reply)
+}
+
+func (s *Server) postQuery(r *http.Request, clientID string, timeout time.Duration) (clientReply, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if budgetErr := budgetError(r); budgetErr != nil {
+			return clientReply{}, budgetErr
+		}
+		return clientReply{}, err
+	}
+	// Reading the body came out of the budget too.
+	if timeout, err = budgetTimeout(r, timeout); err != nil {
+		return clientReply{}, err
+	}
+
+	priority, err := queryPriority(r)
+	if err != nil {
+		return clientReply{}, err
+	}
+
+	maxRTT, err := s.queryMaxRTT(r)
+	if err != nil {
+		return clientReply{}, err
+	}
+
+	query := s.newQueryMessage(r, string(body))
+	query.Priority = priority
+	query.maxRTT = maxRTT
+
+	// A POST may have had effects before the client failed, so it is only
+	// retried elsewhere when the caller made it safe to repeat.
+	if r.Header.Get("Idempotency-Key") != "" {
+		return s.queryWithFailover(clientID, query, timeout)
+	}
+
+	if s.clientDraining(clientID) {
+		return clientReply{}, errClientDraining
+	}
+	client, err := s.pickClient(clientID, query.maxRTT)
+	if err != nil {
+		return clientReply{}, err
+	}
+	return s.queryClient(client, query, timeout)
+}
+
+func (s *Server) handleClientMessages(client *Client) {
+	defer func() {
+		close(client.done)
+		client.Connection.Close()
+		s.removeClient(client)
+		log.Printf("Client disconnected: %s (%s)", client.ID, client.describe())
+		s.events.publish(Event{Type: "disconnect", ClientID: client.ID})
+		s.hookDisconnect(client)
+	}()
+	defer s.recoverClient(client, "reader")
+
+	window := s.currentConfig().FirstActivityTimeout
+	awaiting := client.awaitFirstActivity(window)
+	active := func() {
+		if awaiting {
+			awaiting = false
+			client.Connection.SetReadDeadline(time.Time{})
+		}
+	}
+
+	client.Connection.SetPongHandler(func(payload string) error {
+		active()
+		client.touch()
+		client.recordPong(payload)
+		return nil
+	})
+
+	for {
+		messageType, message, err := client.Connection.ReadMessage()
+		if err != nil {
+			kind := s.recordWebsocketError(client, "read", err)
+			if awaiting && kind == "timeout" {
+				log.Printf("Client %s sent nothing within %s of connecting and was disconnected", client.ID, window)
+				break
+			}
+			if kind == "normal-close" {
+				log.Printf("Client %s closed its connection: %v", client.ID, err)
+				break
+			}
+			log.Printf("Error reading message from client %s: %v (%s)", client.ID, err, kind)
+			break
+		}
+
+		active()
+		client.touch()
+
+		if !client.ready.Load() {
+			if !s.acceptHandshake(client, messageType, message) {
+				break
+			}
+			continue
+		}
+		if s.handleInvalidate(client.ID, messageType, message) {
+			continue
+		}
+		if client.deliverReply(messageType, message) {
+			continue
+		}
+
+		s.receivePush(client, pushMessage{messageType: messageType, data: message})
+	}
+}
+
+// pingClient sends a websocket ping every PingInterval, give or take the
+// configured jitter, until the client's reader goroutine exits. Pongs are
+// picked up by the pong handler installed in handleClientMessages.
+func (s *Server) pingClient(client *Client) {
+	defer s.recoverClient(client, "pinger")
+	timer := time.NewTimer(s.jitter(client.PingInterval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-timer.C:
+			timer.Reset(s.jitter(client.PingInterval))
+			deadline := time.Now().Add(10 * time.Second)
+			if err := client.Connection.WriteControl(websocket.PingMessage, pingPayload(), deadline); err != nil {
+				log.Printf("Error pinging client %s: %v (%s)", client.ID, err, s.recordWebsocketError(client, "write", err))
+				return
+			}
+		}
+	}
+}
+
+// inactivityTimeout is how long a client may go without a message or pong
+// before cleanupInactiveClients disconnects it. Clients with a long ping
+// interval get at least two intervals of slack.
+func inactivityTimeout(client *Client) time.Duration {
+	timeout := 2 * time.Minute
+	if d := 2 * client.PingInterval; d > timeout {
+		timeout = d
+	}
+	return timeout
+}
+
+func (s *Server) cleanupInactiveClients() {
+	for {
+		time.Sleep(s.jitter(time.Minute))
+		s.evictInactiveClients()
+	}
+}
+
+// evictInactiveClients disconnects the connections not heard from within
+// their inactivity timeout and returns how many it did.
+func (s *Server) evictInactiveClients() int {
+	// Only the bookkeeping happens under the lock; closing a connection
+	// can block, and queries and registrations wait on the lock.
+	now := time.Now()
+	var inactive []*Client
+	s.clientsMutex.RLock()
+	for _, set := range s.clients {
+		for _, client := range set.conns {
+			if now.Sub(client.LastPing()) > inactivityTimeout(client) {
+				inactive = append(inactive, client)
+			}
+		}
+	}
+	s.clientsMutex.RUnlock()
+	if len(inactive) == 0 {
+		return 0
+	}
+
+	// A client may have pinged in between; it stays.
+	evicted := inactive[:0]
+	s.clientsMutex.Lock()
+	for _, client := range inactive {
+		if time.Since(client.LastPing()) > inactivityTimeout(client) {
+			s.removeClientLocked(client)
+			evicted = append(evicted, client)
+		}
+	}
+	s.clientsMutex.Unlock()
+
+	for _, client := range evicted {
+		go s.closeConnection(client.Connection, client.ID, closeInactive, inactivityTimeout(client).String(), s.currentConfig().BroadcastTimeout)
+		log.Printf("Client %s was inactive and was disconnected", client.ID)
+	}
+	return len(evicted)
+}
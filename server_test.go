@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnectTakesTheClientIDFromAHeader(t *testing.T) {
+	s, ts := newTestServer(t)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(ts, "/connect"), http.Header{"X-Client-ID": {"db-1"}})
+	if err != nil {
+		t.Fatalf("connecting with X-Client-ID: %v", err)
+	}
+	defer conn.Close()
+	waitFor(t, "the connection to be added", func() bool { return s.connectionCount("db-1") == 1 })
+}
+
+func TestConnectPrefersTheHeaderToTheQueryParameter(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/connect?client_id=from-query", nil)
+	if got := connectClientID(r); got != "from-query" {
+		t.Errorf("connectClientID = %q without the header, want the query parameter", got)
+	}
+	r.Header.Set("X-Client-ID", "from-header")
+	if got := connectClientID(r); got != "from-header" {
+		t.Errorf("connectClientID = %q, want the header", got)
+	}
+}
+
+func TestConnectRequiresAClientID(t *testing.T) {
+	_, ts := newTestServer(t)
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(ts, "/connect"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("connecting without a client ID got %v, want 400", err)
+	}
+}
+
+func TestRegisteredPingIntervalIsClamped(t *testing.T) {
+	s, ts := newTestServer(t, "-min-ping-interval", "5s", "-max-ping-interval", "1m")
+	for id, requested := range map[string]string{"fast": "1s", "slow": "1h", "exact": "20s"} {
+		connectRegistered(t, s, register(t, ts, map[string]any{"client_id": id, "ping_interval": requested}), id)
+	}
+
+	for id, want := range map[string]time.Duration{"fast": 5 * time.Second, "slow": time.Minute, "exact": 20 * time.Second} {
+		if got := s.firstConnection(id).PingInterval; got != want {
+			t.Errorf("client %s pings every %s, want %s", id, got, want)
+		}
+	}
+}
+
+func TestRegisterRejectsABadPingInterval(t *testing.T) {
+	_, ts := newTestServer(t)
+	resp, body := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-1", "ping_interval": "often"}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %s: %s, want 400", resp.Status, body)
+	}
+}
+
+func TestFailureAfterUpgradeClosesTheConnection(t *testing.T) {
+	s, ts := newTestServer(t, "-connection-auth-key", "secret", "-max-connections-per-tenant", "1")
+	registered := register(t, ts, map[string]any{"client_id": "db-1", "tenant": "acme"})
+	conn, _, err := websocket.DefaultDialer.Dial(registered.ConnectionURL, nil)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	defer conn.Close()
+	client := &testClient{t: t, conn: conn}
+	client.read()
+	conn.WriteJSON(challengeResponse{Type: "challenge_response", Signature: "forged"})
+
+	// The connection was hijacked by then, so the refusal can only be a
+	// close frame; nothing is written to the ResponseWriter.
+	client.expectClose(websocket.ClosePolicyViolation)
+	s.clientsMutex.RLock()
+	reserved := s.tenantConnections["acme"]
+	s.clientsMutex.RUnlock()
+	if reserved != 0 || s.connectionCount("db-1") != 0 {
+		t.Errorf("refused connection left %d tenant reservations and %d connections", reserved, s.connectionCount("db-1"))
+	}
+}
+
+func TestBasePathIsNormalized(t *testing.T) {
+	for path, want := range map[string]string{"": "", "/": "", "proxy": "/proxy", "/proxy/": "/proxy", " /a/b/ ": "/a/b"} {
+		if got := normalizeBasePath(path); got != want {
+			t.Errorf("normalizeBasePath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRoutesAreMountedUnderTheBasePath(t *testing.T) {
+	s, ts := newTestServer(t, "-base-path", "proxy/")
+	if resp, _ := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-1"}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("registering outside the base path got %s, want 404", resp.Status)
+	}
+
+	resp, body := do(t, "POST", ts.URL+"/proxy/register", map[string]any{"client_id": "db-1"}, nil)
+	var registered registerResponse
+	if err := json.Unmarshal(body, &registered); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("registering under the base path got %s: %s", resp.Status, body)
+	}
+	if want := wsURL(ts, "/proxy/connect?client_id=db-1"); !strings.HasPrefix(registered.ConnectionURL, want) {
+		t.Errorf("connection URL %s, want it under %s", registered.ConnectionURL, want)
+	}
+	connectRegistered(t, s, registered, "db-1").echo("answer")
+	if resp, body := do(t, "GET", ts.URL+"/proxy/query/db-1", nil, nil); string(body) != "answer" {
+		t.Errorf("query under the base path got %s %q", resp.Status, body)
+	}
+}
+
+func TestServersAreIndependent(t *testing.T) {
+	first, firstTS := newTestServer(t)
+	second, secondTS := newTestServer(t)
+	connectClient(t, first, firstTS, "db-1").echo("first")
+
+	if resp, body := do(t, "GET", firstTS.URL+"/query/db-1", nil, nil); string(body) != "first" {
+		t.Errorf("first server got %s %q", resp.Status, body)
+	}
+	if resp, _ := do(t, "GET", secondTS.URL+"/query/db-1", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second server got %s for a client only the first has, want 404", resp.Status)
+	}
+	if _, ok := second.cached(second.cacheKey("db-1", "")); ok || second.connectionCount("db-1") != 0 {
+		t.Error("the second server shares the first one's clients or cache")
+	}
+}
+
+func TestInactiveConnectionsAreEvicted(t *testing.T) {
+	s, ts := newTestServer(t)
+	idle := connectClient(t, s, ts, "idle")
+	connectClient(t, s, ts, "active")
+	s.firstConnection("idle").lastActive.Store(time.Now().Add(-time.Hour).UnixNano())
+
+	if n := s.evictInactiveClients(); n != 1 {
+		t.Fatalf("evicted %d connections, want the idle one", n)
+	}
+	if s.connectionCount("idle") != 0 || s.connectionCount("active") != 1 {
+		t.Errorf("after eviction idle has %d connections and active %d", s.connectionCount("idle"), s.connectionCount("active"))
+	}
+	idle.expectClose(websocket.CloseGoingAway)
+}
+
+func TestEvictionDoesNotHoldUpOtherClients(t *testing.T) {
+	s, ts := newTestServer(t, "-broadcast-timeout", "3s")
+	connectClient(t, s, ts, "stuck")
+	connectClient(t, s, ts, "active").echo("answer")
+	stuck := s.firstConnection("stuck")
+	stuck.lastActive.Store(time.Now().Add(-time.Hour).UnixNano())
+
+	// The stuck client never reads, so a large enough message fills the
+	// socket and holds its connection's write lock, and the close frame sent
+	// on eviction waits behind it for the whole -broadcast-timeout.
+	unblocked := make(chan struct{})
+	go func() {
+		defer close(unblocked)
+		stuck.writeMutex.Lock()
+		defer stuck.writeMutex.Unlock()
+		stuck.Connection.SetWriteDeadline(time.Now().Add(time.Minute))
+		stuck.Connection.WriteMessage(websocket.BinaryMessage, make([]byte, 64<<20))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if n := s.evictInactiveClients(); n != 1 {
+		t.Fatalf("evicted %d connections, want the stuck one", n)
+	}
+	if _, body := do(t, "GET", ts.URL+"/query/active", nil, nil); string(body) != "answer" {
+		t.Errorf("query during a blocked close got %q", body)
+	}
+	register(t, ts, map[string]any{"client_id": "db-1"})
+	connectClient(t, s, ts, "db-2")
+	select {
+	case <-unblocked:
+		t.Fatal("the stuck connection was closed before the other clients were served")
+	default:
+	}
+
+	select {
+	case <-unblocked:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the stuck connection was never closed")
+	}
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// With -server-timing, replies to /query, /command and /query-cached carry
+// a Server-Timing header, which browser developer tools show as a breakdown
+// of where the time went:
+//
+//	Server-Timing: cache;dur=0.1, queue;dur=12.4, backend;dur=35.2, total;dur=48.0
+//
+// cache is the cache lookup, queue the wait for a slot on the client's
+// connection, backend the round trip from sending the query to the client's
+// reply (to its first chunk, for a streamed one) and total everything up to
+// the response headers. Phases a query didn't go through are left out. The
+// write of the body can only be timed once it is done, so it follows as a
+// Server-Timing trailer, write;dur=..., to callers that send TE: trailers;
+// streamed replies, whose write is the whole stream, don't get one. The
+// same timings go into query traces; see trace.go.
+
+type serverTimingKey struct{}
+
+// serverTiming collects the phases of one request: those no reply records,
+// and, for traces, those of the reply it was answered with.
+type serverTiming struct {
+	start time.Time
+	cache time.Duration
+	// header is set when the timing goes out in Server-Timing.
+	header bool
+	// decisions and queued and rtt are for traces.
+	decisions []cacheDecision
+	queued    queueWait
+	rtt       time.Duration
+}
+
+// serverTimings times the request for its Server-Timing header, if
+// -server-timing is on, and for its trace, if queries are traced.
+func (s *Server) serverTimings(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := s.currentConfig().ServerTiming
+		tracing := s.tracer.Load() != nil
+		if !header && !tracing {
+			next(w, r)
+			return
+		}
+		timing := &serverTiming{start: time.Now(), header: header}
+		r = r.WithContext(context.WithValue(r.Context(), serverTimingKey{}, timing))
+		if !tracing {
+			next(w, r)
+			return
+		}
+		tw := &historyWriter{ResponseWriter: w}
+		next(tw, r)
+		s.traceQuery(r, timing, tw)
+	}
+}
+
+// timingOf returns r's timing, or nil if it isn't timed.
+func timingOf(r *http.Request) *serverTiming {
+	timing, _ := r.Context().Value(serverTimingKey{}).(*serverTiming)
+	return timing
+}
+
+// recordCache notes how long the cache lookup took and the decisions made
+// about the cache.
+func (t *serverTiming) recordCache(d time.Duration, decisions ...cacheDecision) {
+	if t != nil {
+		t.cache += d
+		t.decisions = append(t.decisions, decisions...)
+	}
+}
+
+func timingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(d)/float64(time.Millisecond))
+}
+
+// writeServerTiming sets the Server-Timing header for reply and reports
+// whether a write trailer should follow the body.
+func writeServerTiming(w http.ResponseWriter, r *http.Request, reply clientReply) bool {
+	timing := timingOf(r)
+	if timing == nil {
+		return false
+	}
+	timing.queued, timing.rtt = reply.queued, reply.rtt
+	if !timing.header {
+		return false
+	}
+	var metrics []string
+	if timing.cache > 0 {
+		metrics = append(metrics, timingMetric("cache", timing.cache))
+	}
+	if reply.queued.position > 0 {
+		metrics = append(metrics, timingMetric("queue", reply.queued.wait))
+	}
+	if reply.rtt > 0 {
+		metrics = append(metrics, timingMetric("backend", reply.rtt))
+	}
+	metrics = append(metrics, timingMetric("total", time.Since(timing.start)))
+	w.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+
+	if reply.stream != nil || !acceptsTrailers(r) {
+		return false
+	}
+	w.Header().Add("Trailer", "Server-Timing")
+	return true
+}
+
+// writeTimedBody writes body, followed by the Server-Timing trailer for the
+// write if trailer is set.
+func writeTimedBody(w http.ResponseWriter, body []byte, trailer bool) {
+	start := time.Now()
+	w.Write(body)
+	if trailer {
+		w.Header().Set("Server-Timing", timingMetric("write", time.Since(start)))
+	}
+}
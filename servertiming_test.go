@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+var timingPhase = regexp.MustCompile(`(\w+);dur=\d+\.\d`)
+
+// timingPhases returns the phases named in a Server-Timing value.
+func timingPhases(value string) []string {
+	var phases []string
+	for _, m := range timingPhase.FindAllStringSubmatch(value, -1) {
+		phases = append(phases, m[1])
+	}
+	return phases
+}
+
+func TestServerTimingBreaksDownTheQuery(t *testing.T) {
+	s, ts := newTestServer(t, "-server-timing")
+	connectClient(t, s, ts, "db-1").echo("answer")
+
+	resp, _ := do(t, "GET", ts.URL+"/query/db-1", nil, nil)
+	if phases := timingPhases(resp.Header.Get("Server-Timing")); len(phases) != 3 || phases[0] != "cache" || phases[1] != "backend" || phases[2] != "total" {
+		t.Errorf("live query got Server-Timing %q, want cache, backend and total", resp.Header.Get("Server-Timing"))
+	}
+	resp, _ = do(t, "GET", ts.URL+"/query/db-1", nil, nil)
+	if phases := timingPhases(resp.Header.Get("Server-Timing")); len(phases) != 2 || phases[0] != "cache" || phases[1] != "total" {
+		t.Errorf("cache hit got Server-Timing %q, want cache and total", resp.Header.Get("Server-Timing"))
+	}
+}
+
+func TestServerTimingTrailerTimesTheWrite(t *testing.T) {
+	s, ts := newTestServer(t, "-server-timing")
+	connectClient(t, s, ts, "db-1").echo("answer")
+
+	req, _ := http.NewRequest("GET", ts.URL+"/query/db-1", nil)
+	req.Header.Set("TE", "trailers")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	io.ReadAll(resp.Body)
+	if phases := timingPhases(resp.Trailer.Get("Server-Timing")); len(phases) != 1 || phases[0] != "write" {
+		t.Errorf("got Server-Timing trailer %q, want the write", resp.Trailer.Get("Server-Timing"))
+	}
+}
+
+func TestServerTimingOffByDefault(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "db-1").echo("answer")
+	if resp, _ := do(t, "GET", ts.URL+"/query/db-1", nil, nil); resp.Header.Get("Server-Timing") != "" {
+		t.Errorf("got Server-Timing %q without -server-timing", resp.Header.Get("Server-Timing"))
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// A new version of a backend can be tried on live traffic by mirroring the
+// queries for a client ID to a shadow client, set with -shadow-clients:
+//
+//	-shadow-clients orders=orders-canary,prices=prices-next
+//
+// Each GET query for orders that goes to the client, rather than being
+// served from the cache, is also sent to orders-canary once the caller's
+// reply is in hand. The shadow's reply is only compared with the primary's,
+// status and body, and a difference logged; the caller never waits for it
+// or sees it. POST queries and commands are not mirrored, since they may
+// have effects. At most maxShadowQueries shadow queries run at once, and
+// queries beyond that go unmirrored; every outcome is counted in
+// proxy_shadow_queries_total.
+
+const maxShadowQueries = 64
+
+// parseShadowClients parses a -shadow-clients list into shadow client IDs
+// by primary client ID.
+func parseShadowClients(list string) (map[string]string, error) {
+	shadows := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		primary, shadow, ok := strings.Cut(entry, "=")
+		primary, shadow = strings.TrimSpace(primary), strings.TrimSpace(shadow)
+		switch {
+		case !ok || primary == "" || shadow == "":
+			return nil, fmt.Errorf("%q is not client=shadow", entry)
+		case primary == shadow:
+			return nil, fmt.Errorf("client %s can't shadow itself", primary)
+		}
+		shadows[primary] = shadow
+	}
+	return shadows, nil
+}
+
+// mirrorQuery sends query, which clientID answered with primary, to the
+// shadow of clientID, if it has one, in the background.
+func (s *Server) mirrorQuery(clientID string, query queryMessage, primary clientReply) {
+	cfg := s.currentConfig()
+	shadowID, ok := cfg.shadows[clientID]
+	if !ok {
+		return
+	}
+	select {
+	case s.shadowSlots <- struct{}{}:
+	default:
+		s.incCounter("proxy_shadow_queries_total", "outcome", "skipped")
+		return
+	}
+
+	// The shadow query outlives the caller's request.
+	query.ctx = nil
+	query.RequestID = newRequestID()
+	go func() {
+		defer func() { <-s.shadowSlots }()
+		s.incCounter("proxy_shadow_queries_total", "outcome", s.shadowQuery(clientID, shadowID, query, primary, cfg.QueryTimeout))
+	}()
+}
+
+// shadowQuery queries shadowID and compares its reply with primary,
+// returning the outcome: match, mismatch or error.
+func (s *Server) shadowQuery(clientID, shadowID string, query queryMessage, primary clientReply, timeout time.Duration) string {
+	start := time.Now()
+	client, err := s.pickClient(shadowID, query.maxRTT)
+	if err == nil {
+		var reply clientReply
+		if reply, err = s.queryClient(client, query, timeout); err == nil {
+			if reply, err = reply.collect(); err == nil {
+				return s.compareShadow(clientID, shadowID, query.RequestID, primary, reply, time.Since(start))
+			}
+		}
+	}
+	log.Printf("Shadow %s of client %s failed query %s: %v", shadowID, clientID, query.RequestID, err)
+	return "error"
+}
+
+func (s *Server) compareShadow(clientID, shadowID, requestID string, primary, shadow clientReply, took time.Duration) string {
+	var diffs []string
+	if primary.statusCode() != shadow.statusCode() {
+		diffs = append(diffs, fmt.Sprintf("status %d, shadow %d", primary.statusCode(), shadow.statusCode()))
+	}
+	// A streamed primary reply went to the caller without being kept.
+	if primary.stream == nil && !bytes.Equal(primary.Body, shadow.Body) {
+		diffs = append(diffs, fmt.Sprintf("body of %d bytes, shadow %d, first differing at byte %d", len(primary.Body), len(shadow.Body), firstDifference(primary.Body, shadow.Body)))
+	}
+	if len(diffs) == 0 {
+		return "match"
+	}
+	log.Printf("Shadow %s of client %s differs on query %s (%s): %s", shadowID, clientID, requestID, took.Round(time.Millisecond), strings.Join(diffs, "; "))
+	return "mismatch"
+}
+
+// firstDifference returns the index of the first byte at which a and b
+// differ.
+func firstDifference(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
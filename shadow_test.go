@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseShadowClients(t *testing.T) {
+	shadows, err := parseShadowClients(" orders = orders-canary, prices=prices-next,")
+	if err != nil || len(shadows) != 2 || shadows["orders"] != "orders-canary" || shadows["prices"] != "prices-next" {
+		t.Errorf("parseShadowClients = %v, %v", shadows, err)
+	}
+	for _, list := range []string{"orders", "orders=", "=canary", "orders=orders"} {
+		if _, err := parseShadowClients(list); err == nil {
+			t.Errorf("parseShadowClients(%q) succeeded", list)
+		}
+	}
+}
+
+// shadowOutcomes returns how many shadow queries had outcome.
+func (s *Server) shadowOutcomes(outcome string) float64 {
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	return s.metrics.counters[`proxy_shadow_queries_total{outcome="`+outcome+`"}`]
+}
+
+func TestQueriesAreMirroredToTheShadow(t *testing.T) {
+	s, ts := newTestServer(t, "-shadow-clients", "orders=orders-canary")
+	connectClient(t, s, ts, "orders").echo("v1")
+	shadow := connectClient(t, s, ts, "orders-canary")
+
+	if resp, body := do(t, "GET", ts.URL+"/query/orders?q=match", nil, nil); resp.StatusCode != http.StatusOK || string(body) != "v1" {
+		t.Fatalf("mirrored query got %s: %s, want the primary's reply", resp.Status, body)
+	}
+	query := shadow.readQuery()
+	if query.Params["q"][0] != "match" {
+		t.Errorf("shadow was sent %v", query.Params)
+	}
+	shadow.reply(replyMessage{RequestID: query.RequestID, Body: "v1"})
+	waitFor(t, "the match to be counted", func() bool { return s.shadowOutcomes("match") == 1 })
+
+	do(t, "GET", ts.URL+"/query/orders?q=mismatch", nil, nil)
+	query = shadow.readQuery()
+	shadow.reply(replyMessage{RequestID: query.RequestID, Body: "v2"})
+	waitFor(t, "the mismatch to be counted", func() bool { return s.shadowOutcomes("mismatch") == 1 })
+}
+
+func TestPostQueriesAreNotMirrored(t *testing.T) {
+	s, ts := newTestServer(t, "-shadow-clients", "orders=orders-canary")
+	connectClient(t, s, ts, "orders").echo("v1")
+
+	do(t, "POST", ts.URL+"/query/orders", "payload", nil)
+	do(t, "GET", ts.URL+"/query/orders", nil, nil)
+	// The shadow isn't connected, so the GET's mirror fails; the POST has
+	// none at all.
+	waitFor(t, "the GET's mirror to fail", func() bool { return s.shadowOutcomes("error") == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if n := s.shadowOutcomes("error"); n != 1 {
+		t.Errorf("counted %v shadow errors, want only the GET's", n)
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// On SIGTERM or SIGINT the binary shuts the server down with Shutdown.
+// Rather than cutting clients off, it waits for them to leave: the server
+// stops taking registrations and connections, as when draining, tells every
+// connected client to reconnect to -shutdown-reconnect-url if one is set,
+// and then polls the number of connected clients, returning as soon as it
+// reaches zero. -shutdown-timeout bounds the wait; connections still open
+// then are closed with 1001 (going away). With -shutdown-timeout 0, the
+// default, nothing is waited for. HTTP requests in progress are then
+// finished before Shutdown returns. If Shutdown fails, Close stops the
+// server at once.
+
+// shutdownPoll is how often Shutdown checks whether clients have left.
+const shutdownPoll = 50 * time.Millisecond
+
+// Shutdown drains the server's clients as described above and then shuts
+// down the HTTP server ListenAndServe started, which then returns
+// http.ErrServerClosed. ctx bounds the whole shutdown, on top of
+// -shutdown-timeout.
+func (s *Server) Shutdown(ctx context.Context) error {
+	cfg := s.currentConfig()
+	s.draining.Store(true)
+
+	if cfg.ShutdownReconnectURL != "" {
+		result, err := s.broadcastReconnect(cfg.ShutdownReconnectURL)
+		if err != nil {
+			return err
+		}
+		log.Printf("Shutting down: told %d clients to reconnect to %s (%d failed, %d timed out)", result.Sent, cfg.ShutdownReconnectURL, len(result.Failed), len(result.TimedOut))
+	}
+
+	if remaining := s.awaitClientsGone(ctx, cfg.ShutdownTimeout); remaining > 0 {
+		log.Printf("Shutting down: closing %d connections still open", remaining)
+		s.closeClients(s.connectedClients(), cfg)
+	} else {
+		log.Printf("Shutting down: every client has disconnected")
+	}
+
+	server := s.httpServer.Load()
+	var err error
+	if server != nil {
+		err = server.Shutdown(ctx)
+	}
+	s.SetTraceSink(nil)
+	return err
+}
+
+// Close closes every client connection with 1001 and the HTTP server
+// ListenAndServe started, without waiting for anything to finish.
+func (s *Server) Close() error {
+	s.draining.Store(true)
+	s.closeClients(s.connectedClients(), s.currentConfig())
+	server := s.httpServer.Load()
+	if server == nil {
+		return nil
+	}
+	return server.Close()
+}
+
+// closeClients closes clients' connections with 1001 from a pool of
+// -broadcast-workers, as broadcast sends, so clients slow to take the close
+// message don't each hold up the rest by -broadcast-timeout.
+func (s *Server) closeClients(clients []*Client, cfg *Config) {
+	var wg sync.WaitGroup
+	work := make(chan *Client)
+	for i := 0; i < cfg.BroadcastWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for client := range work {
+				s.closeConnection(client.Connection, client.ID, closeShutdown, "", cfg.BroadcastTimeout)
+			}
+		}()
+	}
+	for _, client := range clients {
+		work <- client
+	}
+	close(work)
+	wg.Wait()
+}
+
+// awaitClientsGone waits up to timeout, or until ctx is done, for every
+// client to disconnect, and returns how many connections are still open.
+func (s *Server) awaitClientsGone(ctx context.Context, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := len(s.connectedClients())
+		if remaining == 0 || !time.Now().Before(deadline) {
+			return remaining
+		}
+		select {
+		case <-ctx.Done():
+			return remaining
+		case <-time.After(shutdownPoll):
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func connectClients(t *testing.T, s *Server, ts *httptest.Server, n int) []*testClient {
+	t.Helper()
+	var clients []*testClient
+	for i := 0; i < n; i++ {
+		clients = append(clients, connectClient(t, s, ts, fmt.Sprintf("db-%d", i)))
+	}
+	return clients
+}
+
+func TestShutdownClosesClientsStillConnected(t *testing.T) {
+	s, ts := newTestServer(t, "-shutdown-timeout", "50ms", "-broadcast-workers", "2")
+	clients := connectClients(t, s, ts, 5)
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	for _, client := range clients {
+		client.expectClose(websocket.CloseGoingAway)
+	}
+}
+
+func TestCloseClosesClientsAtOnce(t *testing.T) {
+	s, ts := newTestServer(t, "-shutdown-timeout", "1h")
+	clients := connectClients(t, s, ts, 3)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for _, client := range clients {
+		client.expectClose(websocket.CloseGoingAway)
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// -write-timeout bounds a response as a whole, and streamed replies get a
+// fresh allowance for every chunk, so a caller that reads just fast enough
+// can hold a query, and the client's stream behind it, for a long time.
+// -slow-read-timeout sets a floor on how fast the caller must read instead:
+// the response to a query is written slowReadChunk bytes at a time, and a
+// piece the caller hasn't taken within the timeout cuts it off. The
+// connection is closed and, for a stream, the query is finished so its
+// slot on the client's connection is freed and the rest of the stream
+// ignored. Each such caller is logged and counted in
+// proxy_slow_readers_total.
+
+const slowReadChunk = 32 << 10
+
+// slowReads applies -slow-read-timeout to next; zero leaves the response to
+// the write timeout alone.
+func (s *Server) slowReads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.currentConfig().SlowReadTimeout
+		if timeout <= 0 {
+			next(w, r)
+			return
+		}
+		sw := &slowReadWriter{ResponseWriter: w, server: s, r: r, timeout: timeout}
+		if s.writeTimeout > 0 {
+			sw.deadline = time.Now().Add(s.writeTimeout)
+		}
+		next(sw, r)
+	}
+}
+
+// slowReadWriter gives each piece of the response its own deadline, never
+// past the one the rest of the server set for the response.
+type slowReadWriter struct {
+	http.ResponseWriter
+	server   *Server
+	r        *http.Request
+	timeout  time.Duration
+	deadline time.Time
+	cutOff   bool
+}
+
+func (w *slowReadWriter) SetWriteDeadline(t time.Time) error {
+	w.deadline = t
+	return http.NewResponseController(w.ResponseWriter).SetWriteDeadline(t)
+}
+
+// arm sets the write deadline for the next piece and returns it.
+func (w *slowReadWriter) arm() (time.Time, bool) {
+	deadline := time.Now().Add(w.timeout)
+	if !w.deadline.IsZero() && w.deadline.Before(deadline) {
+		http.NewResponseController(w.ResponseWriter).SetWriteDeadline(w.deadline)
+		return w.deadline, false
+	}
+	http.NewResponseController(w.ResponseWriter).SetWriteDeadline(deadline)
+	return deadline, true
+}
+
+func (w *slowReadWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		piece := p[:min(len(p), slowReadChunk)]
+		deadline, ours := w.arm()
+		n, err := w.ResponseWriter.Write(piece)
+		written += n
+		if err != nil {
+			w.checkSlow(deadline, ours)
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *slowReadWriter) FlushError() error {
+	deadline, ours := w.arm()
+	err := http.NewResponseController(w.ResponseWriter).Flush()
+	if err != nil {
+		w.checkSlow(deadline, ours)
+	}
+	return err
+}
+
+func (w *slowReadWriter) Flush() {
+	w.FlushError()
+}
+
+// checkSlow records the caller as a slow reader if a write failed because
+// the piece's own deadline passed.
+func (w *slowReadWriter) checkSlow(deadline time.Time, ours bool) {
+	if w.cutOff || !ours || time.Now().Before(deadline) {
+		return
+	}
+	w.cutOff = true
+	log.Printf("Cut off %s reading %s: no progress within %s", w.server.clientIP(w.r), w.r.URL.Path, w.timeout)
+	w.server.incCounter("proxy_slow_readers_total")
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (w *slowReadWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
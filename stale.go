@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// For some routes an old answer beats no answer. When a GET /query can't be
+// answered live because the client is unavailable, not connected, busy,
+// timed out or gone mid-query, and the route's cache policy has
+// stale_on_error, or -stale-on-error is set, the last good reply cached for
+// the query is served however long ago it expired, with
+//
+//	Warning: 111 - "Revalidation Failed"
+//	Warning: 110 - "Response is Stale"
+//
+// along with Age and X-Cache: STALE. Cached error replies don't count as
+// good, and with nothing to serve the query fails, or gets its fallback,
+// as usual. Replies the client did send, errors included, are passed on
+// unchanged.
+
+const revalidationFailedWarning = `111 - "Revalidation Failed"`
+
+// serveStaleOnError serves the entry cached under key, if clientID's cache
+// policy allows it, for a query its client couldn't answer, and reports
+// whether it did.
+func (s *Server) serveStaleOnError(w http.ResponseWriter, r *http.Request, clientID, key string, start time.Time, decisions ...cacheDecision) bool {
+	if !s.cachePolicy(clientID).StaleOnError {
+		return false
+	}
+	cached, ok := s.lookupAnyCache(key)
+	if !ok || cached.Status != 0 {
+		return false
+	}
+
+	w.Header().Add("Warning", revalidationFailedWarning)
+	w.Header().Add("Warning", staleWarning)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(cached.Timestamp).Seconds())))
+	w.Header().Set("X-Cache", "STALE")
+	s.writeReply(w, r, s.cachedReply(r, cached))
+	s.recordQuery(clientID, "stale", start, nil, decisions...)
+	return true
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// putExpired caches entry under key as having expired an hour ago.
+func putExpired(s *Server, key string, entry ClientResponse) {
+	entry.Timestamp, entry.TTL = time.Now().Add(-time.Hour), time.Minute
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+	s.cachePut(key, entry)
+}
+
+func TestStaleServedWhenClientIsAway(t *testing.T) {
+	s, ts := newTestServer(t, "-stale-on-error")
+	putExpired(s, s.cacheKey("weather", "city=paris"), ClientResponse{Data: "sunny"})
+
+	resp, body := do(t, "GET", ts.URL+"/query/weather?city=paris", nil, nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "sunny" {
+		t.Fatalf("got %s: %s, want the stale entry", resp.Status, body)
+	}
+	if resp.Header.Get("X-Cache") != "STALE" || resp.Header.Get("Age") == "" {
+		t.Errorf("stale reply headers %v", resp.Header)
+	}
+	if warnings := resp.Header.Values("Warning"); !slices.Contains(warnings, revalidationFailedWarning) || !slices.Contains(warnings, staleWarning) {
+		t.Errorf("stale reply warnings %q", warnings)
+	}
+}
+
+func TestStaleNotServedForCachedErrors(t *testing.T) {
+	s, ts := newTestServer(t, "-stale-on-error")
+	putExpired(s, s.cacheKey("weather", ""), ClientResponse{Data: "down", Status: http.StatusBadGateway})
+
+	if resp, body := do(t, "GET", ts.URL+"/query/weather", nil, nil); resp.Header.Get("X-Cache") == "STALE" || string(body) == "down" {
+		t.Errorf("cached error served stale: %s: %s", resp.Status, body)
+	}
+}
+
+func TestStaleNotServedForClientReplies(t *testing.T) {
+	s, ts := newTestServer(t, "-stale-on-error")
+	putExpired(s, s.cacheKey("weather", ""), ClientResponse{Data: "sunny"})
+	connectClient(t, s, ts, "weather").serve(func(queryMessage) replyMessage {
+		return replyMessage{Status: http.StatusInternalServerError, Body: "broken"}
+	})
+
+	if resp, body := do(t, "GET", ts.URL+"/query/weather", nil, nil); resp.StatusCode != http.StatusInternalServerError || string(body) != "broken" {
+		t.Errorf("got %s: %s, want the client's own error", resp.Status, body)
+	}
+}
+
+func TestStaleOnErrorPerRoute(t *testing.T) {
+	policies := writeCachePolicies(t, `{"routes": [{"path": "/query/catalog-*", "stale_on_error": true}]}`)
+	s, ts := newTestServer(t, "-cache-policies", policies)
+	putExpired(s, s.cacheKey("catalog-eu", ""), ClientResponse{Data: "items"})
+	putExpired(s, s.cacheKey("weather", ""), ClientResponse{Data: "sunny"})
+
+	if resp, body := do(t, "GET", ts.URL+"/query/catalog-eu", nil, nil); resp.Header.Get("X-Cache") != "STALE" {
+		t.Errorf("route with stale_on_error got %s: %s", resp.Status, body)
+	}
+	if resp, body := do(t, "GET", ts.URL+"/query/weather", nil, nil); resp.Header.Get("X-Cache") == "STALE" {
+		t.Errorf("route without stale_on_error got %s: %s", resp.Status, body)
+	}
+}
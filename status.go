@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /status/{clientID} tells a caller whether a client is there to answer
+// without sending it a query, or counting as one. It reads only what the
+// proxy already knows about the client's connections:
+//
+//	{"client_id":"eu-1","connected":true,"connections":2,"health":"healthy",
+//	 "last_ping":"2026-10-14T15:31:58Z","rtt":"1.2ms","in_flight":3,"queued":0}
+//
+// health is as in X-Client-Health, rtt the average over the connections
+// that have been measured, and in_flight and queued are summed over the
+// connections; paused and draining are set when they apply. A client that
+// registered but isn't connected is reported as not connected; one the
+// proxy knows nothing about gets the same body with 404.
+
+type clientStatus struct {
+	ClientID    string     `json:"client_id"`
+	Connected   bool       `json:"connected"`
+	Connections int        `json:"connections"`
+	Health      string     `json:"health"`
+	LastPing    *time.Time `json:"last_ping,omitempty"`
+	RTT         string     `json:"rtt,omitempty"`
+	InFlight    int        `json:"in_flight"`
+	Queued      int        `json:"queued"`
+	Paused      bool       `json:"paused,omitempty"`
+	Draining    bool       `json:"draining,omitempty"`
+}
+
+// clientStatus summarizes clientID's live connections.
+func (s *Server) clientStatus(clientID string) clientStatus {
+	status := clientStatus{ClientID: clientID, Health: "disconnected"}
+
+	s.clientsMutex.RLock()
+	var conns []*Client
+	if set, ok := s.clients[clientID]; ok {
+		conns = append(conns, set.conns...)
+	}
+	s.clientsMutex.RUnlock()
+
+	var lastPing time.Time
+	var rtt time.Duration
+	measured := 0
+	for _, client := range conns {
+		if client.LastPing().After(lastPing) {
+			lastPing = client.LastPing()
+		}
+		if !client.unhealthy.Load() {
+			status.Health = "healthy"
+		} else if status.Health == "disconnected" {
+			status.Health = "unhealthy"
+		}
+		if d := client.rtt(); d > 0 {
+			rtt += d
+			measured++
+		}
+		client.slotMutex.Lock()
+		status.InFlight += client.inFlight
+		status.Queued += len(client.queue)
+		status.Paused = status.Paused || client.paused
+		client.slotMutex.Unlock()
+	}
+	if !lastPing.IsZero() {
+		status.LastPing = &lastPing
+	}
+	if measured > 0 {
+		status.RTT = formatRTT(rtt / time.Duration(measured))
+	}
+	status.Connections = len(conns)
+	status.Connected = len(conns) > 0
+	status.Draining = s.clientDraining(clientID)
+	return status
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	status := s.clientStatus(clientID)
+
+	code := http.StatusOK
+	if !status.Connected {
+		s.registrationsMutex.RLock()
+		_, registered := s.registrations[clientID]
+		s.registrationsMutex.RUnlock()
+		if !registered {
+			code = http.StatusNotFound
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
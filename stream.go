@@ -0,0 +1,424 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Instead of one reply, a client may stream its answer as chunks:
+//
+//	{"request_id":"9f1c...","type":"chunk","seq":0,"status":200,"headers":{...},"body":"part one"}
+//	{"request_id":"9f1c...","type":"chunk","seq":1,"body":"part two"}
+//	{"request_id":"9f1c...","type":"chunk","seq":2,"body":"","final":true}
+//
+// Sequence numbers start at 0 and count up by one per chunk; the status and
+// headers come from chunk 0. Chunks of different queries may be interleaved
+// freely, and chunks of one query may arrive out of order by up to
+// -chunk-reorder-window places, in which case they are buffered and passed on
+// in sequence. A duplicate, a chunk past the final one or a gap wider than
+// the window fails the stream, and so does a client that gets more than the
+// window plus one chunks ahead of a caller reading slowly, rather than
+// holding up the other queries on its connection.
+//
+// The final chunk says how the stream ended: it may carry trailers, and a
+// client that failed partway through sets an error, optionally with a
+// status:
+//
+//	{"request_id":"9f1c...","type":"chunk","seq":2,"final":true,"status":500,"error":"backend went away","trailers":{"X-Rows":"20"}}
+//
+// Each chunk is written and flushed to the caller as soon as its turn comes,
+// so streamed replies are neither cached nor checked against a response
+// schema, and a failure after the first chunk can no longer change the
+// response status; see writeStream. A stream whose first chunk is also its
+// final one is treated like an ordinary reply.
+//
+// A caller that asks for "Accept: text/event-stream" gets a streamed reply
+// as server-sent events instead, each chunk with a body forwarded as it
+// arrives with its sequence number as the event ID:
+//
+//	id: 0
+//	event: message
+//	data: part one
+//
+// so a client can push intermediate results, progress and the like, over one
+// query before its final answer. After the final chunk the stream closes with
+//
+//	event: end
+//	data: {"status":200,"trailers":{"X-Rows":"20"}}
+//
+// or, if the stream failed, the error event below. A client whose reply is
+// already an event stream is passed through as it is, and a plain reply is
+// answered as usual.
+
+var (
+	errChunkOutOfOrder = errors.New("client sent a chunk out of sequence")
+	errChunkGap        = errors.New("client skipped a chunk beyond the reorder window")
+	errNotChunk        = errors.New("client sent a plain reply in the middle of a stream")
+	errStreamFailed    = errors.New("client reported the stream failed")
+	errStreamOverrun   = errors.New("client sent chunks faster than the caller read them")
+	// errStreamInterrupted is a stream whose client disconnected before
+	// its final chunk.
+	errStreamInterrupted = errors.New("client disconnected mid-stream")
+)
+
+// streamDisconnectModes are the values of -stream-disconnect.
+var streamDisconnectModes = map[string]bool{"abort": true, "end": true}
+
+// replyStream reads one query's chunks in sequence.
+type replyStream struct {
+	client    *Client
+	requestID string
+	pending   *pendingQuery
+	timeout   time.Duration
+	window    int
+	// deadline, if set, is the end of the caller's request budget, past
+	// which no chunk is waited for.
+	deadline time.Time
+
+	next     int
+	finalSeq int
+	buffered map[int]clientReply
+	finished bool
+	// ctx is the caller's, and err why the stream last failed, for the
+	// cancel sent if it is closed before its final chunk; see cancel.go.
+	ctx context.Context
+	err error
+}
+
+func newReplyStream(ctx context.Context, client *Client, requestID string, p *pendingQuery, timeout time.Duration) *replyStream {
+	return &replyStream{
+		ctx:       ctx,
+		client:    client,
+		requestID: requestID,
+		pending:   p,
+		timeout:   timeout,
+		window:    client.server.currentConfig().ChunkReorderWindow,
+		finalSeq:  -1,
+		buffered:  make(map[int]clientReply),
+	}
+}
+
+// first takes the chunk that opened the stream and returns chunk 0 as the
+// reply, carrying the stream unless it already ended.
+func (s *replyStream) first(chunk clientReply) (clientReply, error) {
+	if err := s.add(chunk); err != nil {
+		return clientReply{}, err
+	}
+	reply, err := s.read()
+	if err == nil && s.finished {
+		err = reply.streamResult()
+	}
+	if err != nil {
+		return clientReply{}, err
+	}
+	if !s.finished {
+		reply.stream = s
+	}
+	return reply, nil
+}
+
+// add buffers a chunk that has arrived, rejecting ones that can't fit the
+// sequence.
+func (s *replyStream) add(chunk clientReply) error {
+	if !chunk.chunk {
+		return errNotChunk
+	}
+	if _, dup := s.buffered[chunk.seq]; dup || chunk.seq < s.next {
+		return fmt.Errorf("%w: duplicate seq %d", errChunkOutOfOrder, chunk.seq)
+	}
+	if s.finalSeq >= 0 && chunk.seq > s.finalSeq {
+		return fmt.Errorf("%w: seq %d after final seq %d", errChunkOutOfOrder, chunk.seq, s.finalSeq)
+	}
+	if chunk.seq > s.next+s.window {
+		return fmt.Errorf("%w: got seq %d while waiting for %d", errChunkGap, chunk.seq, s.next)
+	}
+	if chunk.final {
+		s.finalSeq = chunk.seq
+	}
+	s.buffered[chunk.seq] = chunk
+	return nil
+}
+
+// read returns the next chunk in sequence, waiting up to the query timeout
+// for each one to arrive. It returns io.EOF after the final chunk.
+func (s *replyStream) read() (clientReply, error) {
+	if s.finished {
+		return clientReply{}, io.EOF
+	}
+
+	timeout := s.timeout
+	if !s.deadline.IsZero() {
+		timeout = min(timeout, time.Until(s.deadline))
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		if chunk, ok := s.buffered[s.next]; ok {
+			delete(s.buffered, s.next)
+			s.next++
+			s.finished = chunk.final
+			return chunk, nil
+		}
+
+		select {
+		case chunk := <-s.pending.replies:
+			if err := s.add(chunk); err != nil {
+				s.err = err
+				return clientReply{}, err
+			}
+		case <-timer.C:
+			s.err = errQueryTimeout
+			if !s.deadline.IsZero() && !time.Now().Before(s.deadline) {
+				s.err = errBudgetExhausted
+			}
+			return clientReply{}, s.err
+		case <-s.ctx.Done():
+			s.err = contextError(s.ctx)
+			return clientReply{}, s.err
+		case <-s.pending.evicted:
+			s.err = errPendingEvicted
+			return clientReply{}, s.err
+		case <-s.pending.overrun:
+			s.err = errStreamOverrun
+			return clientReply{}, s.err
+		case <-s.client.done:
+			s.err = errStreamInterrupted
+			return clientReply{}, s.err
+		case <-s.client.cancelled:
+			return clientReply{}, s.client.cancelErr
+		}
+	}
+}
+
+// close stops waiting for chunks; chunks still in flight are dropped, and
+// the client is told to stop sending them.
+func (s *replyStream) close() {
+	if !s.finished {
+		s.client.sendCancel(s.requestID, s.err)
+	}
+	s.client.finishPending(s.requestID, s.pending)
+}
+
+// streamResult returns the failure a final chunk reports, if any.
+func (r clientReply) streamResult() error {
+	switch {
+	case r.streamError != "":
+		return fmt.Errorf("%w: %s", errStreamFailed, r.streamError)
+	case r.statusCode() >= 400:
+		return fmt.Errorf("%w: status %d", errStreamFailed, r.statusCode())
+	}
+	return nil
+}
+
+// collect reads the rest of a streamed reply into its body, for callers that
+// need the whole reply at once.
+func (r clientReply) collect() (clientReply, error) {
+	if r.stream == nil {
+		return r, nil
+	}
+	defer r.stream.close()
+
+	body := append([]byte(nil), r.Body...)
+	for {
+		chunk, err := r.stream.read()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = chunk.streamResult()
+		}
+		if err != nil {
+			return clientReply{}, err
+		}
+		body = append(body, chunk.Body...)
+	}
+	return clientReply{Status: r.Status, Headers: r.Headers, Body: body}, nil
+}
+
+// writeStream sends a streamed reply to the caller chunk by chunk. By the
+// time the stream ends, the status line and headers are long gone, so how
+// it ended can only follow the body: X-Stream-Status and, on failure,
+// X-Stream-Error are sent as HTTP trailers, declared in the Trailer header
+// up front, along with any trailers the client put on its final chunk.
+//
+// Trailers are part of every HTTP/2 response, so HTTP/2 callers always get
+// them. Over HTTP/1.1 they need a caller that reads them, so failures are
+// only reported that way to callers that send "TE: trailers". For other
+// HTTP/1.1 callers a failed event stream ends with an in-band error event,
+//
+//	event: error
+//	data: {"status":502,"error":"..."}
+//
+// and any other failed stream has its connection aborted, which keeps a
+// truncated body from passing as complete. A stream whose client
+// disconnected mid-way fails the same way, as soon as the connection's
+// reader notices, unless -stream-disconnect is end: then such callers have
+// the response ended normally instead, for those that would rather keep a
+// truncated body than lose it, and the proxy logs it as truncated.
+func (s *Server) writeStream(w http.ResponseWriter, r *http.Request, reply clientReply) {
+	defer reply.stream.close()
+	if deadline, ok := budgetDeadline(r); ok {
+		reply.stream.deadline = deadline
+	}
+
+	rewrites := s.rewritesFor(reply)
+	if rewrites != nil {
+		reply.Headers = withoutContentLength(reply.Headers)
+	}
+	for name, value := range reply.Headers {
+		w.Header().Set(name, value)
+	}
+	events := acceptsEventStream(r) && !isEventStream(w.Header().Get("Content-Type"))
+	if events {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Del("Content-Length")
+	}
+	w.Header().Set("Trailer", "X-Stream-Status, X-Stream-Error")
+	w.WriteHeader(reply.statusCode())
+
+	clientID := reply.stream.client.ID
+	trailers := r.ProtoMajor >= 2 || acceptsTrailers(r)
+	rc := http.NewResponseController(w)
+	chunk := reply
+	var held []byte
+	for {
+		if rewrites != nil {
+			// Events are rewritten each on its own; raw chunks hold back a
+			// possible match that continues in the next one.
+			chunk.Body, held = rewrites.rewrite(append(held, chunk.Body...), events || chunk.final)
+		}
+		var err error
+		release := s.holdReplyBytes(r, len(chunk.Body))
+		switch {
+		case !events:
+			_, err = w.Write(chunk.Body)
+		case len(chunk.Body) > 0:
+			err = writeEvent(w, strconv.Itoa(chunk.seq), "message", chunk.Body)
+		}
+		release()
+		if err == nil {
+			if err = rc.Flush(); errors.Is(err, http.ErrNotSupported) {
+				err = nil
+			}
+		}
+		if err != nil {
+			// The caller is gone or too slow; stop reading the stream.
+			log.Printf("Stream from client %s abandoned: %v", clientID, err)
+			return
+		}
+		if chunk.final {
+			break
+		}
+
+		s.extendWriteDeadline(w, reply.stream.timeout)
+		if chunk, err = reply.stream.read(); err != nil {
+			end := errors.Is(err, errStreamInterrupted) && s.currentConfig().StreamDisconnect == "end"
+			failStream(w, clientID, trailers, events, queryErrorStatus(err), err, end)
+			return
+		}
+	}
+
+	for name, value := range chunk.trailers {
+		w.Header().Set(http.TrailerPrefix+name, value)
+	}
+	if err := chunk.streamResult(); err != nil {
+		status := chunk.statusCode()
+		if status < 400 {
+			status = http.StatusBadGateway
+		}
+		failStream(w, clientID, trailers, events, status, err, false)
+		return
+	}
+	w.Header().Set("X-Stream-Status", strconv.Itoa(http.StatusOK))
+	if events {
+		data, _ := json.Marshal(struct {
+			Status   int               `json:"status"`
+			Trailers map[string]string `json:"trailers,omitempty"`
+		}{
+			Status:   http.StatusOK,
+			Trailers: chunk.trailers,
+		})
+		fmt.Fprintf(w, "event: end\ndata: %s\n\n", data)
+	}
+}
+
+// failStream reports a stream's failure to the caller. A stream of events the
+// proxy frames itself always ends with the error event, trailers or not. A
+// plain stream is aborted, unless end says to end it normally.
+func failStream(w http.ResponseWriter, clientID string, trailers, events bool, status int, err error, end bool) {
+	log.Printf("Stream from client %s failed: %v", clientID, err)
+	if trailers {
+		w.Header().Set("X-Stream-Status", strconv.Itoa(status))
+		w.Header().Set("X-Stream-Error", err.Error())
+	}
+	switch {
+	case trailers && !events:
+	case events || isEventStream(w.Header().Get("Content-Type")):
+		data, _ := json.Marshal(struct {
+			Status int    `json:"status"`
+			Error  string `json:"error"`
+		}{
+			Status: status,
+			Error:  err.Error(),
+		})
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+	case end:
+		log.Printf("Ended the truncated stream from client %s normally, as -stream-disconnect is end", clientID)
+	default:
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func isEventStream(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream")
+}
+
+// acceptsEventStream reports whether the caller asked for server-sent events.
+func acceptsEventStream(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if isEventStream(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeEvent writes one server-sent event. Text spanning several lines
+// becomes several data lines, which the receiver joins back with newlines.
+func writeEvent(w io.Writer, id, event string, data []byte) error {
+	var b strings.Builder
+	if id != "" {
+		b.WriteString("id: " + id + "\n")
+	}
+	b.WriteString("event: " + event + "\n")
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		b.WriteString("data: ")
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// acceptsTrailers reports whether the caller said it reads trailers.
+func acceptsTrailers(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("TE"), ",") {
+		coding, _, _ := strings.Cut(part, ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func chunkMessage(t *testing.T, requestID string, seq int, final bool, body string) []byte {
+	t.Helper()
+	data, err := json.Marshal(replyMessage{RequestID: requestID, Type: "chunk", Seq: seq, Final: final, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStreamedChunksArriveInSequence(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	result := goGet(ts.URL+"/query/db-1", nil)
+	query := client.readQuery()
+	for _, seq := range []int{1, 0, 3, 2} {
+		client.conn.WriteMessage(websocket.TextMessage, chunkMessage(t, query.RequestID, seq, seq == 3, fmt.Sprintf("<%d>", seq)))
+	}
+
+	if r := <-result; r.status != http.StatusOK || r.body != "<0><1><2><3>" {
+		t.Fatalf("got %d %q %v, want the chunks in sequence", r.status, r.body, r.err)
+	}
+}
+
+func TestOverrunStreamDoesNotStallTheReader(t *testing.T) {
+	s, _ := newTestServer(t, "-chunk-reorder-window", "2")
+	client := &Client{ID: "db-1", pending: make(map[string]*pendingQuery), server: s}
+	slow := client.addPending("slow")
+	other := client.addPending("other")
+
+	// Nobody reads slow's chunks, as with a caller that has stopped
+	// reading its response.
+	var chunks [][]byte
+	for seq := 0; seq < 10; seq++ {
+		chunks = append(chunks, chunkMessage(t, "slow", seq, false, "x"))
+	}
+	delivered := make(chan struct{})
+	go func() {
+		for _, chunk := range chunks {
+			client.deliverReply(websocket.TextMessage, chunk)
+		}
+		client.deliverReply(websocket.TextMessage, []byte(`{"request_id":"other","body":"answer"}`))
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the reader blocked on a stream whose caller stopped reading")
+	}
+
+	select {
+	case <-slow.overrun:
+	default:
+		t.Error("the overrun stream was not failed")
+	}
+	select {
+	case reply := <-other.replies:
+		if string(reply.Body) != "answer" {
+			t.Errorf("other query got %q, want its reply", reply.Body)
+		}
+	default:
+		t.Error("the other query's reply was not delivered")
+	}
+}
+
+// streamTwoChunks starts a query for db-1 with header from caller and answers
+// it as a stream of two chunks, the second final and carrying end.
+func streamTwoChunks(t *testing.T, caller *http.Client, client *testClient, url string, header http.Header, end replyMessage) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header = header
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := caller.Do(req)
+		done <- result{resp, err}
+	}()
+	query := client.readQuery()
+	client.reply(replyMessage{RequestID: query.RequestID, Type: "chunk", Seq: 0, Body: "part one"})
+	end.RequestID, end.Type, end.Seq, end.Final = query.RequestID, "chunk", 1, true
+	client.reply(end)
+
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("GET %s: %v", url, r.err)
+	}
+	t.Cleanup(func() { r.resp.Body.Close() })
+	return r.resp
+}
+
+func TestStreamEndReachesTheCallerAsTrailers(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	te := http.Header{"Te": {"trailers"}}
+
+	resp := streamTwoChunks(t, http.DefaultClient, client, ts.URL+"/query/db-1?q=ok", te, replyMessage{Trailers: map[string]string{"X-Rows": "20"}})
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "part one" {
+		t.Fatalf("read %q, %v", body, err)
+	}
+	if resp.Trailer.Get("X-Stream-Status") != "200" || resp.Trailer.Get("X-Rows") != "20" {
+		t.Errorf("successful stream ended with trailers %v", resp.Trailer)
+	}
+
+	resp = streamTwoChunks(t, http.DefaultClient, client, ts.URL+"/query/db-1?q=failed", te, replyMessage{Status: http.StatusInternalServerError, Error: "backend went away"})
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "part one" {
+		t.Fatalf("read %q, %v", body, err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Trailer.Get("X-Stream-Status") != "500" || !strings.Contains(resp.Trailer.Get("X-Stream-Error"), "backend went away") {
+		t.Errorf("failed stream got %s with trailers %v, want the failure in the trailers", resp.Status, resp.Trailer)
+	}
+}
+
+func TestFailedStreamWithoutTrailersIsAborted(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+
+	resp := streamTwoChunks(t, http.DefaultClient, client, ts.URL+"/query/db-1", nil, replyMessage{Error: "backend went away"})
+	if body, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("failed stream read as complete: %q", body)
+	}
+}
+
+func TestFailedEventStreamEndsWithAnErrorEvent(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+
+	resp := streamTwoChunks(t, http.DefaultClient, client, ts.URL+"/query/db-1", http.Header{"Accept": {"text/event-stream"}}, replyMessage{Error: "backend went away"})
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "id: 0\nevent: message\ndata: part one\n\nevent: error\ndata: {\"status\":502,\"error\":\"client reported the stream failed: backend went away\"}\n\n"
+	if string(body) != want {
+		t.Errorf("event stream got %q, want %q", body, want)
+	}
+}
+
+func TestStreamEndReachesHTTP2CallersAsTrailers(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	h2 := httptest.NewUnstartedServer(s.Handler())
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	// HTTP/2 callers get trailers without asking for them.
+	resp := streamTwoChunks(t, h2.Client(), client, h2.URL+"/query/db-1", nil, replyMessage{Status: http.StatusServiceUnavailable, Error: "backend went away", Trailers: map[string]string{"X-Rows": "1"}})
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "part one" {
+		t.Fatalf("read %q, %v", body, err)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("caller spoke %s, want HTTP/2", resp.Proto)
+	}
+	if resp.Trailer.Get("X-Stream-Status") != "503" || resp.Trailer.Get("X-Stream-Error") == "" || resp.Trailer.Get("X-Rows") != "1" {
+		t.Errorf("HTTP/2 stream ended with trailers %v, want the client's status and trailers", resp.Trailer)
+	}
+}
+
+func TestStreamReachesEventStreamCallersAsEvents(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	accept := http.Header{"Accept": {"text/html, text/event-stream;q=0.9"}}
+
+	resp := streamTwoChunks(t, http.DefaultClient, client, ts.URL+"/query/db-1?q=ok", accept, replyMessage{Body: "two\nlines", Trailers: map[string]string{"X-Rows": "20"}})
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("got Content-Type %q, want text/event-stream", resp.Header.Get("Content-Type"))
+	}
+	want := "id: 0\nevent: message\ndata: part one\n\nid: 1\nevent: message\ndata: two\ndata: lines\n\nevent: end\ndata: {\"status\":200,\"trailers\":{\"X-Rows\":\"20\"}}\n\n"
+	if string(body) != want {
+		t.Errorf("event stream got %q, want %q", body, want)
+	}
+}
+
+func TestClientEventStreamPassesThrough(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	accept := http.Header{"Accept": {"text/event-stream"}}
+
+	done := goGet(ts.URL+"/query/db-1", accept)
+	query := client.readQuery()
+	client.reply(replyMessage{RequestID: query.RequestID, Type: "chunk", Seq: 0, Headers: map[string]string{"Content-Type": "text/event-stream"}, Body: "data: a\n\n"})
+	client.reply(replyMessage{RequestID: query.RequestID, Type: "chunk", Seq: 1, Final: true, Body: "data: b\n\n"})
+	if result := <-done; result.err != nil || string(result.body) != "data: a\n\ndata: b\n\n" {
+		t.Errorf("client's own event stream got %q, %v, want it unchanged", result.body, result.err)
+	}
+}
+
+func TestPlainReplyIgnoresEventStreamAccept(t *testing.T) {
+	s, ts := newTestServer(t)
+	connectClient(t, s, ts, "db-1").echo("plain")
+
+	resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, http.Header{"Accept": {"text/event-stream"}})
+	if string(body) != "plain" || resp.Header.Get("Content-Type") == "text/event-stream" {
+		t.Errorf("plain reply got %q as %q", body, resp.Header.Get("Content-Type"))
+	}
+}
+
+// streamThenDisconnect starts a query for db-1 with header, answers it with
+// one chunk and then disconnects the client.
+func streamThenDisconnect(t *testing.T, client *testClient, url string, header http.Header) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header = header
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		done <- result{resp, err}
+	}()
+	query := client.readQuery()
+	client.reply(replyMessage{RequestID: query.RequestID, Type: "chunk", Seq: 0, Body: "part one"})
+
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("GET %s: %v", url, r.err)
+	}
+	t.Cleanup(func() { r.resp.Body.Close() })
+	client.conn.Close()
+	return r.resp
+}
+
+func TestMidStreamDisconnectReachesTheCallerAsTrailers(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+
+	resp := streamThenDisconnect(t, client, ts.URL+"/query/db-1", http.Header{"Te": {"trailers"}})
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "part one" {
+		t.Fatalf("read %q, %v", body, err)
+	}
+	if resp.Trailer.Get("X-Stream-Status") != "502" || resp.Trailer.Get("X-Stream-Error") != errStreamInterrupted.Error() {
+		t.Errorf("interrupted stream ended with trailers %v", resp.Trailer)
+	}
+}
+
+func TestMidStreamDisconnectAbortsByDefault(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+
+	resp := streamThenDisconnect(t, client, ts.URL+"/query/db-1", nil)
+	if body, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("interrupted stream read as complete: %q", body)
+	}
+}
+
+func TestMidStreamDisconnectEndsTheStreamWhenAsked(t *testing.T) {
+	s, ts := newTestServer(t, "-stream-disconnect", "end")
+	client := connectClient(t, s, ts, "db-1")
+
+	resp := streamThenDisconnect(t, client, ts.URL+"/query/db-1", nil)
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "part one" {
+		t.Errorf("interrupted stream read %q, %v, want it truncated and ended", body, err)
+	}
+	if _, err := LoadConfig([]string{"-stream-disconnect", "retry"}); err == nil {
+		t.Error("-stream-disconnect retry accepted")
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Callers that want a client's unsolicited messages as they arrive, rather
+// than the latest one from the cache, can subscribe with GET
+// /subscribe/{clientID}. The response is a stream of server-sent events, one
+// per message the client pushes from then on, on any of its connections:
+//
+//	event: push
+//	data: {"price":101.5}
+//
+// Binary messages are sent base64-encoded as event: binary. The stream
+// outlives the client's connections, so a subscriber keeps receiving across
+// reconnects, and a comment line goes out every subscribeKeepalive so
+// intermediaries don't time it out. Pushes are still cached as before.
+//
+// A subscriber that falls pushBufferSize messages behind is dropped, its
+// stream ended, so a slow reader never holds up the client's connection; it
+// can subscribe again. At most -max-subscribers streams are open per client
+// ID, and more get 503.
+
+const (
+	pushBufferSize     = 64
+	subscribeKeepalive = 30 * time.Second
+)
+
+type pushMessage struct {
+	messageType int
+	data        []byte
+}
+
+// pushSubscriptions are the open /subscribe streams of each client ID.
+type pushSubscriptions struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[chan pushMessage]struct{}
+}
+
+func newPushSubscriptions() *pushSubscriptions {
+	return &pushSubscriptions{subscribers: make(map[string]map[chan pushMessage]struct{})}
+}
+
+// subscribe returns a channel of clientID's pushes, or nil if it already
+// has limit subscribers. A limit of 0 means no limit.
+func (p *pushSubscriptions) subscribe(clientID string, limit int) chan pushMessage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	set := p.subscribers[clientID]
+	if limit > 0 && len(set) >= limit {
+		return nil
+	}
+	if set == nil {
+		set = make(map[chan pushMessage]struct{})
+		p.subscribers[clientID] = set
+	}
+	ch := make(chan pushMessage, pushBufferSize)
+	set[ch] = struct{}{}
+	return ch
+}
+
+func (p *pushSubscriptions) unsubscribe(clientID string, ch chan pushMessage) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.removeLocked(clientID, ch)
+}
+
+func (p *pushSubscriptions) removeLocked(clientID string, ch chan pushMessage) {
+	set := p.subscribers[clientID]
+	if _, ok := set[ch]; !ok {
+		return
+	}
+	delete(set, ch)
+	close(ch)
+	if len(set) == 0 {
+		delete(p.subscribers, clientID)
+	}
+}
+
+// publish hands message to each of clientID's subscribers without waiting,
+// dropping those whose buffer is full.
+func (p *pushSubscriptions) publish(clientID string, message pushMessage) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for ch := range p.subscribers[clientID] {
+		select {
+		case ch <- message:
+		default:
+			p.removeLocked(clientID, ch)
+			log.Printf("Dropped slow push subscriber of client %s", clientID)
+		}
+	}
+}
+
+func (p *pushSubscriptions) count() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	n := 0
+	for _, set := range p.subscribers {
+		n += len(set)
+	}
+	return n
+}
+
+func (s *Server) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := s.pushSubscriptions.subscribe(clientID, s.currentConfig().MaxSubscribers)
+	if ch == nil {
+		writeTransient(w, "too many subscribers for this client", http.StatusServiceUnavailable, defaultRetryAfter)
+		return
+	}
+	defer s.pushSubscriptions.unsubscribe(clientID, ch)
+
+	clearWriteDeadline(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(subscribeKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case message, ok := <-ch:
+			if !ok {
+				return
+			}
+			writePushEvent(w, message)
+			flusher.Flush()
+		}
+	}
+}
+
+// writePushEvent writes message as one server-sent event.
+func writePushEvent(w http.ResponseWriter, message pushMessage) {
+	if message.messageType == websocket.BinaryMessage {
+		fmt.Fprintf(w, "event: binary\ndata: %s\n\n", base64.StdEncoding.EncodeToString(message.data))
+		return
+	}
+	writeEvent(w, "", "push", message.data)
+}
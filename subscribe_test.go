@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// subscribe opens a /subscribe stream of clientID and returns its events,
+// each the event line and data line joined by a newline.
+func subscribe(t *testing.T, s *Server, ts *httptest.Server, clientID string) <-chan string {
+	t.Helper()
+	before := s.pushSubscriptions.count()
+	resp, err := http.Get(ts.URL + "/subscribe/" + clientID)
+	if err != nil {
+		t.Fatalf("GET /subscribe: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /subscribe got %s %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	waitFor(t, "the push subscription", func() bool { return s.pushSubscriptions.count() > before })
+
+	events := make(chan string, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var event string
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = line
+			case strings.HasPrefix(line, "data: "):
+				events <- event + "\n" + line
+			}
+		}
+	}()
+	return events
+}
+
+func nextPush(t *testing.T, events <-chan string) string {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a push")
+		return ""
+	}
+}
+
+func (c *testClient) push(messageType int, data string) {
+	c.t.Helper()
+	if err := c.conn.WriteMessage(messageType, []byte(data)); err != nil {
+		c.t.Fatalf("push: %v", err)
+	}
+}
+
+func TestSubscribeStreamsPushes(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "ticker")
+	events := subscribe(t, s, ts, "ticker")
+
+	client.push(websocket.TextMessage, `{"price":101.5}`)
+	if got, want := nextPush(t, events), "event: push\ndata: {\"price\":101.5}"; got != want {
+		t.Errorf("got event %q, want %q", got, want)
+	}
+	client.push(websocket.BinaryMessage, "\x00\x01")
+	if got, want := nextPush(t, events), "event: binary\ndata: AAE="; got != want {
+		t.Errorf("got event %q, want %q", got, want)
+	}
+}
+
+func TestSubscriptionOutlivesConnections(t *testing.T) {
+	s, ts := newTestServer(t)
+	first := connectClient(t, s, ts, "ticker")
+	events := subscribe(t, s, ts, "ticker")
+
+	first.conn.Close()
+	waitFor(t, "the first connection to go", func() bool { return s.connectionCount("ticker") == 0 })
+	connectClient(t, s, ts, "ticker").push(websocket.TextMessage, "after")
+	if got := nextPush(t, events); got != "event: push\ndata: after" {
+		t.Errorf("got event %q across the reconnect", got)
+	}
+}
+
+func TestMaxSubscribers(t *testing.T) {
+	s, ts := newTestServer(t, "-max-subscribers", "1")
+	subscribe(t, s, ts, "ticker")
+
+	resp, _ := do(t, "GET", ts.URL+"/subscribe/ticker", nil, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("second subscriber got %s, want 503 with Retry-After", resp.Status)
+	}
+	// The limit is per client ID.
+	subscribe(t, s, ts, "news")
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	p := newPushSubscriptions()
+	ch := p.subscribe("ticker", 0)
+	for i := 0; i <= pushBufferSize; i++ {
+		p.publish("ticker", pushMessage{messageType: websocket.TextMessage, data: []byte("x")})
+	}
+	if p.count() != 0 {
+		t.Fatal("subscriber a full buffer behind wasn't dropped")
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != pushBufferSize {
+		t.Errorf("dropped subscriber's channel had %d messages, want the %d buffered", n, pushBufferSize)
+	}
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Synthetic mode is a load-testing aid, not something to run in production.
+// With -synthetic-clients set, the server starts as usual and then spins up
+// that many in-process fake clients, named synthetic-0, synthetic-1, ...,
+// which register, connect and answer every query. It then sends
+// -synthetic-queries GET queries through the normal HTTP path from
+// -synthetic-concurrency workers, logs throughput and latency, and exits.
+//
+// Fake clients answer with Cache-Control: no-store so every query makes the
+// full round trip. Registrations go through the usual per-IP rate limit, so
+// with -register-rate set, raise it for large client counts.
+
+type syntheticStats struct {
+	latencies []time.Duration
+	errors    int
+	elapsed   time.Duration
+}
+
+func (s *Server) runSynthetic(cfg *Config) {
+	httpBase, httpClient := s.syntheticEndpoints(cfg)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+	ids := make([]string, cfg.SyntheticClients)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("synthetic-%d", i)
+		connectionURL, err := syntheticRegister(httpClient, httpBase, ids[i])
+		if err != nil {
+			log.Fatalf("Synthetic client %s failed to register: %v", ids[i], err)
+		}
+		conn, _, err := dialer.Dial(connectionURL, nil)
+		if err != nil {
+			log.Fatalf("Synthetic client %s failed to connect: %v", ids[i], err)
+		}
+		if cfg.ConnectionAuthKey != "" {
+			if err := syntheticAuthenticate(conn, ids[i], cfg.ConnectionAuthKey); err != nil {
+				log.Fatalf("Synthetic client %s failed to authenticate: %v", ids[i], err)
+			}
+		}
+		if cfg.HandshakeTimeout > 0 {
+			caps, _ := json.Marshal(clientCapabilities{Type: "capabilities", Version: "synthetic"})
+			if err := conn.WriteMessage(websocket.TextMessage, caps); err != nil {
+				log.Fatalf("Synthetic client %s failed to send its capabilities: %v", ids[i], err)
+			}
+		}
+		go syntheticEcho(conn)
+	}
+	log.Printf("Synthetic mode: %d clients connected", len(ids))
+
+	stats := syntheticLoad(httpClient, httpBase, ids, cfg.SyntheticQueries, cfg.SyntheticConcurrency)
+	stats.report()
+	os.Exit(0)
+}
+
+// listenHost is the host:port the fake clients use to reach this server.
+func listenHost(cfg *Config) string {
+	host, port, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		log.Fatalf("Synthetic mode can't use -addr %q: %v", cfg.Addr, err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (s *Server) syntheticEndpoints(cfg *Config) (base string, client *http.Client) {
+	host := listenHost(cfg)
+	client = &http.Client{Timeout: time.Minute}
+	if cfg.TLSCert != "" {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		return "https://" + host + s.basePath, client
+	}
+	return "http://" + host + s.basePath, client
+}
+
+// syntheticRegister registers clientID and returns its connection URL, which
+// points back at base and carries any registration token. It waits for the
+// listener to come up and for the registration rate limit.
+func syntheticRegister(client *http.Client, base, clientID string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"client_id": clientID})
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Post(base+"/register", "application/json", bytes.NewReader(body))
+		if err != nil {
+			if attempt < 50 {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return "", err
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			var registered struct {
+				ConnectionURL string `json:"connection_url"`
+			}
+			if err := json.Unmarshal(data, &registered); err != nil {
+				return "", err
+			}
+			return registered.ConnectionURL, nil
+		case http.StatusTooManyRequests:
+			time.Sleep(time.Second)
+		default:
+			return "", fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+		}
+	}
+}
+
+// syntheticAuthenticate answers the proxy's connection challenge on conn.
+func syntheticAuthenticate(conn *websocket.Conn, clientID, key string) error {
+	var challenge struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := conn.ReadJSON(&challenge); err != nil {
+		return err
+	}
+	return conn.WriteJSON(challengeResponse{
+		Type:      "challenge_response",
+		Signature: challengeSignature(key, challenge.Nonce, clientID),
+	})
+}
+
+// syntheticEcho answers every query on conn until it closes.
+func syntheticEcho(conn *websocket.Conn) {
+	defer conn.Close()
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var query queryMessage
+		if json.Unmarshal(message, &query) != nil || query.Type != "query" {
+			continue
+		}
+		reply, _ := json.Marshal(replyMessage{
+			RequestID: query.RequestID,
+			Headers:   map[string]string{"Cache-Control": "no-store"},
+			Body:      "ok",
+		})
+		if err := conn.WriteMessage(websocket.TextMessage, reply); err != nil {
+			return
+		}
+	}
+}
+
+// syntheticLoad sends total queries spread over ids from concurrency workers.
+func syntheticLoad(client *http.Client, base string, ids []string, total, concurrency int) syntheticStats {
+	var (
+		next  atomic.Int64
+		mu    sync.Mutex
+		stats syntheticStats
+		wg    sync.WaitGroup
+	)
+
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := int(next.Add(1)) - 1
+				if n >= total {
+					return
+				}
+
+				queryStart := time.Now()
+				resp, err := client.Get(base + "/query/" + ids[n%len(ids)])
+				ok := err == nil && resp.StatusCode == http.StatusOK
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				latency := time.Since(queryStart)
+
+				mu.Lock()
+				if ok {
+					stats.latencies = append(stats.latencies, latency)
+				} else {
+					stats.errors++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	stats.elapsed = time.Since(start)
+	return stats
+}
+
+func (s syntheticStats) report() {
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(s.latencies) == 0 {
+			return 0
+		}
+		return s.latencies[int(p*float64(len(s.latencies)-1))]
+	}
+
+	ok := len(s.latencies)
+	log.Printf("Synthetic run: %d queries, %d errors in %s (%.0f queries/s)",
+		ok+s.errors, s.errors, s.elapsed, float64(ok+s.errors)/s.elapsed.Seconds())
+	log.Printf("Synthetic latency: p50 %s, p90 %s, p99 %s, max %s",
+		percentile(0.50), percentile(0.90), percentile(0.99), percentile(1))
+}
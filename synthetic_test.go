@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSyntheticClientsRegisterAndAnswer(t *testing.T) {
+	s, ts := newTestServer(t)
+	ids := []string{"synthetic-0", "synthetic-1"}
+	for _, id := range ids {
+		connectionURL, err := syntheticRegister(http.DefaultClient, ts.URL, id)
+		if err != nil {
+			t.Fatalf("registering %s: %v", id, err)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(connectionURL, nil)
+		if err != nil {
+			t.Fatalf("connecting %s: %v", id, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		go syntheticEcho(conn)
+		waitFor(t, "the synthetic client to connect", func() bool { return s.connectionCount(id) == 1 })
+	}
+
+	stats := syntheticLoad(http.DefaultClient, ts.URL, ids, 20, 4)
+	if stats.errors != 0 || len(stats.latencies) != 20 {
+		t.Errorf("synthetic run had %d errors and %d answers, want 20 answers", stats.errors, len(stats.latencies))
+	}
+	s.cacheMutex.RLock()
+	defer s.cacheMutex.RUnlock()
+	if len(s.cache) != 0 {
+		t.Errorf("%d synthetic replies were cached, want every query to reach its client", len(s.cache))
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// A client that expects its own command format instead of queryMessage can
+// register a query_template, any JSON value whose strings may refer to
+// variables of the query:
+//
+//	{"cmd":"fetch","path":"$path","args":"$query","id":"$request_id","ts":"$now"}
+//
+//	$path        the request path
+//	$query       the query parameters, URL-encoded
+//	$method      the request method
+//	$body        the request body
+//	$request_id  the query's request ID
+//	$caller_ip   the caller's address; see clientIP
+//	$now         the time the query is sent, in RFC 3339
+//
+// Variables are substituted inside strings, object keys included, so the
+// rendered command is always valid JSON. The template is checked at
+// registration; an unknown variable is refused. Replies are matched as
+// usual, so a template without $request_id gets raw, in-order matching.
+
+var templateVariable = regexp.MustCompile(`\$[a-z_]+`)
+
+var templateVariables = map[string]func(q queryMessage) string{
+	"$path":       func(q queryMessage) string { return q.path },
+	"$query":      func(q queryMessage) string { return url.Values(q.Params).Encode() },
+	"$method":     func(q queryMessage) string { return q.Method },
+	"$body":       func(q queryMessage) string { return q.Body },
+	"$request_id": func(q queryMessage) string { return q.RequestID },
+	"$caller_ip":  func(q queryMessage) string { return q.CallerIP },
+	"$now":        func(q queryMessage) string { return time.Now().UTC().Format(time.RFC3339Nano) },
+}
+
+// parseQueryTemplate checks a registered template and returns it parsed.
+func parseQueryTemplate(raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var template interface{}
+	if err := json.Unmarshal(raw, &template); err != nil {
+		return nil, err
+	}
+
+	var err error
+	walkTemplate(template, func(s string) string {
+		for _, name := range templateVariable.FindAllString(s, -1) {
+			if _, ok := templateVariables[name]; !ok && err == nil {
+				err = fmt.Errorf("unknown variable %s", name)
+			}
+		}
+		return s
+	})
+	return template, err
+}
+
+func (s *Server) queryTemplate(clientID string) interface{} {
+	s.registrationsMutex.RLock()
+	defer s.registrationsMutex.RUnlock()
+	return s.registrations[clientID].QueryTemplate
+}
+
+// renderQuery encodes query the way clientID asked for at registration, or
+// as a queryMessage if it registered no template. Commands are always sent
+// as they are.
+func (s *Server) renderQuery(clientID string, query queryMessage) ([]byte, error) {
+	if query.command != nil {
+		return json.Marshal(commandMessage{Type: "command", RequestID: query.RequestID, Command: query.command})
+	}
+	template := s.queryTemplate(clientID)
+	if template == nil {
+		return json.Marshal(query)
+	}
+	rendered := walkTemplate(template, func(s string) string {
+		return templateVariable.ReplaceAllStringFunc(s, func(name string) string {
+			return templateVariables[name](query)
+		})
+	})
+	return json.Marshal(rendered)
+}
+
+// walkTemplate returns a copy of v with every string, keys included, passed
+// through f.
+func walkTemplate(v interface{}, f func(string) string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return f(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = walkTemplate(item, f)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			out[f(key)] = walkTemplate(item, f)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQueryTemplateIsRendered(t *testing.T) {
+	s, ts := newTestServer(t)
+	registered := register(t, ts, map[string]any{
+		"client_id":      "db-1",
+		"query_template": map[string]any{"cmd": "fetch", "at": "$path?$query", "$method": "$body", "id": "$request_id", "ts": "$now"},
+	})
+	client := connectRegistered(t, s, registered, "db-1")
+	result := goPost(ts.URL+"/query/db-1?q=x", "payload", nil)
+
+	var command map[string]string
+	if err := json.Unmarshal(client.read(), &command); err != nil {
+		t.Fatalf("rendered command isn't JSON: %v", err)
+	}
+	if command["cmd"] != "fetch" || command["at"] != "/query/db-1?q=x" || command["POST"] != "payload" || command["id"] == "" {
+		t.Errorf("rendered command %v", command)
+	}
+	if sent, err := time.Parse(time.RFC3339Nano, command["ts"]); err != nil || time.Since(sent) > time.Minute {
+		t.Errorf("$now rendered as %q", command["ts"])
+	}
+
+	client.reply(replyMessage{RequestID: command["id"], Body: "answer"})
+	if r := <-result; r.status != http.StatusOK || r.body != "answer" {
+		t.Errorf("templated query got %d %q, want its answer", r.status, r.body)
+	}
+}
+
+func TestQueryTemplateIsCheckedAtRegistration(t *testing.T) {
+	_, ts := newTestServer(t)
+	resp, body := do(t, "POST", ts.URL+"/register", map[string]any{"client_id": "db-1", "query_template": map[string]any{"cmd": "$nonsense"}}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("template with an unknown variable got %s: %s, want 400", resp.Status, body)
+	}
+}
+
+func TestQueryTemplateRendersTheCallerIP(t *testing.T) {
+	s, ts := newTestServer(t)
+	registered := register(t, ts, map[string]any{"client_id": "db-1", "query_template": map[string]any{"from": "$caller_ip", "id": "$request_id"}})
+	client := connectRegistered(t, s, registered, "db-1")
+	result := goGet(ts.URL+"/query/db-1", nil)
+
+	var command map[string]string
+	if err := json.Unmarshal(client.read(), &command); err != nil || command["from"] != "127.0.0.1" {
+		t.Errorf("rendered command %v, %v, want the caller's address", command, err)
+	}
+	client.reply(replyMessage{RequestID: command["id"]})
+	<-result
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Clients may name a tenant when they register. With
+// -max-connections-per-tenant set, a tenant's connections across all its
+// client IDs are capped so one tenant can't take every connection the
+// server has room for. Clients without a tenant aren't limited.
+//
+// A connection over the cap is refused with 503 at once, unless
+// -tenant-connection-wait is set: then /connect holds it for up to that long
+// in case one of the tenant's connections closes meanwhile, as happens when
+// clients churn, and only refuses it if none does or the caller gives up.
+
+// reserveTenantConnection counts a connection against tenant before the
+// upgrade, waiting up to -tenant-connection-wait for room and reporting
+// false if the tenant stays at its cap. A successful reservation is
+// released by removeClientLocked once the connection is gone, or by
+// releaseTenantConnection if the upgrade fails.
+func (s *Server) reserveTenantConnection(ctx context.Context, tenant string) bool {
+	if tenant == "" {
+		return true
+	}
+
+	cfg := s.currentConfig()
+	var timeout <-chan time.Time
+	start := time.Now()
+	for {
+		s.clientsMutex.Lock()
+		if cfg.MaxConnectionsPerTenant <= 0 || s.tenantConnections[tenant] < cfg.MaxConnectionsPerTenant {
+			s.tenantConnections[tenant]++
+			s.clientsMutex.Unlock()
+			if timeout != nil {
+				log.Printf("Tenant %s connection admitted after waiting %s", tenant, time.Since(start).Round(time.Millisecond))
+			}
+			return true
+		}
+		freed := s.tenantConnectionFreed
+		s.clientsMutex.Unlock()
+
+		if cfg.TenantConnectionWait <= 0 {
+			return false
+		}
+		if timeout == nil {
+			timer := time.NewTimer(cfg.TenantConnectionWait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-freed:
+		case <-timeout:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (s *Server) releaseTenantConnection(tenant string) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	s.releaseTenantConnectionLocked(tenant)
+}
+
+func (s *Server) releaseTenantConnectionLocked(tenant string) {
+	if tenant == "" {
+		return
+	}
+	if s.tenantConnections[tenant]--; s.tenantConnections[tenant] <= 0 {
+		delete(s.tenantConnections, tenant)
+	}
+	// Wake every waiting connection; each checks its own tenant.
+	close(s.tenantConnectionFreed)
+	s.tenantConnectionFreed = make(chan struct{})
+}
+
+func writeTenantLimited(w http.ResponseWriter) {
+	writeTransient(w, "tenant connection limit reached", http.StatusServiceUnavailable, 5)
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTenantConnectionsAreCapped(t *testing.T) {
+	s, ts := newTestServer(t, "-max-connections-per-tenant", "1")
+	first := register(t, ts, map[string]any{"client_id": "db-1", "tenant": "acme"})
+	second := register(t, ts, map[string]any{"client_id": "db-2", "tenant": "acme"})
+	client := connectRegistered(t, s, first, "db-1")
+
+	if _, resp, err := websocket.DefaultDialer.Dial(second.ConnectionURL, nil); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("connection over the tenant's cap got %v, want 503", err)
+	}
+	// Clients without a tenant aren't limited.
+	connectClient(t, s, ts, "db-3")
+	connectClient(t, s, ts, "db-3")
+
+	client.conn.Close()
+	waitFor(t, "the tenant's connection to be released", func() bool {
+		s.clientsMutex.RLock()
+		defer s.clientsMutex.RUnlock()
+		return s.tenantConnections["acme"] == 0
+	})
+	connectRegistered(t, s, second, "db-2")
+}
+
+func TestTenantConnectionWaitsForRoom(t *testing.T) {
+	s, ts := newTestServer(t, "-max-connections-per-tenant", "1", "-tenant-connection-wait", "5s")
+	first := register(t, ts, map[string]any{"client_id": "db-1", "tenant": "acme"})
+	second := register(t, ts, map[string]any{"client_id": "db-2", "tenant": "acme"})
+	client := connectRegistered(t, s, first, "db-1")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client.conn.Close()
+	}()
+	start := time.Now()
+	connectRegistered(t, s, second, "db-2")
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("second connection admitted after %s, before the first closed", waited)
+	}
+}
+
+func TestTenantConnectionWaitRunsOut(t *testing.T) {
+	s, ts := newTestServer(t, "-max-connections-per-tenant", "1", "-tenant-connection-wait", "100ms")
+	first := register(t, ts, map[string]any{"client_id": "db-1", "tenant": "acme"})
+	second := register(t, ts, map[string]any{"client_id": "db-2", "tenant": "acme"})
+	connectRegistered(t, s, first, "db-1")
+
+	start := time.Now()
+	_, resp, err := websocket.DefaultDialer.Dial(second.ConnectionURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("connection still over the cap after the wait got %v, want 503", err)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("connection refused after %s, before the wait ran out", waited)
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net/url"
+	"strings"
+)
+
+// The cache is partitioned by tenant: the entries of a client registered
+// with a tenant are keyed under the tenant as well as the client ID,
+//
+//	acme/db-1?q=x
+//
+// so a client ID that changes tenants can't be answered with what was
+// cached under the old one, and re-registering with another tenant drops
+// the client's entries. POST /admin/cache/flush/tenant/{tenant} clears the
+// entries of every client of one tenant, and replicas follow it. Clients
+// without a tenant are keyed by client ID alone, as before. Replicas know no
+// registrations, so they learn each client's tenant from the keys the
+// primary sends. The tenant and the client ID are both path-escaped, so a
+// slash or question mark in either can't be taken for a separator and a key
+// always splits back into the tenant and client ID it was made from.
+
+// clientTenant returns the tenant clientID registered with, if any.
+func (s *Server) clientTenant(clientID string) string {
+	s.registrationsMutex.RLock()
+	defer s.registrationsMutex.RUnlock()
+	return s.registrations[clientID].Tenant
+}
+
+// tenantKeyPrefix is what cache keys of tenant's clients start with.
+func tenantKeyPrefix(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	return url.PathEscape(tenant) + "/"
+}
+
+// clientKeyPrefix is what cache keys of clientID, of tenant, start with,
+// up to the query.
+func clientKeyPrefix(tenant, clientID string) string {
+	return tenantKeyPrefix(tenant) + url.PathEscape(clientID)
+}
+
+// splitCacheKey returns the tenant and client ID a cache key belongs to.
+func splitCacheKey(key string) (tenant, clientID string) {
+	head, _, _ := strings.Cut(key, "?")
+	escapedTenant, escapedID, ok := strings.Cut(head, "/")
+	if !ok {
+		escapedTenant, escapedID = "", head
+	}
+	return pathUnescape(escapedTenant), pathUnescape(escapedID)
+}
+
+// pathUnescape unescapes part of a cache key, which cacheKey escaped.
+func pathUnescape(escaped string) string {
+	if unescaped, err := url.PathUnescape(escaped); err == nil {
+		return unescaped
+	}
+	return escaped
+}
+
+// flushTenantCache removes every cached entry of tenant's clients and
+// returns how many there were.
+func (s *Server) flushTenantCache(tenant string) int {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+
+	n := 0
+	for key := range s.cache {
+		if owner, _ := splitCacheKey(key); owner == tenant {
+			s.cacheDelete(key)
+			n++
+		}
+	}
+	s.cacheFeed.publish(cacheUpdate{Op: "flush_tenant", Tenant: tenant})
+	return n
+}
+
+// learnTenant records, on a replica, the tenant of the client a cache key
+// from the primary belongs to, so that its own keys for the client match.
+func (s *Server) learnTenant(key string) {
+	tenant, clientID := splitCacheKey(key)
+	s.registrationsMutex.Lock()
+	defer s.registrationsMutex.Unlock()
+
+	registration, ok := s.registrations[clientID]
+	if ok && registration.Tenant == tenant || !ok && tenant == "" {
+		return
+	}
+	registration.Tenant = tenant
+	s.registrations[clientID] = registration
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheKeysSplitBack(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.registrations["db-1"] = Registration{Tenant: "acme"}
+	s.registrations["a/b?c"] = Registration{Tenant: "x/y"}
+
+	for _, tc := range []struct{ tenant, clientID, query string }{
+		{"acme", "db-1", "q=x"},
+		{"", "acme/db-1", ""},
+		{"x/y", "a/b?c", "q=1"},
+	} {
+		key := s.cacheKey(tc.clientID, tc.query)
+		if tenant, clientID := splitCacheKey(key); tenant != tc.tenant || clientID != tc.clientID {
+			t.Errorf("key %q of client %q split into tenant %q and client %q, want tenant %q", key, tc.clientID, tenant, clientID, tc.tenant)
+		}
+	}
+}
+
+func TestTenantFlushSparesClientIDsWithSlashes(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.registrations["db-1"] = Registration{Tenant: "acme"}
+	entry := ClientResponse{Data: "x", Timestamp: time.Now(), TTL: time.Minute}
+	s.cacheMutex.Lock()
+	s.cacheSet(s.cacheKey("db-1", ""), entry)
+	s.cacheSet(s.cacheKey("acme/db-1", ""), entry)
+	stored := len(s.cache)
+	s.cacheMutex.Unlock()
+
+	if stored != 2 {
+		t.Fatalf("the two clients' entries share a key")
+	}
+	if n := s.flushTenantCache("acme"); n != 1 {
+		t.Errorf("tenant flush dropped %d entries, want only the tenant's client's", n)
+	}
+	if n := s.flushClientCache("db-1"); n != 0 {
+		t.Errorf("client flush dropped %d entries of another client", n)
+	}
+}
+
+func TestReplicaLearnsTenantOfClientIDWithSlash(t *testing.T) {
+	primary, _ := newTestServer(t)
+	replica, _ := newTestServer(t)
+	replica.learnTenant(primary.cacheKey("acme/db-1", "q=x"))
+
+	if tenant := replica.clientTenant("db-1"); tenant != "" {
+		t.Errorf("learned tenant %q for client db-1 from another client's key", tenant)
+	}
+	if tenant := replica.clientTenant("acme/db-1"); tenant != "" {
+		t.Errorf("learned tenant %q for a client without one", tenant)
+	}
+}
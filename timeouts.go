@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// The http.Server times out slow callers with -read-header-timeout,
+// -read-timeout (headers plus body), -write-timeout and -idle-timeout
+// between keep-alive requests. How they apply per endpoint:
+//
+//   - /register, /admin/*, /clients, /metrics: all four, as configured.
+//   - /query: the write timeout only starts counting once the client has
+//     had its chance to answer; see extendWriteDeadline. Streamed replies
+//     get a fresh allowance for every chunk. -slow-read-timeout can cut off
+//     callers that read too slowly sooner; see slowread.go.
+//   - /events: the write timeout is lifted for the life of the stream.
+//   - /connect: the read timeouts cover the upgrade request. The upgrade
+//     clears every deadline on the hijacked connection, so websocket
+//     traffic is governed by pings and the inactivity timeout instead.
+//
+// A zero value turns a timeout off.
+
+// extendWriteDeadline gives the response to the current request another
+// -write-timeout on top of wait, the time it may spend waiting on a client.
+// It is a no-op when the write timeout is off.
+func (s *Server) extendWriteDeadline(w http.ResponseWriter, wait time.Duration) {
+	if s.writeTimeout <= 0 {
+		return
+	}
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + s.writeTimeout))
+}
+
+// clearWriteDeadline lifts the write timeout for a long-lived response.
+func clearWriteDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTimedTestServer is newTestServer behind an http.Server with the
+// timeouts ListenAndServe would give it.
+func newTimedTestServer(t *testing.T, args ...string) (*Server, *httptest.Server) {
+	t.Helper()
+	cfg, err := LoadConfig(append([]string{"-admin-token", testAdminToken}, args...))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ts := httptest.NewUnstartedServer(s.Handler())
+	ts.Config.ReadHeaderTimeout = cfg.ReadHeaderTimeout
+	ts.Config.ReadTimeout = cfg.ReadTimeout
+	ts.Config.WriteTimeout = cfg.WriteTimeout
+	ts.Config.IdleTimeout = cfg.IdleTimeout
+	ts.Start()
+	t.Cleanup(func() {
+		ts.CloseClientConnections()
+		ts.Close()
+	})
+	return s, ts
+}
+
+func TestWriteTimeoutSparesTimeWaitingOnTheClient(t *testing.T) {
+	s, ts := newTimedTestServer(t, "-write-timeout", "200ms")
+	client := connectClient(t, s, ts, "db-1")
+	client.serve(func(queryMessage) replyMessage {
+		time.Sleep(400 * time.Millisecond)
+		return replyMessage{Body: "slow answer"}
+	})
+
+	// The connection outlives the write timeout too, and the query waits
+	// for the slow answer without the response being cut off.
+	time.Sleep(300 * time.Millisecond)
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil); resp.StatusCode != http.StatusOK || string(body) != "slow answer" {
+		t.Errorf("slow query got %s %q, want the answer", resp.Status, body)
+	}
+}
+
+func TestSlowReaderIsCutOff(t *testing.T) {
+	s, ts := newTestServer(t, "-slow-read-timeout", "100ms")
+	connectClient(t, s, ts, "db-1").echo(strings.Repeat("x", 4<<20))
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	fmt.Fprintf(conn, "GET /query/db-1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	// Reading nothing fills the socket buffers and stalls the response.
+	waitFor(t, "the slow reader to be cut off", func() bool {
+		s.metrics.mutex.Lock()
+		defer s.metrics.mutex.Unlock()
+		return s.metrics.counters["proxy_slow_readers_total"] == 1
+	})
+}
+
+func TestReaderKeepingUpIsNotCutOff(t *testing.T) {
+	s, ts := newTestServer(t, "-slow-read-timeout", "100ms")
+	connectClient(t, s, ts, "db-1").echo(strings.Repeat("x", 1<<20))
+
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil); resp.StatusCode != http.StatusOK || len(body) != 1<<20 {
+		t.Errorf("got %s with %d bytes, want the whole reply", resp.Status, len(body))
+	}
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	if n := s.metrics.counters["proxy_slow_readers_total"]; n != 0 {
+		t.Errorf("counted %v slow readers", n)
+	}
+}
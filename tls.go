@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// buildTLSConfig turns the TLS flags into a tls.Config, failing on unknown
+// versions or cipher suite names so a typo can't silently weaken the server.
+//
+// Cipher suites only apply to TLS 1.2 and below; TLS 1.3 suites are not
+// configurable in Go. PreferServerCipherSuites is passed through for configs
+// that require it, but Go has chosen the order itself since 1.18.
+func buildTLSConfig(cfg *Config) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[cfg.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q", cfg.TLSMinVersion)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:               minVersion,
+		PreferServerCipherSuites: cfg.TLSPreferServerCiphers,
+	}
+
+	if cfg.TLSCipherSuites != "" {
+		suites := make(map[string]uint16)
+		for _, s := range tls.CipherSuites() {
+			suites[s.Name] = s.ID
+		}
+		for _, s := range tls.InsecureCipherSuites() {
+			suites[s.Name] = s.ID
+		}
+
+		for _, name := range strings.Split(cfg.TLSCipherSuites, ",") {
+			name = strings.TrimSpace(name)
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher suite %q", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// The certificate is served through GetCertificate from an atomically
+// swapped pointer, so it can be rotated without a restart: a Reload, as on
+// SIGHUP, reads -tls-cert and -tls-key again, which may name new files. The
+// new pair is checked first, the key against the certificate and the
+// certificate's validity period against the clock, and a bad one fails the
+// Reload and leaves everything as it was. Connections already established
+// keep the certificate they were handshaken with; new handshakes get the
+// new one. Whether TLS is on at all is still decided at startup.
+
+// loadCertificate reads and checks the certificate and key pair at the given
+// paths.
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate %s is not valid until %s", certFile, leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate %s expired at %s", certFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// reloadCertificate loads cfg's certificate for a Reload, returning nil if
+// the server isn't serving TLS.
+func (s *Server) reloadCertificate(cfg *Config) (*tls.Certificate, error) {
+	if s.certificate.Load() == nil {
+		return nil, nil
+	}
+	cert, err := loadCertificate(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// swapCertificate starts serving cert to new handshakes.
+func (s *Server) swapCertificate(cert *tls.Certificate) {
+	old := s.certificate.Swap(cert)
+	if old == nil || old.Leaf == nil || !old.Leaf.Equal(cert.Leaf) {
+		log.Printf("Serving TLS certificate for %s, valid until %s", certificateName(cert.Leaf), cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.certificate.Load(), nil
+}
+
+func certificateName(leaf *x509.Certificate) string {
+	if len(leaf.DNSNames) > 0 {
+		return strings.Join(leaf.DNSNames, ", ")
+	}
+	return leaf.Subject.CommonName
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildTLSConfig(t *testing.T) {
+	cfg, err := LoadConfig([]string{"-tls-min-version", "1.3", "-tls-cipher-suites", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := buildTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MinVersion = %x, want TLS 1.3", tlsConfig.MinVersion)
+	}
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	if len(tlsConfig.CipherSuites) != 2 || tlsConfig.CipherSuites[0] != want[0] || tlsConfig.CipherSuites[1] != want[1] {
+		t.Errorf("CipherSuites = %v, want %v in order", tlsConfig.CipherSuites, want)
+	}
+}
+
+func TestBuildTLSConfigRejectsUnknownNames(t *testing.T) {
+	for _, args := range [][]string{
+		{"-tls-min-version", "1.4"},
+		{"-tls-cipher-suites", "TLS_ROT13_WITH_NOTHING"},
+	} {
+		cfg, err := LoadConfig(args)
+		if err != nil {
+			continue
+		}
+		if _, err := buildTLSConfig(cfg); err == nil {
+			t.Errorf("buildTLSConfig accepted %v", args)
+		}
+	}
+}
+
+// writeCertificate writes a self-signed certificate for name, valid from
+// notBefore to notAfter, and its key, returning their paths.
+func writeCertificate(t *testing.T, name string, notBefore, notAfter time.Time) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadCertificateChecksValidity(t *testing.T) {
+	now := time.Now()
+	valid, validKey := writeCertificate(t, "proxy.test", now.Add(-time.Hour), now.Add(time.Hour))
+	if cert, err := loadCertificate(valid, validKey); err != nil || cert.Leaf == nil {
+		t.Fatalf("loadCertificate of a valid pair = %v", err)
+	}
+
+	expired, expiredKey := writeCertificate(t, "proxy.test", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	future, futureKey := writeCertificate(t, "proxy.test", now.Add(time.Hour), now.Add(2*time.Hour))
+	for name, pair := range map[string][2]string{
+		"expired":          {expired, expiredKey},
+		"not yet valid":    {future, futureKey},
+		"mismatched key":   {valid, expiredKey},
+		"missing key file": {valid, validKey + ".gone"},
+	} {
+		if _, err := loadCertificate(pair[0], pair[1]); err == nil {
+			t.Errorf("loadCertificate accepted the %s pair", name)
+		}
+	}
+}
+
+func TestReloadSwapsTheCertificate(t *testing.T) {
+	now := time.Now()
+	oldCert, oldKey := writeCertificate(t, "old.test", now.Add(-time.Hour), now.Add(time.Hour))
+	s, _ := newTestServer(t, "-tls-cert", oldCert, "-tls-key", oldKey)
+	cert, err := loadCertificate(oldCert, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.swapCertificate(cert)
+
+	served := func() string {
+		cert, _ := s.getCertificate(nil)
+		return cert.Leaf.Subject.CommonName
+	}
+	newCert, newKey := writeCertificate(t, "new.test", now.Add(-time.Hour), now.Add(time.Hour))
+	if err := s.Reload(loadConfig(t, "-tls-cert", newCert, "-tls-key", newKey)); err != nil {
+		t.Fatalf("Reload with a new certificate: %v", err)
+	}
+	if name := served(); name != "new.test" {
+		t.Errorf("serving %s after the reload, want new.test", name)
+	}
+
+	expired, expiredKey := writeCertificate(t, "expired.test", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	if err := s.Reload(loadConfig(t, "-tls-cert", expired, "-tls-key", expiredKey)); err == nil {
+		t.Error("Reload accepted an expired certificate")
+	}
+	if name := served(); name != "new.test" || s.currentConfig().TLSCert != newCert {
+		t.Errorf("failed reload left %s served with -tls-cert %s", name, s.currentConfig().TLSCert)
+	}
+}
+
+func TestReloadWithoutTLSIgnoresCertificates(t *testing.T) {
+	s, _ := newTestServer(t)
+	if err := s.Reload(loadConfig(t, "-tls-cert", "/nonexistent", "-tls-key", "/nonexistent")); err != nil {
+		t.Errorf("Reload of a server without TLS checked the certificate: %v", err)
+	}
+}
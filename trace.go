@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// For offline analysis, every /query, /command and /query-cached request can
+// be written out as a trace record, one JSON object per line:
+//
+//	{"time":"...","method":"GET","path":"/query/abc","client_id":"abc","status":200,
+//	 "cache":"miss","cache_reason":"stale-expired,stored",
+//	 "phases":{"cache":0.1,"queue":12.4,"backend":35.2,"total":48.0}}
+//
+// Phases are in milliseconds and are those of Server-Timing, except that
+// total runs to the end of the response; error is the start of a failed
+// request's response. -trace-file appends records to a
+// file; code embedding the proxy can send them anywhere with SetTraceSink.
+// Records are handed to a single writer goroutine, which buffers its writes
+// and flushes whenever it runs out of records, so tracing costs a query no
+// I/O. When traceBufferSize records are waiting, new ones are dropped and
+// counted in proxy_traces_dropped_total rather than holding up queries.
+
+const traceBufferSize = 4096
+
+type traceRecord struct {
+	Time        time.Time          `json:"time"`
+	Method      string             `json:"method"`
+	Path        string             `json:"path"`
+	ClientID    string             `json:"client_id"`
+	Status      int                `json:"status"`
+	Cache       string             `json:"cache,omitempty"`
+	CacheReason string             `json:"cache_reason,omitempty"`
+	Phases      map[string]float64 `json:"phases"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// tracer writes trace records to its sink until stopped.
+type tracer struct {
+	records chan traceRecord
+	done    chan struct{}
+	// stopped is set, under mutex, once records is closed.
+	mutex   sync.RWMutex
+	stopped bool
+}
+
+func startTracer(sink io.Writer) *tracer {
+	t := &tracer{records: make(chan traceRecord, traceBufferSize), done: make(chan struct{})}
+	go t.run(sink)
+	return t
+}
+
+func (t *tracer) run(sink io.Writer) {
+	defer close(t.done)
+	w := bufio.NewWriter(sink)
+	encoder := json.NewEncoder(w)
+	for record := range t.records {
+		if err := encoder.Encode(record); err != nil {
+			log.Printf("Error writing query trace: %v", err)
+		}
+		if len(t.records) == 0 {
+			if err := w.Flush(); err != nil {
+				log.Printf("Error writing query trace: %v", err)
+			}
+		}
+	}
+	w.Flush()
+}
+
+// send queues record without waiting and reports whether there was room.
+// Records sent after stop are discarded.
+func (t *tracer) send(record traceRecord) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.stopped {
+		return true
+	}
+	select {
+	case t.records <- record:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop writes out the records still waiting and returns once they are.
+func (t *tracer) stop() {
+	t.mutex.Lock()
+	t.stopped = true
+	close(t.records)
+	t.mutex.Unlock()
+	<-t.done
+}
+
+// openTraceFile opens -trace-file for appending, or returns nil if none is
+// set.
+func openTraceFile(path string) (io.Writer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+// SetTraceSink sends query trace records to sink from now on, in place of
+// -trace-file or an earlier sink, whose waiting records are written out
+// first. A nil sink turns tracing off.
+func (s *Server) SetTraceSink(sink io.Writer) {
+	var next *tracer
+	if sink != nil {
+		next = startTracer(sink)
+	}
+	if previous := s.tracer.Swap(next); previous != nil {
+		previous.stop()
+	}
+}
+
+// traceQuery hands the record of a finished request to the tracer.
+func (s *Server) traceQuery(r *http.Request, timing *serverTiming, w *historyWriter) {
+	t := s.tracer.Load()
+	if t == nil {
+		return
+	}
+
+	record := traceRecord{
+		Time:     timing.start,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		ClientID: mux.Vars(r)["clientID"],
+		Status:   w.status,
+		Phases:   map[string]float64{"total": milliseconds(time.Since(timing.start))},
+	}
+	if record.Status == 0 {
+		record.Status = http.StatusOK
+	}
+	if record.Status >= http.StatusBadRequest {
+		record.Error = strings.TrimSpace(w.errorText.String())
+	}
+	if len(timing.decisions) > 0 {
+		record.CacheReason = joinCacheDecisions(timing.decisions)
+		switch lookup := timing.decisions[0]; lookup {
+		case cacheFreshHit, cacheNegativeHit, cacheGraceHit:
+			record.Cache = lookup.outcome()
+		case cacheNotCached, cacheStaleExpired:
+			record.Cache = "miss"
+		}
+	}
+	if cache := w.Header().Get("X-Cache"); cache != "" {
+		record.Cache = strings.ToLower(cache)
+	}
+	if timing.cache > 0 {
+		record.Phases["cache"] = milliseconds(timing.cache)
+	}
+	if timing.queued.position > 0 {
+		record.Phases["queue"] = milliseconds(timing.queued.wait)
+	}
+	if timing.rtt > 0 {
+		record.Phases["backend"] = milliseconds(timing.rtt)
+	}
+
+	if !t.send(record) {
+		s.incCounter("proxy_traces_dropped_total")
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
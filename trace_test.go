@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// traceRecords decodes the trace records in data, one per line.
+func traceRecords(t *testing.T, data []byte) []traceRecord {
+	t.Helper()
+	var records []traceRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var record traceRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("trace line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestTraceSinkGetsARecordPerQuery(t *testing.T) {
+	s, ts := newTestServer(t)
+	var sink bytes.Buffer
+	s.SetTraceSink(&sink)
+	connectClient(t, s, ts, "weather").serve(func(q queryMessage) replyMessage {
+		if q.Params["city"][0] == "nowhere" {
+			return replyMessage{Status: http.StatusNotFound, Body: "no such city"}
+		}
+		return replyMessage{Body: "sunny"}
+	})
+
+	do(t, "GET", ts.URL+"/query/weather?city=paris", nil, nil)
+	do(t, "GET", ts.URL+"/query/weather?city=paris", nil, nil)
+	do(t, "GET", ts.URL+"/query/weather?city=nowhere", nil, nil)
+	// Turning tracing off writes out the records still waiting.
+	s.SetTraceSink(nil)
+
+	records := traceRecords(t, sink.Bytes())
+	if len(records) != 3 {
+		t.Fatalf("got %d trace records, want 3: %s", len(records), sink.Bytes())
+	}
+	miss, hit, failed := records[0], records[1], records[2]
+	if miss.Cache != "miss" || miss.ClientID != "weather" || miss.Path != "/query/weather" || miss.Status != http.StatusOK {
+		t.Errorf("first query traced as %+v, want a miss", miss)
+	}
+	if _, ok := miss.Phases["backend"]; !ok {
+		t.Errorf("live query's phases %v have no backend time", miss.Phases)
+	}
+	if hit.Cache != "hit" {
+		t.Errorf("repeated query traced as %+v, want a hit", hit)
+	}
+	if failed.Status != http.StatusNotFound || failed.Error != "no such city" {
+		t.Errorf("failed query traced as %+v, want its status and error", failed)
+	}
+	for _, record := range records {
+		if _, ok := record.Phases["total"]; !ok {
+			t.Errorf("record %+v has no total", record)
+		}
+	}
+
+	do(t, "GET", ts.URL+"/query/weather?city=paris", nil, nil)
+	if n := len(traceRecords(t, sink.Bytes())); n != 3 {
+		t.Errorf("%d records after tracing was turned off, want the 3 from before", n)
+	}
+}
+
+func TestTraceFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	s, ts := newTestServer(t, "-trace-file", path)
+	connectClient(t, s, ts, "weather").echo("sunny")
+	do(t, "GET", ts.URL+"/query/weather", nil, nil)
+
+	waitFor(t, "the trace to be written", func() bool {
+		data, _ := os.ReadFile(path)
+		return len(traceRecords(t, data)) == 1
+	})
+}
+
+func TestTracerDropsRecordsWhenBehind(t *testing.T) {
+	r, w := io.Pipe()
+	tracer := startTracer(w)
+	t.Cleanup(func() {
+		r.Close()
+		tracer.stop()
+	})
+
+	// The first record holds up the writer, which is flushing it to a sink
+	// nobody reads.
+	tracer.send(traceRecord{Path: "/query/first"})
+	waitFor(t, "the writer to take the first record", func() bool { return len(tracer.records) == 0 })
+	for i := 0; i < traceBufferSize; i++ {
+		if !tracer.send(traceRecord{}) {
+			t.Fatalf("record %d dropped with room in the buffer", i)
+		}
+	}
+	if tracer.send(traceRecord{}) {
+		t.Error("record past a full buffer wasn't dropped")
+	}
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// For sidecar deployments the proxy can listen on a Unix domain socket with
+// -unix-socket instead of TCP. Everything else is unchanged: TLS still
+// applies if configured, and connection URLs are built from the Host header
+// callers send. TCP keepalive doesn't apply to Unix sockets and is skipped.
+
+// listenUnix listens on the socket at path with the given file mode. A
+// socket file left behind by a server that is gone is removed first; one
+// that still accepts connections is in use and is left alone.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestServingOnAUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	cfg, err := LoadConfig([]string{"-unix-socket", path, "-unix-socket-mode", "0600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ListenAndServe()
+	t.Cleanup(func() { s.Close() })
+	waitFor(t, "the socket to be listened on", func() bool {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode %v, %v, want 0600", info.Mode(), err)
+	}
+
+	dial := func(context.Context, string, string) (net.Conn, error) { return net.Dial("unix", path) }
+	dialer := websocket.Dialer{NetDialContext: dial}
+	conn, _, err := dialer.Dial("ws://proxy/connect?client_id=db-1", nil)
+	if err != nil {
+		t.Fatalf("connecting over the socket: %v", err)
+	}
+	defer conn.Close()
+	waitFor(t, "the connection to be added", func() bool { return s.connectionCount("db-1") == 1 })
+	(&testClient{t: t, conn: conn}).echo("over the socket")
+
+	caller := http.Client{Transport: &http.Transport{DialContext: dial}}
+	resp, err := caller.Get("http://proxy/query/db-1")
+	if err != nil {
+		t.Fatalf("querying over the socket: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "over the socket" {
+		t.Errorf("query over the socket got %s %q", resp.Status, body)
+	}
+}
+
+func TestStaleSocketIsReplaced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path, 0o660)
+	if err != nil {
+		t.Fatalf("listening over a stale socket: %v", err)
+	}
+	defer listener.Close()
+	if _, err := listenUnix(path, 0o660); err == nil {
+		t.Error("listened on a socket another server is using")
+	}
+
+	file := filepath.Join(t.TempDir(), "not-a-socket")
+	os.WriteFile(file, nil, 0o600)
+	if _, err := listenUnix(file, 0o660); err == nil {
+		t.Error("listened over a regular file")
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// A backend that has only just connected may still be filling caches or
+// opening its own connections. With -client-warmup, a connection is held out
+// of query routing for that long after it connected, as long as its client
+// ID has another connection past its warm-up to send the query to instead,
+// so a new replica joins a client ID without taking its share of the load
+// straight away. When every ready connection of the client ID is warming
+// up, -client-warmup-mode decides: prefer, the default, sends the query to
+// one of them anyway, so a client ID that just connected isn't unreachable;
+// strict refuses it with 503 and Retry-After until one is warm. Aggregated
+// queries go to the warm connections the same way. /clients marks warming
+// connections with warming_up, and proxy_warming_connections counts them.
+
+// errClientWarmingUp wraps errClientBusy so it is reported the same way.
+var errClientWarmingUp = fmt.Errorf("%w: client is still warming up", errClientBusy)
+
+// warmupModes are the values of -client-warmup-mode.
+var warmupModes = map[string]bool{"prefer": true, "strict": true}
+
+// warmingUp reports whether client is still within -client-warmup of
+// connecting.
+func (c *Client) warmingUp(cfg *Config) bool {
+	return cfg.ClientWarmup > 0 && time.Since(c.ConnectedAt) < cfg.ClientWarmup
+}
+
+// warmConns returns the connections among conns past their warm-up, or,
+// if there are none, all of conns unless -client-warmup-mode is strict.
+func (s *Server) warmConns(conns []*Client) ([]*Client, error) {
+	cfg := s.currentConfig()
+	if cfg.ClientWarmup <= 0 {
+		return conns, nil
+	}
+	var warm []*Client
+	for _, client := range conns {
+		if !client.warmingUp(cfg) {
+			warm = append(warm, client)
+		}
+	}
+	switch {
+	case len(warm) > 0:
+		return warm, nil
+	case cfg.ClientWarmupMode == "strict":
+		return nil, errClientWarmingUp
+	}
+	return conns, nil
+}
+
+// warmingConnections counts the live connections still warming up, for
+// proxy_warming_connections.
+func (s *Server) warmingConnections() float64 {
+	cfg := s.currentConfig()
+	n := 0
+	for _, client := range s.connectedClients() {
+		if client.warmingUp(cfg) {
+			n++
+		}
+	}
+	return float64(n)
+}
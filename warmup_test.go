@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWarmConnsPassOverWarmingConnections(t *testing.T) {
+	s, _ := newTestServer(t, "-client-warmup", "1m")
+	warm := &Client{ID: "db-1", ConnectedAt: time.Now().Add(-time.Hour)}
+	warming := &Client{ID: "db-1", ConnectedAt: time.Now()}
+
+	if conns, err := s.warmConns([]*Client{warming, warm}); err != nil || len(conns) != 1 || conns[0] != warm {
+		t.Errorf("warmConns = %v, %v, want only the warm connection", conns, err)
+	}
+	// With every connection warming up, prefer routes to them anyway.
+	if conns, err := s.warmConns([]*Client{warming}); err != nil || len(conns) != 1 {
+		t.Errorf("warmConns of warming connections = %v, %v, want them all", conns, err)
+	}
+}
+
+func TestStrictWarmupRefusesWarmingClients(t *testing.T) {
+	s, ts := newTestServer(t, "-client-warmup", "1h", "-client-warmup-mode", "strict")
+	connectClient(t, s, ts, "db-1").echo("answer")
+
+	resp, body := do(t, "GET", ts.URL+"/query/db-1", nil, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("query to a warming client got %s: %s, want 503 with Retry-After", resp.Status, body)
+	}
+	if n := s.warmingConnections(); n != 1 {
+		t.Errorf("warmingConnections = %v, want 1", n)
+	}
+}
+
+func TestPreferWarmupRoutesToWarmConnections(t *testing.T) {
+	s, ts := newTestServer(t, "-client-warmup", "1h")
+	warm := connectClient(t, s, ts, "db-1")
+	warm.echo("warm")
+	if resp, body := do(t, "GET", ts.URL+"/query/db-1?q=alone", nil, nil); string(body) != "warm" {
+		t.Fatalf("query to a client with only a warming connection got %s: %s", resp.Status, body)
+	}
+	s.clientsMutex.Lock()
+	s.clients["db-1"].conns[0].ConnectedAt = time.Now().Add(-2 * time.Hour)
+	s.clientsMutex.Unlock()
+
+	connectClient(t, s, ts, "db-1").echo("warming")
+	for i := 0; i < 5; i++ {
+		if resp, body := do(t, "GET", fmt.Sprintf("%s/query/db-1?q=%d", ts.URL, i), nil, nil); string(body) != "warm" {
+			t.Errorf("query got %s: %s, want it sent to the warm connection", resp.Status, body)
+		}
+	}
+}
+
+func TestClientWarmupValidation(t *testing.T) {
+	for _, args := range [][]string{{"-client-warmup", "-1s"}, {"-client-warmup-mode", "eager"}} {
+		if _, err := LoadConfig(args); err == nil {
+			t.Errorf("LoadConfig accepted %v", args)
+		}
+	}
+}
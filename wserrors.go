@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+)
+
+// Errors reading from or writing to a client's connection are classified so
+// that a client closing its connection can be told apart from a failure:
+//
+//	normal-close    the client closed with 1000 (normal) or 1001 (going away)
+//	abnormal-close  any other close code, 1006 included, or the connection
+//	                was reset or cut off mid-message
+//	protocol-error  the client broke the websocket protocol, sent a message
+//	                over the read limit or closed with a protocol-level code
+//	timeout         a read or write deadline passed
+//	closed-locally  the proxy had already closed the connection itself
+//	other           anything else
+//
+// Each is counted in proxy_websocket_errors_total by op, read or write, and
+// kind, and given in the log line for the error.
+
+// websocketErrorKind classifies an error from a client connection.
+func websocketErrorKind(err error) string {
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &closeErr):
+		switch closeErr.Code {
+		case websocket.CloseNormalClosure, websocket.CloseGoingAway:
+			return "normal-close"
+		case websocket.CloseProtocolError, websocket.CloseUnsupportedData, websocket.CloseInvalidFramePayloadData,
+			websocket.CloseMessageTooBig, websocket.CloseMandatoryExtension:
+			return "protocol-error"
+		}
+		return "abnormal-close"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, net.ErrClosed), errors.Is(err, websocket.ErrCloseSent):
+		return "closed-locally"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "abnormal-close"
+	case errors.Is(err, websocket.ErrReadLimit):
+		return "protocol-error"
+	// The websocket package reports the remaining protocol violations, such
+	// as bad framing or an invalid UTF-8 text message, as untyped errors.
+	case strings.HasPrefix(err.Error(), "websocket: "):
+		return "protocol-error"
+	}
+	return "other"
+}
+
+// recordWebsocketError counts an error from op, "read" or "write", on
+// client's connection and returns its kind.
+func (s *Server) recordWebsocketError(client *Client, op string, err error) string {
+	kind := websocketErrorKind(err)
+	s.incCounter("proxy_websocket_errors_total", s.withLabels(client.ID, "op", op, "kind", kind)...)
+	return kind
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketErrorKinds(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{&websocket.CloseError{Code: websocket.CloseNormalClosure}, "normal-close"},
+		{&websocket.CloseError{Code: websocket.CloseGoingAway}, "normal-close"},
+		{&websocket.CloseError{Code: websocket.CloseAbnormalClosure}, "abnormal-close"},
+		{&websocket.CloseError{Code: 4001}, "abnormal-close"},
+		{&websocket.CloseError{Code: websocket.CloseMessageTooBig}, "protocol-error"},
+		{&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, "timeout"},
+		{fmt.Errorf("write: %w", net.ErrClosed), "closed-locally"},
+		{websocket.ErrCloseSent, "closed-locally"},
+		{io.ErrUnexpectedEOF, "abnormal-close"},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, "abnormal-close"},
+		{websocket.ErrReadLimit, "protocol-error"},
+		{errors.New("websocket: invalid UTF-8 in text frame"), "protocol-error"},
+		{errors.New("something else"), "other"},
+	} {
+		if got := websocketErrorKind(tc.err); got != tc.want {
+			t.Errorf("websocketErrorKind(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestClientCloseIsCountedByKind(t *testing.T) {
+	s, ts := newTestServer(t)
+	client := connectClient(t, s, ts, "db-1")
+	client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
+	waitFor(t, "the close to be counted", func() bool {
+		s.metrics.mutex.Lock()
+		defer s.metrics.mutex.Unlock()
+		return s.metrics.counters[`proxy_websocket_errors_total{op="read",kind="normal-close"}`] == 1
+	})
+}